@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// aggregatedAPIExperimentOptions configure an experiment which holds the same fleet of watches first on a
+// built-in resource and then on one served by an aggregated API server, so that the cost the kube-apiserver pays
+// to proxy every watch can be told apart from that of serving one itself. The aggregated API server must already
+// be installed.
+type aggregatedAPIExperimentOptions struct {
+	resource string
+	count    int
+	rate     int
+	hold     time.Duration
+	cooldown *cooldownOptions
+}
+
+func defaultAggregatedAPIExperimentOptions() *aggregatedAPIExperimentOptions {
+	return &aggregatedAPIExperimentOptions{
+		count:    1000,
+		rate:     100,
+		hold:     2 * time.Minute,
+		cooldown: defaultCooldownOptions(),
+	}
+}
+
+func bindAggregatedAPIExperimentOptions(fs *flag.FlagSet, defaults *aggregatedAPIExperimentOptions) *aggregatedAPIExperimentOptions {
+	prefix := "aggregated-api."
+	fs.StringVar(&defaults.resource, prefix+"resource", defaults.resource, "Namespaced resource served by the aggregated API server, as group/version/resource, like wardle.example.com/v1alpha1/flunders.")
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start on each resource.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.DurationVar(&defaults.hold, prefix+"hold", defaults.hold, "Time to hold every fleet, and the baseline without watches, open.")
+	bindCooldownOptions(fs, prefix, defaults.cooldown)
+	return defaults
+}
+
+func (o *aggregatedAPIExperimentOptions) validate() error {
+	if _, err := o.aggregatedResource(); err != nil {
+		return err
+	}
+	return o.cooldown.validate("aggregated-api.")
+}
+
+func (o *aggregatedAPIExperimentOptions) aggregatedResource() (schema.GroupVersionResource, error) {
+	parts := strings.Split(o.resource, "/")
+	if len(parts) != 3 || parts[0] == "" {
+		return schema.GroupVersionResource{}, errors.New("--aggregated-api.resource must be of form group/version/resource")
+	}
+	return schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]}, nil
+}
+
+const aggregatedAPIFile = "aggregated-api.json"
+
+const (
+	builtinFleet    = "builtin"
+	aggregatedFleet = "aggregated"
+)
+
+type aggregatedAPIFleet struct {
+	Resource    string `json:"resource"`
+	Watches     int    `json:"watches"`
+	Established int    `json:"established"`
+	// Establishment is the distribution of times between a watch being issued and the response headers arriving.
+	Establishment durationSummary `json:"establishment"`
+}
+
+func runAggregatedAPIExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *aggregatedAPIExperimentOptions) error {
+	logrus.Info("Running aggregated API experiment")
+	aggregated, err := opts.aggregatedResource()
+	if err != nil {
+		return err
+	}
+	if err := checkWatchable(client, aggregated); err != nil {
+		return err
+	}
+	namespace, cleanup, err := createNamespace(ctx, client, "aggregated-api")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start(artifacts.BaselinePhase)
+	cooldowns, err := newCooldowns(ctx, opts.cooldown)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cooldowns.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record cooldowns")
+		}
+	}()
+	if err := holdFor(ctx, opts.hold); err != nil {
+		return err
+	}
+
+	results := map[string]aggregatedAPIFleet{}
+	latencies := artifacts.Latencies{}
+	for i, fleet := range []struct {
+		name     string
+		resource schema.GroupVersionResource
+	}{
+		{name: builtinFleet, resource: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}},
+		{name: aggregatedFleet, resource: aggregated},
+	} {
+		if i > 0 {
+			if err := cooldowns.wait(ctx, phases, builtinFleet); err != nil {
+				return err
+			}
+		}
+		tracker, err := holdWatchFleet(ctx, phases, fleet.name, resourceWatch(client, fleet.resource, namespace), opts)
+		if err != nil {
+			return err
+		}
+		result := aggregatedAPIFleet{Resource: fleet.resource.String(), Watches: opts.count}
+		series := tracker.establishmentLatencies()
+		result.Established = len(series.Seconds)
+		var establishment []time.Duration
+		for _, seconds := range series.Seconds {
+			establishment = append(establishment, time.Duration(seconds*float64(time.Second)))
+		}
+		result.Establishment = summarizeDurations(establishment)
+		logrus.Infof("%s fleet: %d/%d watches established, p99 %.3fs", fleet.name, result.Established, result.Watches, result.Establishment.P99)
+		results[fleet.name] = result
+		for kind, series := range tracker.latencies() {
+			latencies[kind+"-"+fleet.name] = series
+		}
+	}
+	if err := artifacts.Write(outputDir, artifacts.LatenciesFile, latencies); err != nil {
+		return err
+	}
+	if err := artifacts.Write(outputDir, aggregatedAPIFile, results); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished aggregated API experiment")
+	return nil
+}
+
+// holdWatchFleet establishes a fleet of watches in a phase named for it, holds it open and then closes it.
+func holdWatchFleet(ctx context.Context, phases *phaseRecorder, name string, open openWatch, opts *aggregatedAPIExperimentOptions) (*watchTracker, error) {
+	fleetCtx, stopFleet := context.WithCancel(ctx)
+	defer stopFleet()
+	phases.start("setup-" + name)
+	tracker := newWatchTracker(opts.count)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.count; i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		go tracker.watch(fleetCtx, i, open)
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.count, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+	phases.start(name)
+	if err := holdFor(ctx, opts.hold); err != nil {
+		return nil, err
+	}
+	return tracker, nil
+}
+
+// checkWatchable ensures that the API servers serve the resource and that it can be watched in a namespace.
+func checkWatchable(client *kubernetes.Clientset, resource schema.GroupVersionResource) error {
+	resources, err := client.Discovery().ServerResourcesForGroupVersion(resource.GroupVersion().String())
+	if err != nil {
+		return fmt.Errorf("could not discover %s, is the aggregated API server installed: %w", resource.GroupVersion(), err)
+	}
+	for _, served := range resources.APIResources {
+		if served.Name != resource.Resource {
+			continue
+		}
+		if !served.Namespaced || !sets.New[string](served.Verbs...).Has("watch") {
+			return fmt.Errorf("%s must be namespaced and support watch", resource)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not served", resource)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// apfDumps are the debug endpoints of API Priority and Fairness, keyed by the name of the dump.
+var apfDumps = map[string]string{
+	artifacts.APFPriorityLevelsDump: "/debug/api_priority_and_fairness/dump_priority_levels",
+	artifacts.APFRequestsDump:       "/debug/api_priority_and_fairness/dump_requests",
+}
+
+// setupAPFDumpMonitors records what API Priority and Fairness holds in its queues on every API server replica at
+// the interval, so that the queueing during watch storms can be reconstructed request by request.
+func setupAPFDumpMonitors(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, selector, outputDir string, interval time.Duration) error {
+	if interval == 0 {
+		return nil
+	}
+	logrus.Info("Setting up API Priority and Fairness dumps")
+	instances, err := apiserverInstances(ctx, client, config, selector)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		nodeDir := filepath.Join(outputDir, artifacts.APFDumpsDir, instance.node)
+		if err := os.MkdirAll(nodeDir, 0777); err != nil {
+			return fmt.Errorf("could not create output dir for node %s: %w", instance.node, err)
+		}
+		go monitorAPFDumps(ctx, instance, nodeDir, interval)
+	}
+	return nil
+}
+
+func monitorAPFDumps(ctx context.Context, instance apiserverInstance, outputDir string, interval time.Duration) {
+	if err := wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (done bool, err error) {
+		if !diskBudget.sample(artifacts.APFDumpsMonitor, instance.pod) {
+			return false, nil
+		}
+		requested := strconv.FormatInt(time.Now().UnixNano(), 10)
+		for dump, path := range apfDumps {
+			raw, err := instance.client.Get().AbsPath(path).DoRaw(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.WithError(err).Errorf("failed to dump %s from %s", dump, instance.pod)
+					collectionErrors.failed(artifacts.APFDumpsMonitor, instance.pod+"/"+dump, err)
+				}
+				continue
+			}
+			collectionErrors.succeeded(artifacts.APFDumpsMonitor, instance.pod+"/"+dump)
+			if err := os.WriteFile(filepath.Join(outputDir, dump+"-"+requested+artifacts.APFDumpExtension), raw, 0666); err != nil {
+				logrus.WithError(err).Errorf("failed to record %s dumped from %s", dump, instance.pod)
+			}
+		}
+		return false, nil
+	}); err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Errorf("failed to monitor API Priority and Fairness of %s", instance.pod)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// setupAPIServerMetricsMonitors scrapes the metrics every API server replica reports about itself at the interval,
+// recording every snapshot verbatim in a directory per node, so that server-side counters can be digested alongside
+// the usage the kubelet reports.
+func setupAPIServerMetricsMonitors(ctx context.Context, outputDir string, interval time.Duration) error {
+	if interval == 0 {
+		return nil
+	}
+	logrus.Info("Setting up API server metrics monitoring")
+	instances, err := apiserverScrapes.replicas(ctx)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		nodeDir := filepath.Join(outputDir, artifacts.APIServerMetricsDir, instance.node)
+		if err := os.MkdirAll(nodeDir, 0777); err != nil {
+			return fmt.Errorf("could not create output dir for node %s: %w", instance.node, err)
+		}
+		go monitorAPIServerMetrics(ctx, instance, nodeDir, interval)
+	}
+	return nil
+}
+
+func monitorAPIServerMetrics(ctx context.Context, instance apiserverInstance, outputDir string, interval time.Duration) {
+	if err := wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (done bool, err error) {
+		if !diskBudget.sample(artifacts.APIServerMetricsMonitor, instance.pod) {
+			return false, nil
+		}
+		scraped, raw, err := apiserverScrapes.raw(ctx, instance, interval/2)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithError(err).Errorf("failed to fetch metrics from %s", instance.pod)
+				collectionErrors.failed(artifacts.APIServerMetricsMonitor, instance.pod, err)
+			}
+			return false, nil
+		}
+		collectionErrors.succeeded(artifacts.APIServerMetricsMonitor, instance.pod)
+		if err := os.WriteFile(filepath.Join(outputDir, strconv.FormatInt(scraped.UnixNano(), 10)+artifacts.MetricsSnapshotExtension), raw, 0666); err != nil {
+			logrus.WithError(err).Errorf("failed to record metrics from %s", instance.pod)
+		}
+		return false, nil
+	}); err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Errorf("failed to monitor metrics from %s", instance.pod)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	auditLoggingMetadataKey = "audit-logging"
+	auditLoggingEnabled     = "enabled"
+	auditLoggingDisabled    = "disabled"
+)
+
+// auditImpactExperimentOptions configure a fixed sequence of load phases which is run once with audit logging
+// enabled on the target cluster and once with it disabled, so that the digest can attribute the difference in
+// control plane resource usage to the audit pipeline.
+type auditImpactExperimentOptions struct {
+	auditLogging  string
+	phaseDuration time.Duration
+	watches       int
+	watchRate     int
+	writeRate     int
+}
+
+func defaultAuditImpactExperimentOptions() *auditImpactExperimentOptions {
+	return &auditImpactExperimentOptions{
+		phaseDuration: 2 * time.Minute,
+		watches:       1000,
+		watchRate:     100,
+		writeRate:     50,
+	}
+}
+
+func bindAuditImpactExperimentOptions(fs *flag.FlagSet, defaults *auditImpactExperimentOptions) *auditImpactExperimentOptions {
+	prefix := "audit-impact."
+	fs.StringVar(&defaults.auditLogging, prefix+"audit-logging", defaults.auditLogging, "Whether audit logging is enabled on the target cluster, one of enabled or disabled.")
+	fs.DurationVar(&defaults.phaseDuration, prefix+"phase-duration", defaults.phaseDuration, "Duration of each load phase.")
+	fs.IntVar(&defaults.watches, prefix+"watches", defaults.watches, "Number of watches to hold open during the watch and write phases.")
+	fs.IntVar(&defaults.watchRate, prefix+"watch-rate", defaults.watchRate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.writeRate, prefix+"write-rate", defaults.writeRate, "Rate of ConfigMap write cycles (create, update, delete), in Hertz.")
+	return defaults
+}
+
+func (o *auditImpactExperimentOptions) validate() error {
+	if o.auditLogging != auditLoggingEnabled && o.auditLogging != auditLoggingDisabled {
+		return fmt.Errorf("--audit-impact.audit-logging must be one of %s or %s", auditLoggingEnabled, auditLoggingDisabled)
+	}
+	if o.watchRate <= 0 || o.writeRate <= 0 {
+		return fmt.Errorf("--audit-impact.watch-rate and --audit-impact.write-rate must be positive")
+	}
+	return nil
+}
+
+func runAuditImpactExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *auditImpactExperimentOptions) error {
+	logrus.Infof("Running audit impact experiment with audit logging %s", opts.auditLogging)
+	namespace, cleanup, err := createNamespace(ctx, client, "audit-impact")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	err = func() error {
+		phases.start("idle")
+		if err := holdFor(ctx, opts.phaseDuration); err != nil {
+			return err
+		}
+
+		phases.start("watch")
+		watchCtx, cancelWatches := context.WithCancel(ctx)
+		defer cancelWatches()
+		deadline := time.Now().Add(opts.phaseDuration)
+		if err := startDrainedWatches(watchCtx, client, namespace, opts.watches, opts.watchRate); err != nil {
+			return err
+		}
+		if err := holdFor(ctx, time.Until(deadline)); err != nil {
+			return err
+		}
+
+		phases.start("write")
+		return churnConfigMaps(ctx, client, namespace, opts.writeRate, opts.phaseDuration)
+	}()
+	if writeErr := phases.write(outputDir); writeErr != nil {
+		return writeErr
+	}
+	if err != nil {
+		return fmt.Errorf("audit impact experiment interrupted: %w", err)
+	}
+
+	logrus.Info("Finished audit impact experiment")
+	return nil
+}
+
+// startDrainedWatches opens watches on ConfigMaps in the namespace at the given rate, consuming their events
+// until the context is cancelled.
+func startDrainedWatches(ctx context.Context, client *kubernetes.Clientset, namespace string, count, rate int) error {
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for i := 0; i < count; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		go func() {
+			watcher, err := client.CoreV1().ConfigMaps(namespace).Watch(ctx, metav1.ListOptions{})
+			if err != nil {
+				logrus.WithError(err).Error("failed to start watch")
+				return
+			}
+			defer watcher.Stop()
+			for range watcher.ResultChan() {
+			}
+		}()
+	}
+	return nil
+}
+
+// churnConfigMaps cycles ConfigMaps through creation, update and deletion at the given rate for the duration,
+// so that a small, bounded population of objects sees a constant stream of writes.
+func churnConfigMaps(ctx context.Context, client *kubernetes.Clientset, namespace string, rate int, duration time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	var failures int64
+	name := func(i int) string {
+		return objectNames.name("churn", i)
+	}
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			if failures > 0 {
+				logrus.Warnf("%d ConfigMap writes failed", failures)
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		write := func(f func() error) {
+			defer wg.Done()
+			if err := f(); err != nil {
+				atomic.AddInt64(&failures, 1)
+			}
+		}
+		wg.Add(1)
+		go write(func() error {
+			_, err := client.CoreV1().ConfigMaps(namespace).Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name(i)},
+				Data:       map[string]string{"generation": "0"},
+			}, metav1.CreateOptions{})
+			return err
+		})
+		if i >= 1 {
+			wg.Add(1)
+			go write(func() error {
+				_, err := client.CoreV1().ConfigMaps(namespace).Update(ctx, &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: name(i - 1)},
+					Data:       map[string]string{"generation": "1"},
+				}, metav1.UpdateOptions{})
+				return err
+			})
+		}
+		if i >= 2 {
+			wg.Add(1)
+			go write(func() error {
+				return client.CoreV1().ConfigMaps(namespace).Delete(ctx, name(i-2), metav1.DeleteOptions{})
+			})
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// exitCodeUnavailable is used when a run is aborted because the API server became unavailable, so that automation
+// can distinguish runs worth retrying from misconfiguration.
+const exitCodeUnavailable = 3
+
+// maxAvailabilityEvidence bounds the number of failed probes kept as evidence for an abort.
+const maxAvailabilityEvidence = 10
+
+// availabilityMonitor probes the API server throughout a run and aborts the experiment when it has been
+// continuously unavailable for longer than the window. While the experiment is restarting part of the control plane
+// on purpose, as declared to podHealth, the API server is expected to be unavailable, so the window only starts once
+// the restart is done.
+type availabilityMonitor struct {
+	lock             sync.Mutex
+	unavailableSince time.Time
+	evidence         []string
+	invalidation     *artifacts.Invalidation
+}
+
+func monitorAvailability(ctx context.Context, client *kubernetes.Clientset, window time.Duration, abort func()) *availabilityMonitor {
+	monitor := &availabilityMonitor{}
+	if window <= 0 {
+		return monitor
+	}
+	go func() {
+		if err := wait.PollUntilContextCancel(ctx, time.Second, false, func(ctx context.Context) (done bool, err error) {
+			reqContext, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+
+			result := client.RESTClient().Get().AbsPath("/healthz").Do(reqContext)
+			status := 0
+			result.StatusCode(&status)
+			if status == 200 {
+				monitor.available()
+				return false, nil
+			}
+			if ctx.Err() != nil {
+				return true, nil
+			}
+			if podHealth.restarting() {
+				monitor.suspend()
+				return false, nil
+			}
+			raw, err := result.Raw()
+			evidence := fmt.Sprintf("%s: /healthz returned %d: %s", time.Now().Format(time.RFC3339Nano), status, string(raw))
+			if err != nil {
+				evidence = fmt.Sprintf("%s: /healthz failed: %v", time.Now().Format(time.RFC3339Nano), err)
+			}
+			if monitor.unavailable(evidence, window) {
+				logrus.Errorf("API server unavailable for longer than %s, aborting experiment", window)
+				abort()
+				return true, nil
+			}
+			return false, nil
+		}); err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Error("failed to monitor API server availability")
+		}
+	}()
+	return monitor
+}
+
+func (m *availabilityMonitor) available() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.unavailableSince.IsZero() {
+		timeline.annotate(artifacts.AnnotationErrors, "API server available again after %s", time.Since(m.unavailableSince).Round(time.Second))
+	}
+	m.unavailableSince = time.Time{}
+	m.evidence = nil
+}
+
+// suspend forgets the failed probes while the experiment is restarting the control plane.
+func (m *availabilityMonitor) suspend() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.unavailableSince = time.Time{}
+	m.evidence = nil
+}
+
+// unavailable records a failed probe, determining if the API server has now been unavailable for too long.
+func (m *availabilityMonitor) unavailable(evidence string, window time.Duration) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if m.unavailableSince.IsZero() {
+		m.unavailableSince = now
+		timeline.annotate(artifacts.AnnotationErrors, "API server unavailable")
+	}
+	m.evidence = append(m.evidence, evidence)
+	if len(m.evidence) > maxAvailabilityEvidence {
+		m.evidence = m.evidence[len(m.evidence)-maxAvailabilityEvidence:]
+	}
+	if now.Sub(m.unavailableSince) < window {
+		return false
+	}
+	m.invalidation = &artifacts.Invalidation{
+		Reason:   fmt.Sprintf("API server unavailable since %s, longer than %s", m.unavailableSince.Format(time.RFC3339Nano), window),
+		Evidence: m.evidence,
+	}
+	return true
+}
+
+// aborted returns the reason the experiment was aborted, if it was.
+func (m *availabilityMonitor) aborted() *artifacts.Invalidation {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.invalidation
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// receivedEvents is the number of watch events received by every tracker in the process.
+var receivedEvents int64
+
+// backlogMonitor samples how many watch events the API servers have sent against how many the benchmark has
+// received. The difference is the backlog of events written to the connections but not yet read; when it grows
+// without bound, the servers will eventually terminate the watchers which cannot keep up.
+//
+// The servers count the events they send to every client, so the backlog is overestimated by the events sent to
+// watchers outside of the benchmark, which is only a constant rate of ConfigMap events for typical clusters.
+type backlogMonitor struct {
+	lock    sync.Mutex
+	backlog artifacts.Backlog
+
+	interval time.Duration
+	// sent holds the events sent by every replica at the last sample, to detect counter resets on restarts
+	sent  map[string]float64
+	total float64
+	// received is the number of events received at the first sample
+	received int64
+}
+
+func monitorBacklog(ctx context.Context, interval time.Duration) *backlogMonitor {
+	monitor := &backlogMonitor{
+		backlog:  artifacts.Backlog{Start: time.Now()},
+		interval: interval,
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := monitor.sample(ctx); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Debug("failed to sample watch backlog")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return monitor
+}
+
+func (m *backlogMonitor) sample(ctx context.Context) error {
+	scraped, err := apiserverScrapes.all(ctx, m.interval/2)
+	if err != nil {
+		return err
+	}
+	sent := map[string]float64{}
+	for pod, families := range scraped {
+		sent[pod] = sumMetric(families, "apiserver_watch_events_total", map[string]string{"kind": "ConfigMap"})
+	}
+	received := atomic.LoadInt64(&receivedEvents)
+	open := atomic.LoadInt64(&openWatches)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// the first sample is the reference that later increases are measured from
+	if m.sent != nil {
+		m.total += counterIncrease(m.sent, sent)
+	}
+	m.sent = sent
+	if len(m.backlog.Offsets) == 0 {
+		m.backlog.Start = time.Now()
+		m.received = received
+	}
+	m.backlog.Offsets = append(m.backlog.Offsets, time.Since(m.backlog.Start).Seconds())
+	m.backlog.Sent = append(m.backlog.Sent, m.total)
+	m.backlog.Received = append(m.backlog.Received, received-m.received)
+	m.backlog.Open = append(m.backlog.Open, open)
+	return nil
+}
+
+func (m *backlogMonitor) write(outputDir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.backlog.Offsets) == 0 {
+		return nil
+	}
+	return artifacts.Write(outputDir, artifacts.BacklogFile, m.backlog)
+}
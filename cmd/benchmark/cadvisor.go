@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// setupCAdvisorMonitors scrapes the cAdvisor metrics of every node at the interval, which hold what the summary
+// does not: CPU throttling, filesystem IO and network counters for every container. Only the samples for the
+// monitored pods are recorded, as a node reports every container it runs.
+func setupCAdvisorMonitors(ctx context.Context, client *kubernetes.Clientset, nodes []string, selectors map[string]labels.Selector, outputDir string, interval time.Duration) error {
+	if interval == 0 {
+		return nil
+	}
+	logrus.Info("Setting up cAdvisor metrics monitoring")
+	var markers [][]byte
+	for identifier, selector := range selectors {
+		pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return fmt.Errorf("could not list %s pods: %w", identifier, err)
+		}
+		for _, pod := range pods.Items {
+			markers = append(markers, []byte(`namespace="`+pod.Namespace+`",pod="`+pod.Name+`"`))
+		}
+	}
+	for _, node := range nodes {
+		nodeDir := filepath.Join(outputDir, artifacts.CAdvisorDir, node)
+		if err := os.MkdirAll(nodeDir, 0777); err != nil {
+			return fmt.Errorf("could not create output dir for node %s: %w", node, err)
+		}
+		go monitorCAdvisor(ctx, client, node, nodeDir, markers, interval)
+	}
+	return nil
+}
+
+func monitorCAdvisor(ctx context.Context, client *kubernetes.Clientset, nodeName, outputDir string, markers [][]byte, interval time.Duration) {
+	if err := wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (done bool, err error) {
+		if !diskBudget.sample(artifacts.CAdvisorMonitor, nodeName) {
+			return false, nil
+		}
+		scraped := time.Now()
+		raw, err := client.RESTClient().Get().AbsPath("/api/v1/nodes/" + nodeName + "/proxy/metrics/cadvisor").DoRaw(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithError(err).Errorf("failed to fetch cAdvisor metrics from node %s", nodeName)
+				collectionErrors.failed(artifacts.CAdvisorMonitor, nodeName, err)
+			}
+			return false, nil
+		}
+		collectionErrors.succeeded(artifacts.CAdvisorMonitor, nodeName)
+		if err := os.WriteFile(filepath.Join(outputDir, strconv.FormatInt(scraped.UnixNano(), 10)+artifacts.MetricsSnapshotExtension), filterSamples(raw, markers), 0666); err != nil {
+			logrus.WithError(err).Errorf("failed to record cAdvisor metrics from node %s", nodeName)
+		}
+		return false, nil
+	}); err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Errorf("failed to monitor cAdvisor metrics from node %s", nodeName)
+	}
+}
+
+// filterSamples keeps the comments and the samples whose labels contain any of the markers. cAdvisor writes the
+// namespace label right before the pod label, which is what the markers match.
+func filterSamples(raw []byte, markers [][]byte) []byte {
+	var filtered bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		keep := len(line) > 0 && line[0] == '#'
+		for i := 0; !keep && i < len(markers); i++ {
+			keep = bytes.Contains(line, markers[i])
+		}
+		if keep {
+			filtered.Write(line)
+			filtered.WriteByte('\n')
+		}
+	}
+	return filtered.Bytes()
+}
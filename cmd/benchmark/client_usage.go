@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// processUsage is what the benchmark process used at one point in time.
+type processUsage struct {
+	// cpu is the total time spent on CPUs, in seconds.
+	cpu     float64
+	rss     float64
+	fds     int
+	sockets int
+}
+
+// clientUsageMonitor samples the resources the benchmark itself uses.
+type clientUsageMonitor struct {
+	lock  sync.Mutex
+	usage artifacts.ClientUsage
+}
+
+func monitorClientUsage(ctx context.Context, interval time.Duration) *clientUsageMonitor {
+	monitor := &clientUsageMonitor{usage: artifacts.ClientUsage{Start: time.Now(), CPUs: runtime.GOMAXPROCS(0)}}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		previous, err := readProcessUsage()
+		if err != nil {
+			logrus.WithError(err).Warn("could not determine resources the benchmark uses, they will not be recorded")
+			return
+		}
+		previousTime := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := readProcessUsage()
+			if err != nil {
+				logrus.WithError(err).Debug("failed to sample resources the benchmark uses")
+				continue
+			}
+			now := time.Now()
+			monitor.lock.Lock()
+			monitor.usage.Offsets = append(monitor.usage.Offsets, now.Sub(monitor.usage.Start).Seconds())
+			monitor.usage.CPU = append(monitor.usage.CPU, (current.cpu-previous.cpu)/now.Sub(previousTime).Seconds())
+			monitor.usage.RSS = append(monitor.usage.RSS, current.rss)
+			monitor.usage.Goroutines = append(monitor.usage.Goroutines, runtime.NumGoroutine())
+			monitor.usage.FDs = append(monitor.usage.FDs, current.fds)
+			monitor.usage.Sockets = append(monitor.usage.Sockets, current.sockets)
+			monitor.lock.Unlock()
+			previous, previousTime = current, now
+		}
+	}()
+	return monitor
+}
+
+func (m *clientUsageMonitor) write(outputDir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.usage.Offsets) == 0 {
+		return nil
+	}
+	return artifacts.Write(outputDir, artifacts.ClientUsageFile, m.usage)
+}
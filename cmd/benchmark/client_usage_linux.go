@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func readProcessUsage() (processUsage, error) {
+	var usage processUsage
+	var rusage unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &rusage); err != nil {
+		return usage, fmt.Errorf("could not get resource usage: %w", err)
+	}
+	usage.cpu = float64(rusage.Utime.Nano()+rusage.Stime.Nano()) / 1e9
+
+	status, err := os.Open("/proc/self/status")
+	if err != nil {
+		return usage, fmt.Errorf("could not read process status: %w", err)
+	}
+	defer func() {
+		_ = status.Close()
+	}()
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 3 && fields[0] == "VmRSS:" {
+			kibibytes, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return usage, fmt.Errorf("could not parse resident set size: %w", err)
+			}
+			usage.rss = kibibytes * 1024
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return usage, fmt.Errorf("could not read process status: %w", err)
+	}
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return usage, fmt.Errorf("could not list file descriptors: %w", err)
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err != nil {
+			// the descriptor listing the directory is closed by the time it is read
+			continue
+		}
+		usage.fds++
+		if strings.HasPrefix(target, "socket:") {
+			usage.sockets++
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func readProcessUsage() (processUsage, error) {
+	return processUsage{}, errors.New("recording the resources the benchmark uses is only supported on Linux")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// coldStartExperimentOptions configure an experiment which restarts an API server while a fleet of watches waits
+// to reconnect to it, as happens during upgrade rollouts, repeating for every dataset size so that the time the
+// server takes to serve the whole fleet again can be related to the amount of state it must load.
+type coldStartExperimentOptions struct {
+	count    int
+	rate     int
+	objects  string
+	settle   time.Duration
+	restart  *restartOptions
+	cooldown *cooldownOptions
+}
+
+func defaultColdStartExperimentOptions() *coldStartExperimentOptions {
+	return &coldStartExperimentOptions{
+		count:    10000,
+		rate:     100,
+		objects:  "0,1000,10000",
+		settle:   30 * time.Second,
+		restart:  defaultRestartOptions(),
+		cooldown: defaultCooldownOptions(),
+	}
+}
+
+func bindColdStartExperimentOptions(fs *flag.FlagSet, defaults *coldStartExperimentOptions) *coldStartExperimentOptions {
+	prefix := "cold-start."
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.StringVar(&defaults.objects, prefix+"objects", defaults.objects, "Comma-delimited list of dataset sizes, in ConfigMaps in the watched namespace, to restart with.")
+	fs.DurationVar(&defaults.settle, prefix+"settle", defaults.settle, "Time to hold steady state before every restart.")
+	bindRestartOptions(fs, prefix, defaults.restart)
+	bindCooldownOptions(fs, prefix, defaults.cooldown)
+	return defaults
+}
+
+func (o *coldStartExperimentOptions) validate() error {
+	if _, err := o.datasetSizes(); err != nil {
+		return err
+	}
+	if err := o.cooldown.validate("cold-start."); err != nil {
+		return err
+	}
+	return o.restart.validate("cold-start.")
+}
+
+func (o *coldStartExperimentOptions) datasetSizes() ([]int, error) {
+	var sizes []int
+	for _, part := range strings.Split(o.objects, ",") {
+		size, err := strconv.Atoi(part)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("--cold-start.objects invalid: %s is not a dataset size", part)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+const coldStartFile = "cold-start.json"
+
+type coldStartResult struct {
+	Objects int    `json:"objects"`
+	Watches int    `json:"watches"`
+	Pod     string `json:"pod"`
+	// Ready is the time, in seconds, from the restart until the replacement server was ready.
+	Ready float64 `json:"ready"`
+
+	Disconnected  int `json:"disconnected"`
+	Reestablished int `json:"reestablished"`
+	// FullFleet is the time, in seconds, from the restart until the last watch was re-established, while
+	// Reestablishment is the distribution of those times over watches.
+	FullFleet       float64         `json:"fullFleet"`
+	Reestablishment durationSummary `json:"reestablishment"`
+	// Synced counts the watchers which received the state of every object again after reconnecting; Delivery is the
+	// distribution of times from the restart until they had.
+	Synced   int             `json:"synced"`
+	Delivery durationSummary `json:"delivery"`
+}
+
+func runColdStartExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *coldStartExperimentOptions) error {
+	logrus.Info("Running cold start experiment")
+	sizes, err := opts.datasetSizes()
+	if err != nil {
+		return err
+	}
+	if _, err := opts.restart.target(ctx, client); err != nil {
+		return err
+	}
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	cooldowns, err := newCooldowns(ctx, opts.cooldown)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cooldowns.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record cooldowns")
+		}
+	}()
+
+	var results []coldStartResult
+	for i, size := range sizes {
+		if i > 0 {
+			if err := cooldowns.wait(ctx, phases, strconv.Itoa(sizes[i-1])); err != nil {
+				return err
+			}
+		}
+		result, err := coldStartWithDataset(ctx, client, phases, size, opts)
+		if err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"objects":   size,
+			"ready":     fmt.Sprintf("%.3fs", result.Ready),
+			"fullFleet": fmt.Sprintf("%.3fs", result.FullFleet),
+			"delivery":  fmt.Sprintf("%.3fs", result.Delivery.P99),
+		}).Info("Watch fleet recovered from cold start")
+		results = append(results, result)
+	}
+	if err := artifacts.Write(outputDir, coldStartFile, results); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished cold start experiment")
+	return nil
+}
+
+func coldStartWithDataset(ctx context.Context, client *kubernetes.Clientset, phases *phaseRecorder, size int, opts *coldStartExperimentOptions) (coldStartResult, error) {
+	result := coldStartResult{Objects: size, Watches: opts.count}
+	phases.start(fmt.Sprintf("setup-%d", size))
+	namespace, cleanup, err := createNamespace(ctx, client, "cold-start")
+	if err != nil {
+		return result, err
+	}
+	defer cleanup()
+	if err := createConfigMaps(ctx, client, namespace, size); err != nil {
+		return result, err
+	}
+
+	// the fleet is torn down before the next dataset is loaded
+	fleetCtx, stopFleet := context.WithCancel(ctx)
+	defer stopFleet()
+	tracker := newWatchTracker(opts.count)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.count; i++ {
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-ticker.C:
+		}
+		go tracker.watchWithReconnect(fleetCtx, i, configMapWatch(client, namespace), nil)
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.count, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+
+	phases.start(fmt.Sprintf("steady-%d", size))
+	if err := holdFor(ctx, opts.settle); err != nil {
+		return result, err
+	}
+
+	phases.start(fmt.Sprintf("restart-%d", size))
+	restarted := tracker.now()
+	pod, err := restartAPIServer(ctx, client, opts.restart)
+	if err != nil {
+		return result, err
+	}
+	result.Pod = pod.Namespace + "/" + pod.Name
+	result.Ready = time.Duration(tracker.now() - restarted).Seconds()
+
+	phases.start(fmt.Sprintf("recovery-%d", size))
+	// nothing is written to the namespace, so watches only see the initial state of every object, sent when they
+	// were first established and again when they reconnected
+	synced := func(i int) bool {
+		record := &tracker.records[i]
+		return atomic.LoadInt64(&record.reestablished) > restarted && atomic.LoadInt64(&record.events) >= int64(2*size)
+	}
+	if err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, opts.restart.timeout, true, func(ctx context.Context) (bool, error) {
+		for i := range tracker.records {
+			if atomic.LoadInt64(&tracker.records[i].disconnected) != 0 && !synced(i) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		logrus.WithError(err).Warn("not all disconnected watches were re-established and synced")
+	}
+
+	var reestablishment, delivery []time.Duration
+	for i := range tracker.records {
+		record := &tracker.records[i]
+		if atomic.LoadInt64(&record.disconnected) == 0 {
+			continue
+		}
+		result.Disconnected++
+		if reestablished := atomic.LoadInt64(&record.reestablished); reestablished > restarted {
+			result.Reestablished++
+			reestablishment = append(reestablishment, time.Duration(reestablished-restarted))
+		}
+		if synced(i) {
+			result.Synced++
+			latest := atomic.LoadInt64(&record.reestablished)
+			if size > 0 {
+				latest = atomic.LoadInt64(&record.lastEvent)
+			}
+			delivery = append(delivery, time.Duration(latest-restarted))
+		}
+	}
+	result.Reestablishment = summarizeDurations(reestablishment)
+	result.FullFleet = result.Reestablishment.Max
+	result.Delivery = summarizeDurations(delivery)
+	return result, nil
+}
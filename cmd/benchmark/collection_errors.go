@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// collectionErrors records when the monitors failed to collect what they monitor, so that the gaps this leaves in
+// the data are marked as such instead of being smoothed over.
+var collectionErrors = &collectionErrorRecorder{open: map[string]*artifacts.CollectionError{}}
+
+type collectionErrorRecorder struct {
+	lock sync.Mutex
+	// open holds the stretches of failures which have not ended yet, keyed by monitor and target.
+	open   map[string]*artifacts.CollectionError
+	closed []artifacts.CollectionError
+}
+
+func (r *collectionErrorRecorder) failed(monitor, target string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := monitor + "/" + target
+	stretch, exists := r.open[key]
+	if !exists {
+		stretch = &artifacts.CollectionError{Monitor: monitor, Target: target, Start: time.Now(), Reasons: map[string]int{}}
+		r.open[key] = stretch
+	}
+	stretch.Failures++
+	stretch.Reasons[err.Error()]++
+}
+
+func (r *collectionErrorRecorder) succeeded(monitor, target string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := monitor + "/" + target
+	stretch, exists := r.open[key]
+	if !exists {
+		return
+	}
+	end := time.Now()
+	stretch.End = &end
+	r.closed = append(r.closed, *stretch)
+	delete(r.open, key)
+}
+
+// write records every stretch of failures, including those which had not ended.
+func (r *collectionErrorRecorder) write(outputDir string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stretches := append([]artifacts.CollectionError{}, r.closed...)
+	for _, stretch := range r.open {
+		stretches = append(stretches, *stretch)
+	}
+	if len(stretches) == 0 {
+		return nil
+	}
+	sort.Slice(stretches, func(i, j int) bool {
+		return stretches[i].Start.Before(stretches[j].Start)
+	})
+	return artifacts.Write(outputDir, artifacts.CollectionErrorsFile, stretches)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// compareCommand runs the same experiment against two clusters at once, like:
+//
+//	benchmark compare --contexts before,after --output comparison -- --kubeconfig config --experiment soak
+//
+// Running both sides in parallel keeps variance in the infrastructure, which follows the time of day, out of the
+// comparison. Every side runs in its own process, which sets up its monitors and then waits at a barrier until the
+// other is ready too, so that both experiments start together; both name their objects with the same seed.
+const compareCommand = "compare"
+
+// startBarrierReady is printed by a run at the start barrier, which then waits for a line on its input.
+const startBarrierReady = "ready"
+
+// runComparison runs both sides of a comparison to completion and records how they were paired.
+func runComparison(args []string) error {
+	fs := flag.NewFlagSet(compareCommand, flag.ExitOnError)
+	contexts := fs.String("contexts", "", "Comma-delimited pair of kubeconfig contexts for the clusters to compare.")
+	outputDir := fs.String("output", "", "Path to output directory, which will hold the output of every side in a subdirectory.")
+	seed := fs.Int64("seed", 0, "Seed for both sides, or zero to choose one at random.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pair := strings.Split(*contexts, ",")
+	if len(pair) != len(artifacts.ComparisonSides) || pair[0] == "" || pair[1] == "" {
+		return errors.New("--contexts must hold two contexts")
+	}
+	if *outputDir == "" {
+		return errors.New("--output is required")
+	}
+	if *seed == 0 {
+		*seed = rand.Int63()
+	}
+	if err := os.RemoveAll(*outputDir); err != nil {
+		return fmt.Errorf("could not clear output dir: %w", err)
+	}
+	if err := os.MkdirAll(*outputDir, 0777); err != nil {
+		return fmt.Errorf("could not create output dir: %w", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not determine benchmark executable: %w", err)
+	}
+
+	comparison := artifacts.Comparison{Seed: *seed, Contexts: map[string]string{}}
+	sides := make([]*comparisonSide, len(pair))
+	for i, side := range artifacts.ComparisonSides {
+		comparison.Contexts[side] = pair[i]
+		sides[i], err = startComparisonSide(executable, append(fs.Args(),
+			"--context="+pair[i],
+			"--seed="+strconv.FormatInt(*seed, 10),
+			"--output="+filepath.Join(*outputDir, side),
+			"--start-barrier",
+		))
+		if err != nil {
+			for _, started := range sides[:i] {
+				started.abort()
+			}
+			return fmt.Errorf("could not start run against %s: %w", pair[i], err)
+		}
+	}
+
+	ready := true
+	for i, side := range sides {
+		if !side.waitForBarrier() {
+			logrus.Errorf("run against %s exited before reaching the start barrier", pair[i])
+			ready = false
+		}
+	}
+	if !ready {
+		for _, side := range sides {
+			side.abort()
+		}
+	} else {
+		logrus.Info("Both runs are ready, starting experiments.")
+		start := time.Now()
+		comparison.Start = &start
+		for _, side := range sides {
+			side.release()
+		}
+	}
+
+	var failed []string
+	for i, side := range sides {
+		if err := side.cmd.Wait(); err != nil {
+			logrus.WithError(err).Errorf("run against %s failed", pair[i])
+			failed = append(failed, pair[i])
+		}
+	}
+	if err := artifacts.Write(*outputDir, artifacts.ComparisonFile, comparison); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("runs against %s failed", strings.Join(failed, " and "))
+	}
+	return nil
+}
+
+type comparisonSide struct {
+	cmd   *exec.Cmd
+	input io.WriteCloser
+	ready chan bool
+}
+
+func startComparisonSide(executable string, args []string) (*comparisonSide, error) {
+	cmd := exec.Command(executable, args...)
+	cmd.Stderr = os.Stderr
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	side := &comparisonSide{cmd: cmd, input: input, ready: make(chan bool, 1)}
+	go func() {
+		var once sync.Once
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			if scanner.Text() == startBarrierReady {
+				once.Do(func() { side.ready <- true })
+			}
+		}
+		once.Do(func() { side.ready <- false })
+	}()
+	return side, nil
+}
+
+// waitForBarrier determines whether the run reached the start barrier, rather than exiting before it.
+func (s *comparisonSide) waitForBarrier() bool {
+	return <-s.ready
+}
+
+func (s *comparisonSide) release() {
+	if _, err := fmt.Fprintln(s.input); err != nil {
+		logrus.WithError(err).Error("could not release run from the start barrier")
+	}
+}
+
+// abort closes the input of the run, which makes it exit at the start barrier.
+func (s *comparisonSide) abort() {
+	if err := s.input.Close(); err != nil {
+		logrus.WithError(err).Debug("failed to close run input")
+	}
+}
+
+// waitAtStartBarrier tells the process running the comparison that this run is ready and waits to be released.
+func waitAtStartBarrier() error {
+	fmt.Println(startBarrierReady)
+	if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err != nil {
+		return fmt.Errorf("was not released from the start barrier: %w", err)
+	}
+	return nil
+}
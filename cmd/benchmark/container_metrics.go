@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// unchangedSamplesFile lists, one per line, the times at which a node was polled but none of its stats had changed.
+const unchangedSamplesFile = "unchanged.txt"
+
+// summaryFetcher fetches the stats summary of a node.
+type summaryFetcher func(ctx context.Context, node string) ([]byte, error)
+
+// kubeletSummaries fetches summaries from the kubelet of every node, through the node proxy of the API server.
+func kubeletSummaries(client rest.Interface) summaryFetcher {
+	return func(ctx context.Context, node string) ([]byte, error) {
+		return client.Get().AbsPath("/api/v1/nodes/" + node + "/proxy/stats/summary").Do(ctx).Raw()
+	}
+}
+
+func setupContainerMetricsMonitors(ctx context.Context, fetch summaryFetcher, nodes []string, outputDir string, interval time.Duration, rotation rotation, dedupe bool) error {
+	logrus.Info("Setting up container metrics monitoring")
+	for _, node := range nodes {
+		nodeDir := filepath.Join(outputDir, artifacts.SummariesDir, node)
+		if err := os.MkdirAll(nodeDir, 0777); err != nil {
+			return fmt.Errorf("could not create output dir for node %s: %w", node, err)
+		}
+		var deduplicator *summaryDeduplicator
+		if dedupe {
+			deduplicator = &summaryDeduplicator{hashes: map[string]uint64{}}
+		}
+		go monitorContainerMetrics(ctx, fetch, node, nodeDir, interval, newRollingFile(nodeDir, rotation), deduplicator)
+	}
+
+	return nil
+}
+
+func monitorContainerMetrics(ctx context.Context, fetch summaryFetcher, nodeName, outputDir string, interval time.Duration, output *rollingFile, deduplicator *summaryDeduplicator) {
+	logrus.Infof("Setting up container metrics monitoring for node %s", nodeName)
+	polls := sync.WaitGroup{}
+	if err := wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (done bool, err error) {
+		if !diskBudget.sample(artifacts.SummaryMonitor, nodeName) {
+			return false, nil
+		}
+		polls.Add(1)
+		go func() {
+			defer polls.Done()
+			raw, err := fetch(ctx, nodeName)
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.WithError(err).Errorf("failed to fetch container metrics")
+					collectionErrors.failed(artifacts.SummaryMonitor, nodeName, err)
+				}
+				return
+			}
+			collectionErrors.succeeded(artifacts.SummaryMonitor, nodeName)
+			if deduplicator != nil {
+				filtered, changed, err := deduplicator.filter(raw)
+				if err != nil {
+					logrus.WithError(err).Errorf("failed to deduplicate container metrics")
+				} else if !changed {
+					if err := deduplicator.recordUnchanged(outputDir, time.Now()); err != nil {
+						logrus.WithError(err).Errorf("failed to record unchanged container metrics")
+					}
+					return
+				} else {
+					raw = filtered
+				}
+			}
+			if err := output.append(raw); err != nil {
+				logrus.WithError(err).Errorf("failed to record container metrics")
+			}
+		}()
+		return false, nil
+	}); err != nil {
+		logrus.WithError(err).Errorf("failed to monitor container metrics")
+	}
+	polls.Wait()
+	if err := output.close(); err != nil {
+		logrus.WithError(err).Errorf("failed to record container metrics")
+	}
+}
+
+// summaryDeduplicator drops stats which have not changed since the last sample from kubelet summaries. The kubelet
+// only refreshes stats every housekeeping interval (~10s) while we poll far more often, so most of what we fetch
+// is a copy of what we already have.
+type summaryDeduplicator struct {
+	lock   sync.Mutex
+	hashes map[string]uint64
+}
+
+// summary is the subset of the kubelet summary the deduplicator needs to understand; everything else is kept as-is.
+type summary struct {
+	Node json.RawMessage   `json:"node"`
+	Pods []json.RawMessage `json:"pods"`
+	// UnchangedPods lists the pods which were dropped from this sample as their stats had not changed.
+	UnchangedPods []string `json:"unchangedPods,omitempty"`
+}
+
+type podStatsReference struct {
+	PodRef struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"podRef"`
+}
+
+// filter removes pods with unchanged stats from the summary, determining whether anything changed at all.
+func (d *summaryDeduplicator) filter(raw []byte) ([]byte, bool, error) {
+	var sample summary
+	if err := json.Unmarshal(raw, &sample); err != nil {
+		return nil, false, fmt.Errorf("could not unmarshal summary: %w", err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	changed := d.update("node", sample.Node)
+	var pods []json.RawMessage
+	for _, pod := range sample.Pods {
+		var ref podStatsReference
+		if err := json.Unmarshal(pod, &ref); err != nil {
+			return nil, false, fmt.Errorf("could not unmarshal pod stats: %w", err)
+		}
+		key := ref.PodRef.Namespace + "/" + ref.PodRef.Name
+		if d.update(key, pod) {
+			pods = append(pods, pod)
+		} else {
+			sample.UnchangedPods = append(sample.UnchangedPods, key)
+		}
+	}
+	if !changed && len(pods) == 0 {
+		return nil, false, nil
+	}
+	sample.Pods = pods
+	filtered, err := json.Marshal(sample)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not marshal summary: %w", err)
+	}
+	return filtered, true, nil
+}
+
+// update records the hash of the stats, determining if they changed.
+func (d *summaryDeduplicator) update(key string, stats []byte) bool {
+	hash := fnv.New64a()
+	_, _ = hash.Write(stats)
+	sum := hash.Sum64()
+	previous, seen := d.hashes[key]
+	d.hashes[key] = sum
+	return !seen || previous != sum
+}
+
+func (d *summaryDeduplicator) recordUnchanged(outputDir string, timestamp time.Time) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return recordUnchanged(outputDir, timestamp)
+}
+
+// recordUnchanged lists the time at which a node was polled in its unchangedSamplesFile.
+func recordUnchanged(outputDir string, timestamp time.Time) error {
+	file, err := os.OpenFile(filepath.Join(outputDir, unchangedSamplesFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(timestamp.Format(time.RFC3339Nano) + "\n"); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
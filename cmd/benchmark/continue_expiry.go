@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// continueExpiryExperimentOptions configure an experiment which starts paginated lists and stalls after the first
+// page, while writes move the etcd revision along, so that continue tokens outlive the compaction window. Every
+// expired token costs the client a full relist, as a reflector would fall back to.
+type continueExpiryExperimentOptions struct {
+	objects   int
+	pageSize  int
+	lists     int
+	stalls    string
+	writeRate int
+}
+
+func defaultContinueExpiryExperimentOptions() *continueExpiryExperimentOptions {
+	return &continueExpiryExperimentOptions{
+		objects:   2000,
+		pageSize:  100,
+		lists:     10,
+		stalls:    "1m,11m",
+		writeRate: 10,
+	}
+}
+
+func bindContinueExpiryExperimentOptions(fs *flag.FlagSet, defaults *continueExpiryExperimentOptions) *continueExpiryExperimentOptions {
+	prefix := "continue-expiry."
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps in the listed namespace.")
+	fs.IntVar(&defaults.pageSize, prefix+"page-size", defaults.pageSize, "Number of objects to request in every page.")
+	fs.IntVar(&defaults.lists, prefix+"lists", defaults.lists, "Number of paginated lists to run concurrently for every stall.")
+	fs.StringVar(&defaults.stalls, prefix+"stalls", defaults.stalls, "Comma-delimited list of times to stall after the first page; etcd compacts every five minutes by default, so tokens expire after at most twice that.")
+	fs.IntVar(&defaults.writeRate, prefix+"write-rate", defaults.writeRate, "Rate of writes moving the etcd revision along, in Hertz.")
+	return defaults
+}
+
+func (o *continueExpiryExperimentOptions) validate() error {
+	if o.objects <= 0 || o.pageSize <= 0 || o.lists <= 0 || o.writeRate <= 0 {
+		return errors.New("--continue-expiry.objects, --continue-expiry.page-size, --continue-expiry.lists and --continue-expiry.write-rate must be positive")
+	}
+	if o.pageSize >= o.objects {
+		return errors.New("--continue-expiry.page-size must be smaller than --continue-expiry.objects for lists to be paginated")
+	}
+	_, err := o.stallDurations()
+	return err
+}
+
+func (o *continueExpiryExperimentOptions) stallDurations() ([]time.Duration, error) {
+	var stalls []time.Duration
+	for _, part := range strings.Split(o.stalls, ",") {
+		stall, err := time.ParseDuration(part)
+		if err != nil || stall < 0 {
+			return nil, fmt.Errorf("--continue-expiry.stalls invalid: %s is not a duration", part)
+		}
+		stalls = append(stalls, stall)
+	}
+	return stalls, nil
+}
+
+const continueExpiryFile = "continue-expiry.json"
+
+type continueExpiryResult struct {
+	Stall   float64        `json:"stall"`
+	Lists   int            `json:"lists"`
+	Expired int            `json:"expired"`
+	Errors  map[string]int `json:"errors,omitempty"`
+	// Completed is the distribution of times taken by paginated lists which completed, stall included.
+	Completed durationSummary `json:"completed"`
+	// Relist is the distribution of times taken by the full relists that expired tokens forced, and RelistBytes is
+	// the total size of their responses, on top of the pages already received.
+	Relist      durationSummary `json:"relist"`
+	RelistBytes int64           `json:"relistBytes"`
+	WastedBytes int64           `json:"wastedBytes"`
+}
+
+func runContinueExpiryExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *continueExpiryExperimentOptions) error {
+	logrus.Info("Running continue token expiry experiment")
+	stalls, err := opts.stallDurations()
+	if err != nil {
+		return err
+	}
+	namespace, cleanup, err := createNamespace(ctx, client, "continue-expiry")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	if err := createConfigMaps(ctx, client, namespace, opts.objects); err != nil {
+		return err
+	}
+	writeCtx, stopWriting := context.WithCancel(ctx)
+	defer stopWriting()
+	go writeConfigMapContinuously(writeCtx, client, namespace, opts.writeRate, func(err error) {
+		if err != nil {
+			logrus.WithError(err).Debug("failed to write ConfigMap")
+		}
+	})
+
+	var results []continueExpiryResult
+	for _, stall := range stalls {
+		phases.start("stall-" + stall.String())
+		result := continueExpiryResult{Stall: stall.Seconds(), Lists: opts.lists, Errors: map[string]int{}}
+		var lock sync.Mutex
+		var completed, relists []time.Duration
+		var wg sync.WaitGroup
+		for i := 0; i < opts.lists; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				outcome := stalledList(ctx, client, namespace, opts.pageSize, stall)
+				lock.Lock()
+				defer lock.Unlock()
+				switch {
+				case outcome.err != nil:
+					result.Errors[outcome.err.Error()]++
+				case outcome.expired:
+					result.Expired++
+					result.WastedBytes += outcome.pageBytes
+					result.RelistBytes += outcome.relistBytes
+					relists = append(relists, outcome.relist)
+				default:
+					completed = append(completed, outcome.took)
+				}
+			}()
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result.Completed = summarizeDurations(completed)
+		result.Relist = summarizeDurations(relists)
+		logrus.Infof("%d/%d lists stalled for %s had their continue token expire", result.Expired, result.Lists, stall)
+		results = append(results, result)
+	}
+	if err := artifacts.Write(outputDir, continueExpiryFile, results); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished continue token expiry experiment")
+	return nil
+}
+
+type stalledListOutcome struct {
+	took      time.Duration
+	pageBytes int64
+	expired   bool
+	// relist is the time taken by the full relist after the token expired, which returned relistBytes.
+	relist      time.Duration
+	relistBytes int64
+	err         error
+}
+
+// stalledList pages through the namespace, stalling after the first page. When the continue token has expired by
+// then, it relists in full, as a reflector would.
+func stalledList(ctx context.Context, client *kubernetes.Clientset, namespace string, pageSize int, stall time.Duration) stalledListOutcome {
+	var outcome stalledListOutcome
+	start := time.Now()
+	options := metav1.ListOptions{Limit: int64(pageSize)}
+	for page := 0; ; page++ {
+		if page == 1 {
+			if err := holdFor(ctx, stall); err != nil {
+				outcome.err = err
+				return outcome
+			}
+		}
+		raw, err := listPage(ctx, client, namespace, options)
+		if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+			outcome.expired = true
+			relistStart := time.Now()
+			raw, err := listPage(ctx, client, namespace, metav1.ListOptions{})
+			if err != nil {
+				outcome.err = err
+				return outcome
+			}
+			outcome.relist = time.Since(relistStart)
+			outcome.relistBytes = int64(len(raw))
+			return outcome
+		}
+		if err != nil {
+			outcome.err = err
+			return outcome
+		}
+		outcome.pageBytes += int64(len(raw))
+		var list struct {
+			Metadata metav1.ListMeta `json:"metadata"`
+		}
+		if err := json.Unmarshal(raw, &list); err != nil {
+			outcome.err = fmt.Errorf("could not decode list metadata: %w", err)
+			return outcome
+		}
+		if list.Metadata.Continue == "" {
+			outcome.took = time.Since(start)
+			return outcome
+		}
+		options.Continue = list.Metadata.Continue
+	}
+}
+
+func listPage(ctx context.Context, client *kubernetes.Clientset, namespace string, options metav1.ListOptions) ([]byte, error) {
+	return client.CoreV1().RESTClient().Get().
+		Namespace(namespace).
+		Resource("configmaps").
+		VersionedParams(&options, scheme.ParameterCodec).
+		DoRaw(ctx)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// exitCodeMissingArtifacts is used when an experiment succeeded without writing what it promises, so that
+// automation does not digest a run which measured nothing.
+const exitCodeMissingArtifacts = 4
+
+// artifactContract is a file an experiment promises to write on success, and the type it must decode into.
+type artifactContract struct {
+	file   string
+	schema func() interface{}
+}
+
+func phasesContract() artifactContract {
+	return artifactContract{file: artifacts.PhasesFile, schema: func() interface{} { return &[]artifacts.Phase{} }}
+}
+
+func latenciesContract() artifactContract {
+	return artifactContract{file: artifacts.LatenciesFile, schema: func() interface{} { return &artifacts.Latencies{} }}
+}
+
+// experimentArtifacts lists what every experiment produces. Artifacts written only under some configurations, like
+// the cohorts of a rolling restart, are left out.
+var experimentArtifacts = map[experiment][]artifactContract{
+	latentWatchExperiment: {
+		{file: artifacts.LatentWatchFile, schema: func() interface{} { return &[]time.Time{} }},
+		latenciesContract(),
+	},
+	auditImpactExperiment: {phasesContract()},
+	rollingRestartExperiment: {
+		phasesContract(), latenciesContract(),
+		{file: rollingRestartFile, schema: func() interface{} { return &rollingRestartResult{} }},
+	},
+	watchMixExperiment: {
+		phasesContract(), latenciesContract(),
+		{file: watchMixFile, schema: func() interface{} { return &map[string]watchMixResult{} }},
+	},
+	idleStepsExperiment: {
+		phasesContract(), latenciesContract(),
+		{file: artifacts.StepsFile, schema: func() interface{} { return &[]artifacts.Step{} }},
+	},
+	rebalanceExperiment: {
+		phasesContract(), latenciesContract(),
+		{file: rebalanceFile, schema: func() interface{} { return &rebalanceResult{} }},
+	},
+	rvMatchExperiment: {
+		phasesContract(),
+		{file: rvMatchFile, schema: func() interface{} { return &map[string]rvMatchResult{} }},
+	},
+	deleteCollectionExperiment: {
+		phasesContract(), latenciesContract(),
+		{file: deleteCollectionFile, schema: func() interface{} { return &deleteCollectionResult{} }},
+	},
+	etcdLeaderExperiment: {
+		phasesContract(),
+		{file: etcdLeaderFile, schema: func() interface{} { return &etcdLeaderResult{} }},
+	},
+	coldStartExperiment: {
+		phasesContract(),
+		{file: coldStartFile, schema: func() interface{} { return &[]coldStartResult{} }},
+	},
+	ssaConflictsExperiment: {
+		phasesContract(),
+		{file: ssaConflictsFile, schema: func() interface{} { return &ssaConflictsResult{} }},
+	},
+	aggregatedAPIExperiment: {
+		phasesContract(), latenciesContract(),
+		{file: aggregatedAPIFile, schema: func() interface{} { return &map[string]aggregatedAPIFleet{} }},
+	},
+	soakExperiment: {
+		phasesContract(),
+		{file: soakFile, schema: func() interface{} { return &soakResult{} }},
+	},
+	continueExpiryExperiment: {
+		phasesContract(),
+		{file: continueExpiryFile, schema: func() interface{} { return &[]continueExpiryResult{} }},
+	},
+	timeToSyncExperiment: {
+		phasesContract(), latenciesContract(),
+		{file: timeToSyncFile, schema: func() interface{} { return &[]timeToSyncResult{} }},
+	},
+	selectorChurnExperiment: {
+		phasesContract(),
+		{file: selectorChurnFile, schema: func() interface{} { return &map[string]selectorChurnPhase{} }},
+	},
+	finalizersExperiment: {
+		phasesContract(), latenciesContract(),
+		{file: finalizersFile, schema: func() interface{} { return &finalizersResult{} }},
+	},
+	flowSchemasExperiment: {
+		phasesContract(),
+		{file: flowSchemasFile, schema: func() interface{} { return &map[string]tenantResult{} }},
+	},
+	streamingExperiment: {
+		phasesContract(),
+		{file: streamingFile, schema: func() interface{} { return &map[string]streamingPhase{} }},
+	},
+}
+
+// validateArtifacts checks that the experiment wrote everything it promises, in a form the digest can read, and
+// that none of it is empty; an experiment whose context ends early can otherwise succeed without having measured
+// anything. Every problem found is returned, so that they can be recorded as evidence.
+func validateArtifacts(outputDir string, e experiment) []string {
+	var problems []string
+	for _, contract := range experimentArtifacts[e] {
+		raw, err := os.ReadFile(filepath.Join(outputDir, contract.file))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("could not read %s: %v", contract.file, err))
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		into := contract.schema()
+		if err := decoder.Decode(into); err != nil {
+			problems = append(problems, fmt.Sprintf("could not decode %s: %v", contract.file, err))
+			continue
+		}
+		if empty(reflect.ValueOf(into).Elem()) {
+			problems = append(problems, fmt.Sprintf("%s holds no data", contract.file))
+		}
+	}
+	return problems
+}
+
+func empty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	default:
+		return value.IsZero()
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// cooldownOptions configure the wait between the sweep points of an experiment, until the API servers have
+// returned to the load they had before the first point, so that later points are not measured on a control plane
+// which is still recovering from the earlier ones.
+type cooldownOptions struct {
+	tolerance float64
+	max       time.Duration
+	interval  time.Duration
+}
+
+func defaultCooldownOptions() *cooldownOptions {
+	return &cooldownOptions{
+		tolerance: 0.1,
+		max:       5 * time.Minute,
+		interval:  10 * time.Second,
+	}
+}
+
+func bindCooldownOptions(fs *flag.FlagSet, prefix string, defaults *cooldownOptions) *cooldownOptions {
+	fs.Float64Var(&defaults.tolerance, prefix+"cooldown.tolerance", defaults.tolerance, "Fraction above the baseline within which the API servers are considered recovered between sweep points.")
+	fs.DurationVar(&defaults.max, prefix+"cooldown.max", defaults.max, "Maximum time to wait for recovery between sweep points, or zero to not wait.")
+	fs.DurationVar(&defaults.interval, prefix+"cooldown.interval", defaults.interval, "Time over which the API server load is measured, and between measurements.")
+	return defaults
+}
+
+func (o *cooldownOptions) validate(prefix string) error {
+	if o.tolerance < 0 {
+		return fmt.Errorf("--%scooldown.tolerance must not be negative", prefix)
+	}
+	if o.max > 0 && o.interval <= 0 {
+		return fmt.Errorf("--%scooldown.interval must be positive", prefix)
+	}
+	return nil
+}
+
+const cooldownsFile = "cooldowns.json"
+
+// idleCPUCores is the CPU usage below which a replica is considered idle, as the tolerance is meaningless against
+// the tiny usage of an idle server.
+const idleCPUCores = 0.05
+
+// replicaLoad is the load of a replica, which is added up over replicas to compare against the baseline.
+type replicaLoad struct {
+	CPUCores  float64 `json:"cpuCores"`
+	HeapBytes float64 `json:"heapBytes"`
+	Watches   float64 `json:"watches"`
+}
+
+type cooldownRecord struct {
+	After     string                 `json:"after"`
+	Seconds   float64                `json:"seconds"`
+	Recovered bool                   `json:"recovered"`
+	Final     map[string]replicaLoad `json:"final,omitempty"`
+}
+
+type cooldowns struct {
+	Baseline map[string]replicaLoad `json:"baseline"`
+	Records  []cooldownRecord       `json:"cooldowns"`
+
+	opts *cooldownOptions
+}
+
+// newCooldowns measures the baseline load of the API servers, which must be done before the first sweep point.
+func newCooldowns(ctx context.Context, opts *cooldownOptions) (*cooldowns, error) {
+	c := &cooldowns{opts: opts}
+	if opts.max == 0 {
+		return c, nil
+	}
+	baseline, err := c.measure(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not measure baseline API server load: %w", err)
+	}
+	c.Baseline = baseline
+	return c, nil
+}
+
+// wait holds until the API servers have recovered from the sweep point, or the maximum cooldown has elapsed.
+func (c *cooldowns) wait(ctx context.Context, phases *phaseRecorder, after string) error {
+	if c.opts.max == 0 {
+		return nil
+	}
+	phases.start("cooldown-" + after)
+	start := time.Now()
+	record := cooldownRecord{After: after}
+	for time.Since(start) < c.opts.max {
+		load, err := c.measure(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			logrus.WithError(err).Warn("failed to measure API server load")
+			if err := holdFor(ctx, c.opts.interval); err != nil {
+				return err
+			}
+			continue
+		}
+		record.Final = load
+		if record.Recovered = c.recovered(load); record.Recovered {
+			break
+		}
+	}
+	record.Seconds = time.Since(start).Seconds()
+	if record.Recovered {
+		logrus.Infof("API servers recovered from %s after %.0fs", after, record.Seconds)
+	} else {
+		logrus.Warnf("API servers did not recover from %s within %s", after, c.opts.max)
+	}
+	c.Records = append(c.Records, record)
+	return nil
+}
+
+// recovered compares the load of all replicas together against the baseline, as replicas restarted by the
+// experiment may be replaced by pods of other names, on other nodes.
+func (c *cooldowns) recovered(load map[string]replicaLoad) bool {
+	if len(load) < len(c.Baseline) {
+		return false
+	}
+	limit := 1 + c.opts.tolerance
+	current, baseline := totalLoad(load), totalLoad(c.Baseline)
+	if current.CPUCores > idleCPUCores*float64(len(load)) && current.CPUCores > baseline.CPUCores*limit {
+		return false
+	}
+	return current.HeapBytes <= baseline.HeapBytes*limit && current.Watches <= baseline.Watches*limit
+}
+
+func totalLoad(load map[string]replicaLoad) replicaLoad {
+	var total replicaLoad
+	for _, replica := range load {
+		total.CPUCores += replica.CPUCores
+		total.HeapBytes += replica.HeapBytes
+		total.Watches += replica.Watches
+	}
+	return total
+}
+
+// measure determines the load of every replica, with CPU usage averaged over the interval.
+func (c *cooldowns) measure(ctx context.Context) (map[string]replicaLoad, error) {
+	instances, err := apiserverScrapes.replicas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type cpuSample struct {
+		time    time.Time
+		seconds float64
+	}
+	cpuBefore := map[string]cpuSample{}
+	for _, instance := range instances {
+		scraped, families, err := apiserverScrapes.families(ctx, instance, c.opts.interval/2)
+		if err != nil {
+			return nil, fmt.Errorf("could not scrape %s: %w", instance.pod, err)
+		}
+		cpuBefore[instance.pod] = cpuSample{time: scraped, seconds: sumMetric(families, "process_cpu_seconds_total", nil)}
+	}
+	if err := holdFor(ctx, c.opts.interval); err != nil {
+		return nil, err
+	}
+	load := map[string]replicaLoad{}
+	for _, instance := range instances {
+		scraped, families, err := apiserverScrapes.families(ctx, instance, c.opts.interval/2)
+		if err != nil {
+			return nil, fmt.Errorf("could not scrape %s: %w", instance.pod, err)
+		}
+		// a scrape shared with other monitors may be older than the hold, so the rate is over when both were taken
+		before := cpuBefore[instance.pod]
+		load[instance.pod] = replicaLoad{
+			CPUCores:  (sumMetric(families, "process_cpu_seconds_total", nil) - before.seconds) / scraped.Sub(before.time).Seconds(),
+			HeapBytes: sumMetric(families, "go_memstats_heap_inuse_bytes", nil),
+			Watches:   sumMetric(families, "apiserver_longrunning_requests", map[string]string{"verb": "WATCH"}),
+		}
+	}
+	return load, nil
+}
+
+func (c *cooldowns) write(outputDir string) error {
+	if len(c.Records) == 0 {
+		return nil
+	}
+	return artifacts.Write(outputDir, cooldownsFile, c)
+}
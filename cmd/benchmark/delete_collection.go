@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// deleteCollectionExperimentOptions configure an experiment which deletes a large collection of objects at once
+// while watchers are subscribed to it, measuring how long the resulting burst of events takes to be delivered.
+type deleteCollectionExperimentOptions struct {
+	watches int
+	rate    int
+	objects int
+	settle  time.Duration
+	timeout time.Duration
+}
+
+func defaultDeleteCollectionExperimentOptions() *deleteCollectionExperimentOptions {
+	return &deleteCollectionExperimentOptions{
+		watches: 1000,
+		rate:    100,
+		objects: 10000,
+		settle:  30 * time.Second,
+		timeout: 5 * time.Minute,
+	}
+}
+
+func bindDeleteCollectionExperimentOptions(fs *flag.FlagSet, defaults *deleteCollectionExperimentOptions) *deleteCollectionExperimentOptions {
+	prefix := "delete-collection."
+	fs.IntVar(&defaults.watches, prefix+"watches", defaults.watches, "Number of watches subscribed to the collection.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps in the deleted collection.")
+	fs.DurationVar(&defaults.settle, prefix+"settle", defaults.settle, "Time to hold steady state before the deletion and after delivery.")
+	fs.DurationVar(&defaults.timeout, prefix+"timeout", defaults.timeout, "Time to wait for every watcher to receive every deletion.")
+	return defaults
+}
+
+func (o *deleteCollectionExperimentOptions) validate() error {
+	if o.watches <= 0 || o.rate <= 0 {
+		return errors.New("--delete-collection.watches and --delete-collection.rate must be positive")
+	}
+	if o.objects < 0 {
+		return errors.New("--delete-collection.objects must not be negative")
+	}
+	return nil
+}
+
+const deleteCollectionFile = "delete-collection.json"
+
+type deleteCollectionResult struct {
+	Objects int `json:"objects"`
+	Watches int `json:"watches"`
+	// Deletion is the time the DeleteCollection request took to complete.
+	Deletion float64 `json:"deletion"`
+	// Delivered counts the watchers which received every deletion; Delivery is the distribution of times between
+	// the request being issued and those watchers receiving their last deletion.
+	Delivered int             `json:"delivered"`
+	Delivery  durationSummary `json:"delivery"`
+}
+
+func runDeleteCollectionExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *deleteCollectionExperimentOptions) error {
+	logrus.Info("Running DeleteCollection experiment")
+	namespace, cleanup, err := createNamespace(ctx, client, "delete-collection")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	if err := createConfigMaps(ctx, client, namespace, opts.objects); err != nil {
+		return err
+	}
+	tracker := newWatchTracker(opts.watches)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.watches; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		go tracker.watch(ctx, i, configMapWatch(client, namespace))
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.watches, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+
+	phases.start("steady")
+	if err := holdFor(ctx, opts.settle); err != nil {
+		return err
+	}
+	// watches without a resourceVersion start with synthetic additions for the existing objects
+	baseline := make([]int64, opts.watches)
+	for i := range tracker.records {
+		baseline[i] = atomic.LoadInt64(&tracker.records[i].events)
+	}
+
+	phases.start("delete")
+	issued := tracker.now()
+	if err := client.CoreV1().ConfigMaps(namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{}); err != nil {
+		return fmt.Errorf("could not delete ConfigMaps: %w", err)
+	}
+	result := deleteCollectionResult{
+		Objects:  opts.objects,
+		Watches:  opts.watches,
+		Deletion: time.Duration(tracker.now() - issued).Seconds(),
+	}
+	delivered := func(i int) bool {
+		return atomic.LoadInt64(&tracker.records[i].events)-baseline[i] >= int64(opts.objects)
+	}
+	if err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, opts.timeout, true, func(ctx context.Context) (bool, error) {
+		for i := range tracker.records {
+			if atomic.LoadInt64(&tracker.records[i].established) != 0 && !delivered(i) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		logrus.WithError(err).Warn("not all watchers received every deletion")
+	}
+
+	phases.start("settle")
+	if err := holdFor(ctx, opts.settle); err != nil {
+		return err
+	}
+
+	series := artifacts.LatencySeries{Start: tracker.start}
+	var delivery []time.Duration
+	for i := range tracker.records {
+		if !delivered(i) {
+			continue
+		}
+		latency := time.Duration(atomic.LoadInt64(&tracker.records[i].lastEvent) - issued)
+		delivery = append(delivery, latency)
+		series.Offsets = append(series.Offsets, time.Duration(issued).Seconds())
+		series.Seconds = append(series.Seconds, latency.Seconds())
+	}
+	result.Delivered = len(delivery)
+	result.Delivery = summarizeDurations(delivery)
+	logrus.WithFields(logrus.Fields{
+		"deletion":  fmt.Sprintf("%.3fs", result.Deletion),
+		"delivered": result.Delivered,
+		"p99":       fmt.Sprintf("%.3fs", result.Delivery.P99),
+	}).Info("Deletions delivered")
+	latencies := tracker.latencies()
+	latencies[deliveryLatency] = series
+	if err := artifacts.Write(outputDir, artifacts.LatenciesFile, latencies); err != nil {
+		return err
+	}
+	if err := artifacts.Write(outputDir, deleteCollectionFile, result); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished DeleteCollection experiment")
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// diskBudgetOptions configure a budget for the size of the output directory. A long run which fills the disk up
+// corrupts whatever is written last, so as the output approaches the budget the monitors sample less often, and
+// close to it all but those of the usage of the monitored pods stop.
+type diskBudgetOptions struct {
+	// budget is a quantity, like 20Gi, or empty for no budget.
+	budget   string
+	interval time.Duration
+	throttle float64
+	stop     float64
+	slowdown int
+}
+
+func defaultDiskBudgetOptions() *diskBudgetOptions {
+	return &diskBudgetOptions{
+		interval: 30 * time.Second,
+		throttle: 0.8,
+		stop:     0.95,
+		slowdown: 4,
+	}
+}
+
+func bindDiskBudgetOptions(fs *flag.FlagSet, defaults *diskBudgetOptions) *diskBudgetOptions {
+	prefix := "disk-budget."
+	fs.StringVar(&defaults.budget, prefix+"size", defaults.budget, "Size the output directory should stay under, like 20Gi, or empty for no budget.")
+	fs.DurationVar(&defaults.interval, prefix+"interval", defaults.interval, "Time between measurements of the size of the output directory.")
+	fs.Float64Var(&defaults.throttle, prefix+"throttle", defaults.throttle, "Fraction of the budget past which the monitors sample less often.")
+	fs.Float64Var(&defaults.stop, prefix+"stop", defaults.stop, "Fraction of the budget past which every monitor but the kubelet summaries stops.")
+	fs.IntVar(&defaults.slowdown, prefix+"slowdown", defaults.slowdown, "Factor by which the monitors sample less often once throttled.")
+	return defaults
+}
+
+func (o *diskBudgetOptions) validate() error {
+	if o.budget == "" {
+		return nil
+	}
+	if size, err := resource.ParseQuantity(o.budget); err != nil {
+		return fmt.Errorf("--disk-budget.size invalid: %w", err)
+	} else if size.Sign() <= 0 {
+		return errors.New("--disk-budget.size must be positive")
+	}
+	if o.interval <= 0 {
+		return errors.New("--disk-budget.interval must be positive")
+	}
+	if o.throttle <= 0 || o.throttle > o.stop || o.stop > 1 {
+		return errors.New("--disk-budget.throttle and --disk-budget.stop must be fractions, with the former no larger than the latter")
+	}
+	if o.slowdown < 1 {
+		return errors.New("--disk-budget.slowdown must be at least one")
+	}
+	return nil
+}
+
+// These name the collectors which do not record collection errors for the disk budget.
+const (
+	profilesCollector     = "profiles"
+	nodeCollectorStreams  = "node-collector"
+	podLogsCollector      = "pod-logs"
+	heapSnapshotCollector = "heap-snapshots"
+)
+
+// errBudgetStopped ends the streams of collectors once the disk budget stopped them.
+var errBudgetStopped = errors.New("stopped by the disk budget")
+
+type budgetLevel int
+
+const (
+	budgetAvailable budgetLevel = iota
+	budgetThrottled
+	budgetStopped
+)
+
+// diskBudget decides whether the monitors should take a sample, for every monitor to ask before it does.
+var diskBudget = &diskBudgetGuard{polls: map[string]int{}}
+
+type diskBudgetGuard struct {
+	lock     sync.Mutex
+	level    budgetLevel
+	slowdown int
+	// polls counts the polls of every monitor and target since the budget was throttled.
+	polls map[string]int
+}
+
+// sample determines whether the collector should take the sample it polled for from the target.
+func (g *diskBudgetGuard) sample(collector, target string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	switch {
+	case g.level == budgetAvailable:
+		return true
+	case g.level == budgetStopped && collector != artifacts.SummaryMonitor && collector != artifacts.ResourceMetricsMonitor:
+		return false
+	}
+	key := collector + "/" + target
+	sample := g.polls[key]%g.slowdown == 0
+	g.polls[key]++
+	return sample
+}
+
+// stopped determines whether the collector was stopped, for collectors which stream or record at milestones rather
+// than polling, and so are not throttled.
+func (g *diskBudgetGuard) stopped(collector string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.level == budgetStopped && collector != artifacts.SummaryMonitor && collector != artifacts.ResourceMetricsMonitor
+}
+
+// budgetedWriter fails every write once the disk budget stopped the collector, which ends the stream copied into it.
+type budgetedWriter struct {
+	collector string
+	writer    io.Writer
+}
+
+func (w *budgetedWriter) Write(p []byte) (int, error) {
+	if diskBudget.stopped(w.collector) {
+		return 0, errBudgetStopped
+	}
+	return w.writer.Write(p)
+}
+
+// guardDiskBudget measures the output directory until the context is cancelled, escalating what the monitors are
+// allowed to record as it approaches the budget and marking every decision on the timeline. The output only grows
+// over a run, so the budget is never relaxed again.
+func guardDiskBudget(ctx context.Context, outputDir string, opts *diskBudgetOptions) {
+	if opts.budget == "" {
+		return
+	}
+	quantity := resource.MustParse(opts.budget)
+	budget := quantity.Value()
+	diskBudget.lock.Lock()
+	diskBudget.slowdown = opts.slowdown
+	diskBudget.lock.Unlock()
+	go func() {
+		if err := wait.PollUntilContextCancel(ctx, opts.interval, true, func(ctx context.Context) (done bool, err error) {
+			size, err := directorySize(outputDir)
+			if err != nil {
+				logrus.WithError(err).Error("could not measure output directory")
+				return false, nil
+			}
+			level := budgetAvailable
+			switch used := float64(size) / float64(budget); {
+			case used >= opts.stop:
+				level = budgetStopped
+			case used >= opts.throttle:
+				level = budgetThrottled
+			}
+			diskBudget.lock.Lock()
+			escalated := level > diskBudget.level
+			if escalated {
+				diskBudget.level = level
+			}
+			diskBudget.lock.Unlock()
+			if !escalated {
+				return false, nil
+			}
+			switch level {
+			case budgetThrottled:
+				logrus.Warnf("Output directory holds %s of the %s budget, sampling %d times less often", formatMebibytes(size), formatMebibytes(budget), opts.slowdown)
+				timeline.annotate(artifacts.AnnotationBudget, "output reached %s of the %s budget, monitors sample %d times less often", formatMebibytes(size), formatMebibytes(budget), opts.slowdown)
+			case budgetStopped:
+				logrus.Warnf("Output directory holds %s of the %s budget, stopping all monitors but the kubelet summaries", formatMebibytes(size), formatMebibytes(budget))
+				timeline.annotate(artifacts.AnnotationBudget, "output reached %s of the %s budget, all monitors but the kubelet summaries stopped", formatMebibytes(size), formatMebibytes(budget))
+			}
+			return false, nil
+		}); err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Error("failed to guard disk budget")
+		}
+	}()
+}
+
+func directorySize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// files come and go as the monitors write them
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// etcdKeyspaceOptions configure the snapshots of the etcd keyspace taken before and after the experiment, counting
+// the keys under every prefix so that what the experiment left behind in etcd, per resource, can be audited. Keys
+// are listed with etcdctl inside an etcd pod, so the snapshots need a cluster where those are reachable.
+type etcdKeyspaceOptions struct {
+	enabled     bool
+	selector    string
+	etcdctlArgs string
+	root        string
+	depth       int
+}
+
+func defaultEtcdKeyspaceOptions() *etcdKeyspaceOptions {
+	return &etcdKeyspaceOptions{
+		selector:    "component=etcd",
+		etcdctlArgs: "--cacert=/etc/kubernetes/pki/etcd/ca.crt --cert=/etc/kubernetes/pki/etcd/server.crt --key=/etc/kubernetes/pki/etcd/server.key",
+		root:        "/registry/",
+		depth:       1,
+	}
+}
+
+func bindEtcdKeyspaceOptions(fs *flag.FlagSet, defaults *etcdKeyspaceOptions) *etcdKeyspaceOptions {
+	prefix := "etcd-keyspace."
+	fs.BoolVar(&defaults.enabled, prefix+"enabled", defaults.enabled, "Count the keys in etcd under every prefix before and after the experiment.")
+	fs.StringVar(&defaults.selector, prefix+"selector", defaults.selector, "Label selector for etcd pods.")
+	fs.StringVar(&defaults.etcdctlArgs, prefix+"etcdctl-args", defaults.etcdctlArgs, "Space-delimited arguments for etcdctl to authenticate to etcd from within its pod.")
+	fs.StringVar(&defaults.root, prefix+"root", defaults.root, "Prefix of the keys to count, which the API servers store their objects under.")
+	fs.IntVar(&defaults.depth, prefix+"depth", defaults.depth, "Number of path segments past the root to count keys by; one counts them by resource, two by resource and namespace.")
+	return defaults
+}
+
+func (o *etcdKeyspaceOptions) validate() error {
+	if !o.enabled {
+		return nil
+	}
+	if !strings.HasPrefix(o.root, "/") || !strings.HasSuffix(o.root, "/") {
+		return errors.New("--etcd-keyspace.root must start and end with a slash")
+	}
+	if o.depth < 1 {
+		return errors.New("--etcd-keyspace.depth must be at least one")
+	}
+	return nil
+}
+
+// etcdKeyspace takes the snapshots of the keyspace at the milestones of the experiment, when enabled.
+var etcdKeyspace = &etcdKeyspaceSnapshotter{}
+
+type etcdKeyspaceSnapshotter struct {
+	client *kubernetes.Clientset
+	config *rest.Config
+	opts   *etcdKeyspaceOptions
+
+	lock      sync.Mutex
+	snapshots []artifacts.EtcdKeyspaceSnapshot
+}
+
+func (s *etcdKeyspaceSnapshotter) setup(client *kubernetes.Clientset, config *rest.Config, opts *etcdKeyspaceOptions) {
+	if opts.enabled {
+		s.client, s.config, s.opts = client, config, opts
+	}
+}
+
+// take counts the keys under every prefix; the keyspace is listed in one go, so this is meant for milestones and
+// not for sampling.
+func (s *etcdKeyspaceSnapshotter) take(ctx context.Context, milestone string) {
+	if s.opts == nil {
+		return
+	}
+	snapshot, err := s.count(ctx, milestone)
+	if err != nil {
+		logrus.WithError(err).Errorf("could not snapshot etcd keyspace at %s", milestone)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.snapshots = append(s.snapshots, snapshot)
+}
+
+func (s *etcdKeyspaceSnapshotter) count(ctx context.Context, milestone string) (artifacts.EtcdKeyspaceSnapshot, error) {
+	pods, err := s.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: s.opts.selector})
+	if err != nil {
+		return artifacts.EtcdKeyspaceSnapshot{}, fmt.Errorf("could not list etcd pods: %w", err)
+	}
+	if len(pods.Items) == 0 {
+		return artifacts.EtcdKeyspaceSnapshot{}, fmt.Errorf("no etcd pods match %s", s.opts.selector)
+	}
+	taken := time.Now()
+	command := append([]string{"etcdctl"}, strings.Fields(s.opts.etcdctlArgs)...)
+	command = append(command, "get", s.opts.root, "--prefix", "--keys-only")
+	keys, err := execInPod(ctx, s.client, s.config, &pods.Items[0], command)
+	if err != nil {
+		return artifacts.EtcdKeyspaceSnapshot{}, err
+	}
+	snapshot := artifacts.EtcdKeyspaceSnapshot{Milestone: milestone, Time: taken, Keys: map[string]int{}}
+	for _, key := range strings.Split(keys, "\n") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		snapshot.Keys[keyPrefix(key, s.opts.root, s.opts.depth)]++
+	}
+	return snapshot, nil
+}
+
+// keyPrefix truncates the key to the root and as many path segments past it as the depth; keys with fewer
+// segments are their own prefix.
+func keyPrefix(key, root string, depth int) string {
+	segments := strings.Split(strings.TrimPrefix(key, root), "/")
+	if len(segments) <= depth {
+		return key
+	}
+	return root + strings.Join(segments[:depth], "/") + "/"
+}
+
+func (s *etcdKeyspaceSnapshotter) write(outputDir string) error {
+	if s.opts == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return artifacts.Write(outputDir, artifacts.EtcdKeyspaceFile, s.snapshots)
+}
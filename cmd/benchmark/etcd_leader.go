@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// etcdLeaderExperimentOptions configure an experiment which transfers etcd leadership while a fleet of watches is
+// receiving a steady stream of writes, measuring delivery stalls and client-visible errors around the election.
+// The leader is moved with etcdctl inside the etcd pods, so the experiment needs a cluster where those are
+// reachable, like one the benchmark provisioned.
+type etcdLeaderExperimentOptions struct {
+	count       int
+	rate        int
+	writeRate   int
+	settle      time.Duration
+	window      time.Duration
+	selector    string
+	etcdctlArgs string
+}
+
+func defaultEtcdLeaderExperimentOptions() *etcdLeaderExperimentOptions {
+	return &etcdLeaderExperimentOptions{
+		count:       1000,
+		rate:        100,
+		writeRate:   10,
+		settle:      time.Minute,
+		window:      30 * time.Second,
+		selector:    "component=etcd",
+		etcdctlArgs: "--cacert=/etc/kubernetes/pki/etcd/ca.crt --cert=/etc/kubernetes/pki/etcd/server.crt --key=/etc/kubernetes/pki/etcd/server.key",
+	}
+}
+
+func bindEtcdLeaderExperimentOptions(fs *flag.FlagSet, defaults *etcdLeaderExperimentOptions) *etcdLeaderExperimentOptions {
+	prefix := "etcd-leader."
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.writeRate, prefix+"write-rate", defaults.writeRate, "Rate of writes to the watched ConfigMaps, in Hertz.")
+	fs.DurationVar(&defaults.settle, prefix+"settle", defaults.settle, "Time to hold steady state before and after the election window.")
+	fs.DurationVar(&defaults.window, prefix+"window", defaults.window, "Time after the leader transfer is requested to attribute to the election.")
+	fs.StringVar(&defaults.selector, prefix+"selector", defaults.selector, "Label selector for etcd pods.")
+	fs.StringVar(&defaults.etcdctlArgs, prefix+"etcdctl-args", defaults.etcdctlArgs, "Space-delimited arguments for etcdctl to authenticate to etcd from within its pod.")
+	return defaults
+}
+
+func (o *etcdLeaderExperimentOptions) validate() error {
+	if o.writeRate <= 0 {
+		return errors.New("--etcd-leader.write-rate must be positive")
+	}
+	return nil
+}
+
+const etcdLeaderFile = "etcd-leader.json"
+
+var etcdLeaderPhases = []string{"steady", "election", "after"}
+
+type etcdLeaderResult struct {
+	LeaderBefore string `json:"leaderBefore"`
+	LeaderAfter  string `json:"leaderAfter"`
+	// Transfer is the time the move-leader request took to complete.
+	Transfer float64 `json:"transfer"`
+
+	Watches      int   `json:"watches"`
+	Disconnected int   `json:"disconnected"`
+	Reconnects   int64 `json:"reconnects"`
+
+	Phases map[string]etcdLeaderPhase `json:"phases"`
+}
+
+type etcdLeaderPhase struct {
+	Writes      int64 `json:"writes"`
+	WriteErrors int64 `json:"writeErrors"`
+	// LongestStall is the longest time, in seconds, during which no watcher received an event; without stalls, it
+	// is the interval between writes.
+	LongestStall float64 `json:"longestStall"`
+}
+
+// etcdMember is the subset of the output of etcdctl endpoint status that identifies the leader.
+type etcdMember struct {
+	Endpoint string `json:"Endpoint"`
+	Status   struct {
+		Header struct {
+			MemberID uint64 `json:"member_id"`
+		} `json:"header"`
+		Leader uint64 `json:"leader"`
+	} `json:"Status"`
+}
+
+func runEtcdLeaderExperiment(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, outputDir string, opts *etcdLeaderExperimentOptions) error {
+	logrus.Info("Running etcd leader election experiment")
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: opts.selector})
+	if err != nil {
+		return fmt.Errorf("could not list etcd pods: %w", err)
+	}
+	if len(pods.Items) < 2 {
+		return fmt.Errorf("leadership can only be transferred with at least two etcd members, found %d pods matching %s", len(pods.Items), opts.selector)
+	}
+	etcdPod := &pods.Items[0]
+	etcdctl := func(args ...string) (string, error) {
+		command := append([]string{"etcdctl"}, strings.Fields(opts.etcdctlArgs)...)
+		return execInPod(ctx, client, config, etcdPod, append(command, args...))
+	}
+
+	namespace, cleanup, err := createNamespace(ctx, client, "etcd-leader")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := createConfigMaps(ctx, client, namespace, 1); err != nil {
+		return err
+	}
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	tracker := newWatchTracker(opts.count)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.count; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		go tracker.watchWithReconnect(ctx, i, configMapWatch(client, namespace), nil)
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.count, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+
+	// the writer and the stall detector attribute what they see to the current phase
+	var current int32 = -1
+	writes, writeErrors := make([]int64, len(etcdLeaderPhases)), make([]int64, len(etcdLeaderPhases))
+	stalls := make([]int64, len(etcdLeaderPhases))
+	measureCtx, stopMeasuring := context.WithCancel(ctx)
+	defer stopMeasuring()
+	go writeConfigMapContinuously(measureCtx, client, namespace, opts.writeRate, func(err error) {
+		phase := atomic.LoadInt32(&current)
+		if phase < 0 {
+			return
+		}
+		atomic.AddInt64(&writes[phase], 1)
+		if err != nil {
+			atomic.AddInt64(&writeErrors[phase], 1)
+		}
+	})
+	go detectStalls(measureCtx, tracker, func(stall time.Duration) {
+		phase := atomic.LoadInt32(&current)
+		if phase >= 0 && int64(stall) > atomic.LoadInt64(&stalls[phase]) {
+			atomic.StoreInt64(&stalls[phase], int64(stall))
+		}
+	})
+
+	result := etcdLeaderResult{Watches: opts.count, Phases: map[string]etcdLeaderPhase{}}
+	for i, name := range etcdLeaderPhases {
+		phases.start(name)
+		atomic.StoreInt32(&current, int32(i))
+		switch name {
+		case "election":
+			leader, err := etcdLeader(etcdctl)
+			if err != nil {
+				return err
+			}
+			result.LeaderBefore = strconv.FormatUint(leader.Status.Header.MemberID, 16)
+			target, err := etcdFollower(etcdctl, leader)
+			if err != nil {
+				return err
+			}
+			// the election disrupts every member, and the API servers may be unavailable until it is over
+			for _, pod := range pods.Items {
+				podHealth.inducingRestart(pod.Spec.NodeName)
+			}
+			start := time.Now()
+			_, err = etcdctl("--endpoints="+leader.Endpoint, "move-leader", strconv.FormatUint(target, 16))
+			for _, pod := range pods.Items {
+				podHealth.restartInduced(pod.Spec.NodeName)
+			}
+			if err != nil {
+				return fmt.Errorf("could not transfer leadership: %w", err)
+			}
+			result.Transfer = time.Since(start).Seconds()
+			logrus.Infof("Moved etcd leadership from %s to %x in %.3fs", result.LeaderBefore, target, result.Transfer)
+			timeline.annotate(artifacts.AnnotationChaos, "moved etcd leadership from %s to %x", result.LeaderBefore, target)
+			if err := holdFor(ctx, opts.window); err != nil {
+				return err
+			}
+		default:
+			if err := holdFor(ctx, opts.settle); err != nil {
+				return err
+			}
+		}
+	}
+	stopMeasuring()
+	leader, err := etcdLeader(etcdctl)
+	if err != nil {
+		return err
+	}
+	result.LeaderAfter = strconv.FormatUint(leader.Status.Header.MemberID, 16)
+
+	for i, name := range etcdLeaderPhases {
+		result.Phases[name] = etcdLeaderPhase{
+			Writes:       atomic.LoadInt64(&writes[i]),
+			WriteErrors:  atomic.LoadInt64(&writeErrors[i]),
+			LongestStall: time.Duration(atomic.LoadInt64(&stalls[i])).Seconds(),
+		}
+	}
+	for i := range tracker.records {
+		record := &tracker.records[i]
+		result.Reconnects += atomic.LoadInt64(&record.reconnects)
+		if atomic.LoadInt64(&record.disconnected) != 0 {
+			result.Disconnected++
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"disconnected": result.Disconnected,
+		"errors":       result.Phases["election"].WriteErrors,
+		"stall":        fmt.Sprintf("%.3fs", result.Phases["election"].LongestStall),
+	}).Info("Watch fleet survived etcd leader election")
+	if err := artifacts.Write(outputDir, etcdLeaderFile, result); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished etcd leader election experiment")
+	return nil
+}
+
+func etcdStatus(etcdctl func(args ...string) (string, error)) ([]etcdMember, error) {
+	raw, err := etcdctl("endpoint", "status", "--cluster", "--write-out=json")
+	if err != nil {
+		return nil, fmt.Errorf("could not determine etcd status: %w", err)
+	}
+	var members []etcdMember
+	if err := json.Unmarshal([]byte(raw), &members); err != nil {
+		return nil, fmt.Errorf("could not parse etcd status: %w", err)
+	}
+	return members, nil
+}
+
+func etcdLeader(etcdctl func(args ...string) (string, error)) (etcdMember, error) {
+	members, err := etcdStatus(etcdctl)
+	if err != nil {
+		return etcdMember{}, err
+	}
+	for _, member := range members {
+		if member.Status.Header.MemberID == member.Status.Leader {
+			return member, nil
+		}
+	}
+	return etcdMember{}, errors.New("no etcd member is the leader")
+}
+
+func etcdFollower(etcdctl func(args ...string) (string, error), leader etcdMember) (uint64, error) {
+	members, err := etcdStatus(etcdctl)
+	if err != nil {
+		return 0, err
+	}
+	for _, member := range members {
+		if member.Status.Header.MemberID != leader.Status.Header.MemberID {
+			return member.Status.Header.MemberID, nil
+		}
+	}
+	return 0, errors.New("no etcd member is a follower")
+}
+
+// writeConfigMapContinuously updates the first ConfigMap in the namespace at the rate until the context is
+// cancelled, reporting the outcome of every write.
+func writeConfigMapContinuously(ctx context.Context, client *kubernetes.Clientset, namespace string, rate int, report func(error)) {
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := client.CoreV1().ConfigMaps(namespace).Update(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: objectNames.object(0)},
+			Data:       map[string]string{"index": strconv.Itoa(i)},
+		}, metav1.UpdateOptions{})
+		if ctx.Err() != nil {
+			return
+		}
+		report(err)
+	}
+}
+
+// detectStalls watches the total number of events received by the fleet, reporting how long it has been since
+// the last increase whenever the fleet starts receiving events again.
+func detectStalls(ctx context.Context, tracker *watchTracker, report func(time.Duration)) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var total int64
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			report(time.Since(last))
+			return
+		case <-ticker.C:
+		}
+		var events int64
+		for i := range tracker.records {
+			events += atomic.LoadInt64(&tracker.records[i].events)
+		}
+		if events > total {
+			report(time.Since(last))
+			total, last = events, time.Now()
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// etcdMetricsOptions configure scraping the metrics every etcd member reports, which hold what the API servers
+// cannot tell: how long fsyncs take, how many proposals were applied, and how large the database has grown. etcd
+// usually serves metrics on the loopback interface of the node only, so they are scraped through a port-forward
+// into the pod, which for static pods on the host network reaches the node itself.
+type etcdMetricsOptions struct {
+	interval time.Duration
+	selector string
+	// port is used when the members do not set --listen-metrics-urls.
+	port int
+}
+
+func defaultEtcdMetricsOptions() *etcdMetricsOptions {
+	return &etcdMetricsOptions{
+		interval: 15 * time.Second,
+		selector: "component=etcd",
+		port:     2381,
+	}
+}
+
+func bindEtcdMetricsOptions(fs *flag.FlagSet, defaults *etcdMetricsOptions) *etcdMetricsOptions {
+	prefix := "etcd-metrics."
+	fs.DurationVar(&defaults.interval, prefix+"interval", defaults.interval, "Time between scrapes of the metrics every etcd member reports, or zero to not record them.")
+	fs.StringVar(&defaults.selector, prefix+"selector", defaults.selector, "Label selector for etcd pods.")
+	fs.IntVar(&defaults.port, prefix+"port", defaults.port, "Port etcd serves plain-text metrics on, used when its pods do not set --listen-metrics-urls.")
+	return defaults
+}
+
+func (o *etcdMetricsOptions) validate() error {
+	if o.interval < 0 {
+		return errors.New("--etcd-metrics.interval must not be negative")
+	}
+	if o.port <= 0 || o.port > 65535 {
+		return errors.New("--etcd-metrics.port must be a valid port")
+	}
+	return nil
+}
+
+// etcdMetricsPort determines where the member serves metrics without client certificates.
+func etcdMetricsPort(pod corev1.Pod, fallback int) (int, error) {
+	for _, container := range pod.Spec.Containers {
+		for _, arg := range append(container.Command, container.Args...) {
+			if !strings.HasPrefix(arg, "--listen-metrics-urls=") {
+				continue
+			}
+			for _, raw := range strings.Split(strings.TrimPrefix(arg, "--listen-metrics-urls="), ",") {
+				parsed, err := url.Parse(raw)
+				if err != nil {
+					return 0, fmt.Errorf("could not parse metrics URL of %s/%s: %w", pod.Namespace, pod.Name, err)
+				}
+				if parsed.Scheme != "http" {
+					continue
+				}
+				return strconv.Atoi(parsed.Port())
+			}
+		}
+	}
+	return fallback, nil
+}
+
+// setupEtcdMetricsMonitors scrapes the metrics of every etcd member at the interval, recording every snapshot
+// verbatim in a directory per node. Clusters whose etcd does not run in pods, like most managed offerings, are
+// benchmarked without them.
+func setupEtcdMetricsMonitors(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, outputDir string, opts *etcdMetricsOptions) error {
+	if opts.interval == 0 {
+		return nil
+	}
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: opts.selector})
+	if err != nil {
+		return fmt.Errorf("could not list etcd pods: %w", err)
+	}
+	if len(pods.Items) == 0 {
+		logrus.Warnf("No etcd pods matched %s, etcd metrics will not be recorded", opts.selector)
+		return nil
+	}
+	logrus.Info("Setting up etcd metrics monitoring")
+	for _, pod := range pods.Items {
+		port, err := etcdMetricsPort(pod, opts.port)
+		if err != nil {
+			return err
+		}
+		nodeDir := filepath.Join(outputDir, artifacts.EtcdMetricsDir, pod.Spec.NodeName)
+		if err := os.MkdirAll(nodeDir, 0777); err != nil {
+			return fmt.Errorf("could not create output dir for node %s: %w", pod.Spec.NodeName, err)
+		}
+		go monitorEtcdMetrics(ctx, client, config, pod, port, nodeDir, opts.interval)
+	}
+	return nil
+}
+
+// monitorEtcdMetrics holds a port-forward to the member open for as long as the context lives, opening it again
+// whenever it breaks, and scrapes through it at the interval.
+func monitorEtcdMetrics(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, pod corev1.Pod, port int, outputDir string, interval time.Duration) {
+	member := pod.Namespace + "/" + pod.Name
+	leadership := &etcdLeadershipObserver{member: member}
+	backoff := reconnectBackoff()
+	for ctx.Err() == nil {
+		err := forwardAndScrape(ctx, client, config, pod, port, outputDir, interval, leadership)
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Errorf("failed to forward to etcd member %s", member)
+		collectionErrors.failed(artifacts.EtcdMetricsMonitor, member, err)
+		if err := holdFor(ctx, backoff.Step()); err != nil {
+			return
+		}
+	}
+}
+
+func forwardAndScrape(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, pod corev1.Pod, port int, outputDir string, interval time.Duration, leadership *etcdLeadershipObserver) error {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return err
+	}
+	forwardURL := client.CoreV1().RESTClient().Post().Namespace(pod.Namespace).Resource("pods").Name(pod.Name).SubResource("portforward").URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, forwardURL)
+	stop, ready := make(chan struct{}), make(chan struct{})
+	forwarder, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, []string{"0:" + strconv.Itoa(port)}, stop, ready, io.Discard, io.Discard)
+	if err != nil {
+		return err
+	}
+	scrapeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-scrapeCtx.Done():
+			close(stop)
+			return
+		case <-ready:
+		}
+		defer close(stop)
+		ports, err := forwarder.GetPorts()
+		if err != nil || len(ports) == 0 {
+			logrus.WithError(err).Errorf("could not determine port forwarded to %s/%s", pod.Namespace, pod.Name)
+			return
+		}
+		address := "http://127.0.0.1:" + strconv.Itoa(int(ports[0].Local)) + "/metrics"
+		if err := wait.PollUntilContextCancel(scrapeCtx, interval, true, func(ctx context.Context) (bool, error) {
+			scraped := time.Now()
+			raw, err := scrapeEtcdMember(ctx, address)
+			if ctx.Err() == nil {
+				leadership.observe(raw, err)
+				if err != nil {
+					collectionErrors.failed(artifacts.EtcdMetricsMonitor, pod.Namespace+"/"+pod.Name, err)
+				}
+			}
+			if err != nil {
+				// closing the forward opens it again, in case it is what broke
+				return false, fmt.Errorf("could not fetch metrics: %w", err)
+			}
+			collectionErrors.succeeded(artifacts.EtcdMetricsMonitor, pod.Namespace+"/"+pod.Name)
+			// leadership is observed on every scrape, whether or not the budget allows for recording it
+			if !diskBudget.sample(artifacts.EtcdMetricsMonitor, pod.Namespace+"/"+pod.Name) {
+				return false, nil
+			}
+			if err := os.WriteFile(filepath.Join(outputDir, strconv.FormatInt(scraped.UnixNano(), 10)+artifacts.MetricsSnapshotExtension), raw, 0666); err != nil {
+				logrus.WithError(err).Errorf("failed to record metrics from %s/%s", pod.Namespace, pod.Name)
+			}
+			return false, nil
+		}); err != nil && scrapeCtx.Err() == nil {
+			logrus.WithError(err).Errorf("failed to monitor metrics from %s/%s", pod.Namespace, pod.Name)
+		}
+	}()
+	if err := forwarder.ForwardPorts(); err != nil {
+		return err
+	}
+	return errors.New("port-forward closed")
+}
+
+func scrapeEtcdMember(ctx context.Context, address string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			logrus.WithError(err).Debug("failed to close etcd metrics response")
+		}
+	}()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// etcdLeadershipObserver follows the leadership and health of one etcd member through its scrapes, marking on the
+// timeline whenever the member sees leadership change, loses its leader or cannot be reached, as elections explain
+// many latency spikes.
+type etcdLeadershipObserver struct {
+	member string
+
+	observed  bool
+	reachable bool
+	changes   float64
+	hasLeader bool
+	isLeader  bool
+}
+
+func (o *etcdLeadershipObserver) observe(raw []byte, scrapeErr error) {
+	var families map[string]*dto.MetricFamily
+	if scrapeErr == nil {
+		var parser expfmt.TextParser
+		var err error
+		if families, err = parser.TextToMetricFamilies(bytes.NewReader(raw)); err != nil {
+			logrus.WithError(err).Debugf("could not parse metrics of etcd member %s", o.member)
+			return
+		}
+	}
+	if reachable := scrapeErr == nil; reachable != o.reachable {
+		if !reachable {
+			o.record("etcd member %s could not be reached", o.member)
+		} else if o.observed {
+			o.record("etcd member %s could be reached again", o.member)
+		}
+		o.reachable = reachable
+	}
+	if !o.reachable {
+		return
+	}
+	changes := sumMetric(families, "etcd_server_leader_changes_seen_total", nil)
+	hasLeader := sumMetric(families, "etcd_server_has_leader", nil) > 0
+	isLeader := sumMetric(families, "etcd_server_is_leader", nil) > 0
+	if o.observed {
+		// the counter starts over when the member restarts, having seen none of the changes since
+		if changes > o.changes {
+			o.record("etcd member %s saw %.0f leader changes", o.member, changes-o.changes)
+		}
+		if hasLeader != o.hasLeader {
+			if hasLeader {
+				o.record("etcd member %s has a leader again", o.member)
+			} else {
+				o.record("etcd member %s lost its leader", o.member)
+			}
+		}
+		if isLeader && !o.isLeader {
+			o.record("etcd member %s became the leader", o.member)
+		}
+	}
+	o.observed, o.changes, o.hasLeader, o.isLeader = true, changes, hasLeader, isLeader
+}
+
+func (o *etcdLeadershipObserver) record(format string, args ...interface{}) {
+	logrus.Infof(format, args...)
+	timeline.annotate(artifacts.AnnotationLeader, format, args...)
+}
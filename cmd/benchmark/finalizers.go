@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// finalizersExperimentOptions configure an experiment which deletes objects held by a finalizer and then releases
+// them, as controllers do, while watchers are subscribed to them. Deleting objects without finalizers is the
+// reference for the events finalizers add: the deletion is delivered once as an update setting the deletion
+// timestamp and once more as the deletion itself.
+type finalizersExperimentOptions struct {
+	objects    int
+	watches    int
+	rate       int
+	deleteRate int
+	loadRate   int
+	timeout    time.Duration
+}
+
+func defaultFinalizersExperimentOptions() *finalizersExperimentOptions {
+	return &finalizersExperimentOptions{
+		objects:    1000,
+		watches:    1000,
+		rate:       100,
+		deleteRate: 50,
+		timeout:    2 * time.Minute,
+	}
+}
+
+func bindFinalizersExperimentOptions(fs *flag.FlagSet, defaults *finalizersExperimentOptions) *finalizersExperimentOptions {
+	prefix := "finalizers."
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps deleted in every phase.")
+	fs.IntVar(&defaults.watches, prefix+"watches", defaults.watches, "Number of watches subscribed to the deleted ConfigMaps.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.deleteRate, prefix+"delete-rate", defaults.deleteRate, "Rate of deletions and of finalizer removals, in Hertz.")
+	fs.IntVar(&defaults.loadRate, prefix+"load-rate", defaults.loadRate, "Rate of unrelated writes to another namespace throughout the experiment, in Hertz, or zero to measure an otherwise idle cluster.")
+	fs.DurationVar(&defaults.timeout, prefix+"timeout", defaults.timeout, "Time to wait for the events of every phase to be observed.")
+	return defaults
+}
+
+func (o *finalizersExperimentOptions) validate() error {
+	if o.objects <= 0 || o.deleteRate <= 0 {
+		return errors.New("--finalizers.objects and --finalizers.delete-rate must be positive")
+	}
+	if o.loadRate < 0 {
+		return errors.New("--finalizers.load-rate must not be negative")
+	}
+	return nil
+}
+
+const finalizersFile = "finalizers.json"
+
+const (
+	benchmarkFinalizer = "benchmark.k8s.io/hold"
+
+	plainDeletesPhase      = "plain-deletes"
+	finalizedDeletesPhase  = "finalized-deletes"
+	finalizerRemovalsPhase = "finalizer-removals"
+)
+
+type finalizersPhase struct {
+	Requests int `json:"requests"`
+	Errors   int `json:"errors"`
+	// Observed counts the requests whose event the experiment observed, and Latency is the distribution of times
+	// between the request being issued and the event: the deletion timestamp being set for finalized deletes, and
+	// the deletion otherwise.
+	Observed int             `json:"observed"`
+	Latency  durationSummary `json:"latency"`
+	// Events is the number of events delivered to all watchers, and EventsPerObject the fan-out of every object.
+	Events          int64   `json:"events"`
+	EventsPerObject float64 `json:"eventsPerObject"`
+}
+
+type finalizersResult struct {
+	Phases map[string]finalizersPhase `json:"phases"`
+	// ExtraEventsPerObject is the number of events every object deleted through a finalizer cost every watcher over
+	// one deleted directly.
+	ExtraEventsPerObject float64 `json:"extraEventsPerObject"`
+}
+
+func runFinalizersExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *finalizersExperimentOptions) error {
+	logrus.Info("Running finalizer experiment")
+	namespace, cleanup, err := createNamespace(ctx, client, "finalizers")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	if opts.loadRate > 0 {
+		loadNamespace, cleanupLoad, err := createNamespace(ctx, client, "finalizers-load")
+		if err != nil {
+			return err
+		}
+		defer cleanupLoad()
+		if err := createConfigMaps(ctx, client, loadNamespace, 1); err != nil {
+			return err
+		}
+		loadCtx, stopLoad := context.WithCancel(ctx)
+		defer stopLoad()
+		go writeConfigMapContinuously(loadCtx, client, loadNamespace, opts.loadRate, func(err error) {
+			if err != nil {
+				logrus.WithError(err).Debug("failed to write load")
+			}
+		})
+	}
+	plain := func(i int) string { return objectNames.name("plain", i) }
+	finalized := func(i int) string { return objectNames.name("finalized", i) }
+	for i := 0; i < opts.objects; i++ {
+		for _, object := range []*corev1.ConfigMap{
+			{ObjectMeta: metav1.ObjectMeta{Name: plain(i)}},
+			{ObjectMeta: metav1.ObjectMeta{Name: finalized(i), Finalizers: []string{benchmarkFinalizer}}},
+		} {
+			if _, err := client.CoreV1().ConfigMaps(namespace).Create(ctx, object, metav1.CreateOptions{}); err != nil {
+				return fmt.Errorf("could not create ConfigMap: %w", err)
+			}
+		}
+	}
+	// objects held by the finalizer would keep the namespace from being removed if the experiment failed midway
+	defer func() {
+		for i := 0; i < opts.objects; i++ {
+			if _, err := client.CoreV1().ConfigMaps(namespace).Patch(context.Background(), finalized(i), types.MergePatchType, []byte(`{"metadata":{"finalizers":null}}`), metav1.PatchOptions{}); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Debug("failed to release ConfigMap")
+			}
+		}
+	}()
+
+	tracker := newWatchTracker(opts.watches)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.watches; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		go tracker.watch(ctx, i, configMapWatch(client, namespace))
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.watches, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+	observer, err := observeDeletions(ctx, client, namespace, tracker)
+	if err != nil {
+		return err
+	}
+
+	result := finalizersResult{Phases: map[string]finalizersPhase{}}
+	latencies := tracker.latencies()
+	steps := []finalizersStep{
+		{phase: plainDeletesPhase, object: plain, observed: observer.deleted, request: func(ctx context.Context, name string) error {
+			return client.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		}},
+		{phase: finalizedDeletesPhase, object: finalized, observed: observer.deleting, request: func(ctx context.Context, name string) error {
+			return client.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		}},
+		{phase: finalizerRemovalsPhase, object: finalized, observed: observer.deleted, request: func(ctx context.Context, name string) error {
+			_, err := client.CoreV1().ConfigMaps(namespace).Patch(ctx, name, types.MergePatchType, []byte(`{"metadata":{"finalizers":null}}`), metav1.PatchOptions{})
+			return err
+		}},
+	}
+	for _, step := range steps {
+		phases.start(step.phase)
+		outcome, series, err := step.run(ctx, tracker, opts)
+		if err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"errors":          outcome.Errors,
+			"observed":        outcome.Observed,
+			"p99":             fmt.Sprintf("%.3fs", outcome.Latency.P99),
+			"eventsPerObject": fmt.Sprintf("%.2f", outcome.EventsPerObject),
+		}).Infof("Finished %s", step.phase)
+		result.Phases[step.phase] = outcome
+		latencies[step.phase] = series
+	}
+	result.ExtraEventsPerObject = result.Phases[finalizedDeletesPhase].EventsPerObject + result.Phases[finalizerRemovalsPhase].EventsPerObject - result.Phases[plainDeletesPhase].EventsPerObject
+
+	if err := artifacts.Write(outputDir, artifacts.LatenciesFile, latencies); err != nil {
+		return err
+	}
+	if err := artifacts.Write(outputDir, finalizersFile, result); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished finalizer experiment")
+	return nil
+}
+
+// finalizersStep issues a request for every object and waits for the event it causes to be observed.
+type finalizersStep struct {
+	phase    string
+	object   func(int) string
+	request  func(context.Context, string) error
+	observed func(string) (int64, bool)
+}
+
+func (s finalizersStep) run(ctx context.Context, tracker *watchTracker, opts *finalizersExperimentOptions) (finalizersPhase, artifacts.LatencySeries, error) {
+	before := totalEvents(tracker)
+	result := finalizersPhase{Requests: opts.objects}
+	issued := make([]int64, opts.objects)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.deleteRate))
+	defer ticker.Stop()
+	for i := 0; i < opts.objects; i++ {
+		select {
+		case <-ctx.Done():
+			return result, artifacts.LatencySeries{}, ctx.Err()
+		case <-ticker.C:
+		}
+		issued[i] = tracker.now()
+		if err := s.request(ctx, s.object(i)); err != nil {
+			if ctx.Err() != nil {
+				return result, artifacts.LatencySeries{}, ctx.Err()
+			}
+			issued[i] = 0
+			result.Errors++
+		}
+	}
+
+	if err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, opts.timeout, true, func(ctx context.Context) (bool, error) {
+		for i := range issued {
+			if _, observed := s.observed(s.object(i)); issued[i] != 0 && !observed {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		logrus.WithError(err).Warnf("not every event in %s was observed", s.phase)
+	}
+	// let the watchers catch up with the observer before counting their events
+	if err := holdFor(ctx, time.Second); err != nil {
+		return result, artifacts.LatencySeries{}, err
+	}
+
+	series := artifacts.LatencySeries{Start: tracker.start}
+	var durations []time.Duration
+	for i := range issued {
+		at, observed := s.observed(s.object(i))
+		if issued[i] == 0 || !observed {
+			continue
+		}
+		latency := time.Duration(at - issued[i])
+		durations = append(durations, latency)
+		series.Offsets = append(series.Offsets, time.Duration(issued[i]).Seconds())
+		series.Seconds = append(series.Seconds, latency.Seconds())
+	}
+	result.Observed = len(durations)
+	result.Latency = summarizeDurations(durations)
+	result.Events = totalEvents(tracker) - before
+	if open := tracker.openCount(); open > 0 {
+		result.EventsPerObject = float64(result.Events) / float64(opts.objects*open)
+	}
+	return result, series, nil
+}
+
+// deletionObserver records when the deletion timestamp of every object was first seen set, and when its deletion
+// was seen, as offsets into the run of the tracker.
+type deletionObserver struct {
+	lock       sync.Mutex
+	deletingAt map[string]int64
+	deletedAt  map[string]int64
+}
+
+func observeDeletions(ctx context.Context, client *kubernetes.Clientset, namespace string, tracker *watchTracker) (*deletionObserver, error) {
+	watcher, err := client.CoreV1().ConfigMaps(namespace).Watch(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not observe deletions: %w", err)
+	}
+	observer := &deletionObserver{deletingAt: map[string]int64{}, deletedAt: map[string]int64{}}
+	go func() {
+		defer watcher.Stop()
+		for event := range watcher.ResultChan() {
+			object, ok := event.Object.(*corev1.ConfigMap)
+			if !ok {
+				continue
+			}
+			now := tracker.now()
+			observer.lock.Lock()
+			switch {
+			case event.Type == watch.Deleted:
+				observer.deletedAt[object.Name] = now
+			case object.DeletionTimestamp != nil:
+				if _, seen := observer.deletingAt[object.Name]; !seen {
+					observer.deletingAt[object.Name] = now
+				}
+			}
+			observer.lock.Unlock()
+		}
+	}()
+	return observer, nil
+}
+
+func (o *deletionObserver) deleting(name string) (int64, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	at, observed := o.deletingAt[name]
+	return at, observed
+}
+
+func (o *deletionObserver) deleted(name string) (int64, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	at, observed := o.deletedAt[name]
+	return at, observed
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	flowcontrolv1beta3 "k8s.io/api/flowcontrol/v1beta3"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// flowSchemasExperimentOptions configure an experiment in which tenants, each a ServiceAccount classified by its own
+// FlowSchema into its own priority level, hold watches and then contend for the API servers with lists, to show how
+// API Priority and Fairness shares capacity between classes of tenant while the servers are under watch pressure.
+type flowSchemasExperimentOptions struct {
+	tenants  string
+	objects  int
+	watches  int
+	rate     int
+	workers  int
+	duration time.Duration
+}
+
+func defaultFlowSchemasExperimentOptions() *flowSchemasExperimentOptions {
+	return &flowSchemasExperimentOptions{
+		tenants:  "high=30,low=10",
+		objects:  1000,
+		watches:  1000,
+		rate:     100,
+		workers:  20,
+		duration: 2 * time.Minute,
+	}
+}
+
+func bindFlowSchemasExperimentOptions(fs *flag.FlagSet, defaults *flowSchemasExperimentOptions) *flowSchemasExperimentOptions {
+	prefix := "flow-schemas."
+	fs.StringVar(&defaults.tenants, prefix+"tenants", defaults.tenants, "Comma-delimited list of tenant=shares pairs, giving the nominal concurrency shares of the priority level of every tenant.")
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps every list returns.")
+	fs.IntVar(&defaults.watches, prefix+"watches", defaults.watches, "Number of watches every tenant holds.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.workers, prefix+"workers", defaults.workers, "Number of clients of every tenant which list back to back.")
+	fs.DurationVar(&defaults.duration, prefix+"duration", defaults.duration, "Time to hold the watches alone, and then to contend with lists, for.")
+	return defaults
+}
+
+func (o *flowSchemasExperimentOptions) validate() error {
+	if _, err := parseTenants(o.tenants); err != nil {
+		return err
+	}
+	if o.workers <= 0 {
+		return errors.New("--flow-schemas.workers must be positive")
+	}
+	return nil
+}
+
+type flowTenant struct {
+	name   string
+	shares int32
+}
+
+func parseTenants(raw string) ([]flowTenant, error) {
+	var tenants []flowTenant
+	for _, part := range strings.Split(raw, ",") {
+		subParts := strings.Split(part, "=")
+		if len(subParts) != 2 || subParts[0] == "" {
+			return nil, fmt.Errorf("--flow-schemas.tenants invalid: %s is not of form tenant=shares", part)
+		}
+		shares, err := strconv.ParseInt(subParts[1], 10, 32)
+		if err != nil || shares <= 0 {
+			return nil, fmt.Errorf("--flow-schemas.tenants invalid: shares for %s must be a positive integer", subParts[0])
+		}
+		tenants = append(tenants, flowTenant{name: subParts[0], shares: int32(shares)})
+	}
+	return tenants, nil
+}
+
+const flowSchemasFile = "flow-schemas.json"
+
+type tenantResult struct {
+	Shares int32 `json:"shares"`
+	// Lists counts the lists every tenant completed, Rejected those the API servers rejected with 429 and Errors
+	// any other failures; Throughput is the rate of completed lists in Hertz.
+	Lists      int             `json:"lists"`
+	Rejected   int             `json:"rejected"`
+	Errors     int             `json:"errors"`
+	Throughput float64         `json:"throughput"`
+	Latency    durationSummary `json:"latency"`
+	// Dispatched and RejectedByServer are what the API servers counted for the priority level of the tenant.
+	Dispatched       float64 `json:"dispatched"`
+	RejectedByServer float64 `json:"rejectedByServer"`
+	OpenWatches      int     `json:"openWatches"`
+}
+
+func runFlowSchemasExperiment(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, outputDir string, opts *flowSchemasExperimentOptions) error {
+	logrus.Info("Running FlowSchema experiment")
+	tenants, err := parseTenants(opts.tenants)
+	if err != nil {
+		return err
+	}
+	namespace, cleanup, err := createNamespace(ctx, client, "flow-schemas")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	if err := createConfigMaps(ctx, client, namespace, opts.objects); err != nil {
+		return err
+	}
+	clients := map[string]*kubernetes.Clientset{}
+	for _, tenant := range tenants {
+		tenantClient, cleanupTenant, err := createTenant(ctx, client, config, namespace, tenant)
+		// the cluster-scoped objects outlive the namespace, so they are cleaned up even when setup failed part way
+		defer cleanupTenant()
+		if err != nil {
+			return err
+		}
+		clients[tenant.name] = tenantClient
+	}
+
+	phases.start("watches")
+	trackers := map[string]*watchTracker{}
+	for _, tenant := range tenants {
+		trackers[tenant.name] = newWatchTracker(opts.watches)
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.watches; i++ {
+		for _, tenant := range tenants {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+			go trackers[tenant.name].watch(ctx, i, configMapWatch(clients[tenant.name], namespace))
+		}
+	}
+	for _, tenant := range tenants {
+		if err := trackers[tenant.name].waitForEstablishment(ctx, opts.watches, time.Minute); err != nil {
+			logrus.WithError(err).Warnf("not all watches of tenant %s were established", tenant.name)
+		}
+	}
+	if err := holdFor(ctx, opts.duration); err != nil {
+		return err
+	}
+
+	phases.start("contention")
+	before, err := scrapePriorityLevels(ctx, tenants, namespace)
+	if err != nil {
+		return err
+	}
+	results := map[string]tenantResult{}
+	tenantLatencies := map[string][]time.Duration{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	contendCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	for _, tenant := range tenants {
+		for worker := 0; worker < opts.workers; worker++ {
+			wg.Add(1)
+			go func(tenant flowTenant) {
+				defer wg.Done()
+				var latencies []time.Duration
+				var result tenantResult
+				for contendCtx.Err() == nil {
+					start := time.Now()
+					_, err := clients[tenant.name].CoreV1().ConfigMaps(namespace).List(contendCtx, metav1.ListOptions{})
+					if contendCtx.Err() != nil {
+						break
+					}
+					switch {
+					case apierrors.IsTooManyRequests(err):
+						result.Rejected++
+					case err != nil:
+						result.Errors++
+					default:
+						result.Lists++
+						latencies = append(latencies, time.Since(start))
+					}
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				merged := results[tenant.name]
+				merged.Lists += result.Lists
+				merged.Rejected += result.Rejected
+				merged.Errors += result.Errors
+				results[tenant.name] = merged
+				tenantLatencies[tenant.name] = append(tenantLatencies[tenant.name], latencies...)
+			}(tenant)
+		}
+	}
+	wg.Wait()
+	cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	after, err := scrapePriorityLevels(ctx, tenants, namespace)
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		result := results[tenant.name]
+		result.Shares = tenant.shares
+		result.Throughput = float64(result.Lists) / opts.duration.Seconds()
+		result.Latency = summarizeDurations(tenantLatencies[tenant.name])
+		result.Dispatched = counterIncrease(before.dispatched[tenant.name], after.dispatched[tenant.name])
+		result.RejectedByServer = counterIncrease(before.rejected[tenant.name], after.rejected[tenant.name])
+		result.OpenWatches = trackers[tenant.name].openCount()
+		logrus.WithFields(logrus.Fields{
+			"shares":     result.Shares,
+			"throughput": fmt.Sprintf("%.1f/s", result.Throughput),
+			"p99":        fmt.Sprintf("%.3fs", result.Latency.P99),
+			"rejected":   result.Rejected,
+		}).Infof("Tenant %s contended", tenant.name)
+		results[tenant.name] = result
+	}
+	if err := artifacts.Write(outputDir, flowSchemasFile, results); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished FlowSchema experiment")
+	return nil
+}
+
+// tenantObjectName names the cluster-scoped objects of the tenant after the namespace, which is unique to the run.
+func tenantObjectName(namespace string, tenant flowTenant) string {
+	return namespace + "-" + tenant.name
+}
+
+// createTenant creates the ServiceAccount of the tenant, allows it to read ConfigMaps in the namespace, and
+// classifies its requests into a priority level of its own, returning a client which impersonates it. The cleanup
+// deleting the cluster-scoped objects is returned even with an error, as some of them may have been created.
+func createTenant(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, namespace string, tenant flowTenant) (*kubernetes.Clientset, func(), error) {
+	name := tenantObjectName(namespace, tenant)
+	account, err := client.CoreV1().ServiceAccounts(namespace).Create(ctx, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: tenant.name},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("could not create ServiceAccount for tenant %s: %w", tenant.name, err)
+	}
+	if _, err := client.RbacV1().Roles(namespace).Create(ctx, &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: tenant.name},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"configmaps"},
+			Verbs:     []string{"get", "list", "watch"},
+		}},
+	}, metav1.CreateOptions{}); err != nil {
+		return nil, func() {}, fmt.Errorf("could not create Role for tenant %s: %w", tenant.name, err)
+	}
+	if _, err := client.RbacV1().RoleBindings(namespace).Create(ctx, &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: tenant.name},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: tenant.name},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: namespace, Name: account.Name}},
+	}, metav1.CreateOptions{}); err != nil {
+		return nil, func() {}, fmt.Errorf("could not create RoleBinding for tenant %s: %w", tenant.name, err)
+	}
+
+	cleanup := func() {
+		if err := client.FlowcontrolV1beta3().FlowSchemas().Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			logrus.WithError(err).Errorf("failed to delete FlowSchema %s", name)
+		}
+		if err := client.FlowcontrolV1beta3().PriorityLevelConfigurations().Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			logrus.WithError(err).Errorf("failed to delete PriorityLevelConfiguration %s", name)
+		}
+	}
+	if _, err := client.FlowcontrolV1beta3().PriorityLevelConfigurations().Create(ctx, &flowcontrolv1beta3.PriorityLevelConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{benchmarkLabel: "flow-schemas"}},
+		Spec: flowcontrolv1beta3.PriorityLevelConfigurationSpec{
+			Type: flowcontrolv1beta3.PriorityLevelEnablementLimited,
+			Limited: &flowcontrolv1beta3.LimitedPriorityLevelConfiguration{
+				NominalConcurrencyShares: tenant.shares,
+				LimitResponse: flowcontrolv1beta3.LimitResponse{
+					Type: flowcontrolv1beta3.LimitResponseTypeQueue,
+					Queuing: &flowcontrolv1beta3.QueuingConfiguration{
+						Queues:           64,
+						HandSize:         6,
+						QueueLengthLimit: 50,
+					},
+				},
+			},
+		},
+	}, metav1.CreateOptions{}); err != nil {
+		return nil, cleanup, fmt.Errorf("could not create PriorityLevelConfiguration for tenant %s: %w", tenant.name, err)
+	}
+	if _, err := client.FlowcontrolV1beta3().FlowSchemas().Create(ctx, &flowcontrolv1beta3.FlowSchema{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{benchmarkLabel: "flow-schemas"}},
+		Spec: flowcontrolv1beta3.FlowSchemaSpec{
+			PriorityLevelConfiguration: flowcontrolv1beta3.PriorityLevelConfigurationReference{Name: name},
+			// take precedence over the suggested schemas for service accounts
+			MatchingPrecedence:  500,
+			DistinguisherMethod: &flowcontrolv1beta3.FlowDistinguisherMethod{Type: flowcontrolv1beta3.FlowDistinguisherMethodByUserType},
+			Rules: []flowcontrolv1beta3.PolicyRulesWithSubjects{{
+				Subjects: []flowcontrolv1beta3.Subject{{
+					Kind:           flowcontrolv1beta3.SubjectKindServiceAccount,
+					ServiceAccount: &flowcontrolv1beta3.ServiceAccountSubject{Namespace: namespace, Name: account.Name},
+				}},
+				ResourceRules: []flowcontrolv1beta3.ResourcePolicyRule{{
+					Verbs:      []string{flowcontrolv1beta3.VerbAll},
+					APIGroups:  []string{flowcontrolv1beta3.APIGroupAll},
+					Resources:  []string{flowcontrolv1beta3.ResourceAll},
+					Namespaces: []string{namespace},
+				}},
+			}},
+		},
+	}, metav1.CreateOptions{}); err != nil {
+		return nil, cleanup, fmt.Errorf("could not create FlowSchema for tenant %s: %w", tenant.name, err)
+	}
+
+	tenantConfig := rest.CopyConfig(config)
+	tenantConfig.Impersonate = rest.ImpersonationConfig{UserName: "system:serviceaccount:" + namespace + ":" + account.Name}
+	tenantClient, err := kubernetes.NewForConfig(tenantConfig)
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("could not create client for tenant %s: %w", tenant.name, err)
+	}
+	return tenantClient, cleanup, nil
+}
+
+type priorityLevelCounts struct {
+	dispatched, rejected map[string]map[string]float64
+}
+
+// scrapePriorityLevels determines how many requests each API server replica has dispatched and rejected for the
+// priority level of every tenant, keyed by tenant and then pod.
+func scrapePriorityLevels(ctx context.Context, tenants []flowTenant, namespace string) (priorityLevelCounts, error) {
+	scraped, err := apiserverScrapes.all(ctx, 0)
+	if err != nil {
+		return priorityLevelCounts{}, err
+	}
+	counts := priorityLevelCounts{dispatched: map[string]map[string]float64{}, rejected: map[string]map[string]float64{}}
+	for _, tenant := range tenants {
+		counts.dispatched[tenant.name] = map[string]float64{}
+		counts.rejected[tenant.name] = map[string]float64{}
+	}
+	for pod, families := range scraped {
+		for _, tenant := range tenants {
+			level := map[string]string{"priority_level": tenantObjectName(namespace, tenant)}
+			counts.dispatched[tenant.name][pod] = sumMetric(families, "apiserver_flowcontrol_dispatched_requests_total", level)
+			counts.rejected[tenant.name][pod] = sumMetric(families, "apiserver_flowcontrol_rejected_requests_total", level)
+		}
+	}
+	return counts, nil
+}
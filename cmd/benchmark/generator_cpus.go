@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// generatorCPUOptions configure how the load generator itself is scheduled. The Go runtime sizes itself to every
+// CPU on the host, even when a cgroup quota allows it a fraction of them, and a throttled or preempted generator
+// shows up as tail latency which the API server never caused; runs on different hosts are only comparable when
+// the generator is given the same CPUs.
+type generatorCPUOptions struct {
+	gomaxprocs int
+	cpus       string
+}
+
+func defaultGeneratorCPUOptions() *generatorCPUOptions {
+	return &generatorCPUOptions{}
+}
+
+func bindGeneratorCPUOptions(fs *flag.FlagSet, defaults *generatorCPUOptions) *generatorCPUOptions {
+	prefix := "generator."
+	fs.IntVar(&defaults.gomaxprocs, prefix+"gomaxprocs", defaults.gomaxprocs, "GOMAXPROCS for the generator, or zero to fit it to the CPUs the generator may use and its cgroup quota.")
+	fs.StringVar(&defaults.cpus, prefix+"cpus", defaults.cpus, "Comma-delimited list of CPUs or ranges of CPUs, like 0-3,8, to pin the generator to. Only supported on Linux.")
+	return defaults
+}
+
+func (o *generatorCPUOptions) validate() error {
+	if o.gomaxprocs < 0 {
+		return errors.New("--generator.gomaxprocs must not be negative")
+	}
+	if _, err := parseCPUList(o.cpus); err != nil {
+		return fmt.Errorf("--generator.cpus invalid: %w", err)
+	}
+	return nil
+}
+
+func parseCPUList(list string) ([]int, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var cpus []int
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("%s is not a CPU or range of CPUs", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("%s is not a CPU or range of CPUs", part)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+const (
+	hostCPUsMetadataKey   = "generator-cpus"
+	cpuQuotaMetadataKey   = "generator-cpu-quota"
+	gomaxprocsMetadataKey = "generator-gomaxprocs"
+	pinnedCPUsMetadataKey = "generator-pinned-cpus"
+)
+
+// configureGeneratorCPUs pins the generator and sizes GOMAXPROCS, returning the configuration to record with the run.
+func configureGeneratorCPUs(opts *generatorCPUOptions) (map[string]string, error) {
+	metadata := map[string]string{}
+	cpus, err := parseCPUList(opts.cpus)
+	if err != nil {
+		return nil, err
+	}
+	if len(cpus) > 0 {
+		if err := pinToCPUs(cpus); err != nil {
+			return nil, fmt.Errorf("could not pin generator to CPUs %s: %w", opts.cpus, err)
+		}
+		metadata[pinnedCPUsMetadataKey] = opts.cpus
+	}
+
+	// the number of CPUs is determined by the affinity of the process, so it is only read once pinned
+	available, err := availableCPUs()
+	if err != nil {
+		return nil, err
+	}
+	metadata[hostCPUsMetadataKey] = strconv.Itoa(available)
+	quota, err := cgroupCPUQuota()
+	if err != nil {
+		logrus.WithError(err).Warn("could not determine CPU quota of the generator")
+	}
+	if quota > 0 {
+		metadata[cpuQuotaMetadataKey] = strconv.FormatFloat(quota, 'f', 2, 64)
+	}
+
+	procs := opts.gomaxprocs
+	if procs == 0 {
+		procs = available
+		if quota > 0 && int(math.Ceil(quota)) < procs {
+			procs = int(math.Ceil(quota))
+		}
+	}
+	if quota > 0 && float64(procs) > quota {
+		logrus.Warnf("GOMAXPROCS of %d exceeds the CPU quota of %.2f cores, the generator will be throttled", procs, quota)
+	}
+	if procs > available {
+		logrus.Warnf("GOMAXPROCS of %d exceeds the %d CPUs the generator may use", procs, available)
+	}
+	runtime.GOMAXPROCS(procs)
+	metadata[gomaxprocsMetadataKey] = strconv.Itoa(procs)
+	logrus.WithFields(logrus.Fields{
+		"cpus":       available,
+		"quota":      quota,
+		"gomaxprocs": procs,
+		"pinned":     opts.cpus,
+	}).Info("Configured generator CPUs")
+	return metadata, nil
+}
+
+// cgroupCPUQuota determines how many cores the cgroup of the generator may use, or zero when it is not limited. Both
+// cgroup v2 and v1 are understood.
+func cgroupCPUQuota() (float64, error) {
+	if raw, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(raw))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, nil
+		}
+		return quotaOf(fields[0], fields[1])
+	}
+	rawQuota, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	rawPeriod, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0, err
+	}
+	return quotaOf(strings.TrimSpace(string(rawQuota)), strings.TrimSpace(string(rawPeriod)))
+}
+
+func quotaOf(rawQuota, rawPeriod string) (float64, error) {
+	quota, err := strconv.ParseFloat(rawQuota, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse CPU quota: %w", err)
+	}
+	period, err := strconv.ParseFloat(rawPeriod, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse CPU period: %w", err)
+	}
+	if quota <= 0 || period <= 0 {
+		return 0, nil
+	}
+	return quota / period, nil
+}
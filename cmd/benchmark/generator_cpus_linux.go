@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// pinToCPUs sets the affinity of every thread of the process; threads started later inherit it from the thread
+// which starts them.
+func pinToCPUs(cpus []int) error {
+	var set unix.CPUSet
+	set.Zero()
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("could not list threads: %w", err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.SchedSetaffinity(tid, &set); err != nil {
+			return fmt.Errorf("could not set affinity of thread %d: %w", tid, err)
+		}
+	}
+	return nil
+}
+
+// availableCPUs counts the CPUs in the affinity of the process as it is now; the runtime only reads it at startup,
+// before the generator was pinned.
+func availableCPUs() (int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return 0, fmt.Errorf("could not determine CPU affinity: %w", err)
+	}
+	return set.Count(), nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+func pinToCPUs([]int) error {
+	return errors.New("pinning is only supported on Linux")
+}
+
+func availableCPUs() (int, error) {
+	return runtime.NumCPU(), nil
+}
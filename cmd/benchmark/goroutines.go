@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// goroutineMonitor samples how many goroutines every API server replica runs against how many watches the
+// benchmark holds open; every watch costs the server a handful of goroutines, and how many is one of the quantities
+// the benchmark exists to explain.
+type goroutineMonitor struct {
+	lock       sync.Mutex
+	goroutines artifacts.Goroutines
+
+	interval time.Duration
+}
+
+func monitorGoroutines(ctx context.Context, interval time.Duration) *goroutineMonitor {
+	monitor := &goroutineMonitor{
+		goroutines: artifacts.Goroutines{Start: time.Now(), Replicas: map[string][]float64{}},
+		interval:   interval,
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := monitor.sample(ctx); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Debug("failed to sample API server goroutines")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return monitor
+}
+
+func (m *goroutineMonitor) sample(ctx context.Context) error {
+	scraped, err := apiserverScrapes.all(ctx, m.interval/2)
+	if err != nil {
+		return err
+	}
+	goroutines := map[string]float64{}
+	for pod, families := range scraped {
+		goroutines[pod] = sumMetric(families, "go_goroutines", nil)
+	}
+	open := atomic.LoadInt64(&openWatches)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	samples := len(m.goroutines.Offsets)
+	m.goroutines.Offsets = append(m.goroutines.Offsets, time.Since(m.goroutines.Start).Seconds())
+	m.goroutines.Open = append(m.goroutines.Open, open)
+	var total float64
+	for pod, count := range goroutines {
+		if _, seen := m.goroutines.Replicas[pod]; !seen {
+			m.goroutines.Replicas[pod] = make([]float64, samples)
+		}
+		total += count
+	}
+	for pod := range m.goroutines.Replicas {
+		m.goroutines.Replicas[pod] = append(m.goroutines.Replicas[pod], goroutines[pod])
+	}
+	m.goroutines.Total = append(m.goroutines.Total, total)
+	return nil
+}
+
+func (m *goroutineMonitor) write(outputDir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.goroutines.Offsets) == 0 {
+		return nil
+	}
+	return artifacts.Write(outputDir, artifacts.GoroutinesFile, m.goroutines)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// guardrailOptions configure the checks made before an experiment creates anything, which refuse to run it when
+// what it would create does not fit into the cluster. An experiment which fills etcd up midway leaves the cluster
+// degraded, with a half-populated namespace to clean up, and its results are useless anyway.
+type guardrailOptions struct {
+	disabled   bool
+	maxObjects int
+	// etcdQuota is used when the quota cannot be read from the arguments of the etcd pods.
+	etcdQuota    string
+	etcdHeadroom float64
+	etcdSelector string
+}
+
+func defaultGuardrailOptions() *guardrailOptions {
+	return &guardrailOptions{
+		maxObjects:   200000,
+		etcdQuota:    "2Gi",
+		etcdHeadroom: 0.2,
+		etcdSelector: "component=etcd",
+	}
+}
+
+func bindGuardrailOptions(fs *flag.FlagSet, defaults *guardrailOptions) *guardrailOptions {
+	prefix := "guardrail."
+	fs.BoolVar(&defaults.disabled, prefix+"disabled", defaults.disabled, "Run the experiment without checking that what it creates fits into the cluster.")
+	fs.IntVar(&defaults.maxObjects, prefix+"max-objects", defaults.maxObjects, "Maximum number of ConfigMaps in the cluster, including those the experiment creates.")
+	fs.StringVar(&defaults.etcdQuota, prefix+"etcd-quota", defaults.etcdQuota, "Size of the etcd backend quota, used when it is not set in the arguments of the etcd pods.")
+	fs.Float64Var(&defaults.etcdHeadroom, prefix+"etcd-headroom", defaults.etcdHeadroom, "Fraction of the etcd backend quota which must remain free once the experiment has created everything.")
+	fs.StringVar(&defaults.etcdSelector, prefix+"etcd-selector", defaults.etcdSelector, "Label selector for etcd pods, whose arguments set the backend quota.")
+	return defaults
+}
+
+func (o *guardrailOptions) validate() error {
+	if _, err := resource.ParseQuantity(o.etcdQuota); err != nil {
+		return fmt.Errorf("--guardrail.etcd-quota invalid: %w", err)
+	}
+	if o.etcdHeadroom < 0 || o.etcdHeadroom >= 1 {
+		return errors.New("--guardrail.etcd-headroom must be at least zero and less than one")
+	}
+	return nil
+}
+
+// configMapOverhead approximates the size of a trivial ConfigMap in etcd, metadata and managed fields included.
+const configMapOverhead = 512
+
+// objectPlan is what an experiment creates at its peak.
+type objectPlan struct {
+	objects int
+	bytes   int64
+}
+
+// plannedObjects determines what the experiment will create; experiments which only create a handful of objects,
+// or create and delete a bounded population continuously, plan none.
+func (o *options) plannedObjects() objectPlan {
+	trivial := func(objects int) objectPlan {
+		return objectPlan{objects: objects, bytes: int64(objects) * configMapOverhead}
+	}
+	switch experiment(o.experiment) {
+	case coldStartExperiment:
+		sizes, _ := o.coldStartExperimentOptions.datasetSizes()
+		largest := 0
+		for _, size := range sizes {
+			if size > largest {
+				largest = size
+			}
+		}
+		return trivial(largest)
+	case continueExpiryExperiment:
+		return trivial(o.continueExpiryExperimentOptions.objects)
+	case deleteCollectionExperiment:
+		return trivial(o.deleteCollectionExperimentOptions.objects)
+	case finalizersExperiment:
+		return trivial(2 * o.finalizersExperimentOptions.objects)
+	case flowSchemasExperiment:
+		return trivial(o.flowSchemasExperimentOptions.objects)
+	case rollingRestartExperiment:
+		return trivial(o.rollingRestartExperimentOptions.objects)
+	case rvMatchExperiment:
+		return trivial(o.rvMatchExperimentOptions.objects)
+	case selectorChurnExperiment:
+		return trivial(o.selectorChurnExperimentOptions.objects)
+	case ssaConflictsExperiment:
+		return trivial(o.ssaConflictsExperimentOptions.objects)
+	case timeToSyncExperiment:
+		opts := o.timeToSyncExperimentOptions
+		return objectPlan{objects: opts.objects, bytes: int64(opts.objects) * int64(opts.size+configMapOverhead)}
+	}
+	return objectPlan{}
+}
+
+// checkGuardrails determines whether what the experiment plans to create fits into the cluster, as observed by the
+// API servers: the ConfigMaps stored must stay under the maximum, and etcd must keep the headroom under its quota.
+func checkGuardrails(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, selector string, plan objectPlan, opts *guardrailOptions) error {
+	if opts.disabled || plan.objects == 0 {
+		return nil
+	}
+	instances, err := apiserverInstances(ctx, client, config, selector)
+	if err != nil {
+		return err
+	}
+	var stored, dbSize float64
+	for _, instance := range instances {
+		families, err := scrapeMetrics(ctx, instance.client)
+		if err != nil {
+			return fmt.Errorf("could not scrape %s: %w", instance.pod, err)
+		}
+		// every replica reports the same objects and databases, so the largest figure is the most recent
+		if objects := sumMetric(families, "apiserver_storage_objects", map[string]string{"resource": "configmaps"}); objects > stored {
+			stored = objects
+		}
+		for _, name := range []string{"apiserver_storage_size_bytes", "apiserver_storage_db_total_size_in_bytes"} {
+			if size := maxMetric(families, name); size > dbSize {
+				dbSize = size
+			}
+		}
+	}
+	if total := int(stored) + plan.objects; total > opts.maxObjects {
+		return fmt.Errorf("the experiment would create %d ConfigMaps on top of the %d stored, over the maximum of %d; lower the object counts of the experiment or raise --guardrail.max-objects", plan.objects, int(stored), opts.maxObjects)
+	}
+
+	quota, err := etcdQuota(ctx, client, opts)
+	if err != nil {
+		return err
+	}
+	limit := float64(quota) * (1 - opts.etcdHeadroom)
+	if dbSize+float64(plan.bytes) > limit {
+		return fmt.Errorf("the experiment would store about %s in etcd on top of the %s used, leaving less than %.0f%% of the %s quota free; lower the object counts of the experiment or compact and defragment etcd", formatMebibytes(plan.bytes), formatMebibytes(int64(dbSize)), 100*opts.etcdHeadroom, formatMebibytes(quota))
+	}
+	logrus.WithFields(logrus.Fields{
+		"objects": plan.objects,
+		"bytes":   formatMebibytes(plan.bytes),
+		"stored":  int(stored),
+		"etcd":    formatMebibytes(int64(dbSize)) + "/" + formatMebibytes(quota),
+	}).Info("The experiment fits into the cluster")
+	return nil
+}
+
+// etcdQuota determines the backend quota of etcd from the arguments of its pods, falling back to the configured
+// quota when no pod sets it or the pods cannot be found.
+func etcdQuota(ctx context.Context, client *kubernetes.Clientset, opts *guardrailOptions) (int64, error) {
+	fallback := resource.MustParse(opts.etcdQuota)
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: opts.etcdSelector})
+	if err != nil {
+		logrus.WithError(err).Warn("could not list etcd pods, assuming the configured quota")
+		return fallback.Value(), nil
+	}
+	var quota int64
+	for _, pod := range pods.Items {
+		for _, container := range pod.Spec.Containers {
+			for _, arg := range append(container.Command, container.Args...) {
+				if !strings.HasPrefix(arg, "--quota-backend-bytes=") {
+					continue
+				}
+				value, err := strconv.ParseInt(strings.TrimPrefix(arg, "--quota-backend-bytes="), 10, 64)
+				if err != nil {
+					return 0, fmt.Errorf("could not parse quota of %s/%s: %w", pod.Namespace, pod.Name, err)
+				}
+				if quota == 0 || value < quota {
+					quota = value
+				}
+			}
+		}
+	}
+	if quota == 0 {
+		return fallback.Value(), nil
+	}
+	return quota, nil
+}
+
+func formatMebibytes(bytes int64) string {
+	return fmt.Sprintf("%.0fMiB", float64(bytes)/(1024*1024))
+}
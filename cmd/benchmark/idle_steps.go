@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// idleStepsExperimentOptions configure an experiment which adds idle watches in steps, holding each step long
+// enough for memory to stabilize, so that the marginal cost of a watch can be determined from the deltas.
+type idleStepsExperimentOptions struct {
+	step  int
+	steps int
+	rate  int
+	hold  time.Duration
+}
+
+func defaultIdleStepsExperimentOptions() *idleStepsExperimentOptions {
+	return &idleStepsExperimentOptions{
+		step:  1000,
+		steps: 10,
+		rate:  100,
+		hold:  2 * time.Minute,
+	}
+}
+
+func bindIdleStepsExperimentOptions(fs *flag.FlagSet, defaults *idleStepsExperimentOptions) *idleStepsExperimentOptions {
+	prefix := "idle-steps."
+	fs.IntVar(&defaults.step, prefix+"step", defaults.step, "Number of watches to add in every step.")
+	fs.IntVar(&defaults.steps, prefix+"steps", defaults.steps, "Number of steps to take.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.DurationVar(&defaults.hold, prefix+"hold", defaults.hold, "Time to hold every step, including the baseline without watches.")
+	return defaults
+}
+
+func (o *idleStepsExperimentOptions) validate() error {
+	if o.step <= 0 || o.steps <= 0 {
+		return errors.New("--idle-steps.step and --idle-steps.steps must be positive")
+	}
+	return nil
+}
+
+func runIdleStepsExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *idleStepsExperimentOptions) error {
+	logrus.Info("Running idle steps experiment")
+	namespace, cleanup, err := createNamespace(ctx, client, "idle-steps")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	var steps []artifacts.Step
+	tracker := newWatchTracker(opts.step * opts.steps)
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+		if err := artifacts.Write(outputDir, artifacts.StepsFile, steps); err != nil {
+			logrus.WithError(err).Error("failed to record steps")
+		}
+		if err := artifacts.Write(outputDir, artifacts.LatenciesFile, tracker.latencies()); err != nil {
+			logrus.WithError(err).Error("failed to record latencies")
+		}
+	}()
+
+	phases.start(artifacts.BaselinePhase)
+	steps = append(steps, artifacts.Step{Phase: artifacts.BaselinePhase})
+	if err := holdFor(ctx, opts.hold); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for step := 1; step <= opts.steps; step++ {
+		phases.start(fmt.Sprintf("ramp-%d", step))
+		for i := (step - 1) * opts.step; i < step*opts.step; i++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+			go tracker.watch(ctx, i, configMapWatch(client, namespace))
+		}
+		if err := tracker.waitForEstablishment(ctx, step*opts.step, time.Minute); err != nil {
+			logrus.WithError(err).Warn("not all issued watches were established")
+		}
+
+		name := fmt.Sprintf("step-%d", step)
+		phases.start(name)
+		steps = append(steps, artifacts.Step{Phase: name, Watches: tracker.openCount()})
+		logrus.Infof("Holding %d open watches", tracker.openCount())
+		if err := holdFor(ctx, opts.hold); err != nil {
+			return err
+		}
+	}
+
+	logrus.Info("Finished idle steps experiment")
+	return nil
+}
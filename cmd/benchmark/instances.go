@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const defaultSecurePort = "6443"
+
+// apiserverInstance talks to one API server replica directly, bypassing any load balancer in front of them, so
+// that per-replica state like metrics can be observed.
+type apiserverInstance struct {
+	pod    string
+	node   string
+	client rest.Interface
+}
+
+// apiserverInstances resolves the API server pods matching the selector into clients which connect to the pod
+// addresses, using the credentials and server name of the original configuration.
+func apiserverInstances(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, selector string) ([]apiserverInstance, error) {
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("could not list API server pods: %w", err)
+	}
+	server, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse API server host: %w", err)
+	}
+	var instances []apiserverInstance
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == "" {
+			continue
+		}
+		port := defaultSecurePort
+		for _, container := range pod.Spec.Containers {
+			for _, arg := range append(container.Command, container.Args...) {
+				if strings.HasPrefix(arg, "--secure-port=") {
+					port = strings.TrimPrefix(arg, "--secure-port=")
+				}
+			}
+		}
+		instanceConfig := rest.CopyConfig(config)
+		instanceConfig.Host = "https://" + net.JoinHostPort(pod.Status.PodIP, port)
+		if instanceConfig.TLSClientConfig.ServerName == "" {
+			instanceConfig.TLSClientConfig.ServerName = server.Hostname()
+		}
+		instanceClient, err := kubernetes.NewForConfig(instanceConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not create client for %s/%s: %w", pod.Namespace, pod.Name, err)
+		}
+		instances = append(instances, apiserverInstance{
+			pod:    pod.Namespace + "/" + pod.Name,
+			node:   pod.Spec.NodeName,
+			client: instanceClient.RESTClient(),
+		})
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no running API server pods matched %s", selector)
+	}
+	return instances, nil
+}
+
+func scrapeMetrics(ctx context.Context, client rest.Interface) (map[string]*dto.MetricFamily, error) {
+	raw, err := client.Get().AbsPath("/metrics").DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not scrape metrics: %w", err)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse metrics: %w", err)
+	}
+	return families, nil
+}
+
+// sumMetric adds up the values of all samples in the family whose labels match. Histograms contribute the number
+// of observations they hold.
+func sumMetric(families map[string]*dto.MetricFamily, name string, matches map[string]string) float64 {
+	family, exists := families[name]
+	if !exists {
+		return 0
+	}
+	var sum float64
+	for _, sample := range family.Metric {
+		labels := labelsFor(sample)
+		matched := true
+		for key, value := range matches {
+			if labels[key] != value {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		sum += valueOf(sample)
+	}
+	return sum
+}
+
+// sumMetricBy adds up the values of all samples in the family, keyed by the value of one label.
+func sumMetricBy(families map[string]*dto.MetricFamily, name, label string) map[string]float64 {
+	sums := map[string]float64{}
+	family, exists := families[name]
+	if !exists {
+		return sums
+	}
+	for _, sample := range family.Metric {
+		sums[labelsFor(sample)[label]] += valueOf(sample)
+	}
+	return sums
+}
+
+// maxMetric determines the largest value of any sample in the family.
+func maxMetric(families map[string]*dto.MetricFamily, name string) float64 {
+	family, exists := families[name]
+	if !exists {
+		return 0
+	}
+	var largest float64
+	for _, sample := range family.Metric {
+		if value := valueOf(sample); value > largest {
+			largest = value
+		}
+	}
+	return largest
+}
+
+func labelsFor(sample *dto.Metric) map[string]string {
+	labels := map[string]string{}
+	for _, pair := range sample.Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+func valueOf(sample *dto.Metric) float64 {
+	switch {
+	case sample.Counter != nil:
+		return sample.Counter.GetValue()
+	case sample.Gauge != nil:
+		return sample.Gauge.GetValue()
+	case sample.Untyped != nil:
+		return sample.Untyped.GetValue()
+	case sample.Histogram != nil:
+		return float64(sample.Histogram.GetSampleCount())
+	}
+	return 0
+}
+
+// counterIncrease determines how much a counter increased between two scrapes of each instance, keyed by pod.
+// Instances which restarted in between have their counters reset, so their whole latest value is the increase.
+func counterIncrease(before, after map[string]float64) float64 {
+	var increase float64
+	for pod, value := range after {
+		previous := before[pod]
+		if value < previous {
+			previous = 0
+		}
+		increase += value - previous
+	}
+	return increase
+}
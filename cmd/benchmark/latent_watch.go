@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+type latentWatchExperimentOptions struct {
+	count int
+	rate  int
+	// burst, when set, replaces the steady rate with bursts of this many watches issued at once, separated by
+	// burstInterval, to reproduce connection stampedes like those after a load balancer fails over.
+	burst         int
+	burstInterval time.Duration
+	// initialEvents opens the watches asking for their initial events, so that the time to the first frame can be
+	// told apart from the time to the response headers.
+	initialEvents bool
+}
+
+// burstMetadataKey records how watches were issued in bursts, as stampedes are not comparable to steady rates.
+const burstMetadataKey = "burst"
+
+func defaultLatentWatchExperimentOptions() *latentWatchExperimentOptions {
+	return &latentWatchExperimentOptions{
+		count:         10000,
+		rate:          100,
+		burstInterval: 10 * time.Second,
+	}
+}
+
+func bindLatentWatchExperimentOptions(fs *flag.FlagSet, defaults *latentWatchExperimentOptions) *latentWatchExperimentOptions {
+	prefix := "latent-watch."
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.burst, prefix+"burst", defaults.burst, "Number of watches to start at once in every burst, ignoring the rate; set to the count to start all watches at once, or zero to start them at the rate.")
+	fs.DurationVar(&defaults.burstInterval, prefix+"burst-interval", defaults.burstInterval, "Time between bursts of watch starts.")
+	fs.BoolVar(&defaults.initialEvents, prefix+"initial-events", defaults.initialEvents, "Open watches asking for their initial events, ended by a bookmark, and record the time to the first frame. Needs the WatchList feature gate.")
+	return defaults
+}
+
+func (o *latentWatchExperimentOptions) validate() error {
+	if o.burst < 0 {
+		return errors.New("--latent-watch.burst must not be negative")
+	}
+	if o.burst > 0 && o.burstInterval <= 0 {
+		return errors.New("--latent-watch.burst-interval must be positive")
+	}
+	if o.burst == 0 && o.rate <= 0 {
+		return errors.New("--latent-watch.rate must be positive")
+	}
+	return nil
+}
+
+func runLatentWatchExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *latentWatchExperimentOptions) error {
+	logrus.Info("Running latent watch experiment")
+	tracker := issueLatentWatches(ctx, client, opts)
+
+	raw, err := json.Marshal(tracker.establishedTimes())
+	if err != nil {
+		return fmt.Errorf("failed to encode latent watch timing: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, artifacts.LatentWatchFile), raw, 0666); err != nil {
+		return fmt.Errorf("failed to record latent watch timing: %w", err)
+	}
+	if err := artifacts.Write(outputDir, artifacts.LatenciesFile, tracker.latencies()); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished latent watch experiment")
+	return nil
+}
+
+// issueLatentWatches starts watches on ConfigMaps, each in a distinct namespace, at the configured rate or in
+// bursts and waits for them to be established. The watches run until the context is cancelled.
+func issueLatentWatches(ctx context.Context, client *kubernetes.Clientset, opts *latentWatchExperimentOptions) *watchTracker {
+	tracker := newWatchTracker(opts.count)
+	tracker.initialFrames = opts.initialEvents
+	open := configMapWatch
+	if opts.initialEvents {
+		open = initialEventsConfigMapWatch
+	}
+	progressInterval := opts.count / 10
+	if progressInterval == 0 {
+		progressInterval = 1
+	}
+
+	// a steady rate is a burst of one watch at every tick
+	burst, interval := opts.burst, opts.burstInterval
+	if opts.burst == 0 {
+		burst, interval = 1, time.Second/time.Duration(opts.rate)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	issued := 0
+	func() {
+		for issued < opts.count {
+			if opts.burst == 0 || issued > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+			if opts.burst > 0 {
+				timeline.annotate(artifacts.AnnotationRate, "starting a burst of up to %d watches", burst)
+			}
+			for i := 0; i < burst && issued < opts.count; i++ {
+				go tracker.watch(ctx, issued, open(client, objectNames.name("", issued)))
+				issued++
+				if issued%progressInterval == 0 {
+					logrus.Infof("issued %d/%d (%.0f%%) watches", issued, opts.count, 100*(float64(issued)/float64(opts.count)))
+				}
+			}
+		}
+	}()
+
+	if err := tracker.waitForEstablishment(ctx, issued, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+	return tracker
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -15,96 +16,426 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
 )
 
 type options struct {
 	kubeconfig string
+	context    string
 	outputDir  string
-
-	podSelectors string
-
-	experiment                   string
-	latentWatchExperimentOptions *latentWatchExperimentOptions
+	seed       int64
+	// startBarrier is set for runs started by a comparison, which must not start their experiment before the run
+	// against the other cluster is ready to.
+	startBarrier bool
+
+	notes notes
+
+	podSelectors    string
+	podLogs         bool
+	usageSource     string
+	summaryInterval time.Duration
+	dedupeSummaries bool
+	// summaryRotateSize is a quantity, like 64Mi.
+	summaryRotateSize     string
+	summaryRotateInterval time.Duration
+	cadvisorInterval      time.Duration
+
+	openWatchesInterval time.Duration
+	backlogInterval     time.Duration
+	goroutinesInterval  time.Duration
+	clientUsageInterval time.Duration
+	podHealthInterval   time.Duration
+
+	unavailableWindow time.Duration
+	etcdIdleWindow    time.Duration
+
+	apiserverSelector        string
+	apiserverMetricsInterval time.Duration
+	apfDumpInterval          time.Duration
+
+	naming string
+
+	nodeCollectorOptions *nodeCollectorOptions
+	guardrailOptions     *guardrailOptions
+	diskBudgetOptions    *diskBudgetOptions
+	noiseOptions         *noiseOptions
+	etcdMetricsOptions   *etcdMetricsOptions
+	etcdKeyspaceOptions  *etcdKeyspaceOptions
+	profileOptions       *profileOptions
+	generatorCPUOptions  *generatorCPUOptions
+
+	experiment                        string
+	latentWatchExperimentOptions      *latentWatchExperimentOptions
+	auditImpactExperimentOptions      *auditImpactExperimentOptions
+	selfTestOptions                   *selfTestOptions
+	rollingRestartExperimentOptions   *rollingRestartExperimentOptions
+	watchMixExperimentOptions         *watchMixExperimentOptions
+	idleStepsExperimentOptions        *idleStepsExperimentOptions
+	rebalanceExperimentOptions        *rebalanceExperimentOptions
+	rvMatchExperimentOptions          *rvMatchExperimentOptions
+	deleteCollectionExperimentOptions *deleteCollectionExperimentOptions
+	etcdLeaderExperimentOptions       *etcdLeaderExperimentOptions
+	coldStartExperimentOptions        *coldStartExperimentOptions
+	ssaConflictsExperimentOptions     *ssaConflictsExperimentOptions
+	aggregatedAPIExperimentOptions    *aggregatedAPIExperimentOptions
+	soakExperimentOptions             *soakExperimentOptions
+	continueExpiryExperimentOptions   *continueExpiryExperimentOptions
+	timeToSyncExperimentOptions       *timeToSyncExperimentOptions
+	selectorChurnExperimentOptions    *selectorChurnExperimentOptions
+	finalizersExperimentOptions       *finalizersExperimentOptions
+	flowSchemasExperimentOptions      *flowSchemasExperimentOptions
+	streamingExperimentOptions        *streamingExperimentOptions
 }
 
 func defaultOptions() *options {
 	return &options{
-		podSelectors:                 "api:component=kube-apiserver|etcd:component=etcd",
-		latentWatchExperimentOptions: defaultLatentWatchExperimentOptions(),
+		podSelectors:                      "api:component=kube-apiserver|etcd:component=etcd|kcm:component=kube-controller-manager|scheduler:component=kube-scheduler",
+		usageSource:                       autoUsageSource,
+		summaryInterval:                   500 * time.Millisecond,
+		dedupeSummaries:                   true,
+		summaryRotateSize:                 "64Mi",
+		summaryRotateInterval:             10 * time.Minute,
+		openWatchesInterval:               500 * time.Millisecond,
+		backlogInterval:                   5 * time.Second,
+		goroutinesInterval:                5 * time.Second,
+		clientUsageInterval:               time.Second,
+		podHealthInterval:                 5 * time.Second,
+		cadvisorInterval:                  10 * time.Second,
+		unavailableWindow:                 time.Minute,
+		etcdIdleWindow:                    30 * time.Second,
+		apiserverSelector:                 "component=kube-apiserver",
+		apiserverMetricsInterval:          15 * time.Second,
+		naming:                            sequentialNaming,
+		nodeCollectorOptions:              defaultNodeCollectorOptions(),
+		guardrailOptions:                  defaultGuardrailOptions(),
+		diskBudgetOptions:                 defaultDiskBudgetOptions(),
+		noiseOptions:                      defaultNoiseOptions(),
+		etcdMetricsOptions:                defaultEtcdMetricsOptions(),
+		etcdKeyspaceOptions:               defaultEtcdKeyspaceOptions(),
+		profileOptions:                    defaultProfileOptions(),
+		generatorCPUOptions:               defaultGeneratorCPUOptions(),
+		latentWatchExperimentOptions:      defaultLatentWatchExperimentOptions(),
+		auditImpactExperimentOptions:      defaultAuditImpactExperimentOptions(),
+		selfTestOptions:                   defaultSelfTestOptions(),
+		rollingRestartExperimentOptions:   defaultRollingRestartExperimentOptions(),
+		watchMixExperimentOptions:         defaultWatchMixExperimentOptions(),
+		idleStepsExperimentOptions:        defaultIdleStepsExperimentOptions(),
+		rebalanceExperimentOptions:        defaultRebalanceExperimentOptions(),
+		rvMatchExperimentOptions:          defaultRVMatchExperimentOptions(),
+		deleteCollectionExperimentOptions: defaultDeleteCollectionExperimentOptions(),
+		etcdLeaderExperimentOptions:       defaultEtcdLeaderExperimentOptions(),
+		coldStartExperimentOptions:        defaultColdStartExperimentOptions(),
+		ssaConflictsExperimentOptions:     defaultSSAConflictsExperimentOptions(),
+		aggregatedAPIExperimentOptions:    defaultAggregatedAPIExperimentOptions(),
+		soakExperimentOptions:             defaultSoakExperimentOptions(),
+		continueExpiryExperimentOptions:   defaultContinueExpiryExperimentOptions(),
+		timeToSyncExperimentOptions:       defaultTimeToSyncExperimentOptions(),
+		selectorChurnExperimentOptions:    defaultSelectorChurnExperimentOptions(),
+		finalizersExperimentOptions:       defaultFinalizersExperimentOptions(),
+		flowSchemasExperimentOptions:      defaultFlowSchemasExperimentOptions(),
+		streamingExperimentOptions:        defaultStreamingExperimentOptions(),
 	}
 }
 
 func bindOptions(fs *flag.FlagSet, defaults *options) *options {
 	fs.StringVar(&defaults.kubeconfig, "kubeconfig", defaults.kubeconfig, "Path to kubeconfig file.")
+	fs.StringVar(&defaults.context, "context", defaults.context, "Kubeconfig context to use, instead of the current one.")
 	fs.StringVar(&defaults.outputDir, "output", defaults.outputDir, "Path to output directory.")
+	fs.Int64Var(&defaults.seed, "seed", defaults.seed, "Seed for everything experiments randomize, or zero to choose one at random.")
+	fs.BoolVar(&defaults.startBarrier, "start-barrier", defaults.startBarrier, "Wait for a line on standard input before starting the experiment.")
+	fs.Var(&defaults.notes, "note", "Free-form note to record with the run, like how the cluster under test was built. May be given more than once.")
 	fs.StringVar(&defaults.podSelectors, "pod-selectors", defaults.podSelectors, "Pipe-delimited list of pod selectors for components to monitor.")
+	fs.BoolVar(&defaults.podLogs, "pod-logs", defaults.podLogs, "Record the logs of the monitored pods for the duration of the run.")
+	fs.StringVar(&defaults.usageSource, "usage-source", defaults.usageSource, fmt.Sprintf("Where to read the usage of the monitored pods from, one of %v.", usageSources))
+	fs.DurationVar(&defaults.summaryInterval, "summary-interval", defaults.summaryInterval, "Time between polls of the usage of every node running a monitored pod.")
+	fs.DurationVar(&defaults.cadvisorInterval, "cadvisor-interval", defaults.cadvisorInterval, "Time between scrapes of the cAdvisor metrics of the monitored pods, or zero to not record them.")
+	fs.BoolVar(&defaults.dedupeSummaries, "dedupe-summaries", defaults.dedupeSummaries, "Skip persisting kubelet stats which have not changed since the last sample.")
+	fs.StringVar(&defaults.summaryRotateSize, "summary-rotate-size", defaults.summaryRotateSize, "Size past which the kubelet stats summaries of a node are appended to a new file.")
+	fs.DurationVar(&defaults.summaryRotateInterval, "summary-rotate-interval", defaults.summaryRotateInterval, "Time after which the kubelet stats summaries of a node are appended to a new file.")
+	fs.DurationVar(&defaults.openWatchesInterval, "open-watches-interval", defaults.openWatchesInterval, "Time between samples of the number of watches the experiment holds open.")
+	fs.DurationVar(&defaults.backlogInterval, "backlog-interval", defaults.backlogInterval, "Time between scrapes of the watch backlog every API server replica reports.")
+	fs.DurationVar(&defaults.goroutinesInterval, "goroutines-interval", defaults.goroutinesInterval, "Time between scrapes of the goroutines every API server replica runs.")
+	fs.DurationVar(&defaults.clientUsageInterval, "client-usage-interval", defaults.clientUsageInterval, "Time between samples of the CPU, memory, goroutines and file descriptors the benchmark itself uses.")
+	fs.DurationVar(&defaults.podHealthInterval, "pod-health-interval", defaults.podHealthInterval, "Time between checks of the monitored pods, and the nodes running them, for OOM kills, evictions, restarts and memory pressure.")
 	fs.StringVar(&defaults.experiment, "experiment", defaults.experiment, "Experiment to run.")
+	fs.DurationVar(&defaults.unavailableWindow, "abort-after-unavailable", defaults.unavailableWindow, "Abort the experiment when the API server is unavailable for longer than this, or zero to never abort.")
+	fs.StringVar(&defaults.naming, "naming", defaults.naming, fmt.Sprintf("Scheme for naming the objects experiments create, which decides their locality in the etcd keyspace, one of %v.", sets.List(namingSchemes)))
+	fs.DurationVar(&defaults.etcdIdleWindow, "etcd-idle-window", defaults.etcdIdleWindow, "Time to count the requests the API servers send to etcd before the experiment starts, as the background traffic to subtract from those counted during it, or zero to not subtract any.")
+	fs.StringVar(&defaults.apiserverSelector, "apiserver-selector", defaults.apiserverSelector, "Label selector for API server pods, which are observed directly to count requests to etcd and to see how load spreads over replicas.")
+	fs.DurationVar(&defaults.apiserverMetricsInterval, "apiserver-metrics-interval", defaults.apiserverMetricsInterval, "Time between scrapes of the metrics every API server replica reports, or zero to not record them.")
+	fs.DurationVar(&defaults.apfDumpInterval, "apf-dump-interval", defaults.apfDumpInterval, "Time between dumps of the priority levels and queued requests of API Priority and Fairness on every API server replica, or zero to not record them.")
+	bindNodeCollectorOptions(fs, defaults.nodeCollectorOptions)
+	bindGuardrailOptions(fs, defaults.guardrailOptions)
+	bindDiskBudgetOptions(fs, defaults.diskBudgetOptions)
+	bindNoiseOptions(fs, defaults.noiseOptions)
+	bindEtcdMetricsOptions(fs, defaults.etcdMetricsOptions)
+	bindEtcdKeyspaceOptions(fs, defaults.etcdKeyspaceOptions)
+	bindProfileOptions(fs, defaults.profileOptions)
+	bindGeneratorCPUOptions(fs, defaults.generatorCPUOptions)
 	bindLatentWatchExperimentOptions(fs, defaults.latentWatchExperimentOptions)
+	bindAuditImpactExperimentOptions(fs, defaults.auditImpactExperimentOptions)
+	bindSelfTestOptions(fs, defaults.selfTestOptions)
+	bindRollingRestartExperimentOptions(fs, defaults.rollingRestartExperimentOptions)
+	bindWatchMixExperimentOptions(fs, defaults.watchMixExperimentOptions)
+	bindIdleStepsExperimentOptions(fs, defaults.idleStepsExperimentOptions)
+	bindRebalanceExperimentOptions(fs, defaults.rebalanceExperimentOptions)
+	bindRVMatchExperimentOptions(fs, defaults.rvMatchExperimentOptions)
+	bindDeleteCollectionExperimentOptions(fs, defaults.deleteCollectionExperimentOptions)
+	bindEtcdLeaderExperimentOptions(fs, defaults.etcdLeaderExperimentOptions)
+	bindColdStartExperimentOptions(fs, defaults.coldStartExperimentOptions)
+	bindSSAConflictsExperimentOptions(fs, defaults.ssaConflictsExperimentOptions)
+	bindAggregatedAPIExperimentOptions(fs, defaults.aggregatedAPIExperimentOptions)
+	bindSoakExperimentOptions(fs, defaults.soakExperimentOptions)
+	bindContinueExpiryExperimentOptions(fs, defaults.continueExpiryExperimentOptions)
+	bindTimeToSyncExperimentOptions(fs, defaults.timeToSyncExperimentOptions)
+	bindSelectorChurnExperimentOptions(fs, defaults.selectorChurnExperimentOptions)
+	bindFinalizersExperimentOptions(fs, defaults.finalizersExperimentOptions)
+	bindFlowSchemasExperimentOptions(fs, defaults.flowSchemasExperimentOptions)
+	bindStreamingExperimentOptions(fs, defaults.streamingExperimentOptions)
 	return defaults
 }
 
 type experiment string
 
 const (
-	latentWatchExperiment experiment = "latent-watch"
+	latentWatchExperiment      experiment = "latent-watch"
+	auditImpactExperiment      experiment = "audit-impact"
+	selfTestExperiment         experiment = "self-test"
+	rollingRestartExperiment   experiment = "rolling-restart"
+	watchMixExperiment         experiment = "watch-mix"
+	idleStepsExperiment        experiment = "idle-steps"
+	rebalanceExperiment        experiment = "rebalance"
+	rvMatchExperiment          experiment = "rv-match"
+	deleteCollectionExperiment experiment = "delete-collection"
+	etcdLeaderExperiment       experiment = "etcd-leader"
+	coldStartExperiment        experiment = "cold-start"
+	ssaConflictsExperiment     experiment = "ssa-conflicts"
+	aggregatedAPIExperiment    experiment = "aggregated-api"
+	soakExperiment             experiment = "soak"
+	continueExpiryExperiment   experiment = "continue-expiry"
+	timeToSyncExperiment       experiment = "time-to-sync"
+	selectorChurnExperiment    experiment = "selector-churn"
+	finalizersExperiment       experiment = "finalizers"
+	flowSchemasExperiment      experiment = "flow-schemas"
+	streamingExperiment        experiment = "streaming"
 )
 
-type latentWatchExperimentOptions struct {
-	count int
-	rate  int
-}
-
-func defaultLatentWatchExperimentOptions() *latentWatchExperimentOptions {
-	return &latentWatchExperimentOptions{
-		count: 10000,
-		rate:  100,
-	}
-}
-
-func bindLatentWatchExperimentOptions(fs *flag.FlagSet, defaults *latentWatchExperimentOptions) *latentWatchExperimentOptions {
-	prefix := "latent-watch."
-	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start.")
-	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
-	return defaults
-}
-
 func (o *options) validate() error {
-	if o.kubeconfig == "" {
+	if o.kubeconfig == "" && experiment(o.experiment) != selfTestExperiment {
 		return errors.New("--kubeconfig is required")
 	}
 	if o.outputDir == "" {
 		return errors.New("--output is required")
 	}
+	for flag, interval := range map[string]time.Duration{
+		"summary-interval":        o.summaryInterval,
+		"summary-rotate-interval": o.summaryRotateInterval,
+		"open-watches-interval":   o.openWatchesInterval,
+		"backlog-interval":        o.backlogInterval,
+		"goroutines-interval":     o.goroutinesInterval,
+		"client-usage-interval":   o.clientUsageInterval,
+		"pod-health-interval":     o.podHealthInterval,
+	} {
+		if interval <= 0 {
+			return fmt.Errorf("--%s must be positive", flag)
+		}
+	}
+	if size, err := resource.ParseQuantity(o.summaryRotateSize); err != nil {
+		return fmt.Errorf("--summary-rotate-size invalid: %w", err)
+	} else if size.Sign() <= 0 {
+		return errors.New("--summary-rotate-size must be positive")
+	}
+	if !sets.New(usageSources...).Has(o.usageSource) {
+		return fmt.Errorf("unrecognized --usage-source %s, must be one of %v", o.usageSource, usageSources)
+	}
+	if o.cadvisorInterval < 0 {
+		return errors.New("--cadvisor-interval must not be negative")
+	}
+	if o.apiserverMetricsInterval < 0 {
+		return errors.New("--apiserver-metrics-interval must not be negative")
+	}
+	if o.etcdIdleWindow < 0 {
+		return errors.New("--etcd-idle-window must not be negative")
+	}
+	if o.apfDumpInterval < 0 {
+		return errors.New("--apf-dump-interval must not be negative")
+	}
+	if err := o.nodeCollectorOptions.validate(); err != nil {
+		return err
+	}
+	if err := o.guardrailOptions.validate(); err != nil {
+		return err
+	}
+	if err := o.diskBudgetOptions.validate(); err != nil {
+		return err
+	}
+	if err := o.noiseOptions.validate(); err != nil {
+		return err
+	}
+	if err := o.etcdMetricsOptions.validate(); err != nil {
+		return err
+	}
+	if err := o.etcdKeyspaceOptions.validate(); err != nil {
+		return err
+	}
+	if err := o.profileOptions.validate(); err != nil {
+		return err
+	}
+	if err := o.generatorCPUOptions.validate(); err != nil {
+		return err
+	}
+	if !namingSchemes.Has(o.naming) {
+		return fmt.Errorf("unrecognized --naming %s, must be one of %v", o.naming, sets.List(namingSchemes))
+	}
 	if o.experiment == "" {
 		return errors.New("--experiment is required")
 	} else {
-		experiments := sets.New[experiment](latentWatchExperiment)
+		experiments := sets.New[experiment](latentWatchExperiment, auditImpactExperiment, selfTestExperiment, rollingRestartExperiment, watchMixExperiment, idleStepsExperiment, rebalanceExperiment, rvMatchExperiment, deleteCollectionExperiment, etcdLeaderExperiment, coldStartExperiment, ssaConflictsExperiment, aggregatedAPIExperiment, soakExperiment, continueExpiryExperiment, timeToSyncExperiment, selectorChurnExperiment, finalizersExperiment, flowSchemasExperiment, streamingExperiment)
 		if !experiments.Has(experiment(o.experiment)) {
 			return fmt.Errorf("unrecognized --experiment %s, must be one of %v", o.experiment, experiments.UnsortedList())
 		}
 	}
+	switch experiment(o.experiment) {
+	case latentWatchExperiment:
+		return o.latentWatchExperimentOptions.validate()
+	case auditImpactExperiment:
+		return o.auditImpactExperimentOptions.validate()
+	case rollingRestartExperiment:
+		return o.rollingRestartExperimentOptions.validate()
+	case watchMixExperiment:
+		return o.watchMixExperimentOptions.validate()
+	case idleStepsExperiment:
+		return o.idleStepsExperimentOptions.validate()
+	case rebalanceExperiment:
+		return o.rebalanceExperimentOptions.validate()
+	case rvMatchExperiment:
+		return o.rvMatchExperimentOptions.validate()
+	case deleteCollectionExperiment:
+		return o.deleteCollectionExperimentOptions.validate()
+	case etcdLeaderExperiment:
+		return o.etcdLeaderExperimentOptions.validate()
+	case coldStartExperiment:
+		return o.coldStartExperimentOptions.validate()
+	case ssaConflictsExperiment:
+		return o.ssaConflictsExperimentOptions.validate()
+	case aggregatedAPIExperiment:
+		return o.aggregatedAPIExperimentOptions.validate()
+	case soakExperiment:
+		return o.soakExperimentOptions.validate()
+	case continueExpiryExperiment:
+		return o.continueExpiryExperimentOptions.validate()
+	case timeToSyncExperiment:
+		return o.timeToSyncExperimentOptions.validate()
+	case selectorChurnExperiment:
+		return o.selectorChurnExperimentOptions.validate()
+	case finalizersExperiment:
+		return o.finalizersExperimentOptions.validate()
+	case flowSchemasExperiment:
+		return o.flowSchemasExperimentOptions.validate()
+	case streamingExperiment:
+		return o.streamingExperimentOptions.validate()
+	}
 	return nil
 }
 
+func (o *options) summaryRotation() rotation {
+	size := resource.MustParse(o.summaryRotateSize)
+	return rotation{size: size.Value(), interval: o.summaryRotateInterval}
+}
+
+func (o *options) metadata() map[string]string {
+	metadata := map[string]string{}
+	if o.naming != sequentialNaming {
+		metadata[namingMetadataKey] = o.naming
+	}
+	if o.noiseOptions.rate > 0 {
+		metadata[noiseMetadataKey] = fmt.Sprintf("%dHz", o.noiseOptions.rate)
+	}
+	if collectors := o.nodeCollectorOptions.metadata(); collectors != "" {
+		metadata[nodeCollectorMetadataKey] = collectors
+	}
+	switch experiment(o.experiment) {
+	case auditImpactExperiment:
+		metadata[auditLoggingMetadataKey] = o.auditImpactExperimentOptions.auditLogging
+	case latentWatchExperiment:
+		if o.latentWatchExperimentOptions.burst > 0 {
+			metadata[burstMetadataKey] = fmt.Sprintf("%d every %s", o.latentWatchExperimentOptions.burst, o.latentWatchExperimentOptions.burstInterval)
+		}
+	case rebalanceExperiment:
+		metadata[disruptionMetadataKey] = o.rebalanceExperimentOptions.disruption
+	}
+	return metadata
+}
+
 func main() {
 	opts := defaultOptions()
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	opts = bindOptions(fs, opts)
-	if err := fs.Parse(os.Args[1:]); err != nil {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == compareCommand {
+		if err := runComparison(args[1:]); err != nil {
+			logrus.WithError(err).Fatal("could not run comparison")
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == annotateCommand {
+		if err := annotateRun(args[1:]); err != nil {
+			logrus.WithError(err).Fatal("could not annotate run")
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == reproduceCommand {
+		var err error
+		if args, err = reproduceArguments(args[1:]); err != nil {
+			logrus.WithError(err).Fatal("could not reproduce run")
+		}
+	}
+	if err := fs.Parse(args); err != nil {
 		logrus.WithError(err).Fatal("failed to parse arguments")
 	}
+	if opts.selfTestOptions.serve {
+		if err := serveSelfTest(); err != nil {
+			logrus.WithError(err).Fatal("could not serve self-test")
+		}
+	}
 	if err := opts.validate(); err != nil {
 		logrus.WithError(err).Fatal("invalid options")
 	}
+	if opts.seed == 0 {
+		// record the seed, so that the run can be reproduced
+		if err := fs.Set("seed", strconv.FormatInt(rand.Int63(), 10)); err != nil {
+			logrus.WithError(err).Fatal("could not choose seed")
+		}
+	}
+	objectNames = newNamingScheme(opts.naming, opts.seed)
+	generatorCPUs, err := configureGeneratorCPUs(opts.generatorCPUOptions)
+	if err != nil {
+		logrus.WithError(err).Fatal("could not configure generator CPUs")
+	}
+
+	if err := os.RemoveAll(opts.outputDir); err != nil {
+		logrus.WithError(err).Fatal("could not clear output dir")
+	}
+	if err := os.MkdirAll(opts.outputDir, 0777); err != nil {
+		logrus.WithError(err).Fatal("could not create output dir")
+	}
+
+	if experiment(opts.experiment) == selfTestExperiment {
+		if err := runSelfTest(context.Background(), opts.outputDir, opts.selfTestOptions); err != nil {
+			logrus.WithError(err).Fatal("could not run self-test")
+		}
+		return
+	}
 
 	loader := clientcmd.NewDefaultClientConfigLoadingRules()
 	loader.ExplicitPath = opts.kubeconfig
@@ -112,22 +443,35 @@ func main() {
 	if err != nil {
 		logrus.WithError(err).Fatal("could not load kubeconfig")
 	}
-	clientConfig, err := clientcmd.NewDefaultClientConfig(*apiConfig, &clientcmd.ConfigOverrides{}).ClientConfig()
+	clientConfig, err := clientcmd.NewDefaultClientConfig(*apiConfig, &clientcmd.ConfigOverrides{CurrentContext: opts.context}).ClientConfig()
 	if err != nil {
 		logrus.WithError(err).Fatal("could not load client configuration")
 	}
 	clientConfig.QPS = -1
-
 	client, err := kubernetes.NewForConfig(clientConfig)
 	if err != nil {
 		logrus.WithError(err).Fatal("could not load create client")
 	}
+	requests := newRequestCounter()
+	workloadConfig := rest.CopyConfig(clientConfig)
+	requests.instrument(workloadConfig)
+	workloadClient, err := kubernetes.NewForConfig(workloadConfig)
+	if err != nil {
+		logrus.WithError(err).Fatal("could not load create client")
+	}
 
-	if err := os.RemoveAll(opts.outputDir); err != nil {
-		logrus.WithError(err).Fatal("could not clear output dir")
+	manifest := &artifacts.Manifest{
+		Experiment: opts.experiment,
+		Start:      time.Now(),
+		Metadata:   opts.metadata(),
+		Notes:      opts.notes,
 	}
-	if err := os.MkdirAll(opts.outputDir, 0777); err != nil {
-		logrus.WithError(err).Fatal("could not create output dir")
+	for key, value := range generatorCPUs {
+		manifest.Metadata[key] = value
+	}
+	manifest.Configuration, manifest.Reproduce = configurationOf(fs)
+	if err := artifacts.Write(opts.outputDir, artifacts.ManifestFile, manifest); err != nil {
+		logrus.WithError(err).Fatal("could not record run manifest")
 	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
@@ -154,6 +498,11 @@ func main() {
 		logrus.WithError(err).Fatalf("did not find API server ready, last response to /healthz: %s", lastHealthContent)
 	}
 
+	if err := checkGuardrails(ctx, client, clientConfig, opts.apiserverSelector, opts.plannedObjects(), opts.guardrailOptions); err != nil {
+		logrus.WithError(err).Fatal("refusing to run experiment")
+	}
+	apiserverScrapes.setup(client, clientConfig, opts.apiserverSelector)
+
 	selectors := map[string]labels.Selector{}
 	parts := strings.Split(opts.podSelectors, "|")
 	for _, part := range parts {
@@ -174,17 +523,261 @@ func main() {
 		logrus.WithError(err).Fatal("could not record pod info")
 	}
 
-	if err := setupContainerMetricsMonitors(ctx, client, nodes, opts.outputDir); err != nil {
+	guardDiskBudget(ctx, opts.outputDir, opts.diskBudgetOptions)
+	fetchSummary, usageSource, err := chooseUsageSource(ctx, client, nodes, selectors, opts.usageSource)
+	if err != nil {
+		logrus.WithError(err).Fatal("could not determine where to read usage from")
+	}
+	cadvisorInterval := opts.cadvisorInterval
+	if usageSource != summaryUsageSource {
+		manifest.Metadata[usageSourceMetadataKey] = usageSource
+		if err := artifacts.Write(opts.outputDir, artifacts.ManifestFile, manifest); err != nil {
+			logrus.WithError(err).Fatal("could not record run manifest")
+		}
+		if opts.usageSource == autoUsageSource && cadvisorInterval > 0 {
+			// cAdvisor is served through the node proxy as well
+			logrus.Warn("Not recording cAdvisor metrics, as the node proxy is forbidden")
+			cadvisorInterval = 0
+		}
+	}
+	if usageSource == resourceMetricsUsageSource {
+		if err := setupResourceMetricsMonitors(ctx, client, nodes, opts.outputDir, opts.summaryInterval); err != nil {
+			logrus.WithError(err).Fatal("could not monitor kubelet resource metrics")
+		}
+	} else if err := setupContainerMetricsMonitors(ctx, fetchSummary, nodes, opts.outputDir, opts.summaryInterval, opts.summaryRotation(), opts.dedupeSummaries); err != nil {
 		logrus.WithError(err).Fatal("could not monitor container metrics")
 	}
+	if err := setupCAdvisorMonitors(ctx, client, nodes, selectors, opts.outputDir, cadvisorInterval); err != nil {
+		logrus.WithError(err).Fatal("could not monitor cAdvisor metrics")
+	}
+	if err := setupAPIServerMetricsMonitors(ctx, opts.outputDir, opts.apiserverMetricsInterval); err != nil {
+		logrus.WithError(err).Fatal("could not monitor API server metrics")
+	}
+	if err := setupAPFDumpMonitors(ctx, client, clientConfig, opts.apiserverSelector, opts.outputDir, opts.apfDumpInterval); err != nil {
+		logrus.WithError(err).Fatal("could not dump API Priority and Fairness state")
+	}
+	if err := setupEtcdMetricsMonitors(ctx, client, clientConfig, opts.outputDir, opts.etcdMetricsOptions); err != nil {
+		logrus.WithError(err).Fatal("could not monitor etcd metrics")
+	}
+	etcdKeyspace.setup(client, clientConfig, opts.etcdKeyspaceOptions)
+	if err := setupProfileMonitors(ctx, client, clientConfig, opts.apiserverSelector, opts.outputDir, opts.profileOptions); err != nil {
+		logrus.WithError(err).Fatal("could not profile API servers")
+	}
+	stopPodLogs, err := setupPodLogCollectors(ctx, client, selectors, opts.outputDir, opts.podLogs)
+	if err != nil {
+		logrus.WithError(err).Fatal("could not collect pod logs")
+	}
+	stopNodeCollector, err := deployNodeCollector(ctx, client, nodes, selectors, opts.outputDir, opts.nodeCollectorOptions)
+	if err != nil {
+		logrus.WithError(err).Fatal("could not deploy node collector")
+	}
 
+	var etcdIdle *etcdCounts
+	if opts.etcdIdleWindow > 0 {
+		if etcdIdle, err = scrapeEtcdRequests(ctx); err == nil {
+			logrus.Infof("Counting requests to etcd for %s before starting the experiment.", opts.etcdIdleWindow)
+			if err := holdFor(ctx, opts.etcdIdleWindow); err != nil {
+				// interrupted, which the experiment will see as well
+				etcdIdle = nil
+			}
+		}
+	}
+	etcdBefore, etcdErr := scrapeEtcdRequests(ctx)
+	if etcdErr != nil {
+		logrus.WithError(etcdErr).Warn("could not count requests to etcd, amplification will not be recorded")
+	}
+	clientBefore := requests.snapshot()
+
+	experimentCtx, abort := context.WithCancel(ctx)
+	defer abort()
+	availability := monitorAvailability(ctx, client, opts.unavailableWindow, abort)
+	gauge := monitorOpenWatches(ctx, opts.openWatchesInterval)
+	backlog := monitorBacklog(ctx, opts.backlogInterval)
+	goroutines := monitorGoroutines(ctx, opts.goroutinesInterval)
+	clientUsage := monitorClientUsage(ctx, opts.clientUsageInterval)
+	podHealth.monitor(ctx, client, selectors, nodes, opts.podHealthInterval)
+	// the collectors deployed to the cluster outlive the benchmark unless stopped, so a run which cannot start is
+	// recorded as invalid once they are, rather than exiting where it failed
+	stopNoise := func() {}
+	abandon := func(reason string, err error) {
+		stopNoise()
+		stopNodeCollector()
+		stopPodLogs()
+		end := time.Now()
+		manifest.End = &end
+		manifest.Invalid = &artifacts.Invalidation{Reason: reason, Evidence: []string{err.Error()}}
+		if err := artifacts.Write(opts.outputDir, artifacts.ManifestFile, manifest); err != nil {
+			logrus.WithError(err).Error("could not record run manifest")
+		}
+		logrus.WithError(err).Fatal(reason)
+	}
+	if opts.startBarrier {
+		if err := waitAtStartBarrier(); err != nil {
+			abandon("could not start experiment", err)
+		}
+	}
+	if stopNoise, err = startNoise(ctx, client, opts.seed, opts.outputDir, opts.noiseOptions); err != nil {
+		abandon("could not start background requests", err)
+	}
+	etcdKeyspace.take(ctx, heapMilestoneStart)
+	heapSnapshots.take(heapMilestoneStart)
+	err = runExperiment(experimentCtx, workloadClient, workloadConfig, opts)
+	heapSnapshots.take(heapMilestoneEnd)
+	etcdKeyspace.take(ctx, heapMilestoneEnd)
+	stopNoise()
+	stopNodeCollector()
+	stopPodLogs()
+	if err := gauge.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record open watches")
+	}
+	if err := backlog.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record watch backlog")
+	}
+	if err := goroutines.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record API server goroutines")
+	}
+	if err := podHealth.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record health of monitored pods")
+	}
+	if err := collectionErrors.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record collection errors")
+	}
+	if err := clientUsage.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record resources the benchmark used")
+	}
+	if err := timeline.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record timeline")
+	}
+	if err := heapSnapshots.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record heap snapshots")
+	}
+	if err := etcdKeyspace.write(opts.outputDir); err != nil {
+		logrus.WithError(err).Error("could not record etcd keyspace snapshots")
+	}
+	clientAfter := requests.snapshot()
+	var etcdAfter *etcdCounts
+	if etcdErr == nil {
+		if etcdAfter, etcdErr = scrapeEtcdRequests(ctx); etcdErr != nil {
+			logrus.WithError(etcdErr).Warn("could not count requests to etcd, amplification will not be recorded")
+		}
+	}
+	if err := recordRequests(opts.outputDir, clientBefore, clientAfter, etcdIdle, etcdBefore, etcdAfter); err != nil {
+		logrus.WithError(err).Error("could not record request counts")
+	}
+	if invalidation := availability.aborted(); invalidation != nil {
+		end := time.Now()
+		manifest.End = &end
+		manifest.Invalid = invalidation
+		if err := artifacts.Write(opts.outputDir, artifacts.ManifestFile, manifest); err != nil {
+			logrus.WithError(err).Error("could not record run manifest")
+		}
+		logrus.WithField("evidence", invalidation.Evidence).Errorf("aborted benchmark: %s", invalidation.Reason)
+		os.Exit(exitCodeUnavailable)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("could not run benchmark")
+	}
+
+	end := time.Now()
+	if problems := validateArtifacts(opts.outputDir, experiment(opts.experiment)); len(problems) > 0 {
+		manifest.End = &end
+		manifest.Invalid = &artifacts.Invalidation{Reason: "experiment did not record what it measured", Evidence: problems}
+		if err := artifacts.Write(opts.outputDir, artifacts.ManifestFile, manifest); err != nil {
+			logrus.WithError(err).Error("could not record run manifest")
+		}
+		for _, problem := range problems {
+			logrus.Error(problem)
+		}
+		logrus.Errorf("aborted benchmark: %s", manifest.Invalid.Reason)
+		os.Exit(exitCodeMissingArtifacts)
+	}
+	manifest.End = &end
+	if err := artifacts.Write(opts.outputDir, artifacts.ManifestFile, manifest); err != nil {
+		logrus.WithError(err).Fatal("could not record run manifest")
+	}
+	logrus.Info("Finished benchmark.")
+}
+
+func runExperiment(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, opts *options) error {
 	switch experiment(opts.experiment) {
 	case latentWatchExperiment:
 		if err := runLatentWatchExperiment(ctx, client, opts.outputDir, opts.latentWatchExperimentOptions); err != nil {
-			logrus.WithError(err).Fatal("could not run latent watch benchmark")
+			return fmt.Errorf("could not run latent watch benchmark: %w", err)
+		}
+	case auditImpactExperiment:
+		if err := runAuditImpactExperiment(ctx, client, opts.outputDir, opts.auditImpactExperimentOptions); err != nil {
+			return fmt.Errorf("could not run audit impact benchmark: %w", err)
+		}
+	case rollingRestartExperiment:
+		if err := runRollingRestartExperiment(ctx, client, config, opts.outputDir, opts.rollingRestartExperimentOptions); err != nil {
+			return fmt.Errorf("could not run rolling restart benchmark: %w", err)
+		}
+	case watchMixExperiment:
+		if err := runWatchMixExperiment(ctx, client, opts.outputDir, opts.watchMixExperimentOptions); err != nil {
+			return fmt.Errorf("could not run watch mix benchmark: %w", err)
+		}
+	case idleStepsExperiment:
+		if err := runIdleStepsExperiment(ctx, client, opts.outputDir, opts.idleStepsExperimentOptions); err != nil {
+			return fmt.Errorf("could not run idle steps benchmark: %w", err)
+		}
+	case rebalanceExperiment:
+		if err := runRebalanceExperiment(ctx, client, opts.apiserverSelector, opts.outputDir, opts.rebalanceExperimentOptions); err != nil {
+			return fmt.Errorf("could not run rebalance benchmark: %w", err)
+		}
+	case rvMatchExperiment:
+		if err := runRVMatchExperiment(ctx, client, opts.outputDir, opts.rvMatchExperimentOptions); err != nil {
+			return fmt.Errorf("could not run resourceVersionMatch benchmark: %w", err)
+		}
+	case deleteCollectionExperiment:
+		if err := runDeleteCollectionExperiment(ctx, client, opts.outputDir, opts.deleteCollectionExperimentOptions); err != nil {
+			return fmt.Errorf("could not run DeleteCollection benchmark: %w", err)
+		}
+	case etcdLeaderExperiment:
+		if err := runEtcdLeaderExperiment(ctx, client, config, opts.outputDir, opts.etcdLeaderExperimentOptions); err != nil {
+			return fmt.Errorf("could not run etcd leader election benchmark: %w", err)
+		}
+	case coldStartExperiment:
+		if err := runColdStartExperiment(ctx, client, opts.outputDir, opts.coldStartExperimentOptions); err != nil {
+			return fmt.Errorf("could not run cold start benchmark: %w", err)
+		}
+	case ssaConflictsExperiment:
+		if err := runSSAConflictsExperiment(ctx, client, opts.outputDir, opts.ssaConflictsExperimentOptions); err != nil {
+			return fmt.Errorf("could not run server-side apply conflicts benchmark: %w", err)
+		}
+	case aggregatedAPIExperiment:
+		if err := runAggregatedAPIExperiment(ctx, client, opts.outputDir, opts.aggregatedAPIExperimentOptions); err != nil {
+			return fmt.Errorf("could not run aggregated API benchmark: %w", err)
+		}
+	case soakExperiment:
+		if err := runSoakExperiment(ctx, client, opts.outputDir, opts.soakExperimentOptions); err != nil {
+			return fmt.Errorf("could not run soak benchmark: %w", err)
+		}
+	case continueExpiryExperiment:
+		if err := runContinueExpiryExperiment(ctx, client, opts.outputDir, opts.continueExpiryExperimentOptions); err != nil {
+			return fmt.Errorf("could not run continue token expiry benchmark: %w", err)
+		}
+	case timeToSyncExperiment:
+		if err := runTimeToSyncExperiment(ctx, client, opts.outputDir, opts.timeToSyncExperimentOptions); err != nil {
+			return fmt.Errorf("could not run time to sync benchmark: %w", err)
+		}
+	case selectorChurnExperiment:
+		if err := runSelectorChurnExperiment(ctx, client, opts.outputDir, opts.selectorChurnExperimentOptions); err != nil {
+			return fmt.Errorf("could not run selector churn benchmark: %w", err)
+		}
+	case finalizersExperiment:
+		if err := runFinalizersExperiment(ctx, client, opts.outputDir, opts.finalizersExperimentOptions); err != nil {
+			return fmt.Errorf("could not run finalizer benchmark: %w", err)
+		}
+	case flowSchemasExperiment:
+		if err := runFlowSchemasExperiment(ctx, client, config, opts.outputDir, opts.flowSchemasExperimentOptions); err != nil {
+			return fmt.Errorf("could not run FlowSchema benchmark: %w", err)
+		}
+	case streamingExperiment:
+		if err := runStreamingExperiment(ctx, client, config, opts.outputDir, opts.streamingExperimentOptions); err != nil {
+			return fmt.Errorf("could not run streaming benchmark: %w", err)
 		}
 	}
-	logrus.Info("Finished benchmark.")
+	return nil
 }
 
 func recordPodInfo(ctx context.Context, client *kubernetes.Clientset, outputDir string, selectors map[string]labels.Selector) ([]string, error) {
@@ -196,6 +789,10 @@ func recordPodInfo(ctx context.Context, client *kubernetes.Clientset, outputDir
 		if err != nil {
 			return nil, fmt.Errorf("could not list %s pods: %w", identifier, err)
 		}
+		if len(pods.Items) == 0 {
+			// managed control planes often hide some components, which should not prevent monitoring the others
+			logrus.Warnf("no %s pods match %s, they will not be monitored", identifier, selector.String())
+		}
 		var names []types.NamespacedName
 		for _, pod := range pods.Items {
 			names = append(names, types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
@@ -208,7 +805,7 @@ func recordPodInfo(ctx context.Context, client *kubernetes.Clientset, outputDir
 	if err != nil {
 		return nil, fmt.Errorf("could not marshal pod info: %w", err)
 	}
-	if err := os.WriteFile(filepath.Join(outputDir, "podInfo.json"), raw, 0777); err != nil {
+	if err := os.WriteFile(filepath.Join(outputDir, artifacts.PodInfoFile), raw, 0777); err != nil {
 		return nil, fmt.Errorf("could not write pod info: %w", err)
 	}
 	fields := logrus.Fields{}
@@ -218,87 +815,3 @@ func recordPodInfo(ctx context.Context, client *kubernetes.Clientset, outputDir
 	logrus.WithFields(fields).Info("found control plane pods")
 	return nodes.UnsortedList(), nil
 }
-
-func setupContainerMetricsMonitors(ctx context.Context, client *kubernetes.Clientset, nodes []string, outputDir string) error {
-	logrus.Info("Setting up container metrics monitoring")
-	for _, node := range nodes {
-		nodeDir := filepath.Join(outputDir, "metrics", node)
-		if err := os.MkdirAll(nodeDir, 0777); err != nil {
-			return fmt.Errorf("could not create output dir for node %s: %w", node, err)
-		}
-		go monitorContainerMetrics(ctx, client.RESTClient(), node, nodeDir)
-	}
-
-	return nil
-}
-
-func monitorContainerMetrics(ctx context.Context, client rest.Interface, nodeName, outputDir string) {
-	logrus.Info("Setting up container metrics monitoring for node %s", nodeName)
-	index := 0
-	if err := wait.PollUntilContextCancel(ctx, 500*time.Millisecond, true, func(ctx context.Context) (done bool, err error) {
-		go func(index int) {
-			result := client.Get().AbsPath("/api/v1/nodes/" + nodeName + "/proxy/stats/summary").Do(ctx)
-			raw, err := result.Raw()
-			if err != nil {
-				logrus.WithError(err).Errorf("failed to fetch container metrics")
-			}
-			if err := os.WriteFile(filepath.Join(outputDir, strconv.Itoa(index)+".json"), raw, 0777); err != nil {
-				logrus.WithError(err).Errorf("failed to record container metrics")
-			}
-		}(index)
-		index++
-		return false, nil
-	}); err != nil {
-		logrus.WithError(err).Errorf("failed to monitor container metrics")
-	}
-}
-
-func runLatentWatchExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *latentWatchExperimentOptions) error {
-	logrus.Info("Running latent watch experiment")
-	var issued int
-	watchers := make(chan watch.Interface, opts.count)
-	timeChan := make(chan time.Time)
-	var timestamps []time.Time
-	go func() {
-		for t := range timeChan {
-			timestamps = append(timestamps, t)
-		}
-	}()
-
-	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
-	defer ticker.Stop()
-	func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				go func() {
-					watcher, err := client.CoreV1().ConfigMaps(strconv.Itoa(issued)).Watch(ctx, metav1.ListOptions{})
-					if err != nil {
-						logrus.WithError(err).Error("failed to start watch")
-					}
-					timeChan <- time.Now()
-					watchers <- watcher
-				}()
-				issued++
-			}
-			if issued%(opts.count/10) == 0 {
-				logrus.Infof("issued %d/%d (%.0f%%) watches", issued, opts.count, 100*(float64(issued)/float64(opts.count)))
-			}
-			if issued == opts.count {
-				return
-			}
-		}
-	}()
-	raw, err := json.Marshal(timestamps)
-	if err != nil {
-		return fmt.Errorf("failed to encode latent watch timing: %w", err)
-	}
-	if err := os.WriteFile(filepath.Join(outputDir, "latent-watch.json"), raw, 0666); err != nil {
-		return fmt.Errorf("failed to record latent watch timing: %w", err)
-	}
-
-	logrus.Info("Finished latent watch experiment")
-	return nil
-}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+)
+
+// usageSourceMetadataKey records where the usage of the monitored pods was read from, when not the kubelet.
+const usageSourceMetadataKey = "usage-source"
+
+const (
+	// summaryUsageSource reads the stats summary of the kubelet through the node proxy.
+	summaryUsageSource = "summary"
+	// metricsServerUsageSource reads the metrics API, for clusters which do not allow the node proxy, like many
+	// managed offerings. The metrics server only refreshes its samples every fifteen seconds or so.
+	metricsServerUsageSource = "metrics-server"
+	// autoUsageSource reads the stats summary, falling back to the metrics API when the node proxy is forbidden.
+	autoUsageSource = "auto"
+)
+
+var usageSources = []string{autoUsageSource, summaryUsageSource, metricsServerUsageSource, resourceMetricsUsageSource}
+
+// chooseUsageSource determines where to read the usage of the monitored pods from, trying the node proxy on the
+// first node if need be. Resource metrics are not read as summaries, so no fetcher is returned for them.
+func chooseUsageSource(ctx context.Context, client *kubernetes.Clientset, nodes []string, selectors map[string]labels.Selector, source string) (summaryFetcher, string, error) {
+	if source == autoUsageSource {
+		source = summaryUsageSource
+		if len(nodes) > 0 {
+			if _, err := kubeletSummaries(client.RESTClient())(ctx, nodes[0]); apierrors.IsForbidden(err) {
+				logrus.WithError(err).Warn("The node proxy is forbidden, reading usage from the metrics server instead")
+				source = metricsServerUsageSource
+			}
+		}
+	}
+	switch source {
+	case summaryUsageSource:
+		return kubeletSummaries(client.RESTClient()), source, nil
+	case resourceMetricsUsageSource:
+		return nil, source, nil
+	}
+	fetch, err := metricsServerSummaries(ctx, client, selectors)
+	return fetch, source, err
+}
+
+// resourceMetrics is what the metrics API reports for a node, or for a pod with the usage of its containers.
+type resourceMetrics struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Timestamp         metav1.Time         `json:"timestamp"`
+	Window            metav1.Duration     `json:"window"`
+	Usage             corev1.ResourceList `json:"usage"`
+	Containers        []struct {
+		Name  string              `json:"name"`
+		Usage corev1.ResourceList `json:"usage"`
+	} `json:"containers"`
+}
+
+// metricsServerSummaries assembles summaries for every node from the metrics API, with the node and the monitored
+// pods on it. The API reports the rate at which CPU is used over a window, not how much was used, so the rate is
+// integrated over the samples to the cumulative usage the summary reports; the first sample of every pod starts
+// at zero.
+func metricsServerSummaries(ctx context.Context, client *kubernetes.Clientset, selectors map[string]labels.Selector) (summaryFetcher, error) {
+	podsByNode := map[string][]types.NamespacedName{}
+	for identifier, selector := range selectors {
+		pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, fmt.Errorf("could not list %s pods: %w", identifier, err)
+		}
+		for _, pod := range pods.Items {
+			podsByNode[pod.Spec.NodeName] = append(podsByNode[pod.Spec.NodeName], types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+		}
+	}
+
+	integrator := &cpuIntegrator{usage: map[string]*integratedCPU{}}
+	get := func(ctx context.Context, path string) (*resourceMetrics, error) {
+		raw, err := client.RESTClient().Get().AbsPath(path).DoRaw(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var metrics resourceMetrics
+		if err := json.Unmarshal(raw, &metrics); err != nil {
+			return nil, fmt.Errorf("could not unmarshal %s: %w", path, err)
+		}
+		return &metrics, nil
+	}
+	return func(ctx context.Context, node string) ([]byte, error) {
+		nodeMetrics, err := get(ctx, "/apis/metrics.k8s.io/v1beta1/nodes/"+node)
+		if err != nil {
+			return nil, err
+		}
+		summary := statsv1alpha1.Summary{Node: statsv1alpha1.NodeStats{
+			NodeName: node,
+			CPU:      integrator.cpu("node/"+node, nodeMetrics.Timestamp, nodeMetrics.Usage),
+			Memory:   memoryOf(nodeMetrics.Timestamp, nodeMetrics.Usage),
+		}}
+		for _, pod := range podsByNode[node] {
+			podMetrics, err := get(ctx, "/apis/metrics.k8s.io/v1beta1/namespaces/"+pod.Namespace+"/pods/"+pod.Name)
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					// the metrics server has not sampled the pod yet
+					continue
+				}
+				return nil, err
+			}
+			usage := corev1.ResourceList{}
+			var containers []statsv1alpha1.ContainerStats
+			for _, container := range podMetrics.Containers {
+				for name, quantity := range container.Usage {
+					total := usage[name]
+					total.Add(quantity)
+					usage[name] = total
+				}
+				containers = append(containers, statsv1alpha1.ContainerStats{
+					Name:   container.Name,
+					CPU:    integrator.cpu(pod.String()+"/"+container.Name, podMetrics.Timestamp, container.Usage),
+					Memory: memoryOf(podMetrics.Timestamp, container.Usage),
+				})
+			}
+			summary.Pods = append(summary.Pods, statsv1alpha1.PodStats{
+				PodRef:     statsv1alpha1.PodReference{Name: pod.Name, Namespace: pod.Namespace},
+				CPU:        integrator.cpu(pod.String(), podMetrics.Timestamp, usage),
+				Memory:     memoryOf(podMetrics.Timestamp, usage),
+				Containers: containers,
+			})
+		}
+		return json.Marshal(summary)
+	}, nil
+}
+
+type cpuIntegrator struct {
+	lock  sync.Mutex
+	usage map[string]*integratedCPU
+}
+
+type integratedCPU struct {
+	timestamp metav1.Time
+	total     uint64
+}
+
+// cpu accumulates the usage of what is keyed at the rate reported for the timestamp, over the time since the last
+// timestamp it was reported for.
+func (i *cpuIntegrator) cpu(key string, timestamp metav1.Time, usage corev1.ResourceList) *statsv1alpha1.CPUStats {
+	quantity, reported := usage[corev1.ResourceCPU]
+	if !reported {
+		return nil
+	}
+	nanoCores := uint64(quantity.ScaledValue(-9))
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	integrated, seen := i.usage[key]
+	if !seen {
+		integrated = &integratedCPU{timestamp: timestamp}
+		i.usage[key] = integrated
+	}
+	if elapsed := timestamp.Sub(integrated.timestamp.Time); elapsed > 0 {
+		integrated.total += uint64(float64(nanoCores) * elapsed.Seconds())
+		integrated.timestamp = timestamp
+	}
+	total := integrated.total
+	return &statsv1alpha1.CPUStats{Time: timestamp, UsageNanoCores: &nanoCores, UsageCoreNanoSeconds: &total}
+}
+
+func memoryOf(timestamp metav1.Time, usage corev1.ResourceList) *statsv1alpha1.MemoryStats {
+	quantity, reported := usage[corev1.ResourceMemory]
+	if !reported {
+		return nil
+	}
+	workingSet := uint64(quantity.Value())
+	return &statsv1alpha1.MemoryStats{Time: timestamp, WorkingSetBytes: &workingSet}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Names decide where objects land in the etcd keyspace, and so how local range reads over them are. Sequential
+// names are what experiments used at first; hash-prefixed names scatter objects over the keyspace the same way in
+// every run, while random names scatter them differently in every run.
+const (
+	sequentialNaming   = "sequential"
+	hashPrefixedNaming = "hash-prefixed"
+	randomNaming       = "random"
+
+	namingMetadataKey = "naming"
+)
+
+var namingSchemes = sets.New[string](sequentialNaming, hashPrefixedNaming, randomNaming)
+
+// objectNames names the objects and namespaces experiments create and watch. It is set from the options before any
+// experiment runs.
+var objectNames = newNamingScheme(sequentialNaming, 0)
+
+type namingScheme struct {
+	scheme string
+	salt   uint64
+}
+
+// newNamingScheme salts random names with the seed, so that runs with the same seed use the same names.
+func newNamingScheme(scheme string, seed int64) namingScheme {
+	return namingScheme{scheme: scheme, salt: rand.New(rand.NewSource(seed)).Uint64()}
+}
+
+// name determines the name for the object at the index, which is stable through the run so that experiments can
+// address objects by index.
+func (n namingScheme) name(prefix string, index int) string {
+	sequential := strconv.Itoa(index)
+	if prefix != "" {
+		sequential = prefix + "-" + sequential
+	}
+	switch n.scheme {
+	case hashPrefixedNaming:
+		return fmt.Sprintf("%08x-%s", uint32(hashIndex(0, index)), sequential)
+	case randomNaming:
+		if prefix == "" {
+			return fmt.Sprintf("%016x", hashIndex(n.salt, index))
+		}
+		return fmt.Sprintf("%s-%016x", prefix, hashIndex(n.salt, index))
+	default:
+		return sequential
+	}
+}
+
+// object names the ConfigMap at the index.
+func (n namingScheme) object(index int) string {
+	return n.name("object", index)
+}
+
+func hashIndex(salt uint64, index int) uint64 {
+	var data [16]byte
+	binary.LittleEndian.PutUint64(data[:8], salt)
+	binary.LittleEndian.PutUint64(data[8:], uint64(index))
+	hash := fnv.New64a()
+	_, _ = hash.Write(data[:])
+	return hash.Sum64()
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// nodeCollectorOptions configure a DaemonSet which the benchmark deploys onto the control-plane nodes to record
+// what the kubelet does not expose, or not often enough. Every collector is a container printing samples to its
+// log, which the benchmark streams back into the output directory.
+//
+// The logs are followed through the API servers under test, as a long-running pods/log request for every collector
+// on every node which the API servers proxy from the kubelets, with every sample passing through them; the cgroups
+// collector alone sends a line for every monitored pod ten times a second by default. Which collectors ran is
+// recorded with the run, so that runs with and without them are not compared as though the load were the same.
+type nodeCollectorOptions struct {
+	psi            bool
+	cgroups        bool
+	cgroupInterval time.Duration
+	audit          bool
+	auditLogPath   string
+	sockets        bool
+	apiserverPort  int
+	conntrack      bool
+	image          string
+}
+
+func defaultNodeCollectorOptions() *nodeCollectorOptions {
+	return &nodeCollectorOptions{
+		cgroupInterval: 100 * time.Millisecond,
+		auditLogPath:   "/var/log/kubernetes/audit/audit.log",
+		apiserverPort:  6443,
+		image:          "busybox:1.36",
+	}
+}
+
+func bindNodeCollectorOptions(fs *flag.FlagSet, defaults *nodeCollectorOptions) *nodeCollectorOptions {
+	prefix := "node-collector."
+	fs.BoolVar(&defaults.psi, prefix+"psi", defaults.psi, "Record CPU, memory and IO pressure stall information from the control-plane nodes every second.")
+	fs.BoolVar(&defaults.cgroups, prefix+"cgroups", defaults.cgroups, "Record CPU and memory usage of the monitored pods from their cgroups, far more often than the kubelet refreshes its stats. Requires cgroup v2.")
+	fs.DurationVar(&defaults.cgroupInterval, prefix+"cgroup-interval", defaults.cgroupInterval, "Time between samples of cgroup stats.")
+	fs.BoolVar(&defaults.audit, prefix+"audit", defaults.audit, "Record the audit log the API servers write on the control-plane nodes, to attribute the load on them to users, verbs and resources.")
+	fs.StringVar(&defaults.auditLogPath, prefix+"audit-log-path", defaults.auditLogPath, "Path to the audit log on the control-plane nodes, as passed to the API servers with --audit-log-path.")
+	fs.BoolVar(&defaults.sockets, prefix+"sockets", defaults.sockets, "Record the TCP sockets on the control-plane nodes every second, and how many connections to the API server are established.")
+	fs.BoolVar(&defaults.conntrack, prefix+"conntrack", defaults.conntrack, "Record how full the conntrack table on the control-plane nodes is, what it failed to track, and the TCP sockets in every state every second.")
+	fs.IntVar(&defaults.apiserverPort, prefix+"apiserver-port", defaults.apiserverPort, "Port the API servers listen on, to count the connections established to them.")
+	fs.StringVar(&defaults.image, prefix+"image", defaults.image, "Image with a POSIX shell to run the collectors in.")
+	return defaults
+}
+
+// nodeCollectorMetadataKey records which collectors streamed their samples through the API servers.
+const nodeCollectorMetadataKey = "node-collector"
+
+// metadata describes the enabled collectors, or is empty when none are.
+func (o *nodeCollectorOptions) metadata() string {
+	var collectors []string
+	if o.psi {
+		collectors = append(collectors, "psi")
+	}
+	if o.cgroups {
+		collectors = append(collectors, "cgroups every "+o.cgroupInterval.String())
+	}
+	if o.sockets {
+		collectors = append(collectors, "sockets")
+	}
+	if o.conntrack {
+		collectors = append(collectors, "conntrack")
+	}
+	if o.audit {
+		collectors = append(collectors, "audit")
+	}
+	return strings.Join(collectors, ",")
+}
+
+func (o *nodeCollectorOptions) validate() error {
+	if o.cgroups && o.cgroupInterval <= 0 {
+		return errors.New("--node-collector.cgroup-interval must be positive")
+	}
+	if o.sockets && (o.apiserverPort <= 0 || o.apiserverPort > 65535) {
+		return errors.New("--node-collector.apiserver-port must be a valid port")
+	}
+	if o.audit && !filepath.IsAbs(o.auditLogPath) {
+		return errors.New("--node-collector.audit-log-path must be absolute")
+	}
+	return nil
+}
+
+// containers builds a collector for every enabled source. The cgroups collector is given the pods to sample as
+// namespace/name=uid pairs and samples those which run on its node.
+func (o *nodeCollectorOptions) containers(pods []string) []corev1.Container {
+	var containers []corev1.Container
+	if o.psi {
+		// pressure files in /proc are not namespaced, so they describe the whole node
+		containers = append(containers, collectorContainer(o.image, artifacts.PSIFile, `while true; do
+  for resource in cpu memory io; do echo "${resource} $(tr '\n' ' ' < /host/proc/pressure/${resource})"; done
+  sleep 1
+done`))
+	}
+	if o.cgroups {
+		// static pods run under the UID recorded on their mirror pod, and the systemd cgroup driver replaces the
+		// dashes in it with underscores; working set is computed as the kubelet does, without inactive file pages.
+		// The files read only exist in the unified hierarchy, so nodes with cgroup v1 fail the collector with a
+		// termination message, rather than it recording nothing
+		container := collectorContainer(o.image, artifacts.CgroupsFile, `if [ ! -f /host/cgroup/cgroup.controllers ]; then
+  echo "`+cgroupV1Message+`" | tee /dev/termination-log >&2
+  exit 1
+fi
+targets=""
+for pod in ${PODS}; do
+  uid="${pod#*=}"
+  dir="$(find /host/cgroup -maxdepth 5 -type d \( -name "*pod${uid}*" -o -name "*pod$(echo "${uid}" | tr - _)*" \) | head -n 1)"
+  if [ -n "${dir}" ]; then targets="${targets} ${pod%%=*}=${dir}"; fi
+done
+while true; do
+  for target in ${targets}; do
+    dir="${target#*=}"
+    echo "${target%%=*} $(awk '/^usage_usec /{print $2}' "${dir}/cpu.stat") $(cat "${dir}/memory.current") $(awk '/^inactive_file /{print $2}' "${dir}/memory.stat")"
+  done
+  sleep ${INTERVAL}
+done`)
+		container.Env = []corev1.EnvVar{
+			{Name: "PODS", Value: strings.Join(pods, " ")},
+			{Name: "INTERVAL", Value: strconv.FormatFloat(o.cgroupInterval.Seconds(), 'f', -1, 64)},
+		}
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "cgroup", MountPath: "/host/cgroup", ReadOnly: true})
+		containers = append(containers, container)
+	}
+	if o.sockets {
+		// the network files of the first process are those of the node, as /proc/net is those of the collector;
+		// sockets are counted in use and in TIME_WAIT, and connections as those established to the local port
+		container := collectorContainer(o.image, artifacts.SocketsFile, `port="$(printf '%04X' "${PORT}")"
+while true; do
+  tcp="$(awk '/^TCP:/{print $3, $7}' /host/proc/1/net/sockstat)"
+  established="$(awk -v port="${port}" 'FNR > 1 && $4 == "01" && substr($2, index($2, ":") + 1) == port { n++ } END { print n + 0 }' /host/proc/1/net/tcp /host/proc/1/net/tcp6)"
+  echo "${tcp} ${established}"
+  sleep 1
+done`)
+		container.Env = []corev1.EnvVar{{Name: "PORT", Value: strconv.Itoa(o.apiserverPort)}}
+		containers = append(containers, container)
+	}
+	if o.conntrack {
+		// every CPU reports the size of the table and counts of its own, in hexadecimal and in the order of the
+		// header; the limit is global, so it reads the same from any network namespace
+		container := collectorContainer(o.image, artifacts.ConntrackFile, `while true; do
+  entries=0; failed=0; dropped=0; early=0
+  if [ -r /host/proc/1/net/stat/nf_conntrack ]; then
+    while read -r size _ _ _ _ _ _ _ _ insert_failed drop early_drop _; do
+      if [ "${size}" = "entries" ]; then continue; fi
+      entries=$((0x${size})); failed=$((failed + 0x${insert_failed})); dropped=$((dropped + 0x${drop})); early=$((early + 0x${early_drop}))
+    done < /host/proc/1/net/stat/nf_conntrack
+  fi
+  max="$(cat /host/proc/sys/net/netfilter/nf_conntrack_max 2>/dev/null || echo 0)"
+  states="$(awk 'FNR > 1 { n[$4]++ } END { for (i = 1; i <= 11; i++) printf " %d", n[sprintf("%02X", i)] }' /host/proc/1/net/tcp /host/proc/1/net/tcp6)"
+  echo "${entries} ${max} ${failed} ${dropped} ${early}${states}"
+  sleep 1
+done`)
+		containers = append(containers, container)
+	}
+	if o.audit {
+		// the directory is mounted rather than the file so that the log can be followed across rotations
+		container := collectorContainer(o.image, artifacts.AuditLogFile, `tail -n 0 -F "/host/audit/${LOG}"`)
+		container.Env = []corev1.EnvVar{{Name: "LOG", Value: filepath.Base(o.auditLogPath)}}
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "audit", MountPath: "/host/audit", ReadOnly: true})
+		containers = append(containers, container)
+	}
+	return containers
+}
+
+const cgroupV1Message = "the node uses cgroup v1, but --node-collector.cgroups requires cgroup v2"
+
+func (o *nodeCollectorOptions) volumes() []corev1.Volume {
+	volumes := []corev1.Volume{{
+		Name:         "proc",
+		VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/proc"}},
+	}, {
+		Name:         "cgroup",
+		VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/sys/fs/cgroup"}},
+	}}
+	if o.audit {
+		directory := corev1.HostPathDirectory
+		volumes = append(volumes, corev1.Volume{
+			Name:         "audit",
+			VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: filepath.Dir(o.auditLogPath), Type: &directory}},
+		})
+	}
+	return volumes
+}
+
+func collectorContainer(image, file, script string) corev1.Container {
+	return corev1.Container{
+		Name:         collectorName(file),
+		Image:        image,
+		Command:      []string{"/bin/sh", "-c", script},
+		VolumeMounts: []corev1.VolumeMount{{Name: "proc", MountPath: "/host/proc", ReadOnly: true}},
+	}
+}
+
+// collectorName names the container after the file its samples are recorded in.
+func collectorName(file string) string {
+	return file[:len(file)-len(filepath.Ext(file))]
+}
+
+// deployNodeCollector runs the enabled collectors on the nodes and streams what they record into the output
+// directory until the returned function is called, which removes them.
+func deployNodeCollector(ctx context.Context, client *kubernetes.Clientset, nodes []string, selectors map[string]labels.Selector, outputDir string, opts *nodeCollectorOptions) (func(), error) {
+	if !opts.psi && !opts.cgroups && !opts.audit && !opts.sockets && !opts.conntrack {
+		return func() {}, nil
+	}
+	var monitored []string
+	for identifier, selector := range selectors {
+		pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return func() {}, fmt.Errorf("could not list %s pods: %w", identifier, err)
+		}
+		for _, pod := range pods.Items {
+			uid := string(pod.UID)
+			if mirrored, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+				uid = mirrored
+			}
+			monitored = append(monitored, pod.Namespace+"/"+pod.Name+"="+uid)
+		}
+	}
+	containers := opts.containers(monitored)
+	logrus.Info("Deploying node collector")
+	namespace, cleanup, err := createNamespace(ctx, client, "node-collector")
+	if err != nil {
+		return func() {}, err
+	}
+	// reading from the host requires a hostPath volume, which only privileged namespaces may use
+	if _, err := client.CoreV1().Namespaces().Patch(ctx, namespace, types.MergePatchType, []byte(`{"metadata":{"labels":{"pod-security.kubernetes.io/enforce":"privileged"}}}`), metav1.PatchOptions{}); err != nil {
+		cleanup()
+		return func() {}, fmt.Errorf("could not allow privileged pods in %s: %w", namespace, err)
+	}
+
+	labels := map[string]string{benchmarkLabel: "node-collector"}
+	if _, err := client.AppsV1().DaemonSets(namespace).Create(ctx, &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-collector"},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: containers,
+					Volumes:    opts.volumes(),
+					Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+						RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+							NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+								MatchFields: []corev1.NodeSelectorRequirement{{
+									Key:      "metadata.name",
+									Operator: corev1.NodeSelectorOpIn,
+									Values:   nodes,
+								}},
+							}},
+						},
+					}},
+					// control-plane nodes are usually tainted
+					Tolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+				},
+			},
+		},
+	}, metav1.CreateOptions{}); err != nil {
+		cleanup()
+		return func() {}, fmt.Errorf("could not create node collector: %w", err)
+	}
+
+	var pods []corev1.Pod
+	if err := wait.PollUntilContextTimeout(ctx, time.Second, 2*time.Minute, true, func(ctx context.Context) (bool, error) {
+		list, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		pods = pods[:0]
+		for _, pod := range list.Items {
+			if err := collectorFailure(pod); err != nil {
+				return false, err
+			}
+			if pod.Status.Phase == corev1.PodRunning {
+				pods = append(pods, pod)
+			}
+		}
+		return len(pods) == len(nodes), nil
+	}); err != nil {
+		cleanup()
+		return func() {}, fmt.Errorf("node collector did not start on all %d nodes: %w", len(nodes), err)
+	}
+
+	streamCtx, stopStreaming := context.WithCancel(ctx)
+	for _, pod := range pods {
+		for _, container := range containers {
+			go streamCollector(streamCtx, client, pod, container.Name, filepath.Join(outputDir, artifacts.NodeCollectorDir, pod.Spec.NodeName))
+		}
+	}
+	return func() {
+		stopStreaming()
+		cleanup()
+	}, nil
+}
+
+// collectorFailure reports a collector which exited with a termination message, as collectors only write one when
+// they cannot collect on the node at all, and would otherwise restart without recording anything.
+func collectorFailure(pod corev1.Pod) error {
+	for _, status := range pod.Status.ContainerStatuses {
+		for _, terminated := range []*corev1.ContainerStateTerminated{status.State.Terminated, status.LastTerminationState.Terminated} {
+			if terminated != nil && terminated.ExitCode != 0 && terminated.Message != "" {
+				return fmt.Errorf("%s collector failed on node %s: %s", status.Name, pod.Spec.NodeName, strings.TrimSpace(terminated.Message))
+			}
+		}
+	}
+	return nil
+}
+
+// streamCollector copies the log of the collector into its file, with every line prefixed by its timestamp. Streams
+// break when the kubelet rotates the log or the API server serving them restarts, so they are reopened from the last
+// line copied, skipping the lines repeated from the same second, until the context is cancelled.
+func streamCollector(ctx context.Context, client *kubernetes.Clientset, pod corev1.Pod, container, outputDir string) {
+	if err := os.MkdirAll(outputDir, 0777); err != nil {
+		logrus.WithError(err).Errorf("could not create output dir for node %s", pod.Spec.NodeName)
+		return
+	}
+	output, err := os.Create(filepath.Join(outputDir, container+".txt"))
+	if err != nil {
+		logrus.WithError(err).Errorf("could not record %s collector", container)
+		return
+	}
+	defer func() {
+		if err := output.Close(); err != nil {
+			logrus.WithError(err).Errorf("could not record %s collector", container)
+		}
+	}()
+	writer := bufio.NewWriter(&budgetedWriter{collector: nodeCollectorStreams, writer: output})
+	defer func() {
+		if err := writer.Flush(); err != nil && !errors.Is(err, errBudgetStopped) {
+			logrus.WithError(err).Errorf("could not record %s collector", container)
+		}
+	}()
+	var last time.Time
+	for ctx.Err() == nil {
+		if err := followCollector(ctx, client, pod, container, &last, writer); errors.Is(err, errBudgetStopped) {
+			logrus.Debugf("stopped streaming %s collector on node %s for the disk budget", container, pod.Spec.NodeName)
+			return
+		} else if apierrors.IsNotFound(err) {
+			logrus.WithError(err).Errorf("stopped streaming %s collector on node %s", container, pod.Spec.NodeName)
+			return
+		} else if err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Debugf("%s collector stream on node %s broke, reopening", container, pod.Spec.NodeName)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// followCollector copies the complete lines the collector logged after last into the output, advancing last, until
+// the stream ends. A line cut off by the stream breaking is left for the next stream to send again.
+func followCollector(ctx context.Context, client *kubernetes.Clientset, pod corev1.Pod, container string, last *time.Time, output io.Writer) error {
+	options := &corev1.PodLogOptions{
+		Container:  container,
+		Follow:     true,
+		Timestamps: true,
+	}
+	if !last.IsZero() {
+		// the API only takes whole seconds, so lines logged earlier in the same second are sent again
+		since := metav1.NewTime(*last)
+		options.SinceTime = &since
+	}
+	stream, err := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, options).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			logrus.WithError(err).Debug("failed to close collector stream")
+		}
+	}()
+	reader := bufio.NewReader(stream)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.HasSuffix(line, "\n") {
+			prefix, _, _ := strings.Cut(line, " ")
+			stamp, parseErr := time.Parse(time.RFC3339Nano, prefix)
+			if parseErr != nil || stamp.After(*last) {
+				if _, err := io.WriteString(output, line); err != nil {
+					return err
+				}
+				if parseErr == nil {
+					*last = stamp
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
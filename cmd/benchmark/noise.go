@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// noiseOptions configure a noisy neighbour: random reads and writes of resources the experiment does not touch, in
+// a namespace of their own, issued throughout the experiment so that watches are measured under contention from
+// other tenants rather than on an otherwise idle control plane.
+type noiseOptions struct {
+	rate      int
+	resources string
+	verbs     string
+	objects   int
+}
+
+func defaultNoiseOptions() *noiseOptions {
+	return &noiseOptions{
+		resources: "secrets,serviceaccounts",
+		verbs:     "get=4,list=1,create=1,update=2,delete=1",
+		objects:   100,
+	}
+}
+
+func bindNoiseOptions(fs *flag.FlagSet, defaults *noiseOptions) *noiseOptions {
+	prefix := "noise."
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of background requests, in Hertz, or zero to run the experiment without them.")
+	fs.StringVar(&defaults.resources, prefix+"resources", defaults.resources, fmt.Sprintf("Comma-delimited list of resources to issue background requests for, from %v.", sets.List(noiseResources)))
+	fs.StringVar(&defaults.verbs, prefix+"verbs", defaults.verbs, "Comma-delimited list of verb=weight pairs, deciding the mix of background requests.")
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of objects of every resource background requests address.")
+	return defaults
+}
+
+// noiseResources are core resources of which an object without any content is valid.
+var noiseResources = sets.New[string]("configmaps", "secrets", "serviceaccounts", "endpoints")
+
+var noiseVerbs = sets.New[string]("get", "list", "create", "update", "delete")
+
+// noiseMetadataKey records the rate of background requests, as runs with and without them are not comparable.
+const noiseMetadataKey = "noise"
+
+func (o *noiseOptions) validate() error {
+	if o.rate < 0 {
+		return errors.New("--noise.rate must not be negative")
+	}
+	if o.rate == 0 {
+		return nil
+	}
+	for _, resource := range strings.Split(o.resources, ",") {
+		if !noiseResources.Has(resource) {
+			return fmt.Errorf("--noise.resources invalid: %s is not one of %v", resource, sets.List(noiseResources))
+		}
+	}
+	if _, err := o.verbWeights(); err != nil {
+		return err
+	}
+	if o.objects <= 0 {
+		return errors.New("--noise.objects must be positive")
+	}
+	return nil
+}
+
+type verbWeight struct {
+	verb   string
+	weight int
+}
+
+func (o *noiseOptions) verbWeights() ([]verbWeight, error) {
+	var weights []verbWeight
+	for _, part := range strings.Split(o.verbs, ",") {
+		subParts := strings.Split(part, "=")
+		if len(subParts) != 2 || !noiseVerbs.Has(subParts[0]) {
+			return nil, fmt.Errorf("--noise.verbs invalid: %s is not of form verb=weight for a verb in %v", part, sets.List(noiseVerbs))
+		}
+		weight, err := strconv.Atoi(subParts[1])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("--noise.verbs invalid: weight for %s must be a positive integer", subParts[0])
+		}
+		weights = append(weights, verbWeight{verb: subParts[0], weight: weight})
+	}
+	return weights, nil
+}
+
+const noiseFile = "noise.json"
+
+type noiseResult struct {
+	Requests int            `json:"requests"`
+	Errors   map[string]int `json:"errors,omitempty"`
+	// Latency is the distribution of times the requests of every verb took, keyed by verb.
+	Latency map[string]durationSummary `json:"latency"`
+}
+
+type noiseGenerator struct {
+	lock      sync.Mutex
+	requests  int
+	errors    map[string]int
+	latencies map[string][]time.Duration
+	done      chan struct{}
+}
+
+// startNoise issues background requests at the rate until the returned function is called, which stops them and
+// records what was issued. Which request is issued when is drawn from the seed, so runs with the same seed see the
+// same noise.
+func startNoise(ctx context.Context, client *kubernetes.Clientset, seed int64, outputDir string, opts *noiseOptions) (func(), error) {
+	if opts.rate == 0 {
+		return func() {}, nil
+	}
+	weights, err := opts.verbWeights()
+	if err != nil {
+		return func() {}, err
+	}
+	resources := strings.Split(opts.resources, ",")
+	namespace, cleanup, err := createNamespace(ctx, client, "noise")
+	if err != nil {
+		return func() {}, err
+	}
+	logrus.Infof("Issuing background requests at %dHz", opts.rate)
+	timeline.annotate(artifacts.AnnotationRate, "started background requests at %dHz", opts.rate)
+
+	generator := &noiseGenerator{errors: map[string]int{}, latencies: map[string][]time.Duration{}, done: make(chan struct{})}
+	noiseCtx, stop := context.WithCancel(ctx)
+	var inflight sync.WaitGroup
+	go func() {
+		defer close(generator.done)
+		random := rand.New(rand.NewSource(seed))
+		var total int
+		for _, weight := range weights {
+			total += weight.weight
+		}
+		ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-noiseCtx.Done():
+				inflight.Wait()
+				return
+			case <-ticker.C:
+			}
+			choice := random.Intn(total)
+			verb := weights[0].verb
+			for _, weight := range weights {
+				if choice < weight.weight {
+					verb = weight.verb
+					break
+				}
+				choice -= weight.weight
+			}
+			resource := resources[random.Intn(len(resources))]
+			name := objectNames.name("noise", random.Intn(opts.objects))
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				generator.issue(noiseCtx, client, namespace, resource, verb, name)
+			}()
+		}
+	}()
+
+	return func() {
+		stop()
+		<-generator.done
+		cleanup()
+		timeline.annotate(artifacts.AnnotationRate, "stopped background requests")
+		if err := generator.write(outputDir); err != nil {
+			logrus.WithError(err).Error("could not record background requests")
+		}
+	}, nil
+}
+
+func (g *noiseGenerator) issue(ctx context.Context, client *kubernetes.Clientset, namespace, resource, verb, name string) {
+	body := []byte(`{"apiVersion":"v1","metadata":{"name":"` + name + `","labels":{"generation":"` + strconv.FormatInt(time.Now().UnixNano(), 10) + `"}}}`)
+	requests := client.CoreV1().RESTClient()
+	start := time.Now()
+	var err error
+	switch verb {
+	case "get":
+		err = requests.Get().Namespace(namespace).Resource(resource).Name(name).Do(ctx).Error()
+	case "list":
+		err = requests.Get().Namespace(namespace).Resource(resource).VersionedParams(&metav1.ListOptions{}, scheme.ParameterCodec).Do(ctx).Error()
+	case "create":
+		err = requests.Post().Namespace(namespace).Resource(resource).Body(body).Do(ctx).Error()
+	case "update":
+		err = requests.Put().Namespace(namespace).Resource(resource).Name(name).Body(body).Do(ctx).Error()
+	case "delete":
+		err = requests.Delete().Namespace(namespace).Resource(resource).Name(name).Do(ctx).Error()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	latency := time.Since(start)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.requests++
+	// objects come and go at random, so requests for objects which do or do not exist yet fail as a matter of course
+	if err != nil {
+		g.errors[verb+": "+errorCategory(err)]++
+		return
+	}
+	g.latencies[verb] = append(g.latencies[verb], latency)
+}
+
+// errorCategory names the kind of error a request failed with coarsely enough that the errors seen over a run stay
+// few: by its reason, or, for errors without one, by the status code the server answered with or else by the type of
+// the error the transport failed with. Messages are never used, as they name objects and addresses.
+func errorCategory(err error) string {
+	if reason := apierrors.ReasonForError(err); reason != metav1.StatusReasonUnknown {
+		return string(reason)
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) && status.Status().Code != 0 {
+		return fmt.Sprintf("status %d", status.Status().Code)
+	}
+	var request *url.Error
+	if errors.As(err, &request) {
+		err = request.Err
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+func (g *noiseGenerator) write(outputDir string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	result := noiseResult{Requests: g.requests, Errors: g.errors, Latency: map[string]durationSummary{}}
+	for verb, latencies := range g.latencies {
+		result.Latency[verb] = summarizeDurations(latencies)
+	}
+	return artifacts.Write(outputDir, noiseFile, result)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// notes collect every value of a flag which may be given more than once.
+type notes []string
+
+func (n *notes) String() string {
+	return strings.Join(*n, "; ")
+}
+
+func (n *notes) Set(value string) error {
+	*n = append(*n, value)
+	return nil
+}
+
+// annotateCommand attaches notes to a past run, for context which was only learned after it ran, like:
+//
+//	benchmark annotate --run old-run -- "etcd was on slower disks"
+//
+// Every argument after the separator is recorded as a note in the manifest, after those the run started with.
+const annotateCommand = "annotate"
+
+func annotateRun(args []string) error {
+	fs := flag.NewFlagSet(annotateCommand, flag.ExitOnError)
+	run := fs.String("run", "", "Path to the output directory of the run to annotate.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *run == "" {
+		return errors.New("--run is required")
+	}
+	if fs.NArg() == 0 {
+		return errors.New("at least one note is required")
+	}
+	var manifest artifacts.Manifest
+	if err := artifacts.Load(*run, artifacts.ManifestFile, &manifest); err != nil {
+		return err
+	}
+	manifest.Notes = append(manifest.Notes, fs.Args()...)
+	return artifacts.Write(*run, artifacts.ManifestFile, manifest)
+}
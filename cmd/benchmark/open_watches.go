@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// openWatches is the number of watches currently established by every tracker in the process. Watches which
+// failed or ended are not counted, so unlike the number issued this is the load the API servers are carrying.
+var openWatches int64
+
+// issuedWatches is the number of watch requests sent by every tracker in the process, reconnections included.
+var issuedWatches int64
+
+// openWatchGauge samples the number of open and issued watches throughout a run.
+type openWatchGauge struct {
+	lock   sync.Mutex
+	gauge  artifacts.Gauge
+	issued artifacts.Gauge
+}
+
+func monitorOpenWatches(ctx context.Context, interval time.Duration) *openWatchGauge {
+	start := time.Now()
+	monitor := &openWatchGauge{gauge: artifacts.Gauge{Start: start}, issued: artifacts.Gauge{Start: start}}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			monitor.sample()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return monitor
+}
+
+func (m *openWatchGauge) sample() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	offset := time.Since(m.gauge.Start).Seconds()
+	m.gauge.Offsets = append(m.gauge.Offsets, offset)
+	m.gauge.Values = append(m.gauge.Values, atomic.LoadInt64(&openWatches))
+	m.issued.Offsets = append(m.issued.Offsets, offset)
+	m.issued.Values = append(m.issued.Values, atomic.LoadInt64(&issuedWatches))
+}
+
+func (m *openWatchGauge) write(outputDir string) error {
+	m.sample()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := artifacts.Write(outputDir, artifacts.IssuedWatchesFile, m.issued); err != nil {
+		return err
+	}
+	return artifacts.Write(outputDir, artifacts.OpenWatchesFile, m.gauge)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// phaseRecorder tracks the sequential phases of an experiment; starting a phase ends the previous one.
+type phaseRecorder struct {
+	phases []artifacts.Phase
+}
+
+func (r *phaseRecorder) start(name string) {
+	now := time.Now()
+	r.end(now)
+	logrus.Infof("Starting phase %s", name)
+	heapSnapshots.take(name)
+	r.phases = append(r.phases, artifacts.Phase{Name: name, Start: now})
+}
+
+func (r *phaseRecorder) end(now time.Time) {
+	if len(r.phases) > 0 && r.phases[len(r.phases)-1].End.IsZero() {
+		r.phases[len(r.phases)-1].End = now
+	}
+}
+
+func (r *phaseRecorder) write(outputDir string) error {
+	r.end(time.Now())
+	return artifacts.Write(outputDir, artifacts.PhasesFile, r.phases)
+}
+
+// holdFor waits out the duration, returning early with an error if the context is cancelled.
+func holdFor(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
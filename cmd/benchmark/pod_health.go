@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// podHealth records the monitored pods being OOM killed, evicted or restarted, and the nodes running them coming
+// under memory pressure, from the statuses of the pods and nodes and the events reported for them. A run in which
+// the control plane fell over measured the recovery, not the load, unless the experiment made it fall over, which
+// it declares to the monitor.
+var podHealth = &podHealthMonitor{recorded: sets.New[string](), restarts: map[string]int32{}, inducing: map[string][]inducedWindow{}}
+
+type podHealthMonitor struct {
+	start time.Time
+
+	lock   sync.Mutex
+	events []artifacts.PodHealthEvent
+	// recorded holds a key for every event recorded, as every poll sees most of them again.
+	recorded sets.Set[string]
+	// restarts holds the restart count of every container when last polled; restarts before the run are not ours.
+	restarts map[string]int32
+	// inducing holds the windows in which the experiment restarted something on every node.
+	inducing map[string][]inducedWindow
+
+	client    *kubernetes.Clientset
+	selectors map[string]labels.Selector
+	nodes     sets.Set[string]
+}
+
+// nodeEventKinds and podEventKinds map the reasons of the events which matter for the health of the control plane
+// to the kind of event they are recorded as.
+var (
+	nodeEventKinds = map[string]string{
+		"SystemOOM":                 artifacts.PodHealthOOMKill,
+		"OOMKilling":                artifacts.PodHealthOOMKill,
+		"EvictionThresholdMet":      artifacts.PodHealthMemoryPressure,
+		"NodeHasInsufficientMemory": artifacts.PodHealthMemoryPressure,
+	}
+	podEventKinds = map[string]string{
+		"Evicted":    artifacts.PodHealthEviction,
+		"OOMKilling": artifacts.PodHealthOOMKill,
+		"Preempted":  artifacts.PodHealthEviction,
+	}
+)
+
+// inducedWindow spans a restart the experiment made, until what it restarted was ready again; End is unset until it
+// was.
+type inducedWindow struct {
+	start time.Time
+	end   *time.Time
+}
+
+func (m *podHealthMonitor) monitor(ctx context.Context, client *kubernetes.Clientset, selectors map[string]labels.Selector, nodes []string, interval time.Duration) {
+	m.lock.Lock()
+	m.start, m.client, m.selectors, m.nodes = time.Now(), client, selectors, sets.New(nodes...)
+	m.lock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := m.sample(ctx); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Debug("failed to sample health of monitored pods")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// inducingRestart declares that the experiment is restarting something on the node, so that what falls over there
+// until restartInduced is called is not taken for the control plane failing.
+func (m *podHealthMonitor) inducingRestart(node string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.inducing[node] = append(m.inducing[node], inducedWindow{start: time.Now()})
+}
+
+func (m *podHealthMonitor) restartInduced(node string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	windows := m.inducing[node]
+	if len(windows) > 0 && windows[len(windows)-1].end == nil {
+		end := time.Now()
+		windows[len(windows)-1].end = &end
+	}
+}
+
+// restarting determines whether the experiment is restarting something on any node right now.
+func (m *podHealthMonitor) restarting() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, windows := range m.inducing {
+		if len(windows) > 0 && windows[len(windows)-1].end == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// inducedLocked determines whether the event happened while the experiment was restarting something on its node.
+func (m *podHealthMonitor) inducedLocked(event artifacts.PodHealthEvent) bool {
+	for _, window := range m.inducing[event.Node] {
+		if !event.Time.Before(window.start) && (window.end == nil || !event.Time.After(*window.end)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *podHealthMonitor) sample(ctx context.Context) error {
+	namespaces := sets.New[string]()
+	pods := sets.New[string]()
+	for identifier, selector := range m.selectors {
+		list, err := m.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return fmt.Errorf("could not list %s pods: %w", identifier, err)
+		}
+		for i := range list.Items {
+			pod := &list.Items[i]
+			namespaces.Insert(pod.Namespace)
+			pods.Insert(pod.Namespace + "/" + pod.Name)
+			m.observePod(pod)
+		}
+	}
+
+	for node := range m.nodes {
+		status, err := m.client.CoreV1().Nodes().Get(ctx, node, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("could not get node %s: %w", node, err)
+		}
+		for _, condition := range status.Status.Conditions {
+			if condition.Type == corev1.NodeMemoryPressure && condition.Status == corev1.ConditionTrue {
+				m.record(condition.LastTransitionTime.Time, artifacts.PodHealthEvent{Kind: artifacts.PodHealthMemoryPressure, Node: node, Reason: condition.Reason, Message: condition.Message})
+			}
+		}
+	}
+
+	for namespace := range namespaces.Insert(metav1.NamespaceDefault) {
+		events, err := m.client.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("could not list events in %s: %w", namespace, err)
+		}
+		for _, event := range events.Items {
+			involved := event.InvolvedObject
+			var kind string
+			health := artifacts.PodHealthEvent{Reason: event.Reason, Message: event.Message}
+			switch {
+			case involved.Kind == "Node" && m.nodes.Has(involved.Name):
+				kind = nodeEventKinds[event.Reason]
+				health.Node = involved.Name
+			case involved.Kind == "Pod" && pods.Has(involved.Namespace+"/"+involved.Name):
+				kind = podEventKinds[event.Reason]
+				health.Pod = involved.Namespace + "/" + involved.Name
+			}
+			if kind == "" {
+				continue
+			}
+			health.Kind = kind
+			m.record(eventTime(event), health)
+		}
+	}
+	return nil
+}
+
+// observePod records restarts of the containers of the pod since it was last polled, and its eviction.
+func (m *podHealthMonitor) observePod(pod *corev1.Pod) {
+	name := pod.Namespace + "/" + pod.Name
+	if pod.Status.Reason == "Evicted" {
+		// the pod stopped being ready when it was evicted, which is the only time its status keeps
+		evicted := time.Now()
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady && !condition.LastTransitionTime.IsZero() {
+				evicted = condition.LastTransitionTime.Time
+			}
+		}
+		m.record(evicted, artifacts.PodHealthEvent{Kind: artifacts.PodHealthEviction, Pod: name, Node: pod.Spec.NodeName, Reason: pod.Status.Reason, Message: pod.Status.Message})
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		key := name + "/" + status.Name
+		m.lock.Lock()
+		previous, seen := m.restarts[key]
+		m.restarts[key] = status.RestartCount
+		m.lock.Unlock()
+		if !seen || status.RestartCount <= previous {
+			continue
+		}
+		event := artifacts.PodHealthEvent{Kind: artifacts.PodHealthRestart, Pod: name, Container: status.Name, Node: pod.Spec.NodeName, Restarts: int(status.RestartCount - previous)}
+		at := time.Now()
+		if running := status.State.Running; running != nil && !running.StartedAt.IsZero() {
+			started := running.StartedAt.Time
+			event.Started = &started
+		}
+		if terminated := status.LastTerminationState.Terminated; terminated != nil {
+			if terminated.Reason == "OOMKilled" {
+				event.Kind = artifacts.PodHealthOOMKill
+			}
+			event.Reason, event.Message = terminated.Reason, fmt.Sprintf("exited with %d", terminated.ExitCode)
+			if !terminated.FinishedAt.IsZero() {
+				at = terminated.FinishedAt.Time
+			}
+		}
+		m.record(at, event)
+	}
+}
+
+// record keeps the event, unless it happened before the run or was recorded already.
+func (m *podHealthMonitor) record(at time.Time, event artifacts.PodHealthEvent) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if at.Before(m.start) {
+		return
+	}
+	event.Time = at
+	key := fmt.Sprintf("%s/%s/%s/%s/%s/%d", event.Kind, event.Node, event.Pod, event.Container, event.Reason, at.UnixNano())
+	if m.recorded.Has(key) {
+		return
+	}
+	m.recorded.Insert(key)
+	m.events = append(m.events, event)
+	logrus.WithFields(logrus.Fields{
+		"node":      event.Node,
+		"pod":       event.Pod,
+		"container": event.Container,
+		"reason":    event.Reason,
+	}).Warnf("Control plane %s: %s", event.Kind, event.Message)
+}
+
+// eventTime determines when the event last happened; events reported through the newer API only set the time of
+// the first occurrence, and series of them their last observation.
+func eventTime(event corev1.Event) time.Time {
+	switch {
+	case event.Series != nil && !event.Series.LastObservedTime.IsZero():
+		return event.Series.LastObservedTime.Time
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.FirstTimestamp.Time
+}
+
+// write records the events, marking those the experiment induced. The monitor polls, so whether an event was
+// induced is only known once the windows around it have closed.
+func (m *podHealthMonitor) write(outputDir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.client == nil {
+		return nil
+	}
+	events := append([]artifacts.PodHealthEvent{}, m.events...)
+	for i := range events {
+		events[i].Induced = m.inducedLocked(events[i])
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return artifacts.Write(outputDir, artifacts.PodHealthFile, events)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// setupPodLogCollectors streams the logs of every container of the monitored pods, from now on, into a file per
+// container until the returned function is called, so that errors and terminated watches in them can be lined up
+// with the metrics.
+func setupPodLogCollectors(ctx context.Context, client *kubernetes.Clientset, selectors map[string]labels.Selector, outputDir string, enabled bool) (func(), error) {
+	if !enabled {
+		return func() {}, nil
+	}
+	logrus.Info("Setting up control plane pod log collection")
+	since := metav1.Now()
+	streamCtx, stopStreaming := context.WithCancel(ctx)
+	var streaming sync.WaitGroup
+	for identifier, selector := range selectors {
+		pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			stopStreaming()
+			return func() {}, fmt.Errorf("could not list %s pods: %w", identifier, err)
+		}
+		for _, pod := range pods.Items {
+			podDir := filepath.Join(outputDir, artifacts.PodLogsDir, pod.Namespace, pod.Name)
+			if err := os.MkdirAll(podDir, 0777); err != nil {
+				stopStreaming()
+				return func() {}, fmt.Errorf("could not create output dir for pod %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+			for _, container := range pod.Spec.Containers {
+				streaming.Add(1)
+				go func(pod corev1.Pod, container string) {
+					defer streaming.Done()
+					collectPodLogs(streamCtx, client, pod, container, since, filepath.Join(podDir, container+artifacts.PodLogExtension))
+				}(pod, container.Name)
+			}
+		}
+	}
+	return func() {
+		stopStreaming()
+		streaming.Wait()
+	}, nil
+}
+
+// collectPodLogs copies the log of the container into the file, with every line prefixed by its timestamp. Streams
+// break when the container restarts or the kubelet closes them, so they are reopened from where they broke; lines
+// logged in the same second as the break may be recorded twice.
+func collectPodLogs(ctx context.Context, client *kubernetes.Clientset, pod corev1.Pod, container string, since metav1.Time, path string) {
+	output, err := os.Create(path)
+	if err != nil {
+		logrus.WithError(err).Errorf("could not record logs of %s/%s", pod.Name, container)
+		return
+	}
+	writer := bufio.NewWriter(&budgetedWriter{collector: podLogsCollector, writer: output})
+	defer func() {
+		if err := writer.Flush(); err != nil && !errors.Is(err, errBudgetStopped) {
+			logrus.WithError(err).Errorf("could not record logs of %s/%s", pod.Name, container)
+		}
+		if err := output.Close(); err != nil {
+			logrus.WithError(err).Errorf("could not record logs of %s/%s", pod.Name, container)
+		}
+	}()
+	for ctx.Err() == nil {
+		if err := streamPodLogs(ctx, client, pod, container, since, writer); errors.Is(err, errBudgetStopped) {
+			logrus.Debugf("stopped collecting logs of %s/%s for the disk budget", pod.Name, container)
+			return
+		} else if err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Debugf("log stream of %s/%s broke, reopening", pod.Name, container)
+		}
+		since = metav1.Now()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func streamPodLogs(ctx context.Context, client *kubernetes.Clientset, pod corev1.Pod, container string, since metav1.Time, output io.Writer) error {
+	stream, err := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container:  container,
+		Follow:     true,
+		Timestamps: true,
+		SinceTime:  &since,
+	}).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			logrus.WithError(err).Debug("failed to close log stream")
+		}
+	}()
+	_, err = io.Copy(output, stream)
+	return err
+}
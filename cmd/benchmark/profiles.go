@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// profileOptions configure collecting profiles from every API server replica, so that what watches cost can be
+// attributed to code paths and not only seen in totals. The replicas must be run with profiling enabled, which is
+// the default.
+type profileOptions struct {
+	cpuInterval time.Duration
+	cpuDuration time.Duration
+	heap        bool
+}
+
+func defaultProfileOptions() *profileOptions {
+	return &profileOptions{
+		cpuDuration: 30 * time.Second,
+	}
+}
+
+func bindProfileOptions(fs *flag.FlagSet, defaults *profileOptions) *profileOptions {
+	prefix := "profiles."
+	fs.DurationVar(&defaults.cpuInterval, prefix+"cpu-interval", defaults.cpuInterval, "Time between the starts of CPU profiles of every API server replica, or zero to not profile.")
+	fs.DurationVar(&defaults.cpuDuration, prefix+"cpu-duration", defaults.cpuDuration, "Time every CPU profile covers.")
+	fs.BoolVar(&defaults.heap, prefix+"heap", defaults.heap, "Record heap profiles of every API server replica when the experiment starts, at every phase boundary and when it ends.")
+	return defaults
+}
+
+func (o *profileOptions) validate() error {
+	if o.cpuInterval < 0 {
+		return errors.New("--profiles.cpu-interval must not be negative")
+	}
+	if o.cpuInterval > 0 && (o.cpuDuration < time.Second || o.cpuDuration > o.cpuInterval) {
+		return errors.New("--profiles.cpu-duration must be at least a second and no longer than --profiles.cpu-interval")
+	}
+	return nil
+}
+
+// setupProfileMonitors profiles every API server replica until the context ends.
+func setupProfileMonitors(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, selector, outputDir string, opts *profileOptions) error {
+	if opts.cpuInterval == 0 && !opts.heap {
+		return nil
+	}
+	logrus.Info("Setting up API server profiling")
+	instances, err := apiserverInstances(ctx, client, config, selector)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		nodeDir := filepath.Join(outputDir, artifacts.ProfilesDir, instance.node)
+		if err := os.MkdirAll(nodeDir, 0777); err != nil {
+			return fmt.Errorf("could not create output dir for node %s: %w", instance.node, err)
+		}
+		if opts.cpuInterval > 0 {
+			go monitorCPUProfiles(ctx, instance, nodeDir, opts)
+		}
+	}
+	if opts.heap {
+		heapSnapshots.ctx, heapSnapshots.instances, heapSnapshots.outputDir = ctx, instances, outputDir
+	}
+	return nil
+}
+
+func monitorCPUProfiles(ctx context.Context, instance apiserverInstance, outputDir string, opts *profileOptions) {
+	if err := wait.PollUntilContextCancel(ctx, opts.cpuInterval, true, func(ctx context.Context) (done bool, err error) {
+		if !diskBudget.sample(profilesCollector, instance.pod) {
+			return false, nil
+		}
+		if err := recordProfile(ctx, instance, outputDir, artifacts.CPUProfile, map[string]string{"seconds": strconv.Itoa(int(opts.cpuDuration.Seconds()))}); err != nil && ctx.Err() == nil {
+			logrus.WithError(err).Errorf("failed to profile %s", instance.pod)
+		}
+		return false, nil
+	}); err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Errorf("failed to monitor profiles of %s", instance.pod)
+	}
+}
+
+// heapMilestoneStart and heapMilestoneEnd name the snapshots taken around the whole experiment; the others are named
+// after the phase they were taken at the start of.
+const (
+	heapMilestoneStart = "experiment-start"
+	heapMilestoneEnd   = "experiment-end"
+)
+
+// heapSnapshots takes heap profiles at the milestones of an experiment, when enabled, for phases to take them at
+// their boundaries wherever they are recorded.
+var heapSnapshots = &heapSnapshotter{}
+
+type heapSnapshotter struct {
+	ctx       context.Context
+	instances []apiserverInstance
+	outputDir string
+
+	lock      sync.Mutex
+	pending   sync.WaitGroup
+	snapshots []artifacts.HeapSnapshot
+}
+
+// take profiles the heap of every replica in the background, recording how many watches were open at the time
+// so that memory can be attributed to them.
+func (s *heapSnapshotter) take(milestone string) {
+	if len(s.instances) == 0 || diskBudget.stopped(heapSnapshotCollector) {
+		return
+	}
+	taken := time.Now()
+	s.lock.Lock()
+	s.snapshots = append(s.snapshots, artifacts.HeapSnapshot{Milestone: milestone, Time: taken, OpenWatches: atomic.LoadInt64(&openWatches)})
+	s.lock.Unlock()
+	for _, instance := range s.instances {
+		s.pending.Add(1)
+		go func(instance apiserverInstance) {
+			defer s.pending.Done()
+			if err := recordProfileAt(s.ctx, instance, filepath.Join(s.outputDir, artifacts.ProfilesDir, instance.node), artifacts.HeapProfile, taken, nil); err != nil && s.ctx.Err() == nil {
+				logrus.WithError(err).Errorf("failed to profile heap of %s", instance.pod)
+			}
+		}(instance)
+	}
+}
+
+// write waits for the profiles in flight and records when every snapshot was taken.
+func (s *heapSnapshotter) write(outputDir string) error {
+	if len(s.instances) == 0 {
+		return nil
+	}
+	s.pending.Wait()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return artifacts.Write(filepath.Join(outputDir, artifacts.ProfilesDir), artifacts.HeapSnapshotsFile, s.snapshots)
+}
+
+// recordProfile fetches the profile from the replica and stores it as-is, named after the profile and the Unix time
+// in nanoseconds at which it was requested.
+func recordProfile(ctx context.Context, instance apiserverInstance, outputDir, profile string, params map[string]string) error {
+	return recordProfileAt(ctx, instance, outputDir, profile, time.Now(), params)
+}
+
+func recordProfileAt(ctx context.Context, instance apiserverInstance, outputDir, profile string, started time.Time, params map[string]string) error {
+	request := instance.client.Get().AbsPath("/debug/pprof/" + profile)
+	for key, value := range params {
+		request = request.Param(key, value)
+	}
+	raw, err := request.DoRaw(ctx)
+	if err != nil {
+		return fmt.Errorf("could not fetch %s profile: %w", profile, err)
+	}
+	return os.WriteFile(filepath.Join(outputDir, profile+"-"+strconv.FormatInt(started.UnixNano(), 10)+artifacts.ProfileExtension), raw, 0666)
+}
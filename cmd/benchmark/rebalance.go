@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// rebalanceExperimentOptions configure an experiment which holds open a fleet of reconnecting watches while the
+// API servers send GOAWAY frames or a load balancer cycles connections, measuring how watches survive and how
+// they redistribute over the replicas. Neither disruption is caused by the benchmark; the cluster must be set up
+// with --goaway-chance or an appropriate load balancer before the run.
+type rebalanceExperimentOptions struct {
+	count      int
+	rate       int
+	duration   time.Duration
+	interval   time.Duration
+	disruption string
+}
+
+func defaultRebalanceExperimentOptions() *rebalanceExperimentOptions {
+	return &rebalanceExperimentOptions{
+		count:      10000,
+		rate:       100,
+		duration:   10 * time.Minute,
+		interval:   10 * time.Second,
+		disruption: goawayDisruption,
+	}
+}
+
+func bindRebalanceExperimentOptions(fs *flag.FlagSet, defaults *rebalanceExperimentOptions) *rebalanceExperimentOptions {
+	prefix := "rebalance."
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.DurationVar(&defaults.duration, prefix+"duration", defaults.duration, "Time to hold the watches open once established.")
+	fs.DurationVar(&defaults.interval, prefix+"interval", defaults.interval, "Interval at which to sample the watches held by every API server replica.")
+	fs.StringVar(&defaults.disruption, prefix+"disruption", defaults.disruption, fmt.Sprintf("Disruption the cluster was set up with, one of %v.", sets.List(rebalanceDisruptions)))
+	return defaults
+}
+
+const (
+	goawayDisruption       = "goaway"
+	loadBalancerDisruption = "load-balancer"
+
+	disruptionMetadataKey = "disruption"
+)
+
+var rebalanceDisruptions = sets.New[string](goawayDisruption, loadBalancerDisruption)
+
+func (o *rebalanceExperimentOptions) validate() error {
+	if !rebalanceDisruptions.Has(o.disruption) {
+		return fmt.Errorf("--rebalance.disruption must be one of %v", sets.List(rebalanceDisruptions))
+	}
+	if o.rate <= 0 {
+		return errors.New("--rebalance.rate must be positive")
+	}
+	return nil
+}
+
+const rebalanceFile = "rebalance.json"
+
+type rebalanceResult struct {
+	// GoawayChance holds the --goaway-chance each API server replica runs with, keyed by pod.
+	GoawayChance map[string]string `json:"goawayChance"`
+
+	Watches      int   `json:"watches"`
+	Disconnected int   `json:"disconnected"`
+	Reconnects   int64 `json:"reconnects"`
+	// Downtime is the distribution over watches of the mean time taken to reconnect after a disconnection.
+	Downtime durationSummary `json:"downtime"`
+
+	Samples []watchDistribution `json:"samples"`
+	// Skew is the ratio of the most watches held by any replica to the mean over replicas, in the last sample.
+	Skew float64 `json:"skew"`
+}
+
+// watchDistribution is the number of watches each API server replica is serving, keyed by pod.
+type watchDistribution struct {
+	Time    time.Time          `json:"time"`
+	Watches map[string]float64 `json:"watches"`
+}
+
+func runRebalanceExperiment(ctx context.Context, client *kubernetes.Clientset, selector, outputDir string, opts *rebalanceExperimentOptions) error {
+	logrus.Info("Running rebalance experiment")
+	goawayChance, err := goawayChances(ctx, client, selector)
+	if err != nil {
+		return err
+	}
+	namespace, cleanup, err := createNamespace(ctx, client, "rebalance")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	tracker := newWatchTracker(opts.count)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.count; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		go tracker.watchWithReconnect(ctx, i, configMapWatch(client, namespace), nil)
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.count, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+
+	phases.start("disruption")
+	result := rebalanceResult{GoawayChance: goawayChance, Watches: opts.count}
+	sampler := time.NewTicker(opts.interval)
+	defer sampler.Stop()
+	deadline := time.NewTimer(opts.duration)
+	defer deadline.Stop()
+	func() {
+		for {
+			sample, err := sampleWatchDistribution(ctx)
+			if err != nil {
+				logrus.WithError(err).Warn("could not sample watch distribution")
+			} else {
+				result.Samples = append(result.Samples, sample)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-deadline.C:
+				return
+			case <-sampler.C:
+			}
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var downtime []time.Duration
+	for i := range tracker.records {
+		record := &tracker.records[i]
+		reconnects := atomic.LoadInt64(&record.reconnects)
+		result.Reconnects += reconnects
+		if atomic.LoadInt64(&record.disconnected) == 0 {
+			continue
+		}
+		result.Disconnected++
+		if reconnects > 0 {
+			downtime = append(downtime, time.Duration(atomic.LoadInt64(&record.downtime)/reconnects))
+		}
+	}
+	result.Downtime = summarizeDurations(downtime)
+	if len(result.Samples) > 0 {
+		result.Skew = skew(result.Samples[len(result.Samples)-1].Watches)
+	}
+	logrus.WithFields(logrus.Fields{
+		"disconnected": result.Disconnected,
+		"reconnects":   result.Reconnects,
+		"p99":          fmt.Sprintf("%.3fs", result.Downtime.P99),
+		"skew":         fmt.Sprintf("%.2f", result.Skew),
+	}).Info("Watch fleet rebalanced")
+	if err := artifacts.Write(outputDir, artifacts.LatenciesFile, tracker.latencies()); err != nil {
+		return err
+	}
+	if err := artifacts.Write(outputDir, rebalanceFile, result); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished rebalance experiment")
+	return nil
+}
+
+// goawayChances reads the --goaway-chance each API server replica was started with, keyed by pod.
+func goawayChances(ctx context.Context, client *kubernetes.Clientset, selector string) (map[string]string, error) {
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("could not list API server pods: %w", err)
+	}
+	chances := map[string]string{}
+	for _, pod := range pods.Items {
+		chance := "0"
+		for _, container := range pod.Spec.Containers {
+			for _, arg := range append(container.Command, container.Args...) {
+				if strings.HasPrefix(arg, "--goaway-chance=") {
+					chance = strings.TrimPrefix(arg, "--goaway-chance=")
+				}
+			}
+		}
+		chances[pod.Namespace+"/"+pod.Name] = chance
+	}
+	return chances, nil
+}
+
+func sampleWatchDistribution(ctx context.Context) (watchDistribution, error) {
+	scraped, err := apiserverScrapes.all(ctx, 0)
+	if err != nil {
+		return watchDistribution{}, err
+	}
+	sample := watchDistribution{Time: time.Now(), Watches: map[string]float64{}}
+	for pod, families := range scraped {
+		sample.Watches[pod] = sumMetric(families, "apiserver_longrunning_requests", map[string]string{"verb": "WATCH", "resource": "configmaps"})
+	}
+	return sample, nil
+}
+
+func skew(watches map[string]float64) float64 {
+	var sum, peak float64
+	for _, count := range watches {
+		sum += count
+		peak = math.Max(peak, count)
+	}
+	if sum == 0 {
+		return 0
+	}
+	return peak / (sum / float64(len(watches)))
+}
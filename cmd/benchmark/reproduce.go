@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// reproduceCommand re-runs a past run with the configuration recorded in its manifest, like:
+//
+//	benchmark reproduce --from old-run -- --output new-run
+//
+// Flags after the separator override the recorded ones, which is necessary at least for the output directory,
+// as the old one would otherwise be cleared; runs which would write to the directory they reproduce are refused.
+const reproduceCommand = "reproduce"
+
+// reproduceArguments loads the manifest of a past run and determines the arguments that reproduce it.
+func reproduceArguments(args []string) ([]string, error) {
+	fs := flag.NewFlagSet(reproduceCommand, flag.ExitOnError)
+	from := fs.String("from", "", "Path to the output directory of the run to reproduce.")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *from == "" {
+		return nil, errors.New("--from is required")
+	}
+	var manifest artifacts.Manifest
+	if err := artifacts.Load(*from, artifacts.ManifestFile, &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Configuration) == 0 {
+		return nil, fmt.Errorf("the run in %s did not record its configuration", *from)
+	}
+	output := manifest.Configuration["output"]
+	if overridden, set := flagValue(fs.Args(), "output"); set {
+		output = overridden
+	}
+	if clears, err := containsPath(output, *from); err != nil {
+		return nil, err
+	} else if clears {
+		return nil, fmt.Errorf("the reproduced run would clear %s, set another --output after --", *from)
+	}
+	reproduced := argumentsFor(manifest.Configuration)
+	return append(reproduced, fs.Args()...), nil
+}
+
+// flagValue finds the last value the arguments set the flag to, as the flag package would parse them.
+func flagValue(args []string, name string) (string, bool) {
+	var value string
+	var set bool
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			break
+		}
+		arg := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		if arg == name && i+1 < len(args) {
+			value, set = args[i+1], true
+			i++
+		} else if strings.HasPrefix(arg, name+"=") {
+			value, set = strings.TrimPrefix(arg, name+"="), true
+		}
+	}
+	return value, set
+}
+
+// containsPath determines whether the path is the directory or inside of it, however either is spelled.
+func containsPath(dir, path string) (bool, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	if relative, err := filepath.Rel(absDir, absPath); err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return true, nil
+	}
+	dirInfo, dirErr := os.Stat(absDir)
+	pathInfo, pathErr := os.Stat(absPath)
+	return dirErr == nil && pathErr == nil && os.SameFile(dirInfo, pathInfo), nil
+}
+
+// configurationOf records the effective value of every flag and a command line which sets all of them.
+func configurationOf(fs *flag.FlagSet) (map[string]string, string) {
+	configuration := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		// nothing would release a reproduced run from the start barrier, and notes describe the original run only
+		if f.Name == "start-barrier" || f.Name == "note" {
+			return
+		}
+		configuration[f.Name] = f.Value.String()
+	})
+	command := []string{filepath.Base(os.Args[0])}
+	for _, arg := range argumentsFor(configuration) {
+		command = append(command, shellQuote(arg))
+	}
+	return configuration, strings.Join(command, " ")
+}
+
+func argumentsFor(configuration map[string]string) []string {
+	names := make([]string, 0, len(configuration))
+	for name := range configuration {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := make([]string, 0, len(names))
+	for _, name := range names {
+		args = append(args, "--"+name+"="+configuration[name])
+	}
+	return args
+}
+
+func shellQuote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_=./,:+@", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// requestCounter counts the resource requests the benchmark sends to the API servers, keyed by verb.
+type requestCounter struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+func newRequestCounter() *requestCounter {
+	return &requestCounter{counts: map[string]int64{}}
+}
+
+// instrument wraps the transport of the configuration, so that every client created from it is counted. Only the
+// configuration the experiment's workload is sent with is instrumented, as the benchmark's own monitoring would
+// otherwise be counted as lists the experiment issued.
+func (c *requestCounter) instrument(config *rest.Config) {
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &countingRoundTripper{counter: c, delegate: rt}
+	})
+}
+
+func (c *requestCounter) snapshot() map[string]int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for verb, count := range c.counts {
+		counts[verb] = count
+	}
+	return counts
+}
+
+type countingRoundTripper struct {
+	counter  *requestCounter
+	delegate http.RoundTripper
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if verb := verbFor(req); verb != "" {
+		rt.counter.lock.Lock()
+		rt.counter.counts[verb]++
+		rt.counter.lock.Unlock()
+	}
+	return rt.delegate.RoundTrip(req)
+}
+
+// verbFor determines the API verb for a resource request in the same way that the API server would, returning an
+// empty string for non-resource requests like /healthz and /metrics.
+func verbFor(req *http.Request) string {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(segments) >= 3 && segments[0] == "api":
+		segments = segments[2:]
+	case len(segments) >= 4 && segments[0] == "apis":
+		segments = segments[3:]
+	default:
+		return ""
+	}
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		segments = segments[2:]
+	}
+	if len(segments) >= 3 && segments[2] == "proxy" {
+		return "proxy"
+	}
+	collection := len(segments) == 1
+	switch req.Method {
+	case http.MethodGet:
+		if req.URL.Query().Get("watch") == "true" || req.URL.Query().Get("watch") == "1" {
+			return "watch"
+		}
+		if collection {
+			return "list"
+		}
+		return "get"
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		if collection {
+			return "deletecollection"
+		}
+		return "delete"
+	}
+	return strings.ToLower(req.Method)
+}
+
+// scrapeEtcdRequests determines how many requests each API server replica has sent to etcd, keyed by pod and then
+// by operation.
+func scrapeEtcdRequests(ctx context.Context) (*etcdCounts, error) {
+	scraped := time.Now()
+	// the counts bound the experiment, so they are always scraped afresh
+	all, err := apiserverScrapes.all(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	requests := map[string]map[string]float64{}
+	for pod, families := range all {
+		requests[pod] = sumMetricBy(families, "etcd_request_duration_seconds", "operation")
+	}
+	return &etcdCounts{time: scraped, requests: requests}, nil
+}
+
+// etcdCounts are the requests every API server replica has sent to etcd, as scraped at a time.
+type etcdCounts struct {
+	time     time.Time
+	requests map[string]map[string]float64
+}
+
+// etcdIncrease adds up the requests all replicas sent to etcd between the two scrapes, by operation.
+func etcdIncrease(before, after etcdCounts) map[string]float64 {
+	operations := map[string]struct{}{}
+	for _, counts := range after.requests {
+		for operation := range counts {
+			operations[operation] = struct{}{}
+		}
+	}
+	increase := map[string]float64{}
+	for operation := range operations {
+		earlier, later := map[string]float64{}, map[string]float64{}
+		for pod, counts := range before.requests {
+			earlier[pod] = counts[operation]
+		}
+		for pod, counts := range after.requests {
+			later[pod] = counts[operation]
+		}
+		increase[operation] = counterIncrease(earlier, later)
+	}
+	return increase
+}
+
+// recordRequests writes the requests made between the two snapshots. The etcd counts are omitted when they could
+// not be scraped, as is the case for managed control planes. When they were also scraped before an idle window ahead
+// of the experiment, the rate of requests to etcd in it is recorded as well, as the API servers send etcd requests of
+// their own and on behalf of every other client of the cluster, which the experiment did not cause.
+func recordRequests(outputDir string, clientBefore, clientAfter map[string]int64, etcdIdle, etcdBefore, etcdAfter *etcdCounts) error {
+	requests := artifacts.Requests{Client: map[string]int64{}}
+	for verb, count := range clientAfter {
+		if increase := count - clientBefore[verb]; increase > 0 {
+			requests.Client[verb] = increase
+		}
+	}
+	if etcdBefore != nil && etcdAfter != nil {
+		requests.Etcd = etcdIncrease(*etcdBefore, *etcdAfter)
+		requests.Seconds = etcdAfter.time.Sub(etcdBefore.time).Seconds()
+		if etcdIdle != nil {
+			elapsed := etcdBefore.time.Sub(etcdIdle.time).Seconds()
+			requests.EtcdIdleRate = map[string]float64{}
+			for operation, count := range etcdIncrease(*etcdIdle, *etcdBefore) {
+				requests.EtcdIdleRate[operation] = count / elapsed
+			}
+		}
+	}
+	logrus.WithField("client", requests.Client).WithField("etcd", requests.Etcd).WithField("etcdIdleRate", requests.EtcdIdleRate).Info("Recorded request counts")
+	return artifacts.Write(outputDir, artifacts.RequestsFile, requests)
+}
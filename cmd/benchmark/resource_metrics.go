@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// resourceMetricsUsageSource reads the resource metrics endpoint of the kubelet through the node proxy, which
+// reports only the CPU and memory of nodes, pods and containers and is much cheaper for the kubelet to serve than
+// the stats summary.
+const resourceMetricsUsageSource = "resource-metrics"
+
+// setupResourceMetricsMonitors scrapes the resource metrics of every node at the interval. The kubelet timestamps
+// every sample with when it last refreshed its stats, so a scrape identical to the last one is not recorded again.
+func setupResourceMetricsMonitors(ctx context.Context, client *kubernetes.Clientset, nodes []string, outputDir string, interval time.Duration) error {
+	logrus.Info("Setting up kubelet resource metrics monitoring")
+	for _, node := range nodes {
+		nodeDir := filepath.Join(outputDir, artifacts.ResourceMetricsDir, node)
+		if err := os.MkdirAll(nodeDir, 0777); err != nil {
+			return fmt.Errorf("could not create output dir for node %s: %w", node, err)
+		}
+		go monitorResourceMetrics(ctx, client, node, nodeDir, interval)
+	}
+	return nil
+}
+
+func monitorResourceMetrics(ctx context.Context, client *kubernetes.Clientset, nodeName, outputDir string, interval time.Duration) {
+	var last []byte
+	if err := wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (done bool, err error) {
+		if !diskBudget.sample(artifacts.ResourceMetricsMonitor, nodeName) {
+			return false, nil
+		}
+		scraped := time.Now()
+		raw, err := client.RESTClient().Get().AbsPath("/api/v1/nodes/" + nodeName + "/proxy/metrics/resource").DoRaw(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithError(err).Errorf("failed to fetch resource metrics from node %s", nodeName)
+				collectionErrors.failed(artifacts.ResourceMetricsMonitor, nodeName, err)
+			}
+			return false, nil
+		}
+		collectionErrors.succeeded(artifacts.ResourceMetricsMonitor, nodeName)
+		if bytes.Equal(raw, last) {
+			if err := recordUnchanged(outputDir, scraped); err != nil {
+				logrus.WithError(err).Errorf("failed to record unchanged resource metrics")
+			}
+			return false, nil
+		}
+		last = raw
+		if err := os.WriteFile(filepath.Join(outputDir, strconv.FormatInt(scraped.UnixNano(), 10)+artifacts.MetricsSnapshotExtension), raw, 0666); err != nil {
+			logrus.WithError(err).Errorf("failed to record resource metrics from node %s", nodeName)
+		}
+		return false, nil
+	}); err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Errorf("failed to monitor resource metrics of node %s", nodeName)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const benchmarkLabel = "apiserver-watch-benchmarking/experiment"
+
+// createNamespace creates a uniquely-named namespace for the experiment, returning a cleanup function which
+// removes it. Cleanup uses a fresh context, so it still runs when the experiment's context has been cancelled.
+func createNamespace(ctx context.Context, client *kubernetes.Clientset, experiment string) (string, func(), error) {
+	namespace, err := client.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: experiment + "-",
+			Labels:       map[string]string{benchmarkLabel: experiment},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", func() {}, fmt.Errorf("could not create namespace: %w", err)
+	}
+	logrus.Infof("Created namespace %s", namespace.Name)
+	return namespace.Name, func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := client.CoreV1().Namespaces().Delete(cleanupCtx, namespace.Name, metav1.DeleteOptions{}); err != nil {
+			logrus.WithError(err).Errorf("failed to clean up namespace %s", namespace.Name)
+		}
+	}, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const (
+	restartMethodDeletePod = "delete-pod"
+	restartMethodCommand   = "command"
+)
+
+// restartOptions configure how an API server replica is restarted mid-experiment. Deleting the pod only restarts
+// the server when it is managed by a controller; static pods, as used by kubeadm, need a command which restarts
+// the container on the node, which is run with $POD and $NODE set to the target.
+type restartOptions struct {
+	prefix   string
+	selector string
+	pod      string
+	method   string
+	command  string
+	timeout  time.Duration
+}
+
+func defaultRestartOptions() *restartOptions {
+	return &restartOptions{
+		selector: "component=kube-apiserver",
+		method:   restartMethodDeletePod,
+		timeout:  5 * time.Minute,
+	}
+}
+
+func bindRestartOptions(fs *flag.FlagSet, prefix string, defaults *restartOptions) *restartOptions {
+	defaults.prefix = prefix
+	fs.StringVar(&defaults.selector, prefix+"selector", defaults.selector, "Label selector for API server pods.")
+	fs.StringVar(&defaults.pod, prefix+"pod", defaults.pod, "Name of the API server pod to restart, defaulting to the first matching the selector.")
+	fs.StringVar(&defaults.method, prefix+"method", defaults.method, "How to restart the API server, one of delete-pod or command.")
+	fs.StringVar(&defaults.command, prefix+"command", defaults.command, "Shell command restarting the API server, with $POD and $NODE set, for the command method.")
+	fs.DurationVar(&defaults.timeout, prefix+"timeout", defaults.timeout, "Maximum time to wait for the restarted API server to become ready.")
+	return defaults
+}
+
+func (o *restartOptions) validate(prefix string) error {
+	switch o.method {
+	case restartMethodDeletePod:
+	case restartMethodCommand:
+		if o.command == "" {
+			return fmt.Errorf("--%scommand is required for the %s method", prefix, restartMethodCommand)
+		}
+	default:
+		return fmt.Errorf("--%smethod must be one of %s or %s", prefix, restartMethodDeletePod, restartMethodCommand)
+	}
+	return nil
+}
+
+// target resolves the API server replica to restart. Deleting a static pod only deletes its mirror pod, which the
+// kubelet recreates without restarting the server, so targets with a mirror pod are refused for the delete-pod
+// method; experiments resolve their target before starting, so that this fails before any load is generated.
+func (o *restartOptions) target(ctx context.Context, client *kubernetes.Clientset) (*corev1.Pod, error) {
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: o.selector})
+	if err != nil {
+		return nil, fmt.Errorf("could not list API server pods: %w", err)
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].Name < pods.Items[j].Name
+	})
+	var target *corev1.Pod
+	for i := range pods.Items {
+		if o.pod == "" || pods.Items[i].Name == o.pod {
+			target = &pods.Items[i]
+			break
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("no API server pod matched %s", o.selector)
+	}
+	if _, mirror := target.Annotations[corev1.MirrorPodAnnotationKey]; mirror && o.method == restartMethodDeletePod {
+		return nil, fmt.Errorf("API server %s/%s is a static pod, which deleting does not restart: use --%smethod=%s with a --%scommand restarting its container on %s", target.Namespace, target.Name, o.prefix, restartMethodCommand, o.prefix, target.Spec.NodeName)
+	}
+	return target, nil
+}
+
+// restartAPIServer restarts one API server replica and waits for its replacement to be ready, returning the
+// restarted pod.
+func restartAPIServer(ctx context.Context, client *kubernetes.Clientset, opts *restartOptions) (*corev1.Pod, error) {
+	target, err := opts.target(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	// none of the replicas running before the restart can be the replacement of the target
+	existing, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: opts.selector})
+	if err != nil {
+		return nil, fmt.Errorf("could not list API server pods: %w", err)
+	}
+	previous := sets.NewString()
+	for _, pod := range existing.Items {
+		previous.Insert(string(pod.UID))
+	}
+
+	logrus.Infof("Restarting API server %s/%s on %s", target.Namespace, target.Name, target.Spec.NodeName)
+	timeline.annotate(artifacts.AnnotationRestart, "restarting API server %s/%s on %s", target.Namespace, target.Name, target.Spec.NodeName)
+	podHealth.inducingRestart(target.Spec.NodeName)
+	defer podHealth.restartInduced(target.Spec.NodeName)
+	switch opts.method {
+	case restartMethodDeletePod:
+		if err := client.CoreV1().Pods(target.Namespace).Delete(ctx, target.Name, metav1.DeleteOptions{}); err != nil {
+			return nil, fmt.Errorf("could not delete %s/%s: %w", target.Namespace, target.Name, err)
+		}
+	case restartMethodCommand:
+		cmd := exec.CommandContext(ctx, "sh", "-c", opts.command)
+		cmd.Env = append(os.Environ(), "POD="+target.Name, "NODE="+target.Spec.NodeName)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("could not restart %s/%s: %w: %s", target.Namespace, target.Name, err, string(output))
+		}
+	}
+
+	// the API server may well be unreachable while it restarts, so errors here are expected and retried
+	var replacement *corev1.Pod
+	if err := wait.PollUntilContextTimeout(ctx, time.Second, opts.timeout, false, func(ctx context.Context) (bool, error) {
+		pods, err := client.CoreV1().Pods(target.Namespace).List(ctx, metav1.ListOptions{LabelSelector: opts.selector})
+		if err != nil {
+			return false, nil
+		}
+		for i := range pods.Items {
+			if replaces(pods.Items[i], target, opts.method, previous) && podReady(pods.Items[i]) {
+				replacement = &pods.Items[i]
+				return true, nil
+			}
+		}
+		return false, nil
+	}); err != nil {
+		return nil, fmt.Errorf("restarted API server did not become ready: %w", err)
+	}
+	timeline.annotate(artifacts.AnnotationRestart, "API server %s/%s on %s ready again", replacement.Namespace, replacement.Name, replacement.Spec.NodeName)
+	return target, nil
+}
+
+// replaces determines whether the pod is the restarted target. A command restarts the containers of the target in
+// place, or has the kubelet recreate its static pod under the same name, so the pod must have restarted containers
+// or a new UID; deleting the target has its controller create a pod under a new name, on whichever node it was
+// scheduled to, so the pod must be one of the same controller which did not exist before the restart. Neither
+// compares container start times with the local clock, which the nodes' may be skewed from.
+func replaces(pod corev1.Pod, target *corev1.Pod, method string, previous sets.String) bool {
+	if method == restartMethodCommand {
+		return pod.Name == target.Name && (pod.UID != target.UID || restartCount(pod) > restartCount(*target))
+	}
+	if previous.Has(string(pod.UID)) {
+		return false
+	}
+	owner := metav1.GetControllerOf(target)
+	if owner == nil {
+		return true
+	}
+	replacementOwner := metav1.GetControllerOf(&pod)
+	return replacementOwner != nil && replacementOwner.UID == owner.UID
+}
+
+func restartCount(pod corev1.Pod) int32 {
+	var restarts int32
+	for _, status := range pod.Status.ContainerStatuses {
+		restarts += status.RestartCount
+	}
+	return restarts
+}
+
+func podReady(pod corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// rotation bounds the files a rollingFile writes: a new one is started once the current one would grow over the
+// size, or has been written to for longer than the interval.
+type rotation struct {
+	size     int64
+	interval time.Duration
+}
+
+// rollingFile appends documents as newline-delimited JSON to a series of files in a directory, named after the
+// Unix time in nanoseconds they were started, so that frequent samples do not each need a file of their own. Every
+// document is written out as soon as it is appended, so a run which is killed loses at most the line in flight.
+type rollingFile struct {
+	dir      string
+	rotation rotation
+
+	lock    sync.Mutex
+	file    *os.File
+	started time.Time
+	written int64
+}
+
+func newRollingFile(dir string, rotation rotation) *rollingFile {
+	return &rollingFile{dir: dir, rotation: rotation}
+}
+
+// append writes the document on a line of its own, rotating the file first if need be.
+func (f *rollingFile) append(document []byte) error {
+	line := &bytes.Buffer{}
+	if err := json.Compact(line, document); err != nil {
+		return fmt.Errorf("could not compact document: %w", err)
+	}
+	line.WriteByte('\n')
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	if f.file != nil && f.written > 0 && (f.written+int64(line.Len()) > f.rotation.size || now.Sub(f.started) > f.rotation.interval) {
+		if err := f.closeLocked(); err != nil {
+			return err
+		}
+	}
+	if f.file == nil {
+		file, err := os.OpenFile(filepath.Join(f.dir, strconv.FormatInt(now.UnixNano(), 10)+artifacts.SummaryLogExtension), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return fmt.Errorf("could not open file: %w", err)
+		}
+		f.file, f.started, f.written = file, now, 0
+	}
+	n, err := f.file.Write(line.Bytes())
+	f.written += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write to %s: %w", f.file.Name(), err)
+	}
+	return nil
+}
+
+// close closes the current file; appending afterwards starts a new one.
+func (f *rollingFile) close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closeLocked()
+}
+
+func (f *rollingFile) closeLocked() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return fmt.Errorf("could not close file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// rollingRestartExperimentOptions configure an experiment which holds open a fleet of watches, restarts one API
+// server replica and measures how the fleet recovers. Watchers relist before re-watching, as informers do. With a
+// bookmark cohort, watchers instead resume from the last resourceVersion they saw and only relist when it has
+// expired, and the given fraction of them ask for bookmarks, so that both populations can be compared.
+type rollingRestartExperimentOptions struct {
+	count          int
+	rate           int
+	objects        int
+	settle         time.Duration
+	bookmarkCohort float64
+	restart        *restartOptions
+}
+
+func defaultRollingRestartExperimentOptions() *rollingRestartExperimentOptions {
+	return &rollingRestartExperimentOptions{
+		count:   10000,
+		rate:    100,
+		objects: 100,
+		settle:  30 * time.Second,
+		restart: defaultRestartOptions(),
+	}
+}
+
+func bindRollingRestartExperimentOptions(fs *flag.FlagSet, defaults *rollingRestartExperimentOptions) *rollingRestartExperimentOptions {
+	prefix := "rolling-restart."
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps in the watched namespace, which every relist returns.")
+	fs.DurationVar(&defaults.settle, prefix+"settle", defaults.settle, "Time to hold steady state before the restart and after recovery.")
+	fs.Float64Var(&defaults.bookmarkCohort, prefix+"bookmark-cohort", defaults.bookmarkCohort, "Fraction of watchers which resume with bookmarks enabled, with the rest resuming without them; zero to always relist instead.")
+	bindRestartOptions(fs, prefix, defaults.restart)
+	return defaults
+}
+
+func (o *rollingRestartExperimentOptions) validate() error {
+	if o.rate <= 0 {
+		return errors.New("--rolling-restart.rate must be positive")
+	}
+	if o.bookmarkCohort < 0 || o.bookmarkCohort > 1 {
+		return errors.New("--rolling-restart.bookmark-cohort must be between zero and one")
+	}
+	return o.restart.validate("rolling-restart.")
+}
+
+const (
+	bookmarksCohort   = "bookmarks"
+	noBookmarksCohort = "no-bookmarks"
+)
+
+// inBookmarkCohort spreads the bookmark cohort evenly over the order in which watches are issued.
+func (o *rollingRestartExperimentOptions) inBookmarkCohort(index int) bool {
+	return int(float64(index+1)*o.bookmarkCohort) > int(float64(index)*o.bookmarkCohort)
+}
+
+const rollingRestartFile = "rolling-restart.json"
+
+type rollingRestartResult struct {
+	Pod       string    `json:"pod"`
+	Restarted time.Time `json:"restarted"`
+	Ready     time.Time `json:"ready"`
+	Recovered time.Time `json:"recovered"`
+
+	Watches       int `json:"watches"`
+	Disconnected  int `json:"disconnected"`
+	Reestablished int `json:"reestablished"`
+	// Reestablishment is the distribution of times between a watch being disconnected and opened again.
+	Reestablishment durationSummary `json:"reestablishment"`
+
+	// ClientRelists counts the lists issued by watchers before reconnecting, while StorageLists counts the lists
+	// the API servers served from etcd over the restart.
+	ClientRelists int64   `json:"clientRelists"`
+	StorageLists  float64 `json:"storageLists"`
+}
+
+func runRollingRestartExperiment(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, outputDir string, opts *rollingRestartExperimentOptions) error {
+	logrus.Info("Running rolling restart experiment")
+	if _, err := opts.restart.target(ctx, client); err != nil {
+		return err
+	}
+	namespace, cleanup, err := createNamespace(ctx, client, "rolling-restart")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := createConfigMaps(ctx, client, namespace, opts.objects); err != nil {
+		return err
+	}
+
+	var relists int64
+	relist := func(ctx context.Context) error {
+		atomic.AddInt64(&relists, 1)
+		_, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+		return err
+	}
+	cohortRelists := map[string]*int64{bookmarksCohort: new(int64), noBookmarksCohort: new(int64)}
+	cohortOf := func(index int) string {
+		if opts.inBookmarkCohort(index) {
+			return bookmarksCohort
+		}
+		return noBookmarksCohort
+	}
+	// resumingRelist only lists when the watch has no resourceVersion to resume from, seeding it from the list
+	resumingRelist := func(record *watchRecord, cohort string) func(context.Context) error {
+		return func(ctx context.Context) error {
+			if atomic.LoadInt64(&record.resourceVersion) != 0 {
+				return nil
+			}
+			atomic.AddInt64(&relists, 1)
+			atomic.AddInt64(cohortRelists[cohort], 1)
+			list, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return err
+			}
+			if resourceVersion, err := strconv.ParseInt(list.ResourceVersion, 10, 64); err == nil {
+				atomic.StoreInt64(&record.resourceVersion, resourceVersion)
+			}
+			return nil
+		}
+	}
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	tracker := newWatchTracker(opts.count)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.count; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if opts.bookmarkCohort == 0 {
+			go tracker.watchWithReconnect(ctx, i, configMapWatch(client, namespace), relist)
+			continue
+		}
+		record, cohort := &tracker.records[i], cohortOf(i)
+		go tracker.watchWithReconnect(ctx, i, resumingConfigMapWatch(client, namespace, record, cohort == bookmarksCohort), resumingRelist(record, cohort))
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.count, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+
+	phases.start("steady")
+	if err := holdFor(ctx, opts.settle); err != nil {
+		return err
+	}
+	storageListsBefore, err := scrapeStorageLists(ctx, client, config, opts.restart.selector)
+	if err != nil {
+		return err
+	}
+	relistsBefore := atomic.LoadInt64(&relists)
+
+	phases.start("restart")
+	restarted := time.Now()
+	pod, err := restartAPIServer(ctx, client, opts.restart)
+	if err != nil {
+		return err
+	}
+	ready := time.Now()
+
+	phases.start("recovery")
+	if err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, opts.restart.timeout, true, func(ctx context.Context) (bool, error) {
+		for i := range tracker.records {
+			record := &tracker.records[i]
+			if atomic.LoadInt64(&record.disconnected) != 0 && atomic.LoadInt64(&record.reestablished) < atomic.LoadInt64(&record.disconnected) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		logrus.WithError(err).Warn("not all disconnected watches were re-established")
+	}
+	recovered := time.Now()
+	phases.start("settle")
+	if err := holdFor(ctx, opts.settle); err != nil {
+		return err
+	}
+	storageListsAfter, err := scrapeStorageLists(ctx, client, config, opts.restart.selector)
+	if err != nil {
+		return err
+	}
+
+	result := rollingRestartResult{
+		Pod:           pod.Namespace + "/" + pod.Name,
+		Restarted:     restarted,
+		Ready:         ready,
+		Recovered:     recovered,
+		Watches:       opts.count,
+		ClientRelists: atomic.LoadInt64(&relists) - relistsBefore,
+		StorageLists:  counterIncrease(storageListsBefore, storageListsAfter),
+	}
+	var reestablishment []time.Duration
+	for i := range tracker.records {
+		record := &tracker.records[i]
+		disconnected, reestablished := atomic.LoadInt64(&record.disconnected), atomic.LoadInt64(&record.reestablished)
+		if disconnected == 0 {
+			continue
+		}
+		result.Disconnected++
+		if reestablished > disconnected {
+			result.Reestablished++
+			reestablishment = append(reestablishment, time.Duration(reestablished-disconnected))
+		}
+	}
+	result.Reestablishment = summarizeDurations(reestablishment)
+	if opts.bookmarkCohort > 0 {
+		if err := artifacts.Write(outputDir, artifacts.CohortsFile, cohortsOf(tracker, cohortOf, cohortRelists)); err != nil {
+			return err
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"disconnected":  result.Disconnected,
+		"reestablished": result.Reestablished,
+		"p99":           fmt.Sprintf("%.3fs", result.Reestablishment.P99),
+		"relists":       result.ClientRelists,
+		"storageLists":  result.StorageLists,
+	}).Info("Watch fleet recovered")
+	if err := artifacts.Write(outputDir, artifacts.LatenciesFile, tracker.latencies()); err != nil {
+		return err
+	}
+	if err := artifacts.Write(outputDir, rollingRestartFile, result); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished rolling restart experiment")
+	return nil
+}
+
+// scrapeStorageLists determines how many lists each API server replica has served from etcd, keyed by pod.
+func scrapeStorageLists(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, selector string) (map[string]float64, error) {
+	instances, err := apiserverInstances(ctx, client, config, selector)
+	if err != nil {
+		return nil, err
+	}
+	lists := map[string]float64{}
+	for _, instance := range instances {
+		families, err := scrapeMetrics(ctx, instance.client)
+		if err != nil {
+			return nil, fmt.Errorf("could not scrape %s: %w", instance.pod, err)
+		}
+		lists[instance.pod] = sumMetric(families, "apiserver_storage_list_total", map[string]string{"resource": "configmaps"})
+	}
+	return lists, nil
+}
+
+// createConfigMaps populates the namespace with trivial ConfigMaps.
+func createConfigMaps(ctx context.Context, client *kubernetes.Clientset, namespace string, count int) error {
+	return createSizedConfigMaps(ctx, client, namespace, count, 0)
+}
+
+// createSizedConfigMaps creates ConfigMaps carrying a payload of the size, in bytes, on top of their index.
+func createSizedConfigMaps(ctx context.Context, client *kubernetes.Clientset, namespace string, count, size int) error {
+	for i := 0; i < count; i++ {
+		data := map[string]string{"index": strconv.Itoa(i)}
+		if size > 0 {
+			data["payload"] = strings.Repeat("x", size)
+		}
+		if _, err := client.CoreV1().ConfigMaps(namespace).Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: objectNames.object(i)},
+			Data:       data,
+		}, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("could not create ConfigMap: %w", err)
+		}
+	}
+	return nil
+}
+
+func cohortsOf(tracker *watchTracker, cohortOf func(int) string, relists map[string]*int64) artifacts.Cohorts {
+	cohorts := artifacts.Cohorts{}
+	for i := range tracker.records {
+		record := &tracker.records[i]
+		name := cohortOf(i)
+		cohort := cohorts[name]
+		cohort.Watches++
+		disconnected, reestablished := atomic.LoadInt64(&record.disconnected), atomic.LoadInt64(&record.reestablished)
+		if disconnected != 0 {
+			cohort.Disconnected++
+			if reestablished > disconnected {
+				cohort.Reestablished++
+				cohort.Reestablishment = append(cohort.Reestablishment, time.Duration(reestablished-disconnected).Seconds())
+			}
+		}
+		cohort.Relists = atomic.LoadInt64(relists[name])
+		cohorts[name] = cohort
+	}
+	return cohorts
+}
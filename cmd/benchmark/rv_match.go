@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// rvMatchExperimentOptions configure an experiment which lists with every combination of resourceVersion and
+// resourceVersionMatch semantics, recording whether the API servers served each from the watch cache or from etcd.
+type rvMatchExperimentOptions struct {
+	objects  int
+	requests int
+	updates  int
+}
+
+func defaultRVMatchExperimentOptions() *rvMatchExperimentOptions {
+	return &rvMatchExperimentOptions{
+		objects:  1000,
+		requests: 100,
+		updates:  100,
+	}
+}
+
+func bindRVMatchExperimentOptions(fs *flag.FlagSet, defaults *rvMatchExperimentOptions) *rvMatchExperimentOptions {
+	prefix := "rv-match."
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps in the listed namespace.")
+	fs.IntVar(&defaults.requests, prefix+"requests", defaults.requests, "Number of lists to issue for every variant.")
+	fs.IntVar(&defaults.updates, prefix+"updates", defaults.updates, "Number of updates made after populating the namespace, so that the resourceVersion recorded then is not the latest.")
+	return defaults
+}
+
+func (o *rvMatchExperimentOptions) validate() error {
+	if o.objects <= 0 || o.requests <= 0 {
+		return errors.New("--rv-match.objects and --rv-match.requests must be positive")
+	}
+	return nil
+}
+
+const rvMatchFile = "rv-match.json"
+
+type rvMatchResult struct {
+	ResourceVersion      string `json:"resourceVersion"`
+	ResourceVersionMatch string `json:"resourceVersionMatch,omitempty"`
+
+	Requests int             `json:"requests"`
+	Errors   map[string]int  `json:"errors,omitempty"`
+	Latency  durationSummary `json:"latency"`
+	// CacheLists and StorageLists count the lists the API servers served from the watch cache and from etcd.
+	CacheLists   float64 `json:"cacheLists"`
+	StorageLists float64 `json:"storageLists"`
+}
+
+type rvMatchVariant struct {
+	name    string
+	options metav1.ListOptions
+}
+
+func runRVMatchExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *rvMatchExperimentOptions) error {
+	logrus.Info("Running resourceVersionMatch experiment")
+	namespace, cleanup, err := createNamespace(ctx, client, "rv-match")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	if err := createConfigMaps(ctx, client, namespace, opts.objects); err != nil {
+		return err
+	}
+	populated, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{Limit: 1})
+	if err != nil {
+		return fmt.Errorf("could not determine resourceVersion: %w", err)
+	}
+	older := populated.ResourceVersion
+	for i := 0; i < opts.updates; i++ {
+		object, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, objectNames.object(i%opts.objects), metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("could not get ConfigMap: %w", err)
+		}
+		object.Data["updated"] = time.Now().Format(time.RFC3339Nano)
+		if _, err := client.CoreV1().ConfigMaps(namespace).Update(ctx, object, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("could not update ConfigMap: %w", err)
+		}
+	}
+	latest, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{Limit: 1})
+	if err != nil {
+		return fmt.Errorf("could not determine resourceVersion: %w", err)
+	}
+
+	variants := []rvMatchVariant{
+		{name: "consistent", options: metav1.ListOptions{}},
+		{name: "any", options: metav1.ListOptions{ResourceVersion: "0"}},
+		{name: "not-older-than-latest", options: metav1.ListOptions{ResourceVersion: latest.ResourceVersion, ResourceVersionMatch: metav1.ResourceVersionMatchNotOlderThan}},
+		{name: "not-older-than-older", options: metav1.ListOptions{ResourceVersion: older, ResourceVersionMatch: metav1.ResourceVersionMatchNotOlderThan}},
+		{name: "exact-latest", options: metav1.ListOptions{ResourceVersion: latest.ResourceVersion, ResourceVersionMatch: metav1.ResourceVersionMatchExact}},
+		{name: "exact-older", options: metav1.ListOptions{ResourceVersion: older, ResourceVersionMatch: metav1.ResourceVersionMatchExact}},
+	}
+	results := map[string]rvMatchResult{}
+	for _, variant := range variants {
+		phases.start(variant.name)
+		result, err := runRVMatchVariant(ctx, client, namespace, variant, opts.requests)
+		if err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"errors":       result.Errors,
+			"p99":          fmt.Sprintf("%.3fs", result.Latency.P99),
+			"cacheLists":   result.CacheLists,
+			"storageLists": result.StorageLists,
+		}).Infof("Listed with %s semantics", variant.name)
+		results[variant.name] = result
+	}
+	if err := artifacts.Write(outputDir, rvMatchFile, results); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished resourceVersionMatch experiment")
+	return nil
+}
+
+// runRVMatchVariant issues the lists sequentially, so that the lists the API servers record in between scrapes are
+// attributable to the variant.
+func runRVMatchVariant(ctx context.Context, client *kubernetes.Clientset, namespace string, variant rvMatchVariant, requests int) (rvMatchResult, error) {
+	result := rvMatchResult{
+		ResourceVersion:      variant.options.ResourceVersion,
+		ResourceVersionMatch: string(variant.options.ResourceVersionMatch),
+		Requests:             requests,
+		Errors:               map[string]int{},
+	}
+	before, err := scrapeListSources(ctx)
+	if err != nil {
+		return result, err
+	}
+	var latencies []time.Duration
+	for i := 0; i < requests; i++ {
+		start := time.Now()
+		_, err := client.CoreV1().ConfigMaps(namespace).List(ctx, variant.options)
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if err != nil {
+			if reason := apierrors.ReasonForError(err); reason != metav1.StatusReasonUnknown {
+				result.Errors[string(reason)]++
+			} else {
+				result.Errors[err.Error()]++
+			}
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	result.Latency = summarizeDurations(latencies)
+	after, err := scrapeListSources(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.CacheLists = counterIncrease(before.cache, after.cache)
+	result.StorageLists = counterIncrease(before.storage, after.storage)
+	return result, nil
+}
+
+type listSources struct {
+	cache, storage map[string]float64
+}
+
+// scrapeListSources determines how many ConfigMap lists each API server replica has served from the watch cache
+// and from etcd, keyed by pod.
+func scrapeListSources(ctx context.Context) (listSources, error) {
+	scraped, err := apiserverScrapes.all(ctx, 0)
+	if err != nil {
+		return listSources{}, err
+	}
+	sources := listSources{cache: map[string]float64{}, storage: map[string]float64{}}
+	for pod, families := range scraped {
+		sources.cache[pod] = sumMetric(families, "apiserver_cache_list_total", map[string]string{"resource_prefix": "/configmaps"})
+		sources.storage[pod] = sumMetric(families, "apiserver_storage_list_total", map[string]string{"resource": "configmaps"})
+	}
+	return sources, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// instanceRefreshInterval is how long the API server replicas are resolved for before they are listed again, to
+// follow replicas which were replaced.
+const instanceRefreshInterval = time.Minute
+
+// apiserverScrapes is shared by every monitor which samples the metrics of the API server replicas, so that the
+// replicas are not listed, and every replica is not scraped, once for each of them on every tick.
+var apiserverScrapes = &scrapeCache{scrapes: map[string]*replicaScrape{}}
+
+// replicaScrape is the latest scrape of one replica. Its metric families are parsed on first use, as the monitor
+// recording snapshots verbatim has no use for them, and are shared between monitors, which must not modify them.
+type replicaScrape struct {
+	lock     sync.Mutex
+	time     time.Time
+	raw      []byte
+	families map[string]*dto.MetricFamily
+}
+
+type scrapeCache struct {
+	lock      sync.Mutex
+	client    *kubernetes.Clientset
+	config    *rest.Config
+	selector  string
+	instances []apiserverInstance
+	resolved  time.Time
+	scrapes   map[string]*replicaScrape
+}
+
+func (c *scrapeCache) setup(client *kubernetes.Clientset, config *rest.Config, selector string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.client, c.config, c.selector = client, config, selector
+}
+
+// replicas resolves the API server replicas, listing them again once instanceRefreshInterval has passed, or after a
+// scrape of one of them failed, as it may have been replaced.
+func (c *scrapeCache) replicas(ctx context.Context) ([]apiserverInstance, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.instances != nil && time.Since(c.resolved) < instanceRefreshInterval {
+		return c.instances, nil
+	}
+	instances, err := apiserverInstances(ctx, c.client, c.config, c.selector)
+	if err != nil {
+		return nil, err
+	}
+	c.instances, c.resolved = instances, time.Now()
+	return instances, nil
+}
+
+func (c *scrapeCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.instances = nil
+}
+
+// raw returns the latest scrape of the replica if it was taken less than maxAge ago, and scrapes it again otherwise.
+// Monitors pass half their interval, so that those sampling at the same interval share every scrape while none reads
+// one taken long before its tick.
+func (c *scrapeCache) raw(ctx context.Context, instance apiserverInstance, maxAge time.Duration) (time.Time, []byte, error) {
+	scrape, err := c.take(ctx, instance, maxAge, false)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return scrape.time, scrape.raw, nil
+}
+
+// families scrapes the replica as raw does, parsing its metric families once for every monitor that reads them.
+func (c *scrapeCache) families(ctx context.Context, instance apiserverInstance, maxAge time.Duration) (time.Time, map[string]*dto.MetricFamily, error) {
+	scrape, err := c.take(ctx, instance, maxAge, true)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return scrape.time, scrape.families, nil
+}
+
+func (c *scrapeCache) take(ctx context.Context, instance apiserverInstance, maxAge time.Duration, parse bool) (replicaScrape, error) {
+	c.lock.Lock()
+	scrape, exists := c.scrapes[instance.pod]
+	if !exists {
+		scrape = &replicaScrape{}
+		c.scrapes[instance.pod] = scrape
+	}
+	c.lock.Unlock()
+
+	// concurrent readers of the same replica wait for one scrape rather than each taking their own
+	scrape.lock.Lock()
+	defer scrape.lock.Unlock()
+	if scrape.raw == nil || time.Since(scrape.time) >= maxAge {
+		scraped := time.Now()
+		raw, err := instance.client.Get().AbsPath("/metrics").DoRaw(ctx)
+		if err != nil {
+			c.invalidate()
+			return replicaScrape{}, fmt.Errorf("could not scrape metrics: %w", err)
+		}
+		scrape.time, scrape.raw, scrape.families = scraped, raw, nil
+	}
+	if parse && scrape.families == nil {
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(bytes.NewReader(scrape.raw))
+		if err != nil {
+			return replicaScrape{}, fmt.Errorf("could not parse metrics: %w", err)
+		}
+		scrape.families = families
+	}
+	return replicaScrape{time: scrape.time, raw: scrape.raw, families: scrape.families}, nil
+}
+
+// all scrapes every replica as families does, keyed by pod.
+func (c *scrapeCache) all(ctx context.Context, maxAge time.Duration) (map[string]map[string]*dto.MetricFamily, error) {
+	instances, err := c.replicas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scraped := map[string]map[string]*dto.MetricFamily{}
+	for _, instance := range instances {
+		_, families, err := c.families(ctx, instance, maxAge)
+		if err != nil {
+			return nil, fmt.Errorf("could not scrape %s: %w", instance.pod, err)
+		}
+		scraped[instance.pod] = families
+	}
+	return scraped, nil
+}
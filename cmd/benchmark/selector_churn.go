@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// selectorChurnExperimentOptions configure an experiment in which objects flap between two label values, each
+// selected by half of the watchers, so that every relabel is delivered as a synthetic deletion to one half and a
+// synthetic addition to the other. A phase of updates which leave labels alone is the reference for the cost of
+// re-evaluating selectors.
+type selectorChurnExperimentOptions struct {
+	objects   int
+	watches   int
+	rate      int
+	writeRate int
+	duration  time.Duration
+}
+
+func defaultSelectorChurnExperimentOptions() *selectorChurnExperimentOptions {
+	return &selectorChurnExperimentOptions{
+		objects:   100,
+		watches:   1000,
+		rate:      100,
+		writeRate: 10,
+		duration:  2 * time.Minute,
+	}
+}
+
+func bindSelectorChurnExperimentOptions(fs *flag.FlagSet, defaults *selectorChurnExperimentOptions) *selectorChurnExperimentOptions {
+	prefix := "selector-churn."
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps written to.")
+	fs.IntVar(&defaults.watches, prefix+"watches", defaults.watches, "Number of watches with label selectors.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.writeRate, prefix+"write-rate", defaults.writeRate, "Rate of writes, either updates or relabels, in Hertz.")
+	fs.DurationVar(&defaults.duration, prefix+"duration", defaults.duration, "Time to hold each of the idle, update and relabel phases for.")
+	return defaults
+}
+
+func (o *selectorChurnExperimentOptions) validate() error {
+	if o.objects <= 0 || o.rate <= 0 || o.writeRate <= 0 {
+		return errors.New("--selector-churn.objects, --selector-churn.rate and --selector-churn.write-rate must be positive")
+	}
+	return nil
+}
+
+const selectorChurnFile = "selector-churn.json"
+
+const (
+	churnGroupLabel = "group"
+	updatesPhase    = "updates"
+	relabelsPhase   = "relabels"
+)
+
+var churnGroups = [2]string{"a", "b"}
+
+type selectorChurnPhase struct {
+	Writes      int64 `json:"writes"`
+	WriteErrors int64 `json:"writeErrors"`
+	// Events is the number of events delivered to all watchers, and EventsPerWrite the fan-out of every write.
+	Events         int64   `json:"events"`
+	EventsPerWrite float64 `json:"eventsPerWrite"`
+}
+
+func runSelectorChurnExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *selectorChurnExperimentOptions) error {
+	logrus.Info("Running selector churn experiment")
+	namespace, cleanup, err := createNamespace(ctx, client, "selector-churn")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	// objects start evenly spread over the groups
+	for i := 0; i < opts.objects; i++ {
+		if _, err := client.CoreV1().ConfigMaps(namespace).Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: objectNames.object(i), Labels: map[string]string{churnGroupLabel: churnGroups[i%2]}},
+			Data:       map[string]string{"generation": "0"},
+		}, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("could not create ConfigMap: %w", err)
+		}
+	}
+	tracker := newWatchTracker(opts.watches)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.watches; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		go tracker.watch(ctx, i, selectingConfigMapWatch(client, namespace, churnGroupLabel+"="+churnGroups[i%2]))
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.watches, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+
+	phases.start(artifacts.BaselinePhase)
+	if err := holdFor(ctx, opts.duration); err != nil {
+		return err
+	}
+
+	results := map[string]selectorChurnPhase{}
+	// groups holds the current group of every object, so that relabels always flip it
+	groups := make([]int, opts.objects)
+	for i := range groups {
+		groups[i] = i % 2
+	}
+	for _, phase := range []string{updatesPhase, relabelsPhase} {
+		phases.start(phase)
+		before := totalEvents(tracker)
+		var result selectorChurnPhase
+		writeCtx, cancel := context.WithTimeout(ctx, opts.duration)
+		writes := time.NewTicker(time.Second / time.Duration(opts.writeRate))
+		for i := 0; ; i++ {
+			select {
+			case <-writeCtx.Done():
+			case <-writes.C:
+				index := i % opts.objects
+				if phase == relabelsPhase {
+					groups[index] = 1 - groups[index]
+				}
+				_, err := client.CoreV1().ConfigMaps(namespace).Update(writeCtx, &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: objectNames.object(index), Labels: map[string]string{churnGroupLabel: churnGroups[groups[index]]}},
+					Data:       map[string]string{"generation": strconv.Itoa(i + 1)},
+				}, metav1.UpdateOptions{})
+				if writeCtx.Err() == nil {
+					result.Writes++
+					if err != nil {
+						result.WriteErrors++
+					}
+				}
+				continue
+			}
+			break
+		}
+		writes.Stop()
+		cancel()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result.Events = totalEvents(tracker) - before
+		if result.Writes > 0 {
+			result.EventsPerWrite = float64(result.Events) / float64(result.Writes)
+		}
+		logrus.Infof("%s: %d writes delivered as %d events", phase, result.Writes, result.Events)
+		results[phase] = result
+	}
+	if err := artifacts.Write(outputDir, selectorChurnFile, results); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished selector churn experiment")
+	return nil
+}
+
+func totalEvents(tracker *watchTracker) int64 {
+	var events int64
+	for i := range tracker.records {
+		events += atomic.LoadInt64(&tracker.records[i].events)
+	}
+	return events
+}
+
+func selectingConfigMapWatch(client *kubernetes.Clientset, namespace, selector string) openWatch {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return client.CoreV1().RESTClient().Get().
+			Namespace(namespace).
+			Resource("configmaps").
+			VersionedParams(&metav1.ListOptions{Watch: true, LabelSelector: selector}, scheme.ParameterCodec).
+			Stream(ctx)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// selfTestOptions configure a run of the latent watch generator against a trivial API server in a child process,
+// measuring the client-side overhead of each watch so that generator hosts can be sized.
+type selfTestOptions struct {
+	count int
+	rate  int
+	serve bool
+}
+
+func defaultSelfTestOptions() *selfTestOptions {
+	return &selfTestOptions{
+		count: 100000,
+		rate:  1000,
+	}
+}
+
+func bindSelfTestOptions(fs *flag.FlagSet, defaults *selfTestOptions) *selfTestOptions {
+	prefix := "self-test."
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.BoolVar(&defaults.serve, prefix+"serve", defaults.serve, "Serve the API server for a self-test; used internally.")
+	return defaults
+}
+
+const selfTestFile = "self-test.json"
+
+type selfTestResult struct {
+	Watches            int     `json:"watches"`
+	HeapBytesPerWatch  float64 `json:"heapBytesPerWatch"`
+	StackBytesPerWatch float64 `json:"stackBytesPerWatch"`
+	TotalBytesPerWatch float64 `json:"totalBytesPerWatch"`
+	GoroutinesPerWatch float64 `json:"goroutinesPerWatch"`
+}
+
+func runSelfTest(ctx context.Context, outputDir string, opts *selfTestOptions) error {
+	logrus.Info("Running self-test")
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not determine executable: %w", err)
+	}
+	server := exec.CommandContext(ctx, executable, "--experiment="+string(selfTestExperiment), "--self-test.serve")
+	server.Stderr = os.Stderr
+	stdout, err := server.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("could not connect to self-test server: %w", err)
+	}
+	if err := server.Start(); err != nil {
+		return fmt.Errorf("could not start self-test server: %w", err)
+	}
+	defer func() {
+		if err := server.Process.Kill(); err != nil {
+			logrus.WithError(err).Error("failed to stop self-test server")
+		}
+		_ = server.Wait()
+	}()
+	scanner := bufio.NewScanner(stdout)
+	if !scanner.Scan() {
+		return fmt.Errorf("self-test server did not report its address: %v", scanner.Err())
+	}
+
+	client, err := kubernetes.NewForConfig(&rest.Config{
+		Host:            scanner.Text(),
+		TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+		QPS:             -1,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create self-test client: %w", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	goroutinesBefore := runtime.NumGoroutine()
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tracker := issueLatentWatches(watchCtx, client, &latentWatchExperimentOptions{count: opts.count, rate: opts.rate})
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	open := tracker.openCount()
+	if open == 0 {
+		return fmt.Errorf("no watches were established")
+	}
+	perWatch := func(before, after uint64) float64 {
+		return (float64(after) - float64(before)) / float64(open)
+	}
+	result := selfTestResult{
+		Watches:            open,
+		HeapBytesPerWatch:  perWatch(before.HeapInuse, after.HeapInuse),
+		StackBytesPerWatch: perWatch(before.StackInuse, after.StackInuse),
+		TotalBytesPerWatch: perWatch(before.Sys, after.Sys),
+		GoroutinesPerWatch: float64(runtime.NumGoroutine()-goroutinesBefore) / float64(open),
+	}
+	logrus.WithFields(logrus.Fields{
+		"watches":    result.Watches,
+		"heap":       fmt.Sprintf("%.0fB/watch", result.HeapBytesPerWatch),
+		"stack":      fmt.Sprintf("%.0fB/watch", result.StackBytesPerWatch),
+		"total":      fmt.Sprintf("%.0fB/watch", result.TotalBytesPerWatch),
+		"goroutines": fmt.Sprintf("%.1f/watch", result.GoroutinesPerWatch),
+	}).Info("Measured client overhead")
+	return artifacts.Write(outputDir, selfTestFile, result)
+}
+
+// serveSelfTest serves an API server which accepts every watch and then holds it idle, printing the address on
+// which it is listening.
+func serveSelfTest() error {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	// mirror the kube-apiserver default for --http2-max-streams-per-connection
+	if err := http2.ConfigureServer(server.Config, &http2.Server{MaxConcurrentStreams: 1000}); err != nil {
+		return fmt.Errorf("could not configure HTTP/2: %w", err)
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	fmt.Println(server.URL)
+	select {}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// soakExperimentOptions configure an experiment which holds a steady watch and churn load for hours, snapshotting
+// the state of the API servers periodically, so that slow memory growth and drift in the watch cache show up
+// where a short experiment would only see spikes.
+type soakExperimentOptions struct {
+	count    int
+	rate     int
+	churn    int
+	duration time.Duration
+	interval time.Duration
+}
+
+func defaultSoakExperimentOptions() *soakExperimentOptions {
+	return &soakExperimentOptions{
+		count:    1000,
+		rate:     100,
+		churn:    10,
+		duration: 4 * time.Hour,
+		interval: 5 * time.Minute,
+	}
+}
+
+func bindSoakExperimentOptions(fs *flag.FlagSet, defaults *soakExperimentOptions) *soakExperimentOptions {
+	prefix := "soak."
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to hold open.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.IntVar(&defaults.churn, prefix+"churn", defaults.churn, "Rate of ConfigMap create, update and delete cycles in the watched namespace, in Hertz, or zero for none.")
+	fs.DurationVar(&defaults.duration, prefix+"duration", defaults.duration, "Time to hold the load for.")
+	fs.DurationVar(&defaults.interval, prefix+"interval", defaults.interval, "Time between snapshots of API server state.")
+	return defaults
+}
+
+func (o *soakExperimentOptions) validate() error {
+	if o.churn < 0 {
+		return errors.New("--soak.churn must not be negative")
+	}
+	if o.interval <= 0 || o.duration < o.interval {
+		return errors.New("--soak.interval must be positive and no longer than --soak.duration")
+	}
+	return nil
+}
+
+const soakFile = "soak.json"
+
+type soakResult struct {
+	Snapshots []soakSnapshot `json:"snapshots"`
+	// Growth is the slope of a least-squares fit of each quantity over the soak, per hour, keyed by pod.
+	Growth map[string]replicaState `json:"growth,omitempty"`
+}
+
+type soakSnapshot struct {
+	Time time.Time `json:"time"`
+	// OpenWatches and Reconnects are as seen by the generator, while Replicas holds the state of every API server.
+	OpenWatches int                     `json:"openWatches"`
+	Reconnects  int64                   `json:"reconnects"`
+	Replicas    map[string]replicaState `json:"replicas"`
+}
+
+type replicaState struct {
+	HeapBytes          float64 `json:"heapBytes"`
+	ResidentBytes      float64 `json:"residentBytes"`
+	Goroutines         float64 `json:"goroutines"`
+	Watches            float64 `json:"watches"`
+	WatchCacheCapacity float64 `json:"watchCacheCapacity"`
+}
+
+func runSoakExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *soakExperimentOptions) error {
+	logrus.Info("Running soak experiment")
+	namespace, cleanup, err := createNamespace(ctx, client, "soak")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	tracker := newWatchTracker(opts.count)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	for i := 0; i < opts.count; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		// watches are closed by the server at its request timeout, so they must reconnect to last the soak
+		go tracker.watchWithReconnect(ctx, i, configMapWatch(client, namespace), nil)
+	}
+	if err := tracker.waitForEstablishment(ctx, opts.count, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+
+	phases.start("soak")
+	soakCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+	if opts.churn > 0 {
+		go func() {
+			if err := churnConfigMaps(soakCtx, client, namespace, opts.churn, opts.duration); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Error("failed to churn ConfigMaps")
+			}
+		}()
+	}
+
+	var result soakResult
+	snapshots := time.NewTicker(opts.interval)
+	defer snapshots.Stop()
+	for {
+		snapshot, err := snapshotSoak(soakCtx, tracker)
+		if err != nil {
+			logrus.WithError(err).Warn("failed to snapshot API server state")
+		} else {
+			result.Snapshots = append(result.Snapshots, snapshot)
+			// the result is rewritten with every snapshot, so that a soak cut short still leaves its data
+			if err := artifacts.Write(outputDir, soakFile, result); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-soakCtx.Done():
+		case <-snapshots.C:
+			continue
+		}
+		break
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	result.Growth = soakGrowth(result.Snapshots)
+	for pod, growth := range result.Growth {
+		logrus.WithFields(logrus.Fields{
+			"pod":        pod,
+			"heap":       fmt.Sprintf("%.0fB/h", growth.HeapBytes),
+			"goroutines": fmt.Sprintf("%.1f/h", growth.Goroutines),
+		}).Info("API server growth over soak")
+	}
+	if err := artifacts.Write(outputDir, soakFile, result); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished soak experiment")
+	return nil
+}
+
+func snapshotSoak(ctx context.Context, tracker *watchTracker) (soakSnapshot, error) {
+	snapshot := soakSnapshot{Time: time.Now(), OpenWatches: tracker.openCount(), Replicas: map[string]replicaState{}}
+	for i := range tracker.records {
+		snapshot.Reconnects += atomic.LoadInt64(&tracker.records[i].reconnects)
+	}
+	scraped, err := apiserverScrapes.all(ctx, 0)
+	if err != nil {
+		return snapshot, err
+	}
+	for pod, families := range scraped {
+		snapshot.Replicas[pod] = replicaState{
+			HeapBytes:          sumMetric(families, "go_memstats_heap_inuse_bytes", nil),
+			ResidentBytes:      sumMetric(families, "process_resident_memory_bytes", nil),
+			Goroutines:         sumMetric(families, "go_goroutines", nil),
+			Watches:            sumMetric(families, "apiserver_longrunning_requests", map[string]string{"verb": "WATCH"}),
+			WatchCacheCapacity: sumMetric(families, "watch_cache_capacity", map[string]string{"resource": "configmaps"}),
+		}
+	}
+	return snapshot, nil
+}
+
+// soakGrowth fits a line through every quantity of every replica over time, in units per hour. Replicas which
+// were not present in at least two snapshots are left out.
+func soakGrowth(snapshots []soakSnapshot) map[string]replicaState {
+	hours := map[string][]float64{}
+	states := map[string][]replicaState{}
+	for _, snapshot := range snapshots {
+		for pod, state := range snapshot.Replicas {
+			hours[pod] = append(hours[pod], snapshot.Time.Sub(snapshots[0].Time).Hours())
+			states[pod] = append(states[pod], state)
+		}
+	}
+	growth := map[string]replicaState{}
+	for pod, x := range hours {
+		if len(x) < 2 {
+			continue
+		}
+		field := func(value func(replicaState) float64) float64 {
+			y := make([]float64, len(states[pod]))
+			for i, state := range states[pod] {
+				y[i] = value(state)
+			}
+			return fitSlope(x, y)
+		}
+		growth[pod] = replicaState{
+			HeapBytes:          field(func(s replicaState) float64 { return s.HeapBytes }),
+			ResidentBytes:      field(func(s replicaState) float64 { return s.ResidentBytes }),
+			Goroutines:         field(func(s replicaState) float64 { return s.Goroutines }),
+			Watches:            field(func(s replicaState) float64 { return s.Watches }),
+			WatchCacheCapacity: field(func(s replicaState) float64 { return s.WatchCacheCapacity }),
+		}
+	}
+	return growth
+}
+
+// fitSlope determines the slope of the least-squares line through the points.
+func fitSlope(x, y []float64) float64 {
+	var meanX, meanY float64
+	for i := range x {
+		meanX += x[i] / float64(len(x))
+		meanY += y[i] / float64(len(y))
+	}
+	var covariance, variance float64
+	for i := range x {
+		covariance += (x[i] - meanX) * (y[i] - meanY)
+		variance += (x[i] - meanX) * (x[i] - meanX)
+	}
+	if variance == 0 {
+		return 0
+	}
+	return covariance / variance
+}
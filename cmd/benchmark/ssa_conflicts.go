@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// ssaConflictsExperimentOptions configure an experiment in which several field managers repeatedly apply
+// overlapping configuration to the same objects. Managers which force their applies take ownership of the shared
+// field from one another, churning managedFields, while the rest are refused with conflicts.
+type ssaConflictsExperimentOptions struct {
+	managers int
+	forcing  int
+	objects  int
+	rate     int
+	duration time.Duration
+}
+
+func defaultSSAConflictsExperimentOptions() *ssaConflictsExperimentOptions {
+	return &ssaConflictsExperimentOptions{
+		managers: 4,
+		forcing:  2,
+		objects:  10,
+		rate:     10,
+		duration: 2 * time.Minute,
+	}
+}
+
+func bindSSAConflictsExperimentOptions(fs *flag.FlagSet, defaults *ssaConflictsExperimentOptions) *ssaConflictsExperimentOptions {
+	prefix := "ssa-conflicts."
+	fs.IntVar(&defaults.managers, prefix+"managers", defaults.managers, "Number of field managers applying to the objects.")
+	fs.IntVar(&defaults.forcing, prefix+"forcing", defaults.forcing, "Number of the field managers which force their applies.")
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps the managers contend for.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of applies from every manager, in Hertz.")
+	fs.DurationVar(&defaults.duration, prefix+"duration", defaults.duration, "Time to keep applying for.")
+	return defaults
+}
+
+func (o *ssaConflictsExperimentOptions) validate() error {
+	if o.managers <= 0 || o.objects <= 0 || o.rate <= 0 {
+		return errors.New("--ssa-conflicts.managers, --ssa-conflicts.objects and --ssa-conflicts.rate must be positive")
+	}
+	if o.forcing < 0 || o.forcing > o.managers {
+		return errors.New("--ssa-conflicts.forcing must be between zero and --ssa-conflicts.managers")
+	}
+	return nil
+}
+
+const ssaConflictsFile = "ssa-conflicts.json"
+
+type ssaConflictsResult struct {
+	Managers int `json:"managers"`
+	Forcing  int `json:"forcing"`
+	Objects  int `json:"objects"`
+
+	Applies   int            `json:"applies"`
+	Conflicts int            `json:"conflicts"`
+	Errors    map[string]int `json:"errors,omitempty"`
+	// Latency is the distribution of times taken by successful applies, while ConflictLatency is that of the
+	// applies refused with a conflict.
+	Latency         durationSummary `json:"latency"`
+	ConflictLatency durationSummary `json:"conflictLatency"`
+
+	// Before and After are the mean sizes of the objects once every manager has applied to them and at the end.
+	Before objectSize `json:"before"`
+	After  objectSize `json:"after"`
+}
+
+type objectSize struct {
+	Bytes              float64 `json:"bytes"`
+	ManagedFieldsBytes float64 `json:"managedFieldsBytes"`
+}
+
+func runSSAConflictsExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *ssaConflictsExperimentOptions) error {
+	logrus.Info("Running server-side apply conflicts experiment")
+	namespace, cleanup, err := createNamespace(ctx, client, "ssa-conflicts")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	managers := make([]ssaManager, opts.managers)
+	for i := range managers {
+		managers[i] = ssaManager{name: "manager-" + strconv.Itoa(i), force: i < opts.forcing}
+	}
+
+	phases.start("setup")
+	// every manager applies once without contention, forcing, so that all of them hold some fields to begin with
+	for i := 0; i < opts.objects; i++ {
+		for _, manager := range managers {
+			if _, err := client.CoreV1().ConfigMaps(namespace).Apply(ctx, manager.configuration(namespace, i, 0), metav1.ApplyOptions{FieldManager: manager.name, Force: true}); err != nil {
+				return fmt.Errorf("could not apply ConfigMap: %w", err)
+			}
+		}
+	}
+	result := ssaConflictsResult{Managers: opts.managers, Forcing: opts.forcing, Objects: opts.objects, Errors: map[string]int{}}
+	if result.Before, err = meanObjectSize(ctx, client, namespace); err != nil {
+		return err
+	}
+
+	phases.start("contention")
+	var lock sync.Mutex
+	var latencies, conflictLatencies []time.Duration
+	applyCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, manager := range managers {
+		wg.Add(1)
+		go func(manager ssaManager) {
+			defer wg.Done()
+			ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+			defer ticker.Stop()
+			for generation := 1; ; generation++ {
+				select {
+				case <-applyCtx.Done():
+					return
+				case <-ticker.C:
+				}
+				start := time.Now()
+				_, err := client.CoreV1().ConfigMaps(namespace).Apply(applyCtx, manager.configuration(namespace, generation%opts.objects, generation), metav1.ApplyOptions{FieldManager: manager.name, Force: manager.force})
+				if applyCtx.Err() != nil {
+					return
+				}
+				took := time.Since(start)
+				lock.Lock()
+				result.Applies++
+				switch {
+				case err == nil:
+					latencies = append(latencies, took)
+				case apierrors.IsConflict(err):
+					result.Conflicts++
+					conflictLatencies = append(conflictLatencies, took)
+				default:
+					result.Errors[err.Error()]++
+				}
+				lock.Unlock()
+			}
+		}(manager)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	result.Latency = summarizeDurations(latencies)
+	result.ConflictLatency = summarizeDurations(conflictLatencies)
+	if result.After, err = meanObjectSize(ctx, client, namespace); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"applies":       result.Applies,
+		"conflicts":     result.Conflicts,
+		"p99":           fmt.Sprintf("%.3fs", result.Latency.P99),
+		"managedFields": fmt.Sprintf("%.0fB -> %.0fB", result.Before.ManagedFieldsBytes, result.After.ManagedFieldsBytes),
+	}).Info("Finished applying")
+	if err := artifacts.Write(outputDir, ssaConflictsFile, result); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished server-side apply conflicts experiment")
+	return nil
+}
+
+type ssaManager struct {
+	name  string
+	force bool
+}
+
+// configuration holds a field shared by all managers and one owned only by this manager, both of which change
+// with every generation.
+func (m ssaManager) configuration(namespace string, index, generation int) *corev1ac.ConfigMapApplyConfiguration {
+	value := m.name + "-" + strconv.Itoa(generation)
+	return corev1ac.ConfigMap(objectNames.object(index), namespace).WithData(map[string]string{
+		"shared": value,
+		m.name:   value,
+	})
+}
+
+func meanObjectSize(ctx context.Context, client *kubernetes.Clientset, namespace string) (objectSize, error) {
+	list, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return objectSize{}, fmt.Errorf("could not list ConfigMaps: %w", err)
+	}
+	var size objectSize
+	for _, object := range list.Items {
+		raw, err := json.Marshal(object)
+		if err != nil {
+			return objectSize{}, fmt.Errorf("could not marshal ConfigMap: %w", err)
+		}
+		managedFields, err := json.Marshal(object.ManagedFields)
+		if err != nil {
+			return objectSize{}, fmt.Errorf("could not marshal managedFields: %w", err)
+		}
+		size.Bytes += float64(len(raw))
+		size.ManagedFieldsBytes += float64(len(managedFields))
+	}
+	if len(list.Items) > 0 {
+		size.Bytes /= float64(len(list.Items))
+		size.ManagedFieldsBytes /= float64(len(list.Items))
+	}
+	return size, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// durationSummary describes a distribution of durations, in seconds.
+type durationSummary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+func summarizeDurations(durations []time.Duration) durationSummary {
+	if len(durations) == 0 {
+		return durationSummary{}
+	}
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	quantile := func(q float64) float64 {
+		return sorted[int(q*float64(len(sorted)-1))].Seconds()
+	}
+	return durationSummary{
+		Count: len(sorted),
+		P50:   quantile(0.5),
+		P90:   quantile(0.9),
+		P99:   quantile(0.99),
+		Max:   sorted[len(sorted)-1].Seconds(),
+	}
+}
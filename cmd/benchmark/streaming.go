@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// streamingExperimentOptions configure an experiment which adds long-lived streaming connections, following pod
+// logs and forwarding ports, on top of a watch fleet. The API servers proxy both to the kubelet, and the proxies
+// compete with watch serving for memory, goroutines and connections.
+type streamingExperimentOptions struct {
+	watches      int
+	logs         int
+	portForwards int
+	rate         int
+	duration     time.Duration
+	probes       int
+	image        string
+}
+
+func defaultStreamingExperimentOptions() *streamingExperimentOptions {
+	return &streamingExperimentOptions{
+		watches:      1000,
+		logs:         100,
+		portForwards: 100,
+		rate:         20,
+		duration:     2 * time.Minute,
+		probes:       20,
+		image:        "busybox:1.36",
+	}
+}
+
+func bindStreamingExperimentOptions(fs *flag.FlagSet, defaults *streamingExperimentOptions) *streamingExperimentOptions {
+	prefix := "streaming."
+	fs.IntVar(&defaults.watches, prefix+"watches", defaults.watches, "Number of watches to hold open throughout.")
+	fs.IntVar(&defaults.logs, prefix+"logs", defaults.logs, "Number of streams following the logs of the target pod.")
+	fs.IntVar(&defaults.portForwards, prefix+"port-forwards", defaults.portForwards, "Number of port-forwards to the target pod, each carrying a request every second.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of starts of watches and streams, in Hertz.")
+	fs.DurationVar(&defaults.duration, prefix+"duration", defaults.duration, "Time to hold every phase for.")
+	fs.IntVar(&defaults.probes, prefix+"probes", defaults.probes, "Number of watches started at the end of every phase to measure how quickly new watches are served.")
+	fs.StringVar(&defaults.image, prefix+"image", defaults.image, "Image of the target pod, which must provide busybox httpd.")
+	return defaults
+}
+
+func (o *streamingExperimentOptions) validate() error {
+	if o.watches < 0 || o.logs < 0 || o.portForwards < 0 {
+		return errors.New("--streaming.watches, --streaming.logs and --streaming.port-forwards must not be negative")
+	}
+	if o.rate <= 0 || o.probes <= 0 {
+		return errors.New("--streaming.rate and --streaming.probes must be positive")
+	}
+	return nil
+}
+
+const streamingFile = "streaming.json"
+
+const streamingTargetPort = 8080
+
+type streamingPhase struct {
+	// OpenWatches, OpenLogs and OpenPortForwards are the connections the generator held at the end of the phase,
+	// and Failures counts the streams which failed to start or ended early.
+	OpenWatches      int   `json:"openWatches"`
+	OpenLogs         int64 `json:"openLogs"`
+	OpenPortForwards int64 `json:"openPortForwards"`
+	Failures         int64 `json:"failures"`
+	// Probe is the distribution of times new watches took to be established at the end of the phase.
+	Probe    durationSummary         `json:"probe"`
+	Replicas map[string]streamingAPI `json:"replicas"`
+}
+
+type streamingAPI struct {
+	ResidentBytes float64 `json:"residentBytes"`
+	Goroutines    float64 `json:"goroutines"`
+	// LongRunning counts the long-running requests the replica was serving, keyed by verb and subresource.
+	LongRunning map[string]float64 `json:"longRunning"`
+}
+
+func runStreamingExperiment(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, outputDir string, opts *streamingExperimentOptions) error {
+	logrus.Info("Running streaming experiment")
+	namespace, cleanup, err := createNamespace(ctx, client, "streaming")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	target, err := createStreamingTarget(ctx, client, namespace, opts.image)
+	if err != nil {
+		return err
+	}
+	streams := &streamCounts{}
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	results := map[string]streamingPhase{}
+	tracker := newWatchTracker(opts.watches)
+	// every phase adds a kind of connection and then holds all of them
+	for _, phase := range []struct {
+		name  string
+		count int
+		open  func(int)
+	}{
+		{name: "watches", count: opts.watches, open: func(i int) {
+			tracker.watch(ctx, i, configMapWatch(client, namespace))
+		}},
+		{name: "logs", count: opts.logs, open: func(int) {
+			followLogs(ctx, client, target, streams)
+		}},
+		{name: "port-forwards", count: opts.portForwards, open: func(int) {
+			forwardPort(ctx, client, config, target, streams)
+		}},
+	} {
+		phases.start(phase.name)
+		for i := 0; i < phase.count; i++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+			go phase.open(i)
+		}
+		if err := holdFor(ctx, opts.duration); err != nil {
+			return err
+		}
+		result := streamingPhase{
+			OpenWatches:      tracker.openCount(),
+			OpenLogs:         atomic.LoadInt64(&streams.logs),
+			OpenPortForwards: atomic.LoadInt64(&streams.portForwards),
+			Failures:         atomic.LoadInt64(&streams.failures),
+		}
+		if result.Probe, err = probeWatchEstablishment(ctx, client, namespace, opts.probes); err != nil {
+			return err
+		}
+		if result.Replicas, err = snapshotStreaming(ctx); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"watches":      result.OpenWatches,
+			"logs":         result.OpenLogs,
+			"portForwards": result.OpenPortForwards,
+			"failures":     result.Failures,
+			"probeP99":     fmt.Sprintf("%.3fs", result.Probe.P99),
+		}).Infof("Held %s", phase.name)
+		results[phase.name] = result
+		if err := artifacts.Write(outputDir, streamingFile, results); err != nil {
+			return err
+		}
+	}
+
+	logrus.Info("Finished streaming experiment")
+	return nil
+}
+
+// streamCounts tracks the streams which are open, and those which failed to open or ended early.
+type streamCounts struct {
+	logs, portForwards, failures int64
+}
+
+// createStreamingTarget runs a pod which logs continuously and serves HTTP, and waits for it to be running.
+func createStreamingTarget(ctx context.Context, client *kubernetes.Clientset, namespace, image string) (*corev1.Pod, error) {
+	if _, err := client.CoreV1().Pods(namespace).Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "target"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:    "target",
+				Image:   image,
+				Command: []string{"/bin/sh", "-c", "httpd -p " + strconv.Itoa(streamingTargetPort) + " -h /tmp; while true; do date; sleep 0.1; done"},
+				Ports:   []corev1.ContainerPort{{ContainerPort: streamingTargetPort}},
+			}},
+		},
+	}, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("could not create target pod: %w", err)
+	}
+	var target *corev1.Pod
+	if err := wait.PollUntilContextTimeout(ctx, time.Second, 2*time.Minute, true, func(ctx context.Context) (bool, error) {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, "target", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		target = pod
+		return pod.Status.Phase == corev1.PodRunning, nil
+	}); err != nil {
+		return nil, fmt.Errorf("target pod did not start: %w", err)
+	}
+	return target, nil
+}
+
+// followLogs follows the logs of the pod, discarding them, until the context is cancelled.
+func followLogs(ctx context.Context, client *kubernetes.Clientset, pod *corev1.Pod, streams *streamCounts) {
+	stream, err := client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Follow: true}).Stream(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.WithError(err).Debug("failed to follow logs")
+			atomic.AddInt64(&streams.failures, 1)
+		}
+		return
+	}
+	atomic.AddInt64(&streams.logs, 1)
+	defer func() {
+		atomic.AddInt64(&streams.logs, -1)
+		if err := stream.Close(); err != nil {
+			logrus.WithError(err).Debug("failed to close log stream")
+		}
+	}()
+	if _, err := io.Copy(io.Discard, stream); ctx.Err() == nil {
+		logrus.WithError(err).Debug("log stream ended")
+		atomic.AddInt64(&streams.failures, 1)
+	}
+}
+
+// forwardPort forwards a local port to the pod and sends a request through it every second, until the context is
+// cancelled.
+func forwardPort(ctx context.Context, client *kubernetes.Clientset, config *rest.Config, pod *corev1.Pod, streams *streamCounts) {
+	fail := func(err error) {
+		if ctx.Err() == nil {
+			logrus.WithError(err).Debug("failed to forward port")
+			atomic.AddInt64(&streams.failures, 1)
+		}
+	}
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		fail(err)
+		return
+	}
+	url := client.CoreV1().RESTClient().Post().Namespace(pod.Namespace).Resource("pods").Name(pod.Name).SubResource("portforward").URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+	stop, ready := make(chan struct{}), make(chan struct{})
+	forwarder, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, []string{"0:" + strconv.Itoa(streamingTargetPort)}, stop, ready, io.Discard, io.Discard)
+	if err != nil {
+		fail(err)
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-ready:
+			atomic.AddInt64(&streams.portForwards, 1)
+			defer atomic.AddInt64(&streams.portForwards, -1)
+			ports, err := forwarder.GetPorts()
+			if err != nil || len(ports) == 0 {
+				fail(fmt.Errorf("could not determine forwarded port: %v", err))
+				close(stop)
+				return
+			}
+			address := "http://127.0.0.1:" + strconv.Itoa(int(ports[0].Local)) + "/"
+			if err := wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+				request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+				if err != nil {
+					return false, err
+				}
+				response, err := http.DefaultClient.Do(request)
+				if err != nil {
+					logrus.WithError(err).Debug("failed to send request through port-forward")
+					return false, nil
+				}
+				_, _ = io.Copy(io.Discard, response.Body)
+				return false, response.Body.Close()
+			}); err != nil && ctx.Err() == nil {
+				fail(err)
+			}
+			close(stop)
+		}
+	}()
+	if err := forwarder.ForwardPorts(); err != nil {
+		fail(err)
+	}
+}
+
+// probeWatchEstablishment starts watches one after another and measures how long every one took to be established.
+func probeWatchEstablishment(ctx context.Context, client *kubernetes.Clientset, namespace string, probes int) (durationSummary, error) {
+	var latencies []time.Duration
+	for i := 0; i < probes; i++ {
+		start := time.Now()
+		body, err := configMapWatch(client, namespace)(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return durationSummary{}, ctx.Err()
+			}
+			logrus.WithError(err).Debug("failed to start probe watch")
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+		if err := body.Close(); err != nil {
+			logrus.WithError(err).Debug("failed to close probe watch")
+		}
+	}
+	return summarizeDurations(latencies), nil
+}
+
+// snapshotStreaming records the memory, goroutines and long-running requests of every API server, keyed by pod.
+func snapshotStreaming(ctx context.Context) (map[string]streamingAPI, error) {
+	scraped, err := apiserverScrapes.all(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := map[string]streamingAPI{}
+	for pod, families := range scraped {
+		state := streamingAPI{
+			ResidentBytes: sumMetric(families, "process_resident_memory_bytes", nil),
+			Goroutines:    sumMetric(families, "go_goroutines", nil),
+			LongRunning:   map[string]float64{},
+		}
+		if family, exists := families["apiserver_longrunning_requests"]; exists {
+			for _, sample := range family.Metric {
+				labels := labelsFor(sample)
+				key := labels["verb"]
+				if labels["subresource"] != "" {
+					key += "/" + labels["subresource"]
+				}
+				state.LongRunning[key] += valueOf(sample)
+			}
+		}
+		snapshot[pod] = state
+	}
+	return snapshot, nil
+}
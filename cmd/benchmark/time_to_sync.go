@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// timeToSyncExperimentOptions configure an experiment which measures how long new clients take to receive the
+// full state of a large namespace, as more of them start at once. Watchers receive the state as synthetic
+// additions at the start of their watch, while informers list it first.
+type timeToSyncExperimentOptions struct {
+	objects     int
+	size        int
+	concurrency string
+	timeout     time.Duration
+}
+
+func defaultTimeToSyncExperimentOptions() *timeToSyncExperimentOptions {
+	return &timeToSyncExperimentOptions{
+		objects:     10000,
+		size:        1024,
+		concurrency: "1,10,100",
+		timeout:     5 * time.Minute,
+	}
+}
+
+func bindTimeToSyncExperimentOptions(fs *flag.FlagSet, defaults *timeToSyncExperimentOptions) *timeToSyncExperimentOptions {
+	prefix := "time-to-sync."
+	fs.IntVar(&defaults.objects, prefix+"objects", defaults.objects, "Number of ConfigMaps in the synced namespace.")
+	fs.IntVar(&defaults.size, prefix+"size", defaults.size, "Size of the payload of every ConfigMap, in bytes.")
+	fs.StringVar(&defaults.concurrency, prefix+"concurrency", defaults.concurrency, "Comma-delimited list of numbers of clients to start syncing at once.")
+	fs.DurationVar(&defaults.timeout, prefix+"timeout", defaults.timeout, "Time to wait for every client to sync.")
+	return defaults
+}
+
+func (o *timeToSyncExperimentOptions) validate() error {
+	if o.objects <= 0 || o.size < 0 {
+		return errors.New("--time-to-sync.objects must be positive and --time-to-sync.size must not be negative")
+	}
+	_, err := o.concurrencies()
+	return err
+}
+
+func (o *timeToSyncExperimentOptions) concurrencies() ([]int, error) {
+	var concurrencies []int
+	for _, part := range strings.Split(o.concurrency, ",") {
+		concurrency, err := strconv.Atoi(part)
+		if err != nil || concurrency <= 0 {
+			return nil, fmt.Errorf("--time-to-sync.concurrency invalid: %s is not a number of clients", part)
+		}
+		concurrencies = append(concurrencies, concurrency)
+	}
+	return concurrencies, nil
+}
+
+const timeToSyncFile = "time-to-sync.json"
+
+const (
+	watchSync   = "watch"
+	listSync    = "list"
+	syncLatency = "sync"
+)
+
+type timeToSyncResult struct {
+	Mode        string `json:"mode"`
+	Concurrency int    `json:"concurrency"`
+	// Synced counts the clients which received every object; Sync is the distribution of times between them
+	// starting and receiving the last object.
+	Synced int             `json:"synced"`
+	Sync   durationSummary `json:"sync"`
+	Errors map[string]int  `json:"errors,omitempty"`
+}
+
+func runTimeToSyncExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *timeToSyncExperimentOptions) error {
+	logrus.Info("Running time to sync experiment")
+	concurrencies, err := opts.concurrencies()
+	if err != nil {
+		return err
+	}
+	namespace, cleanup, err := createNamespace(ctx, client, "time-to-sync")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	if err := createSizedConfigMaps(ctx, client, namespace, opts.objects, opts.size); err != nil {
+		return err
+	}
+
+	var results []timeToSyncResult
+	latencies := artifacts.Latencies{}
+	for _, concurrency := range concurrencies {
+		phases.start(fmt.Sprintf("%s-%d", watchSync, concurrency))
+		result, series, err := syncByWatching(ctx, client, namespace, concurrency, opts)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+		latencies[fmt.Sprintf("%s-%s-%d", syncLatency, watchSync, concurrency)] = series
+
+		phases.start(fmt.Sprintf("%s-%d", listSync, concurrency))
+		result, err = syncByListing(ctx, client, namespace, concurrency)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+	for _, result := range results {
+		logrus.Infof("%d clients syncing by %s: %d synced, p99 %.3fs", result.Concurrency, result.Mode, result.Synced, result.Sync.P99)
+	}
+	if err := artifacts.Write(outputDir, artifacts.LatenciesFile, latencies); err != nil {
+		return err
+	}
+	if err := artifacts.Write(outputDir, timeToSyncFile, results); err != nil {
+		return err
+	}
+
+	logrus.Info("Finished time to sync experiment")
+	return nil
+}
+
+// syncByWatching starts all watches at once and waits for each to receive an addition for every object.
+func syncByWatching(ctx context.Context, client *kubernetes.Clientset, namespace string, concurrency int, opts *timeToSyncExperimentOptions) (timeToSyncResult, artifacts.LatencySeries, error) {
+	result := timeToSyncResult{Mode: watchSync, Concurrency: concurrency}
+	fleetCtx, stopFleet := context.WithCancel(ctx)
+	defer stopFleet()
+	tracker := newWatchTracker(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go tracker.watch(fleetCtx, i, configMapWatch(client, namespace))
+	}
+	synced := func(i int) bool {
+		return atomic.LoadInt64(&tracker.records[i].events) >= int64(opts.objects)
+	}
+	if err := wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, opts.timeout, true, func(ctx context.Context) (bool, error) {
+		for i := range tracker.records {
+			if !synced(i) && atomic.LoadInt64(&tracker.records[i].terminated) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		if ctx.Err() != nil {
+			return result, artifacts.LatencySeries{}, ctx.Err()
+		}
+		logrus.WithError(err).Warnf("not all %d watchers synced", concurrency)
+	}
+
+	series := artifacts.LatencySeries{Start: tracker.start}
+	var syncs []time.Duration
+	for i := range tracker.records {
+		if !synced(i) {
+			continue
+		}
+		record := &tracker.records[i]
+		issued := atomic.LoadInt64(&record.issued)
+		took := time.Duration(atomic.LoadInt64(&record.lastEvent) - issued)
+		syncs = append(syncs, took)
+		series.Offsets = append(series.Offsets, time.Duration(issued).Seconds())
+		series.Seconds = append(series.Seconds, took.Seconds())
+	}
+	result.Synced = len(syncs)
+	result.Sync = summarizeDurations(syncs)
+	return result, series, nil
+}
+
+// syncByListing starts all lists at once, as informers would before watching from the resourceVersion listed.
+func syncByListing(ctx context.Context, client *kubernetes.Clientset, namespace string, concurrency int) (timeToSyncResult, error) {
+	result := timeToSyncResult{Mode: listSync, Concurrency: concurrency, Errors: map[string]int{}}
+	var lock sync.Mutex
+	var syncs []time.Duration
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			_, err := listPage(ctx, client, namespace, metav1.ListOptions{})
+			took := time.Since(start)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				result.Errors[err.Error()]++
+				return
+			}
+			syncs = append(syncs, took)
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	result.Synced = len(syncs)
+	result.Sync = summarizeDurations(syncs)
+	return result, nil
+}
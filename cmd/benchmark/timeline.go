@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// watchFailureBurst is the number of watches which must fail within one second for the failures to be marked on the
+// timeline; a few failures are expected in any long run.
+const watchFailureBurst = 10
+
+// timeline records what happened over the course of a run besides the phases the experiment moved through, like
+// restarts and injected faults, for every process-wide observer and experiment to annotate.
+var timeline = &timelineRecorder{failures: map[int64]int64{}}
+
+type timelineRecorder struct {
+	lock        sync.Mutex
+	annotations []artifacts.Annotation
+	// failures counts the watches which failed to start or ended unexpectedly, keyed by the second, since the
+	// epoch, in which they did.
+	failures map[int64]int64
+}
+
+func (r *timelineRecorder) annotate(kind, format string, args ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.annotations = append(r.annotations, artifacts.Annotation{Time: time.Now(), Kind: kind, Description: fmt.Sprintf(format, args...)})
+}
+
+func (r *timelineRecorder) watchFailed() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures[time.Now().Unix()]++
+}
+
+// write records the annotations along with bursts of watch failures, which span consecutive seconds in which at
+// least watchFailureBurst watches failed.
+func (r *timelineRecorder) write(outputDir string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var seconds []int64
+	for second, failures := range r.failures {
+		if failures >= watchFailureBurst {
+			seconds = append(seconds, second)
+		}
+	}
+	sort.Slice(seconds, func(i, j int) bool {
+		return seconds[i] < seconds[j]
+	})
+	annotations := append([]artifacts.Annotation{}, r.annotations...)
+	for i := 0; i < len(seconds); {
+		j, failures := i, r.failures[seconds[i]]
+		for j+1 < len(seconds) && seconds[j+1] == seconds[j]+1 {
+			j++
+			failures += r.failures[seconds[j]]
+		}
+		end := time.Unix(seconds[j]+1, 0)
+		annotations = append(annotations, artifacts.Annotation{
+			Time:        time.Unix(seconds[i], 0),
+			End:         &end,
+			Kind:        artifacts.AnnotationErrors,
+			Description: fmt.Sprintf("%d watches failed", failures),
+		})
+		i = j + 1
+	}
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].Time.Before(annotations[j].Time)
+	})
+	return artifacts.Write(outputDir, artifacts.TimelineFile, annotations)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// watchMixExperimentOptions configure an experiment which spreads watches over a weighted mix of resources, as the
+// watch cache for each resource behaves differently.
+type watchMixExperimentOptions struct {
+	count   int
+	rate    int
+	weights string
+}
+
+func defaultWatchMixExperimentOptions() *watchMixExperimentOptions {
+	return &watchMixExperimentOptions{
+		count:   10000,
+		rate:    100,
+		weights: "pods=1,secrets=1,configmaps=1,endpoints=1",
+	}
+}
+
+func bindWatchMixExperimentOptions(fs *flag.FlagSet, defaults *watchMixExperimentOptions) *watchMixExperimentOptions {
+	prefix := "watch-mix."
+	fs.IntVar(&defaults.count, prefix+"count", defaults.count, "Number of watches to start.")
+	fs.IntVar(&defaults.rate, prefix+"rate", defaults.rate, "Rate of watch starts, in Hertz.")
+	fs.StringVar(&defaults.weights, prefix+"weights", defaults.weights, "Comma-delimited list of resource=weight pairs, where custom resources are given as group/version/resource.")
+	return defaults
+}
+
+func (o *watchMixExperimentOptions) validate() error {
+	if o.rate <= 0 {
+		return errors.New("--watch-mix.rate must be positive")
+	}
+	_, err := parseResourceWeights(o.weights)
+	return err
+}
+
+type resourceWeight struct {
+	key      string
+	resource schema.GroupVersionResource
+	weight   int
+}
+
+func parseResourceWeights(raw string) ([]resourceWeight, error) {
+	var weights []resourceWeight
+	for _, part := range strings.Split(raw, ",") {
+		subParts := strings.Split(part, "=")
+		if len(subParts) != 2 {
+			return nil, fmt.Errorf("--watch-mix.weights invalid: %s is not of form resource=weight", part)
+		}
+		weight, err := strconv.Atoi(subParts[1])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("--watch-mix.weights invalid: weight for %s must be a positive integer", subParts[0])
+		}
+		resource := schema.GroupVersionResource{Version: "v1", Resource: subParts[0]}
+		if segments := strings.Split(subParts[0], "/"); len(segments) == 3 {
+			resource = schema.GroupVersionResource{Group: segments[0], Version: segments[1], Resource: segments[2]}
+		} else if len(segments) != 1 {
+			return nil, fmt.Errorf("--watch-mix.weights invalid: %s is neither a core resource nor group/version/resource", subParts[0])
+		}
+		weights = append(weights, resourceWeight{key: subParts[0], resource: resource, weight: weight})
+	}
+	return weights, nil
+}
+
+// assignResources spreads watches over resources in proportion to their weights, interleaving them using smooth
+// weighted round-robin so that every resource sees watches arrive throughout issuance.
+func assignResources(weights []resourceWeight, count int) []uint8 {
+	var total int
+	for _, weight := range weights {
+		total += weight.weight
+	}
+	current := make([]int, len(weights))
+	assignments := make([]uint8, count)
+	for i := range assignments {
+		chosen := 0
+		for j, weight := range weights {
+			current[j] += weight.weight
+			if current[j] > current[chosen] {
+				chosen = j
+			}
+		}
+		current[chosen] -= total
+		assignments[i] = uint8(chosen)
+	}
+	return assignments
+}
+
+const watchMixFile = "watch-mix.json"
+
+type watchMixResult struct {
+	Weight      int `json:"weight"`
+	Watches     int `json:"watches"`
+	Established int `json:"established"`
+	// Establishment is the distribution of times between a watch being issued and the response headers arriving.
+	Establishment durationSummary `json:"establishment"`
+}
+
+func runWatchMixExperiment(ctx context.Context, client *kubernetes.Clientset, outputDir string, opts *watchMixExperimentOptions) error {
+	logrus.Info("Running watch mix experiment")
+	weights, err := parseResourceWeights(opts.weights)
+	if err != nil {
+		return err
+	}
+	if len(weights) > 256 {
+		return fmt.Errorf("at most 256 resources may be mixed")
+	}
+	namespace, cleanup, err := createNamespace(ctx, client, "watch-mix")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := &phaseRecorder{}
+	defer func() {
+		if err := phases.write(outputDir); err != nil {
+			logrus.WithError(err).Error("failed to record phases")
+		}
+	}()
+
+	phases.start("setup")
+	assignments := assignResources(weights, opts.count)
+	opens := make([]openWatch, len(weights))
+	for i, weight := range weights {
+		opens[i] = resourceWatch(client, weight.resource, namespace)
+	}
+	tracker := newWatchTracker(opts.count)
+	ticker := time.NewTicker(time.Second / time.Duration(opts.rate))
+	defer ticker.Stop()
+	issued := 0
+	func() {
+		for ; issued < opts.count; issued++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			go tracker.watch(ctx, issued, opens[assignments[issued]])
+		}
+	}()
+	if err := tracker.waitForEstablishment(ctx, issued, time.Minute); err != nil {
+		logrus.WithError(err).Warn("not all issued watches were established")
+	}
+
+	results := map[string]watchMixResult{}
+	establishment := make([][]time.Duration, len(weights))
+	for i := 0; i < issued; i++ {
+		record := &tracker.records[i]
+		index := assignments[i]
+		result := results[weights[index].key]
+		result.Weight = weights[index].weight
+		result.Watches++
+		if established := atomic.LoadInt64(&record.established); established != 0 {
+			result.Established++
+			establishment[index] = append(establishment[index], time.Duration(established-atomic.LoadInt64(&record.issued)))
+		}
+		results[weights[index].key] = result
+	}
+	var keys []string
+	for i, weight := range weights {
+		result := results[weight.key]
+		result.Establishment = summarizeDurations(establishment[i])
+		results[weight.key] = result
+		keys = append(keys, weight.key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		logrus.Infof("%s: %d/%d watches established, p99 %.3fs", key, results[key].Established, results[key].Watches, results[key].Establishment.P99)
+	}
+	if err := artifacts.Write(outputDir, artifacts.LatenciesFile, tracker.latencies()); err != nil {
+		return err
+	}
+	if err := artifacts.Write(outputDir, watchMixFile, results); err != nil {
+		return err
+	}
+	if issued < opts.count {
+		return fmt.Errorf("watch mix experiment interrupted: %w", ctx.Err())
+	}
+
+	logrus.Info("Finished watch mix experiment")
+	return nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// watchRecord is the bookkeeping held for every watch. It is kept deliberately small, as the generator needs to
+// track hundreds of thousands of these; timestamps are nanoseconds since the tracker started, zero when unset.
+type watchRecord struct {
+	issued      int64
+	established int64
+	terminated  int64
+	bytes       int64
+	// disconnected is the first time an established watch ended unexpectedly, while reestablished is the last time
+	// it was opened again; both are only set for watches which reconnect. reconnects counts the disconnections the
+	// watch was re-established after, however many attempts that took, and downtime accumulates the time between
+	// each of them and the re-establishment.
+	disconnected  int64
+	reestablished int64
+	reconnects    int64
+	downtime      int64
+	// events counts the newline-delimited events received, and lastEvent is the time the latest one arrived, so
+	// that delivery can be measured without decoding.
+	events    int64
+	lastEvent int64
+	// firstFrame is the first time any data arrived on the stream. established is set once the response headers
+	// are received, after authentication and authorization. Watches asking for their initial events are only sent
+	// the bookmark ending them once the watch cache has caught up to serve the watch, so for those the two tell apart
+	// where establishment time goes; other watches are sent nothing until an object changes, which is workload timing.
+	firstFrame int64
+	// resourceVersion is the latest seen in the stream, so that the watch can resume from it as an informer would;
+	// it is reset when the server reports that it has expired.
+	resourceVersion int64
+}
+
+// watchTracker holds the records for a fleet of watches, indexed by the order in which they were issued.
+type watchTracker struct {
+	start   time.Time
+	records []watchRecord
+	open    int64
+	// initialFrames is set when the watches ask for their initial events, so that the time to the first frame is
+	// recorded as a latency.
+	initialFrames bool
+}
+
+func newWatchTracker(count int) *watchTracker {
+	return &watchTracker{
+		start:   time.Now(),
+		records: make([]watchRecord, count),
+	}
+}
+
+func (t *watchTracker) now() int64 {
+	return int64(time.Since(t.start))
+}
+
+// timeOf converts a recorded offset into a timestamp, returning nil when the offset was never set.
+func (t *watchTracker) timeOf(offset int64) *time.Time {
+	if offset == 0 {
+		return nil
+	}
+	instant := t.start.Add(time.Duration(offset))
+	return &instant
+}
+
+// openWatch is a function which starts a watch request and returns the response body once the response headers
+// have been received.
+type openWatch func(ctx context.Context) (io.ReadCloser, error)
+
+// watch runs the watch at the index, recording its lifecycle, until the stream ends or the context is cancelled.
+func (t *watchTracker) watch(ctx context.Context, index int, open openWatch) {
+	record := &t.records[index]
+	atomic.StoreInt64(&record.issued, t.now())
+	if err := t.stream(ctx, record, open, func(at int64) {
+		atomic.StoreInt64(&record.established, at)
+	}); err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Error("failed to start watch")
+	}
+}
+
+// watchWithReconnect runs the watch at the index, opening it again whenever it ends, until the context is
+// cancelled. When provided, relist is called before every reconnection, as an informer would.
+func (t *watchTracker) watchWithReconnect(ctx context.Context, index int, open openWatch, relist func(context.Context) error) {
+	record := &t.records[index]
+	atomic.StoreInt64(&record.issued, t.now())
+	backoff := reconnectBackoff()
+	// down is when the watch was last disconnected, until it is re-established
+	var down int64
+	for {
+		err := t.stream(ctx, record, open, func(at int64) {
+			if atomic.LoadInt64(&record.established) == 0 {
+				atomic.StoreInt64(&record.established, at)
+				return
+			}
+			atomic.StoreInt64(&record.reestablished, at)
+			if down != 0 {
+				// recorded while the stream is live, as experiments read them before their watches end
+				atomic.AddInt64(&record.downtime, at-down)
+				atomic.AddInt64(&record.reconnects, 1)
+				down = 0
+			}
+		})
+		ended := t.now()
+		if err != nil {
+			logrus.WithError(err).Debug("failed to start watch")
+		} else {
+			backoff = reconnectBackoff()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if atomic.LoadInt64(&record.established) != 0 {
+			atomic.CompareAndSwapInt64(&record.disconnected, 0, ended)
+			if down == 0 {
+				down = ended
+			}
+		}
+		if err := holdFor(ctx, backoff.Step()); err != nil {
+			return
+		}
+		if relist != nil {
+			if err := relist(ctx); err != nil {
+				logrus.WithError(err).Debug("failed to relist")
+				continue
+			}
+		}
+	}
+}
+
+func reconnectBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: 100 * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    math.MaxInt32,
+		Cap:      5 * time.Second,
+	}
+}
+
+// stream opens the watch and consumes it until it ends, calling established with the time it was established.
+func (t *watchTracker) stream(ctx context.Context, record *watchRecord, open openWatch, established func(at int64)) error {
+	atomic.AddInt64(&issuedWatches, 1)
+	body, err := open(ctx)
+	if err != nil {
+		atomic.StoreInt64(&record.terminated, t.now())
+		if ctx.Err() == nil {
+			timeline.watchFailed()
+		}
+		return err
+	}
+	established(t.now())
+	atomic.AddInt64(&t.open, 1)
+	atomic.AddInt64(&openWatches, 1)
+	defer func() {
+		atomic.AddInt64(&t.open, -1)
+		atomic.AddInt64(&openWatches, -1)
+		atomic.StoreInt64(&record.terminated, t.now())
+		if err := body.Close(); err != nil {
+			logrus.WithError(err).Debug("failed to close watch")
+		}
+	}()
+	t.drain(body, record)
+	if ctx.Err() == nil {
+		timeline.watchFailed()
+	}
+	return nil
+}
+
+// watchBuffers are shared between all watches. An idle watch blocks in a single-byte read, so it holds no buffer
+// of its own; only when data arrives is a pooled buffer borrowed to consume what is available.
+var watchBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 32*1024)
+		return &buffer
+	},
+}
+
+func (t *watchTracker) drain(body io.Reader, record *watchRecord) {
+	var probe [1]byte
+	for {
+		var events int
+		n, err := body.Read(probe[:])
+		if n > 0 && probe[0] == '\n' {
+			events++
+		}
+		if n > 0 && err == nil {
+			buffer := watchBuffers.Get().(*[]byte)
+			var m int
+			m, err = body.Read(*buffer)
+			events += bytes.Count((*buffer)[:m], newline)
+			observeResourceVersion((*buffer)[:m], record)
+			watchBuffers.Put(buffer)
+			n += m
+		}
+		if n > 0 {
+			atomic.CompareAndSwapInt64(&record.firstFrame, 0, t.now())
+		}
+		atomic.AddInt64(&record.bytes, int64(n))
+		if events > 0 {
+			atomic.AddInt64(&receivedEvents, int64(events))
+			atomic.AddInt64(&record.events, int64(events))
+			atomic.StoreInt64(&record.lastEvent, t.now())
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var (
+	newline               = []byte{'\n'}
+	resourceVersionMarker = []byte(`"resourceVersion":"`)
+	expiredMarker         = []byte(`"code":410`)
+)
+
+// observeResourceVersion records the last resourceVersion in the data, without decoding it. Markers split across
+// reads are missed, which only delays the update to the next event.
+func observeResourceVersion(data []byte, record *watchRecord) {
+	if bytes.Contains(data, expiredMarker) {
+		atomic.StoreInt64(&record.resourceVersion, 0)
+		return
+	}
+	start := bytes.LastIndex(data, resourceVersionMarker)
+	if start < 0 {
+		return
+	}
+	value := data[start+len(resourceVersionMarker):]
+	end := bytes.IndexByte(value, '"')
+	if end < 0 {
+		return
+	}
+	if resourceVersion, err := strconv.ParseInt(string(value[:end]), 10, 64); err == nil {
+		atomic.StoreInt64(&record.resourceVersion, resourceVersion)
+	}
+}
+
+// openCount is the number of watches currently established.
+func (t *watchTracker) openCount() int {
+	return int(atomic.LoadInt64(&t.open))
+}
+
+// waitForEstablishment waits until the first issued watches have either been established or failed.
+func (t *watchTracker) waitForEstablishment(ctx context.Context, issued int, timeout time.Duration) error {
+	return wait.PollUntilContextTimeout(ctx, 100*time.Millisecond, timeout, true, func(ctx context.Context) (bool, error) {
+		for i := 0; i < issued; i++ {
+			record := &t.records[i]
+			if atomic.LoadInt64(&record.established) == 0 && atomic.LoadInt64(&record.terminated) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+const (
+	establishmentLatency = "establishment"
+	firstFrameLatency    = "first-frame"
+	deliveryLatency      = "delivery"
+)
+
+// latencies lists the time taken to establish every watch and, for watches asking for their initial events, to
+// receive its first frame, when any arrived.
+func (t *watchTracker) latencies() artifacts.Latencies {
+	latencies := artifacts.Latencies{establishmentLatency: t.establishmentLatencies()}
+	if !t.initialFrames {
+		return latencies
+	}
+	if firstFrame := t.latenciesUntil(func(record *watchRecord) *int64 { return &record.firstFrame }); len(firstFrame.Seconds) > 0 {
+		latencies[firstFrameLatency] = firstFrame
+	}
+	return latencies
+}
+
+// establishmentLatencies lists the time taken to establish every watch, against the time it was issued.
+func (t *watchTracker) establishmentLatencies() artifacts.LatencySeries {
+	return t.latenciesUntil(func(record *watchRecord) *int64 { return &record.established })
+}
+
+// latenciesUntil lists the time from issuing every watch until the offset in its record, for those where it is set.
+func (t *watchTracker) latenciesUntil(offset func(*watchRecord) *int64) artifacts.LatencySeries {
+	series := artifacts.LatencySeries{Start: t.start}
+	for i := range t.records {
+		record := &t.records[i]
+		issued, until := atomic.LoadInt64(&record.issued), atomic.LoadInt64(offset(record))
+		if until == 0 {
+			continue
+		}
+		series.Offsets = append(series.Offsets, time.Duration(issued).Seconds())
+		series.Seconds = append(series.Seconds, time.Duration(until-issued).Seconds())
+	}
+	return series
+}
+
+// establishedTimes lists the times at which watches were established, in order of establishment.
+func (t *watchTracker) establishedTimes() []time.Time {
+	offsets := make([]int64, 0, len(t.records))
+	for i := range t.records {
+		if offset := atomic.LoadInt64(&t.records[i].established); offset != 0 {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+	times := make([]time.Time, len(offsets))
+	for i, offset := range offsets {
+		times[i] = t.start.Add(time.Duration(offset))
+	}
+	return times
+}
+
+func configMapWatch(client *kubernetes.Clientset, namespace string) openWatch {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return client.CoreV1().RESTClient().Get().
+			Namespace(namespace).
+			Resource("configmaps").
+			VersionedParams(&metav1.ListOptions{Watch: true}, scheme.ParameterCodec).
+			Stream(ctx)
+	}
+}
+
+// initialEventsConfigMapWatch opens watches on ConfigMaps which are sent the existing ConfigMaps as events, ended by a
+// bookmark, as informers do with the WatchList feature gate enabled; servers without it reject the watches.
+func initialEventsConfigMapWatch(client *kubernetes.Clientset, namespace string) openWatch {
+	sendInitialEvents := true
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return client.CoreV1().RESTClient().Get().
+			Namespace(namespace).
+			Resource("configmaps").
+			VersionedParams(&metav1.ListOptions{
+				Watch:                true,
+				SendInitialEvents:    &sendInitialEvents,
+				ResourceVersionMatch: metav1.ResourceVersionMatchNotOlderThan,
+				AllowWatchBookmarks:  true,
+			}, scheme.ParameterCodec).
+			Stream(ctx)
+	}
+}
+
+// resumingConfigMapWatch opens watches on ConfigMaps from the latest resourceVersion the record has seen, as an
+// informer would, optionally asking for bookmarks to keep that resourceVersion fresh while nothing changes.
+func resumingConfigMapWatch(client *kubernetes.Clientset, namespace string, record *watchRecord, bookmarks bool) openWatch {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		options := &metav1.ListOptions{Watch: true, AllowWatchBookmarks: bookmarks}
+		if resourceVersion := atomic.LoadInt64(&record.resourceVersion); resourceVersion != 0 {
+			options.ResourceVersion = strconv.FormatInt(resourceVersion, 10)
+		}
+		return client.CoreV1().RESTClient().Get().
+			Namespace(namespace).
+			Resource("configmaps").
+			VersionedParams(options, scheme.ParameterCodec).
+			Stream(ctx)
+	}
+}
+
+// resourceWatch opens watches for any namespaced resource, built-in or custom.
+func resourceWatch(client *kubernetes.Clientset, resource schema.GroupVersionResource, namespace string) openWatch {
+	prefix := "/apis/" + resource.Group + "/" + resource.Version
+	if resource.Group == "" {
+		prefix = "/api/" + resource.Version
+	}
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return client.RESTClient().Get().
+			AbsPath(prefix, "namespaces", namespace, resource.Resource).
+			Param("watch", "true").
+			Stream(ctx)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const amplificationFile = "amplification.json"
+
+// amplification relates the requests the API servers sent to etcd to the requests the benchmark sent to them.
+// Factors are omitted when the benchmark issued no requests of that kind.
+type amplification struct {
+	ClientLists   int64 `json:"clientLists"`
+	ClientWatches int64 `json:"clientWatches"`
+	// EtcdOperations are the operations the experiment caused, with EtcdBackgroundOperations, the traffic etcd was
+	// served at the rate measured before the experiment started, subtracted from those counted during it.
+	EtcdOperations           map[string]float64 `json:"etcdOperations"`
+	EtcdBackgroundOperations map[string]float64 `json:"etcdBackgroundOperations,omitempty"`
+	// EtcdListsPerClientList is the number of lists served from etcd for every list the benchmark issued, which
+	// is near zero when lists are served from the watch cache.
+	EtcdListsPerClientList *float64 `json:"etcdListsPerClientList,omitempty"`
+	// EtcdOperationsPerClientRead is the number of etcd operations of any kind for every list or watch the
+	// benchmark issued.
+	EtcdOperationsPerClientRead *float64 `json:"etcdOperationsPerClientRead,omitempty"`
+}
+
+// digestAmplification records amplification factors, when the experiment counted requests to etcd.
+func digestAmplification(dataDir string) error {
+	var requests artifacts.Requests
+	if err := artifacts.Load(dataDir, artifacts.RequestsFile, &requests); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if requests.Etcd == nil {
+		logrus.Info("requests to etcd were not counted, skipping amplification")
+		return nil
+	}
+
+	result := amplification{
+		ClientLists:    requests.Client["list"],
+		ClientWatches:  requests.Client["watch"],
+		EtcdOperations: map[string]float64{},
+	}
+	if requests.EtcdIdleRate == nil {
+		logrus.Warn("requests to etcd were not counted before the experiment, so amplification includes background traffic")
+	} else {
+		result.EtcdBackgroundOperations = map[string]float64{}
+	}
+	for operation, count := range requests.Etcd {
+		if rate, measured := requests.EtcdIdleRate[operation]; measured {
+			background := math.Min(count, rate*requests.Seconds)
+			result.EtcdBackgroundOperations[operation] = background
+			count -= background
+		}
+		result.EtcdOperations[operation] = count
+	}
+	var etcdLists, etcdOperations float64
+	for operation, count := range result.EtcdOperations {
+		etcdOperations += count
+		if operation == "list" {
+			etcdLists += count
+		}
+	}
+	if result.ClientLists > 0 {
+		factor := etcdLists / float64(result.ClientLists)
+		result.EtcdListsPerClientList = &factor
+	}
+	if reads := result.ClientLists + result.ClientWatches; reads > 0 {
+		factor := etcdOperations / float64(reads)
+		result.EtcdOperationsPerClientRead = &factor
+	}
+	return artifacts.Write(dataDir, amplificationFile, result)
+}
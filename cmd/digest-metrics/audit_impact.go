@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const (
+	auditImpactExperiment   = "audit-impact"
+	auditLoggingMetadataKey = "audit-logging"
+	auditLoggingEnabled     = "enabled"
+	auditLoggingDisabled    = "disabled"
+
+	auditImpactFile = "audit-impact.json"
+)
+
+type auditImpact struct {
+	Enabled  string `json:"enabled"`
+	Disabled string `json:"disabled"`
+	// Phases holds the resource usage deltas keyed by phase and then identifier.
+	Phases map[string]map[string]auditImpactDelta `json:"phases"`
+}
+
+type auditImpactDelta struct {
+	Enabled  usage `json:"enabled"`
+	Disabled usage `json:"disabled"`
+	// Delta is the usage attributable to the audit pipeline, the difference between the enabled and disabled runs.
+	Delta usage `json:"delta"`
+}
+
+// digestAuditImpact pairs two audit-impact runs, one with audit logging enabled and one without, and records the
+// difference in resource usage for every phase into the first data directory.
+func digestAuditImpact(dataDir, pairDir string, memory memoryStatistics) error {
+	dirs := map[string]string{}
+	usages := map[string]map[string]map[string]usage{}
+	for _, dir := range []string{dataDir, pairDir} {
+		var manifest artifacts.Manifest
+		if err := artifacts.Load(dir, artifacts.ManifestFile, &manifest); err != nil {
+			return err
+		}
+		if manifest.Experiment != auditImpactExperiment {
+			return fmt.Errorf("%s holds a %s run, not %s", dir, manifest.Experiment, auditImpactExperiment)
+		}
+		mode := manifest.Metadata[auditLoggingMetadataKey]
+		if previous, recorded := dirs[mode]; recorded {
+			return fmt.Errorf("both %s and %s were run with audit logging %s", previous, dir, mode)
+		}
+		dirs[mode] = dir
+
+		var phases []artifacts.Phase
+		if err := loadPhases(dir, &phases); err != nil {
+			return err
+		}
+		podsByIdentifier, err := loadPodInfo(dir)
+		if err != nil {
+			return err
+		}
+		metrics, err := loadMetrics(dir, podsByIdentifier, memory)
+		if err != nil {
+			return fmt.Errorf("failed to read metrics from %s: %w", dir, err)
+		}
+		usages[mode], err = usageByPhase(metrics, phases)
+		_ = metrics.close()
+		if err != nil {
+			return err
+		}
+	}
+	if dirs[auditLoggingEnabled] == "" || dirs[auditLoggingDisabled] == "" {
+		return fmt.Errorf("audit impact requires one run with audit logging %s and one %s", auditLoggingEnabled, auditLoggingDisabled)
+	}
+
+	impact := auditImpact{
+		Enabled:  dirs[auditLoggingEnabled],
+		Disabled: dirs[auditLoggingDisabled],
+		Phases:   map[string]map[string]auditImpactDelta{},
+	}
+	for phase, byIdentifier := range usages[auditLoggingEnabled] {
+		for identifier, enabled := range byIdentifier {
+			disabled, exists := usages[auditLoggingDisabled][phase][identifier]
+			if !exists {
+				continue
+			}
+			if _, exists := impact.Phases[phase]; !exists {
+				impact.Phases[phase] = map[string]auditImpactDelta{}
+			}
+			impact.Phases[phase][identifier] = auditImpactDelta{
+				Enabled:  enabled,
+				Disabled: disabled,
+				Delta: usage{
+					CPUCores:       enabled.CPUCores - disabled.CPUCores,
+					PeakCPUCores:   enabled.PeakCPUCores - disabled.PeakCPUCores,
+					P99CPUCores:    enabled.P99CPUCores - disabled.P99CPUCores,
+					MemoryBytes:    enabled.MemoryBytes - disabled.MemoryBytes,
+					P99MemoryBytes: enabled.P99MemoryBytes - disabled.P99MemoryBytes,
+				},
+			}
+		}
+	}
+	return artifacts.Write(dataDir, auditImpactFile, impact)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const auditLogFile = "audit-log.json"
+
+// auditAttribution counts the requests one user made with one verb on one resource. Rate is per second.
+type auditAttribution struct {
+	User     string  `json:"user"`
+	Verb     string  `json:"verb"`
+	Resource string  `json:"resource"`
+	Requests int     `json:"requests"`
+	Rate     float64 `json:"rate"`
+}
+
+// auditEvent holds the fields of an audit event which attribute a request.
+type auditEvent struct {
+	AuditID string `json:"auditID"`
+	Verb    string `json:"verb"`
+	User    struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	ObjectRef *struct {
+		Resource    string `json:"resource"`
+		Subresource string `json:"subresource"`
+	} `json:"objectRef"`
+	RequestReceivedTimestamp time.Time `json:"requestReceivedTimestamp"`
+}
+
+func (e auditEvent) resource() string {
+	if e.ObjectRef == nil {
+		return ""
+	}
+	if e.ObjectRef.Subresource != "" {
+		return e.ObjectRef.Resource + "/" + e.ObjectRef.Subresource
+	}
+	return e.ObjectRef.Resource
+}
+
+// digestAuditLog attributes the requests the API servers audited to users, verbs and resources, over the run and in
+// every phase, keyed by window, when the run recorded the audit log. Requests are counted once, however many stages
+// the audit policy records for them, in the window they were received in.
+func digestAuditLog(dataDir string) error {
+	files, err := filepath.Glob(filepath.Join(dataDir, artifacts.NodeCollectorDir, "*", artifacts.AuditLogFile))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var events []auditEvent
+	seen := map[string]struct{}{}
+	for _, file := range files {
+		if err := loadAuditEvents(file, func(event auditEvent) {
+			if _, counted := seen[event.AuditID]; counted {
+				return
+			}
+			seen[event.AuditID] = struct{}{}
+			events = append(events, event)
+		}); err != nil {
+			return err
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].RequestReceivedTimestamp.Before(events[j].RequestReceivedTimestamp)
+	})
+
+	attributions := map[string][]auditAttribution{}
+	windows := append([]artifacts.Phase{{
+		Name:  runWindow,
+		Start: events[0].RequestReceivedTimestamp,
+		End:   events[len(events)-1].RequestReceivedTimestamp.Add(time.Nanosecond),
+	}}, phases...)
+	for _, window := range windows {
+		counts := map[auditAttribution]int{}
+		for _, event := range events {
+			if window.Contains(event.RequestReceivedTimestamp) {
+				counts[auditAttribution{User: event.User.Username, Verb: event.Verb, Resource: event.resource()}]++
+			}
+		}
+		elapsed := window.End.Sub(window.Start).Seconds()
+		var attributed []auditAttribution
+		for attribution, requests := range counts {
+			attribution.Requests = requests
+			if elapsed > 0 {
+				attribution.Rate = float64(requests) / elapsed
+			}
+			attributed = append(attributed, attribution)
+		}
+		sort.Slice(attributed, func(i, j int) bool {
+			if attributed[i].Requests != attributed[j].Requests {
+				return attributed[i].Requests > attributed[j].Requests
+			}
+			return attributed[i].User+attributed[i].Verb+attributed[i].Resource < attributed[j].User+attributed[j].Verb+attributed[j].Resource
+		})
+		attributions[window.Name] = attributed
+	}
+	return artifacts.Write(dataDir, auditLogFile, attributions)
+}
+
+// loadAuditEvents parses the audit events in the file, from lines holding the time the collector read them and
+// the event as the API server logged it. Lines cut short when the collector stopped are skipped.
+func loadAuditEvents(path string, handle func(auditEvent)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	// events hold the objects in requests and responses at some audit levels, which can be large
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		_, raw, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			continue
+		}
+		var event auditEvent
+		if err := json.Unmarshal([]byte(raw), &event); err != nil || event.AuditID == "" {
+			continue
+		}
+		handle(event)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
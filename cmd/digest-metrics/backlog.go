@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const backlogGrowthFile = "backlog-growth.json"
+
+// backlogWindows is the number of windows the run is split into to tell sustained growth of the backlog from
+// noise; growth must continue through all of them.
+const backlogWindows = 6
+
+type backlogGrowth struct {
+	// Windows holds the mean backlog per open watch, in events, in consecutive windows of the run.
+	Windows []float64 `json:"windows"`
+	// Slope is the growth of the backlog per open watch, in events per minute, fit over the whole run.
+	Slope float64 `json:"slope"`
+	// Growing is set when the backlog grew through every window, which precedes watchers being terminated for
+	// falling behind.
+	Growing bool `json:"growing"`
+}
+
+// digestBacklog determines whether the backlog of watch events grew throughout the run, when the run sampled it.
+func digestBacklog(dataDir string) error {
+	var backlog artifacts.Backlog
+	if err := artifacts.Load(dataDir, artifacts.BacklogFile, &backlog); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var minutes, perWatch []float64
+	for i, offset := range backlog.Offsets {
+		if backlog.Open[i] <= 0 {
+			continue
+		}
+		minutes = append(minutes, offset/60)
+		perWatch = append(perWatch, (backlog.Sent[i]-float64(backlog.Received[i]))/float64(backlog.Open[i]))
+	}
+	result := backlogGrowth{Slope: slope(minutes, perWatch)}
+	if len(perWatch) >= backlogWindows {
+		for window := 0; window < backlogWindows; window++ {
+			result.Windows = append(result.Windows, meanOf(perWatch[window*len(perWatch)/backlogWindows:(window+1)*len(perWatch)/backlogWindows]))
+		}
+		result.Growing = true
+		for i := 1; i < len(result.Windows); i++ {
+			if result.Windows[i] <= result.Windows[i-1] {
+				result.Growing = false
+			}
+		}
+	}
+	return artifacts.Write(dataDir, backlogGrowthFile, result)
+}
+
+// backlogAlarm describes the growth of the backlog for the report, if it grew.
+func backlogAlarm(dataDir string) (string, error) {
+	var growth backlogGrowth
+	if err := artifacts.Load(dataDir, backlogGrowthFile, &growth); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	if !growth.Growing {
+		return "", nil
+	}
+	return fmt.Sprintf("The watch delivery backlog grew throughout the run, by %.1f events per watch per minute, to %.1f events per watch. Watchers which cannot keep up will be terminated.", growth.Slope, growth.Windows[len(growth.Windows)-1]), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const cadvisorFile = "cadvisor.json"
+
+// containerActivity is what cAdvisor reported about one container over one phase. Rates are per second.
+type containerActivity struct {
+	Phase     string `json:"phase"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	// ThrottledFraction is the fraction of CFS periods in which the container was throttled, and ThrottledSeconds
+	// how long it was throttled for, per second.
+	ThrottledFraction float64 `json:"throttledFraction"`
+	ThrottledSeconds  float64 `json:"throttledSeconds"`
+	FSReadBytes       float64 `json:"fsReadBytes"`
+	FSWriteBytes      float64 `json:"fsWriteBytes"`
+	// Network counters are reported for the pod as a whole, under an empty container name.
+	NetworkReceiveBytes  float64 `json:"networkReceiveBytes"`
+	NetworkTransmitBytes float64 `json:"networkTransmitBytes"`
+}
+
+// cadvisorCounters are the counters digested, each summed over every other label of a container.
+var cadvisorCounters = []string{
+	"container_cpu_cfs_periods_total",
+	"container_cpu_cfs_throttled_periods_total",
+	"container_cpu_cfs_throttled_seconds_total",
+	"container_fs_reads_bytes_total",
+	"container_fs_writes_bytes_total",
+	"container_network_receive_bytes_total",
+	"container_network_transmit_bytes_total",
+}
+
+type containerKey struct {
+	pod, container string
+}
+
+// counterSeries holds the samples of a counter in time order.
+type counterSeries struct {
+	times  []time.Time
+	values []float64
+}
+
+// over determines how much the counter increased over the phase and how many seconds that increase spans,
+// starting from the last sample before the phase when there is one.
+func (s counterSeries) over(phase artifacts.Phase) (float64, float64) {
+	first, last := -1, -1
+	for i, at := range s.times {
+		if at.Before(phase.Start) {
+			first = i
+		}
+		if phase.Contains(at) {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if last <= first || first < 0 {
+		return 0, 0
+	}
+	var total float64
+	for i := first + 1; i <= last; i++ {
+		total += increase(s.values[i-1], s.values[i])
+	}
+	return total, s.times[last].Sub(s.times[first]).Seconds()
+}
+
+// digestCAdvisor determines how much every monitored container was throttled, and how much IO it did, in each phase.
+func digestCAdvisor(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.CAdvisorDir, "container_")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	counters := map[containerKey]map[string]*counterSeries{}
+	for _, series := range snapshots {
+		for _, snapshot := range series {
+			for _, name := range cadvisorCounters {
+				family, exists := snapshot.families[name]
+				if !exists {
+					continue
+				}
+				sums := map[containerKey]float64{}
+				for _, sample := range family.Metric {
+					sums[keyOf(sample)] += sampleValue(sample)
+				}
+				for key, value := range sums {
+					if _, exists := counters[key]; !exists {
+						counters[key] = map[string]*counterSeries{}
+					}
+					if _, exists := counters[key][name]; !exists {
+						counters[key][name] = &counterSeries{}
+					}
+					counters[key][name].times = append(counters[key][name].times, snapshot.time)
+					counters[key][name].values = append(counters[key][name].values, value)
+				}
+			}
+		}
+	}
+
+	var keys []containerKey
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pod != keys[j].pod {
+			return keys[i].pod < keys[j].pod
+		}
+		return keys[i].container < keys[j].container
+	})
+	var result []containerActivity
+	for _, phase := range phases {
+		for _, key := range keys {
+			rate := func(name string) float64 {
+				series, exists := counters[key][name]
+				if !exists {
+					return 0
+				}
+				increase, seconds := series.over(phase)
+				if seconds == 0 {
+					return 0
+				}
+				return increase / seconds
+			}
+			activity := containerActivity{
+				Phase:                phase.Name,
+				Pod:                  key.pod,
+				Container:            key.container,
+				ThrottledSeconds:     rate("container_cpu_cfs_throttled_seconds_total"),
+				FSReadBytes:          rate("container_fs_reads_bytes_total"),
+				FSWriteBytes:         rate("container_fs_writes_bytes_total"),
+				NetworkReceiveBytes:  rate("container_network_receive_bytes_total"),
+				NetworkTransmitBytes: rate("container_network_transmit_bytes_total"),
+			}
+			if periods := rate("container_cpu_cfs_periods_total"); periods > 0 {
+				activity.ThrottledFraction = rate("container_cpu_cfs_throttled_periods_total") / periods
+			}
+			result = append(result, activity)
+		}
+	}
+	return artifacts.Write(dataDir, cadvisorFile, result)
+}
+
+// keyOf identifies the container a sample describes; the pod sandbox is reported as the POD container by some
+// runtimes and as none by others.
+func keyOf(sample *dto.Metric) containerKey {
+	container := labelValue(sample, "container")
+	if container == "POD" {
+		container = ""
+	}
+	return containerKey{pod: labelValue(sample, "namespace") + "/" + labelValue(sample, "pod"), container: container}
+}
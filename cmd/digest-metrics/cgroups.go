@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const cgroupUsageFile = "cgroup-usage.json"
+
+// fineUsage summarizes the high-resolution samples recorded from cgroups, which show spikes that the kubelet
+// summary averages away.
+type fineUsage struct {
+	PeakCPUCores        float64 `json:"peakCpuCores"`
+	P99CPUCores         float64 `json:"p99CpuCores"`
+	PeakWorkingSetBytes float64 `json:"peakWorkingSetBytes"`
+}
+
+type cgroupSample struct {
+	time time.Time
+	// usage is the cumulative CPU time, in microseconds.
+	usage      float64
+	workingSet float64
+}
+
+// digestCgroupUsage determines the peak usage of every identifier over the run and in every phase, keyed by window
+// and identifier, when the run recorded cgroup stats. Like the other figures, those of the pods of an identifier
+// are summed.
+func digestCgroupUsage(dataDir string, podsByIdentifier map[string][]types.NamespacedName) error {
+	files, err := filepath.Glob(filepath.Join(dataDir, artifacts.NodeCollectorDir, "*", artifacts.CgroupsFile))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	identifierForPod := map[string]string{}
+	for identifier, pods := range podsByIdentifier {
+		for _, pod := range pods {
+			identifierForPod[pod.String()] = identifier
+		}
+	}
+
+	samples := map[string][]cgroupSample{}
+	for _, file := range files {
+		if err := loadCgroups(file, samples); err != nil {
+			return err
+		}
+	}
+	var start, end time.Time
+	for _, series := range samples {
+		if len(series) == 0 {
+			continue
+		}
+		if start.IsZero() || series[0].time.Before(start) {
+			start = series[0].time
+		}
+		if last := series[len(series)-1].time; last.After(end) {
+			end = last
+		}
+	}
+	windows := append([]artifacts.Phase{{Name: runWindow, Start: start, End: end.Add(time.Nanosecond)}}, phases...)
+
+	result := map[string]map[string]fineUsage{}
+	for _, window := range windows {
+		result[window.Name] = map[string]fineUsage{}
+		for pod, series := range samples {
+			identifier, known := identifierForPod[pod]
+			if !known {
+				continue
+			}
+			var rates, workingSets []float64
+			var previous *cgroupSample
+			for i := range series {
+				sample := &series[i]
+				if !window.Contains(sample.time) {
+					continue
+				}
+				workingSets = append(workingSets, sample.workingSet)
+				// counters reset when a container restarts, which must not read as negative usage
+				if previous != nil && sample.time.After(previous.time) && sample.usage >= previous.usage {
+					rates = append(rates, (sample.usage-previous.usage)/float64(sample.time.Sub(previous.time).Microseconds()))
+				}
+				previous = sample
+			}
+			if len(workingSets) == 0 {
+				continue
+			}
+			usage := result[window.Name][identifier]
+			usage.PeakCPUCores += percentile(rates, 1)
+			usage.P99CPUCores += percentile(rates, 0.99)
+			usage.PeakWorkingSetBytes += percentile(workingSets, 1)
+			result[window.Name][identifier] = usage
+		}
+	}
+	return artifacts.Write(dataDir, cgroupUsageFile, result)
+}
+
+// loadCgroups parses the samples for every pod, keyed by namespace/name, from lines like:
+//
+//	2006-01-02T15:04:05.999999999Z namespace/name <usage_usec> <memory.current> <inactive_file>
+func loadCgroups(path string, samples map[string][]cgroupSample) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 {
+			// the collector prints incomplete lines when a pod goes away mid-sample
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse timestamp in %s: %w", path, err)
+		}
+		var values [3]float64
+		for i, field := range fields[2:] {
+			if values[i], err = strconv.ParseFloat(field, 64); err != nil {
+				return fmt.Errorf("failed to parse sample in %s: %w", path, err)
+			}
+		}
+		samples[fields[1]] = append(samples[fields[1]], cgroupSample{
+			time:       timestamp,
+			usage:      values[0],
+			workingSet: values[1] - values[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const clientUsageSummaryFile = "client-usage-summary.json"
+
+// clientSaturation is the fraction of its CPUs the benchmark may use in a phase before it is suspected to have
+// throttled the load it generated.
+const clientSaturation = 0.9
+
+// clientUsagePhase summarizes the resources the benchmark used in one phase.
+type clientUsagePhase struct {
+	// CPU and PeakCPU are the mean and largest cores used.
+	CPU            float64 `json:"cpu"`
+	PeakCPU        float64 `json:"peakCPU"`
+	PeakRSS        float64 `json:"peakRSS"`
+	PeakGoroutines int     `json:"peakGoroutines"`
+	PeakSockets    int     `json:"peakSockets"`
+}
+
+type clientUsageSummary struct {
+	CPUs   int                         `json:"cpus"`
+	Phases map[string]clientUsagePhase `json:"phases"`
+}
+
+// digestClientUsage summarizes the resources the benchmark used in every phase, and over the run.
+func digestClientUsage(dataDir string) error {
+	var usage artifacts.ClientUsage
+	if err := artifacts.Load(dataDir, artifacts.ClientUsageFile, &usage); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(usage.Offsets) == 0 {
+		return nil
+	}
+
+	windows := append([]artifacts.Phase{{
+		Name:  runWindow,
+		Start: usage.Start,
+		End:   usage.Start.Add(time.Duration(usage.Offsets[len(usage.Offsets)-1]*float64(time.Second)) + time.Nanosecond),
+	}}, phases...)
+	result := clientUsageSummary{CPUs: usage.CPUs, Phases: map[string]clientUsagePhase{}}
+	for _, window := range windows {
+		var summary clientUsagePhase
+		var cpu []float64
+		for i, offset := range usage.Offsets {
+			if !window.Contains(usage.Start.Add(time.Duration(offset * float64(time.Second)))) {
+				continue
+			}
+			cpu = append(cpu, usage.CPU[i])
+			if usage.CPU[i] > summary.PeakCPU {
+				summary.PeakCPU = usage.CPU[i]
+			}
+			if usage.RSS[i] > summary.PeakRSS {
+				summary.PeakRSS = usage.RSS[i]
+			}
+			if usage.Goroutines[i] > summary.PeakGoroutines {
+				summary.PeakGoroutines = usage.Goroutines[i]
+			}
+			if usage.Sockets[i] > summary.PeakSockets {
+				summary.PeakSockets = usage.Sockets[i]
+			}
+		}
+		if len(cpu) == 0 {
+			continue
+		}
+		summary.CPU = meanOf(cpu)
+		result.Phases[window.Name] = summary
+	}
+	return artifacts.Write(dataDir, clientUsageSummaryFile, result)
+}
+
+// clientUsageAlarm warns when the benchmark kept its CPUs busy through a phase, as the load it meant to generate
+// was then likely limited by the benchmark, not the API servers.
+func clientUsageAlarm(dataDir string) (string, error) {
+	var summary clientUsageSummary
+	if err := artifacts.Load(dataDir, clientUsageSummaryFile, &summary); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	var saturated []string
+	for phase, usage := range summary.Phases {
+		if phase != runWindow && summary.CPUs > 0 && usage.CPU >= clientSaturation*float64(summary.CPUs) {
+			saturated = append(saturated, fmt.Sprintf("%s (%.1f cores)", phase, usage.CPU))
+		}
+	}
+	if len(saturated) == 0 {
+		return "", nil
+	}
+	sort.Strings(saturated)
+	return fmt.Sprintf("The benchmark used nearly all of its %d CPUs in %s. The load it generated was likely limited by the benchmark itself, not the API servers.", summary.CPUs, strings.Join(saturated, ", ")), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const cohortComparisonFile = "cohort-comparison.json"
+
+type cohortComparison struct {
+	Watches       int   `json:"watches"`
+	Disconnected  int   `json:"disconnected"`
+	Reestablished int   `json:"reestablished"`
+	Relists       int64 `json:"relists"`
+	// RelistsPerDisconnect is the fraction of disconnections which could not resume from the last resourceVersion
+	// seen, because it had fallen out of the watch cache window.
+	RelistsPerDisconnect float64 `json:"relistsPerDisconnect"`
+	// Reestablishment percentiles are in seconds.
+	P50Reestablishment float64 `json:"p50Reestablishment"`
+	P99Reestablishment float64 `json:"p99Reestablishment"`
+	MaxReestablishment float64 `json:"maxReestablishment"`
+}
+
+// digestCohorts summarizes every cohort of watches side by side, when the run split watches into cohorts.
+func digestCohorts(dataDir string) error {
+	var cohorts artifacts.Cohorts
+	if err := artifacts.Load(dataDir, artifacts.CohortsFile, &cohorts); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	comparison := map[string]cohortComparison{}
+	for name, cohort := range cohorts {
+		summary := cohortComparison{
+			Watches:            cohort.Watches,
+			Disconnected:       cohort.Disconnected,
+			Reestablished:      cohort.Reestablished,
+			Relists:            cohort.Relists,
+			P50Reestablishment: percentile(cohort.Reestablishment, 0.5),
+			P99Reestablishment: percentile(cohort.Reestablishment, 0.99),
+			MaxReestablishment: percentile(cohort.Reestablishment, 1),
+		}
+		if cohort.Disconnected > 0 {
+			summary.RelistsPerDisconnect = float64(cohort.Relists) / float64(cohort.Disconnected)
+		}
+		comparison[name] = summary
+	}
+	return artifacts.Write(dataDir, cohortComparisonFile, comparison)
+}
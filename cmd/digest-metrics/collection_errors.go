@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+func loadCollectionErrors(dataDir string) ([]artifacts.CollectionError, error) {
+	var stretches []artifacts.CollectionError
+	if err := artifacts.Load(dataDir, artifacts.CollectionErrorsFile, &stretches); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return stretches, nil
+}
+
+// gapAnnotation marks the stretch of failures on the timeline, with its most frequent reason.
+func gapAnnotation(stretch artifacts.CollectionError) artifacts.Annotation {
+	var reasons []string
+	for reason := range stretch.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if stretch.Reasons[reasons[i]] != stretch.Reasons[reasons[j]] {
+			return stretch.Reasons[reasons[i]] > stretch.Reasons[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	description := fmt.Sprintf("%s could not collect from %s, %d failures", stretch.Monitor, stretch.Target, stretch.Failures)
+	if len(reasons) > 0 {
+		description += ": " + strings.TrimSpace(reasons[0])
+	}
+	return artifacts.Annotation{Time: stretch.Start, End: stretch.End, Kind: artifacts.AnnotationGap, Description: description}
+}
+
+// gapBetween determines whether the usage of a node could not be collected for the whole time between two samples,
+// returning when it could not be from. The stretches do not tell which pods ran on the node that could not be
+// polled, so any two samples around a stretch are taken to span it.
+func gapBetween(before, after time.Time, stretches []artifacts.CollectionError) (time.Time, bool) {
+	for _, stretch := range stretches {
+		if (stretch.Monitor != artifacts.SummaryMonitor && stretch.Monitor != artifacts.ResourceMetricsMonitor) || stretch.End == nil {
+			continue
+		}
+		if before.Before(stretch.Start) && after.After(*stretch.End) {
+			return stretch.Start, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	texttemplate "text/template"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const (
+	pairedComparisonFile = "paired-comparison.json"
+	comparisonReportFile = "comparison.md"
+	comparisonQuantile   = 0.99
+
+	baselineComparisonFile       = "baseline-comparison.json"
+	baselineComparisonReportFile = "baseline-comparison.md"
+)
+
+type pairedComparison struct {
+	Contexts map[string]string `json:"contexts"`
+	// Simultaneous is set when both sides ran at the same time, against two clusters, rather than one after the
+	// other.
+	Simultaneous bool `json:"simultaneous"`
+	// Notes holds what people recorded about the run of every side, keyed by side.
+	Notes map[string][]string `json:"notes,omitempty"`
+	// Alarms holds, keyed by side, why the run of a side cannot be compared like for like; a control plane which
+	// fell over on one side only makes the deltas meaningless.
+	Alarms map[string][]string `json:"alarms,omitempty"`
+	// Phases holds the resource usage of both sides keyed by phase and then identifier.
+	Phases map[string]map[string]pairedUsage `json:"phases"`
+	// Latencies holds the 99th percentile of every latency both sides recorded, in seconds, keyed by what was
+	// measured.
+	Latencies map[string]pairedLatency `json:"latencies,omitempty"`
+}
+
+type pairedUsage struct {
+	A usage `json:"a"`
+	B usage `json:"b"`
+	// Delta is the usage of the second side less that of the first, and Ratio the usage of the second side over that
+	// of the first, or zero where the first side used none.
+	Delta usage `json:"delta"`
+	Ratio usage `json:"ratio"`
+}
+
+type pairedLatency struct {
+	A     float64 `json:"a"`
+	B     float64 `json:"b"`
+	Delta float64 `json:"delta"`
+	Ratio float64 `json:"ratio"`
+}
+
+// isComparison determines whether the data directory holds the runs of a comparison, rather than a single run.
+func isComparison(dataDir string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(dataDir, artifacts.ComparisonFile)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// digestComparison pairs the phases and latencies of the runs against both clusters of a comparison, which ran the
+// same experiment at the same time, and reports how the second cluster differs from the first.
+func digestComparison(dataDir string, trimmed trim, memory memoryStatistics) error {
+	var comparison artifacts.Comparison
+	if err := artifacts.Load(dataDir, artifacts.ComparisonFile, &comparison); err != nil {
+		return err
+	}
+	if comparison.Start == nil {
+		return errors.New("the comparison did not start both experiments")
+	}
+	sides := map[string]string{}
+	for _, side := range artifacts.ComparisonSides {
+		sides[side] = filepath.Join(dataDir, side)
+	}
+	paired, err := pairRuns(sides, trimmed, memory)
+	if err != nil {
+		return err
+	}
+	paired.Contexts = comparison.Contexts
+	paired.Simultaneous = true
+	if err := artifacts.Write(dataDir, pairedComparisonFile, paired); err != nil {
+		return err
+	}
+	return renderComparison(filepath.Join(dataDir, comparisonReportFile), paired)
+}
+
+// digestBaselineComparison compares the run to one of a baseline, which ran the same experiment before, phase by
+// phase, so that a patch can be evaluated by running the experiment against the cluster with and without it.
+func digestBaselineComparison(dataDir, baselineDir string, trimmed trim, memory memoryStatistics) error {
+	a, b := artifacts.ComparisonSides[0], artifacts.ComparisonSides[1]
+	paired, err := pairRuns(map[string]string{a: baselineDir, b: dataDir}, trimmed, memory)
+	if err != nil {
+		return err
+	}
+	paired.Contexts = map[string]string{a: "baseline", b: "candidate"}
+	if err := artifacts.Write(dataDir, baselineComparisonFile, paired); err != nil {
+		return err
+	}
+	return renderComparison(filepath.Join(dataDir, baselineComparisonReportFile), paired)
+}
+
+// pairRuns pairs the resource usage in the phases both runs, keyed by side, have in common, and the latencies both
+// recorded, with both runs trimmed alike.
+func pairRuns(sides map[string]string, trimmed trim, memory memoryStatistics) (pairedComparison, error) {
+	usages := map[string]map[string]map[string]usage{}
+	latencies := map[string]artifacts.Latencies{}
+	notes := map[string][]string{}
+	alarms := map[string][]string{}
+	for _, side := range artifacts.ComparisonSides {
+		dir := sides[side]
+		var manifest artifacts.Manifest
+		if err := artifacts.Load(dir, artifacts.ManifestFile, &manifest); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pairedComparison{}, err
+		}
+		if len(manifest.Notes) > 0 {
+			notes[side] = manifest.Notes
+		}
+		alarm, err := podHealthAlarm(dir)
+		if err != nil {
+			return pairedComparison{}, err
+		}
+		if alarm != "" {
+			alarms[side] = append(alarms[side], alarm)
+		}
+		var phases []artifacts.Phase
+		if err := loadPhases(dir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pairedComparison{}, err
+		}
+		podsByIdentifier, err := loadPodInfo(dir)
+		if err != nil {
+			return pairedComparison{}, err
+		}
+		metrics, err := loadMetrics(dir, podsByIdentifier, memory)
+		if err != nil {
+			return pairedComparison{}, fmt.Errorf("failed to read metrics from %s: %w", dir, err)
+		}
+		usages[side], err = usageByPhase(metrics, trimmed.apply(phases))
+		_ = metrics.close()
+		if err != nil {
+			return pairedComparison{}, err
+		}
+		var sideLatencies artifacts.Latencies
+		if err := artifacts.Load(dir, artifacts.LatenciesFile, &sideLatencies); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pairedComparison{}, err
+		}
+		latencies[side] = sideLatencies
+	}
+
+	a, b := artifacts.ComparisonSides[0], artifacts.ComparisonSides[1]
+	paired := pairedComparison{
+		Notes:     notes,
+		Alarms:    alarms,
+		Phases:    map[string]map[string]pairedUsage{},
+		Latencies: map[string]pairedLatency{},
+	}
+	for phase, byIdentifier := range usages[a] {
+		for identifier, first := range byIdentifier {
+			second, exists := usages[b][phase][identifier]
+			if !exists {
+				continue
+			}
+			if _, exists := paired.Phases[phase]; !exists {
+				paired.Phases[phase] = map[string]pairedUsage{}
+			}
+			paired.Phases[phase][identifier] = pairedUsage{
+				A: first,
+				B: second,
+				Delta: usage{
+					CPUCores:             second.CPUCores - first.CPUCores,
+					PeakCPUCores:         second.PeakCPUCores - first.PeakCPUCores,
+					P99CPUCores:          second.P99CPUCores - first.P99CPUCores,
+					MemoryBytes:          second.MemoryBytes - first.MemoryBytes,
+					P99MemoryBytes:       second.P99MemoryBytes - first.P99MemoryBytes,
+					NetworkReceiveBytes:  second.NetworkReceiveBytes - first.NetworkReceiveBytes,
+					NetworkTransmitBytes: second.NetworkTransmitBytes - first.NetworkTransmitBytes,
+				},
+				Ratio: usage{
+					CPUCores:             ratio(first.CPUCores, second.CPUCores),
+					PeakCPUCores:         ratio(first.PeakCPUCores, second.PeakCPUCores),
+					P99CPUCores:          ratio(first.P99CPUCores, second.P99CPUCores),
+					MemoryBytes:          ratio(first.MemoryBytes, second.MemoryBytes),
+					P99MemoryBytes:       ratio(first.P99MemoryBytes, second.P99MemoryBytes),
+					NetworkReceiveBytes:  ratio(first.NetworkReceiveBytes, second.NetworkReceiveBytes),
+					NetworkTransmitBytes: ratio(first.NetworkTransmitBytes, second.NetworkTransmitBytes),
+				},
+			}
+		}
+	}
+	for kind, first := range latencies[a] {
+		second, exists := latencies[b][kind]
+		if !exists || len(first.Seconds) == 0 || len(second.Seconds) == 0 {
+			continue
+		}
+		firstQuantile, secondQuantile := percentile(first.Seconds, comparisonQuantile), percentile(second.Seconds, comparisonQuantile)
+		paired.Latencies[kind] = pairedLatency{A: firstQuantile, B: secondQuantile, Delta: secondQuantile - firstQuantile, Ratio: ratio(firstQuantile, secondQuantile)}
+	}
+	return paired, nil
+}
+
+// ratio divides the second value by the first, or is zero when the first is, as JSON has no infinity.
+func ratio(first, second float64) float64 {
+	if first == 0 {
+		return 0
+	}
+	return second / first
+}
+
+type comparisonReport struct {
+	A, B         string
+	Simultaneous bool
+	Notes        []comparisonNote
+	Alarms       []comparisonNote
+	Phases       []comparisonRow
+	Latencies    []comparisonRow
+}
+
+type comparisonNote struct {
+	Context, Note string
+}
+
+type comparisonRow struct {
+	Name, Identifier   string
+	A, B, Delta, Ratio string
+}
+
+func renderComparison(path string, paired pairedComparison) error {
+	content := comparisonReport{
+		A:            paired.Contexts[artifacts.ComparisonSides[0]],
+		B:            paired.Contexts[artifacts.ComparisonSides[1]],
+		Simultaneous: paired.Simultaneous,
+	}
+	for _, side := range artifacts.ComparisonSides {
+		for _, note := range paired.Notes[side] {
+			content.Notes = append(content.Notes, comparisonNote{Context: paired.Contexts[side], Note: note})
+		}
+		for _, alarm := range paired.Alarms[side] {
+			content.Alarms = append(content.Alarms, comparisonNote{Context: paired.Contexts[side], Note: alarm})
+		}
+	}
+	var phases []string
+	for phase := range paired.Phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		var identifiers []string
+		for identifier := range paired.Phases[phase] {
+			identifiers = append(identifiers, identifier)
+		}
+		sort.Strings(identifiers)
+		for _, identifier := range identifiers {
+			used := paired.Phases[phase][identifier]
+			content.Phases = append(content.Phases, comparisonRow{
+				Name:       phase,
+				Identifier: identifier + " CPU (cores)",
+				A:          fmt.Sprintf("%.2f", used.A.CPUCores),
+				B:          fmt.Sprintf("%.2f", used.B.CPUCores),
+				Delta:      fmt.Sprintf("%+.2f", used.Delta.CPUCores),
+				Ratio:      formatRatio(used.Ratio.CPUCores),
+			}, comparisonRow{
+				Name:       phase,
+				Identifier: identifier + " memory",
+				A:          formatBytes(used.A.MemoryBytes),
+				B:          formatBytes(used.B.MemoryBytes),
+				Delta:      formatSignedBytes(used.Delta.MemoryBytes),
+				Ratio:      formatRatio(used.Ratio.MemoryBytes),
+			})
+		}
+	}
+	var kinds []string
+	for kind := range paired.Latencies {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		latency := paired.Latencies[kind]
+		sign := "+"
+		if latency.Delta < 0 {
+			sign = "-"
+		}
+		content.Latencies = append(content.Latencies, comparisonRow{
+			Name:  kind,
+			A:     formatSeconds(latency.A),
+			B:     formatSeconds(latency.B),
+			Delta: sign + formatSeconds(math.Abs(latency.Delta)),
+			Ratio: formatRatio(latency.Ratio),
+		})
+	}
+
+	output, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", filepath.Base(path), err)
+	}
+	defer func() {
+		_ = output.Close()
+	}()
+	if err := comparisonTemplate.Execute(output, content); err != nil {
+		return fmt.Errorf("could not render %s: %w", filepath.Base(path), err)
+	}
+	return output.Close()
+}
+
+func formatRatio(ratio float64) string {
+	if ratio == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2fx", ratio)
+}
+
+func formatSignedBytes(bytes float64) string {
+	if bytes < 0 {
+		return "-" + formatBytes(-bytes)
+	}
+	return "+" + formatBytes(bytes)
+}
+
+var comparisonTemplate = texttemplate.Must(texttemplate.New("comparison").Parse(`# Comparison of {{ .A }} and {{ .B }}
+
+{{ if .Simultaneous }}Both experiments started at the same time; deltas{{ else }}The experiments ran one after the other and are aligned by phase; deltas{{ end }} are {{ .B }} less {{ .A }}, and ratios {{ .B }} over {{ .A }}.
+{{ range .Alarms }}
+> **Alarm, {{ .Context }}:** {{ .Note }}
+{{ end }}{{ if .Notes }}
+## Notes
+{{ range .Notes }}
+- **{{ .Context }}:** {{ .Note }}
+{{- end }}
+{{ end }}{{ if .Phases }}
+## Resource usage by phase
+
+| Phase | Measure | {{ .A }} | {{ .B }} | Delta | Ratio |
+|-------|---------|---:|---:|------:|------:|
+{{- range .Phases }}
+| {{ .Name }} | {{ .Identifier }} | {{ .A }} | {{ .B }} | {{ .Delta }} | {{ .Ratio }} |
+{{- end }}
+{{ end }}
+{{- if .Latencies }}
+## P99 latency
+
+| Measured | {{ .A }} | {{ .B }} | Delta | Ratio |
+|----------|---:|---:|------:|------:|
+{{- range .Latencies }}
+| {{ .Name }} | {{ .A }} | {{ .B }} | {{ .Delta }} | {{ .Ratio }} |
+{{- end }}
+{{ end }}`))
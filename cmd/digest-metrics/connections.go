@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const connectionsFile = "connections.json"
+
+type socketSample struct {
+	time                         time.Time
+	inUse, timeWait, established float64
+}
+
+// socketSummary describes the TCP sockets on one node over a window, as means unless stated otherwise.
+type socketSummary struct {
+	// Established counts the connections established to the API server on the node.
+	Established     float64 `json:"established"`
+	PeakEstablished float64 `json:"peakEstablished"`
+	InUse           float64 `json:"inUse"`
+	TimeWait        float64 `json:"timeWait"`
+}
+
+type connectionsWindow struct {
+	Nodes map[string]socketSummary `json:"nodes,omitempty"`
+	// HandshakeErrors is the number of TLS handshakes all API server replicas failed.
+	HandshakeErrors float64 `json:"handshakeErrors"`
+}
+
+type connections struct {
+	// Windows are keyed by phase, and by runWindow for the whole run.
+	Windows map[string]connectionsWindow `json:"windows"`
+	// PerWatch is the number of connections to the API servers established for every watch open, as the slope of
+	// one against the other, summed over nodes. Watches multiplexed over HTTP/2 cost a fraction of a connection.
+	PerWatch float64 `json:"perWatch"`
+}
+
+// digestConnections characterizes the connections the API servers held and the TLS handshakes they failed, over the
+// run and in every phase, to show what watches cost in connections, especially when every watch dials anew.
+func digestConnections(dataDir string) error {
+	files, err := filepath.Glob(filepath.Join(dataDir, artifacts.NodeCollectorDir, "*", artifacts.SocketsFile))
+	if err != nil {
+		return err
+	}
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.APIServerMetricsDir, "apiserver_tls_handshake_errors_total")
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 && len(snapshots) == 0 {
+		return nil
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	open, err := loadOpenWatches(dataDir)
+	if err != nil {
+		return err
+	}
+
+	sockets := map[string][]socketSample{}
+	var start, end time.Time
+	for _, file := range files {
+		node := filepath.Base(filepath.Dir(file))
+		if sockets[node], err = loadSockets(file); err != nil {
+			return err
+		}
+		if series := sockets[node]; len(series) > 0 {
+			if start.IsZero() || series[0].time.Before(start) {
+				start = series[0].time
+			}
+			if last := series[len(series)-1].time; last.After(end) {
+				end = last
+			}
+		}
+	}
+	for _, series := range snapshots {
+		if start.IsZero() || series[0].time.Before(start) {
+			start = series[0].time
+		}
+		if last := series[len(series)-1].time; last.After(end) {
+			end = last
+		}
+	}
+
+	result := connections{Windows: map[string]connectionsWindow{}}
+	windows := append([]artifacts.Phase{{Name: runWindow, Start: start, End: end.Add(time.Nanosecond)}}, phases...)
+	for _, window := range windows {
+		digested := connectionsWindow{Nodes: map[string]socketSummary{}}
+		for node, series := range sockets {
+			var established, inUse, timeWait []float64
+			var summary socketSummary
+			for _, sample := range series {
+				if !window.Contains(sample.time) {
+					continue
+				}
+				established = append(established, sample.established)
+				inUse = append(inUse, sample.inUse)
+				timeWait = append(timeWait, sample.timeWait)
+				summary.PeakEstablished = math.Max(summary.PeakEstablished, sample.established)
+			}
+			if len(established) == 0 {
+				continue
+			}
+			summary.Established, summary.InUse, summary.TimeWait = meanOf(established), meanOf(inUse), meanOf(timeWait)
+			digested.Nodes[node] = summary
+		}
+		for _, series := range snapshots {
+			// errors are counted from the last snapshot before the window, when there is one
+			first, last := -1, -1
+			for i, snapshot := range series {
+				if snapshot.time.Before(window.Start) {
+					first = i
+				}
+				if window.Contains(snapshot.time) {
+					if first < 0 {
+						first = i
+					}
+					last = i
+				}
+			}
+			for i := first + 1; first >= 0 && i <= last; i++ {
+				digested.HandshakeErrors += increase(
+					series[i-1].sumBy("apiserver_tls_handshake_errors_total", "")[""],
+					series[i].sumBy("apiserver_tls_handshake_errors_total", "")[""],
+				)
+			}
+		}
+		result.Windows[window.Name] = digested
+	}
+
+	if open != nil {
+		var nodes []string
+		for node := range sockets {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			var watches, established []float64
+			for _, sample := range sockets[node] {
+				watches = append(watches, float64(gaugeAt(open, sample.time)))
+				established = append(established, sample.established)
+			}
+			result.PerWatch += slope(watches, established)
+		}
+	}
+	return artifacts.Write(dataDir, connectionsFile, result)
+}
+
+// loadSockets parses the samples of the sockets on a node, from lines like:
+//
+//	2006-01-02T15:04:05.999999999Z <in use> <in TIME_WAIT> <established to the API server>
+func loadSockets(path string) ([]socketSample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var samples []socketSample
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp in %s: %w", path, err)
+		}
+		var values [3]float64
+		for i, field := range fields[1:] {
+			if values[i], err = strconv.ParseFloat(field, 64); err != nil {
+				return nil, fmt.Errorf("failed to parse sample in %s: %w", path, err)
+			}
+		}
+		samples = append(samples, socketSample{time: timestamp, inUse: values[0], timeWait: values[1], established: values[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return samples, nil
+}
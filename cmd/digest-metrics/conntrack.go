@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const conntrackFile = "conntrack.json"
+
+// conntrackSaturation is the fraction of the conntrack table which may be used before new connections are at risk
+// of not being tracked, and so dropped.
+const conntrackSaturation = 0.9
+
+// tcpStates name the states of TCP sockets in the order the kernel numbers them, from one.
+var tcpStates = []string{"ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT", "CLOSE", "CLOSE_WAIT", "LAST_ACK", "LISTEN", "CLOSING"}
+
+type conntrackSample struct {
+	time         time.Time
+	entries, max float64
+	// failed, dropped and earlyDropped are cumulative.
+	failed, dropped, earlyDropped float64
+	states                        []float64
+}
+
+// conntrackSummary describes the conntrack table and the TCP sockets on one node over a window. Failed inserts and
+// drops are connections the table could not track, which the node drops.
+type conntrackSummary struct {
+	PeakEntries float64 `json:"peakEntries"`
+	Max         float64 `json:"max"`
+	// PeakUtilization is the largest fraction of the table used, when its size is known.
+	PeakUtilization float64 `json:"peakUtilization,omitempty"`
+	InsertFailed    float64 `json:"insertFailed"`
+	Dropped         float64 `json:"dropped"`
+	EarlyDropped    float64 `json:"earlyDropped"`
+	// PeakStates holds the largest number of sockets in every state the node had any in.
+	PeakStates map[string]float64 `json:"peakStates"`
+}
+
+type conntrack struct {
+	// Windows are keyed by phase, and by runWindow for the whole run, then by node.
+	Windows map[string]map[string]conntrackSummary `json:"windows"`
+}
+
+// digestConntrack summarizes how full the conntrack tables of the control-plane nodes got and the states their TCP
+// sockets were in, over the run and in every phase, as running out of either is how massive numbers of watches
+// most often fail.
+func digestConntrack(dataDir string) error {
+	files, err := filepath.Glob(filepath.Join(dataDir, artifacts.NodeCollectorDir, "*", artifacts.ConntrackFile))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	samples := map[string][]conntrackSample{}
+	var start, end time.Time
+	for _, file := range files {
+		node := filepath.Base(filepath.Dir(file))
+		if samples[node], err = loadConntrack(file); err != nil {
+			return err
+		}
+		if series := samples[node]; len(series) > 0 {
+			if start.IsZero() || series[0].time.Before(start) {
+				start = series[0].time
+			}
+			if last := series[len(series)-1].time; last.After(end) {
+				end = last
+			}
+		}
+	}
+
+	result := conntrack{Windows: map[string]map[string]conntrackSummary{}}
+	windows := append([]artifacts.Phase{{Name: runWindow, Start: start, End: end.Add(time.Nanosecond)}}, phases...)
+	for _, window := range windows {
+		digested := map[string]conntrackSummary{}
+		for node, series := range samples {
+			// counters are measured from the last sample before the window, when there is one
+			var previous *conntrackSample
+			summary := conntrackSummary{PeakStates: map[string]float64{}}
+			var seen bool
+			for i := range series {
+				sample := &series[i]
+				if sample.time.Before(window.Start) {
+					previous = sample
+					continue
+				}
+				if !window.Contains(sample.time) {
+					break
+				}
+				seen = true
+				if previous != nil {
+					summary.InsertFailed += increase(previous.failed, sample.failed)
+					summary.Dropped += increase(previous.dropped, sample.dropped)
+					summary.EarlyDropped += increase(previous.earlyDropped, sample.earlyDropped)
+				}
+				previous = sample
+				summary.PeakEntries = math.Max(summary.PeakEntries, sample.entries)
+				summary.Max = math.Max(summary.Max, sample.max)
+				if sample.max > 0 {
+					summary.PeakUtilization = math.Max(summary.PeakUtilization, sample.entries/sample.max)
+				}
+				for state, count := range sample.states {
+					if count > 0 {
+						summary.PeakStates[tcpStates[state]] = math.Max(summary.PeakStates[tcpStates[state]], count)
+					}
+				}
+			}
+			if seen {
+				digested[node] = summary
+			}
+		}
+		if len(digested) > 0 {
+			result.Windows[window.Name] = digested
+		}
+	}
+	return artifacts.Write(dataDir, conntrackFile, result)
+}
+
+// loadConntrack parses the samples of the conntrack table and TCP sockets on a node, from lines like:
+//
+//	2006-01-02T15:04:05.999999999Z <entries> <max> <insert failed> <dropped> <early dropped> <sockets in every state>
+func loadConntrack(path string) ([]conntrackSample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var samples []conntrackSample
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6+len(tcpStates) {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp in %s: %w", path, err)
+		}
+		values := make([]float64, len(fields)-1)
+		for i, field := range fields[1:] {
+			if values[i], err = strconv.ParseFloat(field, 64); err != nil {
+				return nil, fmt.Errorf("failed to parse sample in %s: %w", path, err)
+			}
+		}
+		samples = append(samples, conntrackSample{
+			time:         timestamp,
+			entries:      values[0],
+			max:          values[1],
+			failed:       values[2],
+			dropped:      values[3],
+			earlyDropped: values[4],
+			states:       values[5:],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return samples, nil
+}
+
+// conntrackAlarm warns when a conntrack table came close to full or failed to track connections during the run.
+func conntrackAlarm(dataDir string) (string, error) {
+	var result conntrack
+	if err := artifacts.Load(dataDir, conntrackFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	var nodes []string
+	for node, summary := range result.Windows[runWindow] {
+		if summary.PeakUtilization >= conntrackSaturation || summary.InsertFailed+summary.Dropped+summary.EarlyDropped > 0 {
+			nodes = append(nodes, fmt.Sprintf("%s (%.0f%% full, %.0f untracked)", node, summary.PeakUtilization*100, summary.InsertFailed+summary.Dropped+summary.EarlyDropped))
+		}
+	}
+	if len(nodes) == 0 {
+		return "", nil
+	}
+	sort.Strings(nodes)
+	return fmt.Sprintf("The conntrack table came close to full or failed to track connections on %s. Connections which are not tracked are dropped, so failed watches may be the network's doing.", strings.Join(nodes, ", ")), nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const (
+	cpuProfilesFile = "cpu-profiles.json"
+	// mergedProfilesDir holds the merged profile of every API server replica over every window, in a directory per
+	// node, to be read with go tool pprof.
+	mergedProfilesDir = "merged-profiles"
+	// topFunctions is how many of the functions most time was spent in are recorded for every window; the report
+	// shows fewer.
+	topFunctions       = 20
+	reportTopFunctions = 10
+)
+
+// functionCost is the CPU time sampled in a function: flat in the function itself, cumulative in it and everything
+// it called.
+type functionCost struct {
+	Function           string  `json:"function"`
+	FlatSeconds        float64 `json:"flatSeconds"`
+	FlatFraction       float64 `json:"flatFraction"`
+	CumulativeSeconds  float64 `json:"cumulativeSeconds"`
+	CumulativeFraction float64 `json:"cumulativeFraction"`
+}
+
+// profileSummary describes the CPU profiles of one API server replica which were taken entirely within a window.
+type profileSummary struct {
+	Profiles int `json:"profiles"`
+	// ProfiledSeconds is how long the profiles ran for, and CPUSeconds the CPU time they sampled in that time.
+	ProfiledSeconds float64 `json:"profiledSeconds"`
+	CPUSeconds      float64 `json:"cpuSeconds"`
+	// Merged is the merged profile, relative to the data directory.
+	Merged string         `json:"merged"`
+	Top    []functionCost `json:"top"`
+}
+
+type cpuProfiles struct {
+	// Windows are keyed by phase, and by runWindow for the whole run, then by node.
+	Windows map[string]map[string]profileSummary `json:"windows"`
+}
+
+// cpuProfileFile is a CPU profile taken of an API server replica, named after when it was requested.
+type cpuProfileFile struct {
+	path      string
+	requested time.Time
+}
+
+// digestCPUProfiles merges the CPU profiles taken of every API server replica over the run and in every phase, and
+// records the functions most of the time was spent in, so that a regression in CPU usage can be traced to the code
+// which regressed. A profile counts toward a phase only when it was taken entirely within it.
+func digestCPUProfiles(dataDir string) error {
+	files, err := filepath.Glob(filepath.Join(dataDir, artifacts.ProfilesDir, "*", artifacts.CPUProfile+"-*"+artifacts.ProfileExtension))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	byNode := map[string][]cpuProfileFile{}
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), artifacts.CPUProfile+"-"), artifacts.ProfileExtension)
+		nanos, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			logrus.WithError(err).Warnf("skipping CPU profile %s not named after when it was taken", file)
+			continue
+		}
+		node := filepath.Base(filepath.Dir(file))
+		byNode[node] = append(byNode[node], cpuProfileFile{path: file, requested: time.Unix(0, nanos).UTC()})
+	}
+
+	result := cpuProfiles{Windows: map[string]map[string]profileSummary{}}
+	var lock sync.Mutex
+	var tasks []func() error
+	for node, profiles := range byNode {
+		node, profiles := node, profiles
+		tasks = append(tasks, func() error {
+			summaries, err := digestNodeProfiles(dataDir, node, profiles, phases)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for window, summary := range summaries {
+				if result.Windows[window] == nil {
+					result.Windows[window] = map[string]profileSummary{}
+				}
+				result.Windows[window][node] = summary
+			}
+			return nil
+		})
+	}
+	if err := inParallel(tasks); err != nil {
+		return err
+	}
+	return artifacts.Write(dataDir, cpuProfilesFile, result)
+}
+
+// digestNodeProfiles merges the CPU profiles of one replica into a profile per window, in the order they were taken.
+func digestNodeProfiles(dataDir, node string, files []cpuProfileFile, phases []artifacts.Phase) (map[string]profileSummary, error) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].requested.Before(files[j].requested)
+	})
+	merged := map[string]*profile.Profile{}
+	summaries := map[string]profileSummary{}
+	for _, file := range files {
+		taken, err := readProfile(file.path)
+		if err != nil {
+			return nil, err
+		}
+		if cpuValueIndex(taken) < 0 {
+			logrus.Warnf("skipping profile %s, which did not sample CPU time", file.path)
+			continue
+		}
+		end := file.requested.Add(time.Duration(taken.DurationNanos))
+		windows := []string{runWindow}
+		for _, phase := range phases {
+			if phase.Contains(file.requested) && !end.After(phase.End) {
+				windows = append(windows, phase.Name)
+			}
+		}
+		for _, window := range windows {
+			// profiles are merged as they are read, rather than all at once, so that only one is held per window
+			sources := []*profile.Profile{taken}
+			if merged[window] != nil {
+				sources = append(sources, merged[window])
+			}
+			if merged[window], err = profile.Merge(sources); err != nil {
+				return nil, fmt.Errorf("failed to merge %s: %w", file.path, err)
+			}
+			summary := summaries[window]
+			summary.Profiles++
+			summaries[window] = summary
+		}
+	}
+
+	for window, combined := range merged {
+		relative := filepath.Join(mergedProfilesDir, node, window+artifacts.ProfileExtension)
+		if err := writeProfile(filepath.Join(dataDir, relative), combined); err != nil {
+			return nil, err
+		}
+		summary := summaries[window]
+		summary.Merged = relative
+		summary.ProfiledSeconds = time.Duration(combined.DurationNanos).Seconds()
+		summary.CPUSeconds, summary.Top = topFunctionsOf(combined)
+		summaries[window] = summary
+	}
+	return summaries, nil
+}
+
+// readProfile reads a profile, gzipped as the API server serves it or not.
+func readProfile(path string) (*profile.Profile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	parsed, err := profile.Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return parsed, nil
+}
+
+// writeProfile writes the profile in the pprof format, gzipped as the pprof tooling expects it.
+func writeProfile(path string, merged *profile.Profile) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if err := merged.Write(file); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// cpuValueIndex finds the values of CPU time in nanoseconds in the samples of the profile, or -1 when it has none.
+func cpuValueIndex(p *profile.Profile) int {
+	for i, kind := range p.SampleType {
+		if kind.Type == "cpu" && kind.Unit == "nanoseconds" {
+			return i
+		}
+	}
+	return -1
+}
+
+// topFunctionsOf adds up the CPU time sampled in the profile by function, like pprof -top: flat time goes to the
+// innermost function of every sample, and cumulative time to every function in it, once however often it recursed.
+func topFunctionsOf(p *profile.Profile) (float64, []functionCost) {
+	index := cpuValueIndex(p)
+	var total int64
+	flat, cumulative := map[string]int64{}, map[string]int64{}
+	for _, sample := range p.Sample {
+		value := sample.Value[index]
+		total += value
+		seen := map[string]bool{}
+		// the innermost location comes first, and in every location the innermost function inlined into it
+		for i, location := range sample.Location {
+			for j, line := range location.Line {
+				if line.Function == nil {
+					continue
+				}
+				if i == 0 && j == 0 {
+					flat[line.Function.Name] += value
+				}
+				if !seen[line.Function.Name] {
+					cumulative[line.Function.Name] += value
+					seen[line.Function.Name] = true
+				}
+			}
+		}
+	}
+
+	var functions []string
+	for function := range cumulative {
+		functions = append(functions, function)
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		if flat[functions[i]] != flat[functions[j]] {
+			return flat[functions[i]] > flat[functions[j]]
+		}
+		if cumulative[functions[i]] != cumulative[functions[j]] {
+			return cumulative[functions[i]] > cumulative[functions[j]]
+		}
+		return functions[i] < functions[j]
+	})
+	if len(functions) > topFunctions {
+		functions = functions[:topFunctions]
+	}
+	fraction := func(value int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(value) / float64(total)
+	}
+	var top []functionCost
+	for _, function := range functions {
+		top = append(top, functionCost{
+			Function:           function,
+			FlatSeconds:        time.Duration(flat[function]).Seconds(),
+			FlatFraction:       fraction(flat[function]),
+			CumulativeSeconds:  time.Duration(cumulative[function]).Seconds(),
+			CumulativeFraction: fraction(cumulative[function]),
+		})
+	}
+	return time.Duration(total).Seconds(), top
+}
+
+// loadCPUProfiles loads the functions most time was spent in for the report, the run first and then the phases in
+// order, returning none for runs without profiles.
+func loadCPUProfiles(dataDir string, phases []artifacts.Phase) ([]profileRow, error) {
+	var profiles cpuProfiles
+	if err := artifacts.Load(dataDir, cpuProfilesFile, &profiles); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	windows := []string{runWindow}
+	for _, phase := range phases {
+		windows = append(windows, phase.Name)
+	}
+	var rows []profileRow
+	for _, window := range windows {
+		var nodes []string
+		for node := range profiles.Windows[window] {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			top := profiles.Windows[window][node].Top
+			if len(top) > reportTopFunctions {
+				top = top[:reportTopFunctions]
+			}
+			for _, function := range top {
+				rows = append(rows, profileRow{
+					Window:     window,
+					Node:       node,
+					Function:   function.Function,
+					Flat:       fmt.Sprintf("%.2fs (%.1f%%)", function.FlatSeconds, function.FlatFraction*100),
+					Cumulative: fmt.Sprintf("%.2fs (%.1f%%)", function.CumulativeSeconds, function.CumulativeFraction*100),
+				})
+			}
+		}
+	}
+	return rows, nil
+}
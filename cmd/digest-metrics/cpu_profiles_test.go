@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// takeCPUProfile profiles the test itself spinning for the duration, so that the profile is a real one, with the
+// mappings and addresses of the binary, as the API server would serve it.
+func takeCPUProfile(t *testing.T, path string, duration time.Duration) *profile.Profile {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pprof.StartCPUProfile(file); err != nil {
+		t.Fatal(err)
+	}
+	spin(duration)
+	pprof.StopCPUProfile()
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	taken, err := readProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taken
+}
+
+//go:noinline
+func spin(duration time.Duration) int {
+	sum := 0
+	for start := time.Now(); time.Since(start) < duration; {
+		for i := 0; i < 1000; i++ {
+			sum += i
+		}
+	}
+	return sum
+}
+
+func TestDigestNodeProfilesMergesRealProfiles(t *testing.T) {
+	dataDir := t.TempDir()
+	profilesDir := filepath.Join(dataDir, artifacts.ProfilesDir, "node")
+	if err := os.MkdirAll(profilesDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	var files []cpuProfileFile
+	var taken []*profile.Profile
+	for i, requested := range []time.Time{time.Unix(100, 0).UTC(), time.Unix(200, 0).UTC()} {
+		path := filepath.Join(profilesDir, artifacts.CPUProfile+"-"+strconv.FormatInt(requested.UnixNano(), 10)+artifacts.ProfileExtension)
+		taken = append(taken, takeCPUProfile(t, path, time.Duration(i+1)*200*time.Millisecond))
+		files = append(files, cpuProfileFile{path: path, requested: requested})
+	}
+
+	summaries, err := digestNodeProfiles(dataDir, "node", files, []artifacts.Phase{
+		{Name: "first", Start: time.Unix(90, 0).UTC(), End: time.Unix(150, 0).UTC()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run, phase := summaries[runWindow], summaries["first"]
+	if run.Profiles != 2 || phase.Profiles != 1 {
+		t.Fatalf("expected both profiles in the run and the first in its phase, got %d and %d", run.Profiles, phase.Profiles)
+	}
+	merged, err := readProfile(filepath.Join(dataDir, run.Merged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := merged.CheckValid(); err != nil {
+		t.Fatalf("merged profile is invalid: %v", err)
+	}
+
+	var expected int64
+	for _, p := range taken {
+		expected += p.DurationNanos
+	}
+	if merged.DurationNanos != expected {
+		t.Errorf("expected the merged profile to last %dns, got %d", expected, merged.DurationNanos)
+	}
+	cpuOf := func(p *profile.Profile) time.Duration {
+		var total int64
+		for _, sample := range p.Sample {
+			total += sample.Value[cpuValueIndex(p)]
+		}
+		return time.Duration(total)
+	}
+	if want := cpuOf(taken[0]) + cpuOf(taken[1]); cpuOf(merged) != want || run.CPUSeconds != want.Seconds() {
+		t.Errorf("expected %s of CPU time in the merged profile, got %s written and %fs summarized", want, cpuOf(merged), run.CPUSeconds)
+	}
+	if want := cpuOf(taken[0]); phase.CPUSeconds != want.Seconds() {
+		t.Errorf("expected %s of CPU time in the phase, got %fs", want, phase.CPUSeconds)
+	}
+	if len(merged.Mapping) == 0 {
+		t.Error("expected the merged profile to keep the mappings of the binary")
+	}
+	addressed := false
+	for _, location := range merged.Location {
+		addressed = addressed || location.Address != 0
+	}
+	if !addressed {
+		t.Error("expected the merged profile to keep the addresses of its locations")
+	}
+
+	found := false
+	for _, function := range run.Top {
+		found = found || function.Function == "apiserver-watch-benchmarking/cmd/digest-metrics.spin"
+	}
+	if !found {
+		t.Errorf("expected the function the profiles spun in to be among the top ones, got %v", run.Top)
+	}
+}
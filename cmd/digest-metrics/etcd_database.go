@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const etcdDatabaseFile = "etcd-database.json"
+
+// etcdDatabaseSeries holds the size of the database of one etcd member, in bytes, at every snapshot. InUse excludes
+// the pages freed by compaction but not yet returned by defragmentation.
+type etcdDatabaseSeries struct {
+	Node  string      `json:"node"`
+	Times []time.Time `json:"times"`
+	Total []float64   `json:"total"`
+	InUse []float64   `json:"inUse"`
+}
+
+// etcdDatabasePhase summarizes how the database of the largest member changed over a phase.
+type etcdDatabasePhase struct {
+	Phase string `json:"phase"`
+	// Growth is how much the total size grew over the phase, and InUseGrowth how much of that is live data.
+	Growth      float64 `json:"growth"`
+	InUseGrowth float64 `json:"inUseGrowth"`
+	// Total and InUse are the sizes at the end of the phase.
+	Total float64 `json:"total"`
+	InUse float64 `json:"inUse"`
+}
+
+type etcdDatabase struct {
+	Members []etcdDatabaseSeries `json:"members"`
+	Phases  []etcdDatabasePhase  `json:"phases,omitempty"`
+}
+
+// digestEtcdDatabase tracks the size of the etcd database through the run, from the metrics snapshots of the etcd
+// members, so that write-heavy experiments show how much the database grew and how much compaction reclaimed.
+func digestEtcdDatabase(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.EtcdMetricsDir, "etcd_mvcc_db_total_size_in_")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var result etcdDatabase
+	for node, series := range snapshots {
+		member := etcdDatabaseSeries{Node: node}
+		for _, snapshot := range series {
+			member.Times = append(member.Times, snapshot.time)
+			member.Total = append(member.Total, snapshot.sumBy("etcd_mvcc_db_total_size_in_bytes", "")[""])
+			member.InUse = append(member.InUse, snapshot.sumBy("etcd_mvcc_db_total_size_in_use_in_bytes", "")[""])
+		}
+		result.Members = append(result.Members, member)
+	}
+	sort.Slice(result.Members, func(i, j int) bool {
+		return result.Members[i].Node < result.Members[j].Node
+	})
+
+	// members hold the same data, but compact and defragment on their own, so the largest is summarized
+	largest := result.Members[0]
+	for _, member := range result.Members[1:] {
+		if member.Total[len(member.Total)-1] > largest.Total[len(largest.Total)-1] {
+			largest = member
+		}
+	}
+	for _, phase := range phases {
+		// growth is measured from the last sample before the phase, when there is one, to not miss what grew between
+		// samples around its start
+		first, last := -1, -1
+		for i, at := range largest.Times {
+			if at.Before(phase.Start) {
+				first = i
+			}
+			if phase.Contains(at) {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+		if last < 0 {
+			continue
+		}
+		result.Phases = append(result.Phases, etcdDatabasePhase{
+			Phase:       phase.Name,
+			Growth:      largest.Total[last] - largest.Total[first],
+			InUseGrowth: largest.InUse[last] - largest.InUse[first],
+			Total:       largest.Total[last],
+			InUse:       largest.InUse[last],
+		})
+	}
+	return artifacts.Write(dataDir, etcdDatabaseFile, result)
+}
+
+func loadEtcdDatabase(dataDir string) (*etcdDatabase, error) {
+	var result etcdDatabase
+	if err := artifacts.Load(dataDir, etcdDatabaseFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const etcdDiskFile = "etcd-disk.json"
+
+// etcdDiskHistograms are the histograms of how long etcd waited on its disk, keyed by what is reported for them.
+var etcdDiskHistograms = map[string]string{
+	"etcd_disk_wal_fsync_duration_seconds":                "walFsync",
+	"etcd_disk_backend_commit_duration_seconds":           "backendCommit",
+	"etcd_disk_backend_defrag_duration_seconds":           "backendDefrag",
+	"etcd_disk_backend_snapshot_duration_seconds":         "backendSnapshot",
+	"etcd_mvcc_db_compaction_total_duration_milliseconds": "compaction",
+}
+
+// etcdDiskLatency summarizes the observations one member made of a disk operation over a phase, in seconds.
+// Quantiles are estimated from the buckets, so they are only as precise as the buckets are fine.
+type etcdDiskLatency struct {
+	Count float64 `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P99   float64 `json:"p99"`
+}
+
+type etcdDiskPhase struct {
+	Phase string `json:"phase"`
+	Node  string `json:"node"`
+	// Latencies are keyed by operation, like walFsync.
+	Latencies map[string]etcdDiskLatency `json:"latencies"`
+}
+
+// digestEtcdDisk determines how long every etcd member waited on its disk in each phase, from the histograms in its
+// metrics snapshots, so that latency regressions under load can be told apart as slow disks or busy CPUs.
+func digestEtcdDisk(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.EtcdMetricsDir, "etcd_")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var nodes []string
+	for node := range snapshots {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var result []etcdDiskPhase
+	for _, phase := range phases {
+		for _, node := range nodes {
+			// histograms are measured from the last snapshot before the phase, when there is one
+			first, last := -1, -1
+			for i, snapshot := range snapshots[node] {
+				if snapshot.time.Before(phase.Start) {
+					first = i
+				}
+				if phase.Contains(snapshot.time) {
+					if first < 0 {
+						first = i
+					}
+					last = i
+				}
+			}
+			if last <= first || first < 0 {
+				continue
+			}
+			digested := etcdDiskPhase{Phase: phase.Name, Node: node, Latencies: map[string]etcdDiskLatency{}}
+			for name, key := range etcdDiskHistograms {
+				before, after := histogramOf(snapshots[node][first], name), histogramOf(snapshots[node][last], name)
+				if after == nil {
+					continue
+				}
+				latency := histogramDelta(before, after)
+				if name == "etcd_mvcc_db_compaction_total_duration_milliseconds" {
+					latency.Mean, latency.P50, latency.P99 = latency.Mean/1000, latency.P50/1000, latency.P99/1000
+				}
+				if latency.Count > 0 {
+					digested.Latencies[key] = latency
+				}
+			}
+			result = append(result, digested)
+		}
+	}
+	return artifacts.Write(dataDir, etcdDiskFile, result)
+}
+
+func histogramOf(snapshot metricsSnapshot, name string) *dto.Histogram {
+	family, exists := snapshot.families[name]
+	if !exists || len(family.Metric) == 0 {
+		return nil
+	}
+	return family.Metric[0].Histogram
+}
+
+// histogramDelta summarizes the observations made between two scrapes of a histogram. When the histogram was reset
+// in between, every observation in the later scrape is counted.
+func histogramDelta(before, after *dto.Histogram) etcdDiskLatency {
+	delta := bucketsOf(after).since(bucketsOf(before))
+	if delta.count == 0 {
+		return etcdDiskLatency{}
+	}
+	return etcdDiskLatency{
+		Count: delta.count,
+		Mean:  delta.sum / delta.count,
+		P50:   delta.quantile(0.5),
+		P99:   delta.quantile(0.99),
+	}
+}
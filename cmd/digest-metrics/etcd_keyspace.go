@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const etcdKeyspaceGrowthFile = "etcd-keyspace-growth.json"
+
+// etcdKeyspacePrefix records how many keys were under a prefix in etcd before and after the experiment.
+type etcdKeyspacePrefix struct {
+	Prefix string `json:"prefix"`
+	Before int    `json:"before"`
+	After  int    `json:"after"`
+	Growth int    `json:"growth"`
+}
+
+// digestEtcdKeyspace compares the first and last snapshots of the etcd keyspace, listing the prefixes under which
+// the number of keys changed, most changed first, so that what the experiment left behind in etcd is auditable.
+func digestEtcdKeyspace(dataDir string) error {
+	var snapshots []artifacts.EtcdKeyspaceSnapshot
+	if err := artifacts.Load(dataDir, artifacts.EtcdKeyspaceFile, &snapshots); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if len(snapshots) < 2 {
+		return nil
+	}
+	before, after := snapshots[0], snapshots[len(snapshots)-1]
+	prefixes := map[string]bool{}
+	for prefix := range before.Keys {
+		prefixes[prefix] = true
+	}
+	for prefix := range after.Keys {
+		prefixes[prefix] = true
+	}
+	growth := []etcdKeyspacePrefix{}
+	for prefix := range prefixes {
+		if before.Keys[prefix] == after.Keys[prefix] {
+			continue
+		}
+		growth = append(growth, etcdKeyspacePrefix{Prefix: prefix, Before: before.Keys[prefix], After: after.Keys[prefix], Growth: after.Keys[prefix] - before.Keys[prefix]})
+	}
+	sort.Slice(growth, func(i, j int) bool {
+		if magnitude(growth[i].Growth) != magnitude(growth[j].Growth) {
+			return magnitude(growth[i].Growth) > magnitude(growth[j].Growth)
+		}
+		return growth[i].Prefix < growth[j].Prefix
+	})
+	return artifacts.Write(dataDir, etcdKeyspaceGrowthFile, growth)
+}
+
+func loadEtcdKeyspaceGrowth(dataDir string) ([]etcdKeyspacePrefix, error) {
+	var growth []etcdKeyspacePrefix
+	if err := artifacts.Load(dataDir, etcdKeyspaceGrowthFile, &growth); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return growth, nil
+}
+
+func magnitude(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// issuancePhase and steadyStatePhase are the phases in which the latent watch experiment issues its watches, and
+// holds them all idle.
+const (
+	issuancePhase    = "issuance"
+	steadyStatePhase = "steady"
+)
+
+// derivedPhasesFile holds the phases derived from the event log of a run, apart from the phases the run recorded, so
+// that every digest derives them afresh.
+const derivedPhasesFile = "derived-phases.json"
+
+// eventLogPhases derive the phases of experiments which record a log of their events rather than their phases, by
+// the file the log is in. Every derivation is given the window of the run, and returns no phases when the log does
+// not allow any.
+var eventLogPhases = map[string]func(dataDir string, start, end time.Time) ([]artifacts.Phase, error){
+	artifacts.LatentWatchFile: latentWatchPhases,
+}
+
+// derivePhases records the phases of the run from the event log of its experiment, when the experiment did not
+// record them itself, so that usage is reported separately for every phase all the same.
+func derivePhases(dataDir string, metrics *metricSamples) error {
+	// phases derived by an earlier digest are derived again, as the derivation may have changed since
+	if err := os.Remove(filepath.Join(dataDir, derivedPhasesFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, artifacts.PhasesFile)); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var manifest artifacts.Manifest
+	if err := artifacts.Load(dataDir, artifacts.ManifestFile, &manifest); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	// runs which were stopped before recording their end last as long as they were sampled
+	start, end := manifest.Start, time.Time{}
+	if manifest.End != nil {
+		end = *manifest.End
+	} else {
+		_, end = metrics.span()
+	}
+	for file, derive := range eventLogPhases {
+		if _, err := os.Stat(filepath.Join(dataDir, file)); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		phases, err := derive(dataDir, start, end)
+		if err != nil {
+			return err
+		}
+		if len(phases) == 0 {
+			continue
+		}
+		logrus.Infof("derived %d phases from %s", len(phases), file)
+		return artifacts.Write(dataDir, derivedPhasesFile, phases)
+	}
+	return nil
+}
+
+// loadPhases loads the phases the run recorded or, failing that, those derived from its event log.
+func loadPhases(dataDir string, phases *[]artifacts.Phase) error {
+	if err := artifacts.Load(dataDir, artifacts.PhasesFile, phases); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return artifacts.Load(dataDir, derivedPhasesFile, phases)
+}
+
+// latentWatchPhases splits the run at the first and the last watch the experiment established: before the first,
+// the cluster holds no watches; until the last, the watches are being issued; after it, they are all idle.
+func latentWatchPhases(dataDir string, start, end time.Time) ([]artifacts.Phase, error) {
+	var established []time.Time
+	if err := artifacts.Load(dataDir, artifacts.LatentWatchFile, &established); err != nil {
+		return nil, err
+	}
+	if len(established) == 0 {
+		return nil, nil
+	}
+	first, last := established[0], established[len(established)-1]
+	var phases []artifacts.Phase
+	for _, phase := range []artifacts.Phase{
+		{Name: artifacts.BaselinePhase, Start: start, End: first},
+		{Name: issuancePhase, Start: first, End: last},
+		{Name: steadyStatePhase, Start: last, End: end},
+	} {
+		if phase.End.After(phase.Start) {
+			phases = append(phases, phase)
+		}
+	}
+	return phases, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const flowControlFile = "flowcontrol.json"
+
+// flowControlSeries holds how requests at one priority level fared on one API server replica, sample by sample.
+type flowControlSeries struct {
+	Node          string      `json:"node"`
+	PriorityLevel string      `json:"priorityLevel"`
+	Times         []time.Time `json:"times"`
+	InQueue       []float64   `json:"inQueue"`
+	Executing     []float64   `json:"executing"`
+	// Rejected counts the requests rejected since the first sample.
+	Rejected []float64 `json:"rejected"`
+	// Wait is the mean time, in seconds, requests dispatched since the previous sample waited in queue.
+	Wait []float64 `json:"wait"`
+}
+
+type flowControl struct {
+	Series []flowControlSeries `json:"series"`
+	// Rejected and MaxInQueue summarize the series of every priority level across replicas.
+	Rejected   map[string]float64 `json:"rejected"`
+	MaxInQueue map[string]float64 `json:"maxInQueue"`
+}
+
+// digestFlowControl extracts what API Priority and Fairness did with requests from the metrics snapshots of the
+// API servers, to show whether the load was queued or rejected and at which priority level.
+func digestFlowControl(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.APIServerMetricsDir, "apiserver_flowcontrol_")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	result := flowControl{Rejected: map[string]float64{}, MaxInQueue: map[string]float64{}}
+	var nodes []string
+	for node := range snapshots {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		byLevel := map[string]*flowControlSeries{}
+		var previousRejected, previousWaits, previousWaited map[string]float64
+		for _, snapshot := range snapshots[node] {
+			inQueue := snapshot.sumBy("apiserver_flowcontrol_current_inqueue_requests", "priority_level")
+			executing := snapshot.sumBy("apiserver_flowcontrol_current_executing_requests", "priority_level")
+			rejected := snapshot.sumBy("apiserver_flowcontrol_rejected_requests_total", "priority_level")
+			waits := snapshot.sumBy("apiserver_flowcontrol_request_wait_duration_seconds", "priority_level")
+			waited := snapshot.histogramSumBy("apiserver_flowcontrol_request_wait_duration_seconds", "priority_level")
+			levels := map[string]struct{}{}
+			for _, values := range []map[string]float64{inQueue, executing, rejected, waits} {
+				for level := range values {
+					levels[level] = struct{}{}
+				}
+			}
+			for level := range levels {
+				series, exists := byLevel[level]
+				if !exists {
+					series = &flowControlSeries{Node: node, PriorityLevel: level}
+					byLevel[level] = series
+				}
+				var rejectedSince, wait float64
+				// the first sample is the reference that later increases are measured from
+				if previousRejected != nil {
+					if len(series.Rejected) > 0 {
+						rejectedSince = series.Rejected[len(series.Rejected)-1]
+					}
+					rejectedSince += increase(previousRejected[level], rejected[level])
+					if dispatched := increase(previousWaits[level], waits[level]); dispatched > 0 {
+						wait = increase(previousWaited[level], waited[level]) / dispatched
+					}
+				}
+				series.Times = append(series.Times, snapshot.time)
+				series.InQueue = append(series.InQueue, inQueue[level])
+				series.Executing = append(series.Executing, executing[level])
+				series.Rejected = append(series.Rejected, rejectedSince)
+				series.Wait = append(series.Wait, wait)
+				if inQueue[level] > result.MaxInQueue[level] {
+					result.MaxInQueue[level] = inQueue[level]
+				}
+			}
+			previousRejected, previousWaits, previousWaited = rejected, waits, waited
+		}
+		var levels []string
+		for level := range byLevel {
+			levels = append(levels, level)
+		}
+		sort.Strings(levels)
+		for _, level := range levels {
+			series := byLevel[level]
+			result.Rejected[level] += series.Rejected[len(series.Rejected)-1]
+			result.Series = append(result.Series, *series)
+		}
+	}
+	return artifacts.Write(dataDir, flowControlFile, result)
+}
+
+// flowControlAlarm warns when requests were rejected by API Priority and Fairness, as the load the experiment meant
+// to put on the servers then never reached them.
+func flowControlAlarm(dataDir string) (string, error) {
+	var result flowControl
+	if err := artifacts.Load(dataDir, flowControlFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	var rejections []string
+	var levels []string
+	for level := range result.Rejected {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	for _, level := range levels {
+		if rejected := result.Rejected[level]; rejected > 0 {
+			rejections = append(rejections, fmt.Sprintf("%.0f at %s", rejected, level))
+		}
+	}
+	if len(rejections) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("API Priority and Fairness rejected requests during the run: %s. Rejected load never reached the servers.", strings.Join(rejections, ", ")), nil
+}
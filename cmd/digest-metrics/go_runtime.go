@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const goRuntimeFile = "go-runtime.json"
+
+// goRuntimeSeries holds what the Go runtime of one API server replica reported, sample by sample. Allocated, GCs
+// and GCPause count what happened since the first sample; the rest are gauges, in bytes.
+type goRuntimeSeries struct {
+	Node        string      `json:"node"`
+	Times       []time.Time `json:"times"`
+	HeapInUse   []float64   `json:"heapInUse"`
+	HeapObjects []float64   `json:"heapObjects"`
+	NextGC      []float64   `json:"nextGC"`
+	Allocated   []float64   `json:"allocated"`
+	GCs         []float64   `json:"gcs"`
+	// GCPause is in seconds.
+	GCPause []float64 `json:"gcPause"`
+}
+
+// goRuntimePhase summarizes the Go runtime of the API servers, added up across replicas, over a phase. Serializing
+// events for watchers allocates a lot of short-lived garbage, which shows as allocation and collection rates out
+// of proportion to the growth of the heap in use; a heap which grows holds on to what it allocated.
+type goRuntimePhase struct {
+	Phase string `json:"phase"`
+	// AllocationRate is in bytes per second and GCRate in collections per second.
+	AllocationRate float64 `json:"allocationRate"`
+	GCRate         float64 `json:"gcRate"`
+	// GCPauseFraction is the fraction of the phase the replicas spent stopped for collections.
+	GCPauseFraction float64 `json:"gcPauseFraction"`
+	HeapGrowth      float64 `json:"heapGrowth"`
+	// HeapInUse is the heap in use at the end of the phase.
+	HeapInUse float64 `json:"heapInUse"`
+}
+
+type goRuntime struct {
+	Series []goRuntimeSeries `json:"series"`
+	Phases []goRuntimePhase  `json:"phases,omitempty"`
+}
+
+// digestGoRuntime extracts the memory and garbage collection statistics of the Go runtime from the metrics
+// snapshots of the API servers, so that pressure on the collector can be told apart from growth of the live heap.
+func digestGoRuntime(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.APIServerMetricsDir, "go_memstats_", "go_gc_")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var result goRuntime
+	for node, samples := range snapshots {
+		series := goRuntimeSeries{Node: node}
+		var previous metricsSnapshot
+		for _, snapshot := range samples {
+			if len(snapshot.families) == 0 {
+				// the replica does not expose the runtime metrics
+				continue
+			}
+			since := func(counters []float64, value func(metricsSnapshot) float64) []float64 {
+				// the first sample is the reference that later increases are measured from
+				if len(counters) == 0 {
+					return append(counters, 0)
+				}
+				return append(counters, counters[len(counters)-1]+increase(value(previous), value(snapshot)))
+			}
+			series.Times = append(series.Times, snapshot.time)
+			series.HeapInUse = append(series.HeapInUse, snapshot.sumBy("go_memstats_heap_inuse_bytes", "")[""])
+			series.HeapObjects = append(series.HeapObjects, snapshot.sumBy("go_memstats_heap_objects", "")[""])
+			series.NextGC = append(series.NextGC, snapshot.sumBy("go_memstats_next_gc_bytes", "")[""])
+			series.Allocated = since(series.Allocated, func(s metricsSnapshot) float64 {
+				return s.sumBy("go_memstats_alloc_bytes_total", "")[""]
+			})
+			series.GCs = since(series.GCs, func(s metricsSnapshot) float64 {
+				return gcSummary(s).count
+			})
+			series.GCPause = since(series.GCPause, func(s metricsSnapshot) float64 {
+				return gcSummary(s).sum
+			})
+			previous = snapshot
+		}
+		if len(series.Times) > 0 {
+			result.Series = append(result.Series, series)
+		}
+	}
+	if len(result.Series) == 0 {
+		return nil
+	}
+	sort.Slice(result.Series, func(i, j int) bool {
+		return result.Series[i].Node < result.Series[j].Node
+	})
+
+	for _, phase := range phases {
+		summary := goRuntimePhase{Phase: phase.Name}
+		var measured int
+		for _, series := range result.Series {
+			// counters are measured from the last sample before the phase, when there is one
+			first, last := -1, -1
+			for i, at := range series.Times {
+				if at.Before(phase.Start) {
+					first = i
+				}
+				if phase.Contains(at) {
+					if first < 0 {
+						first = i
+					}
+					last = i
+				}
+			}
+			if last <= first || first < 0 {
+				continue
+			}
+			measured++
+			elapsed := series.Times[last].Sub(series.Times[first]).Seconds()
+			summary.AllocationRate += (series.Allocated[last] - series.Allocated[first]) / elapsed
+			summary.GCRate += (series.GCs[last] - series.GCs[first]) / elapsed
+			summary.GCPauseFraction += (series.GCPause[last] - series.GCPause[first]) / elapsed
+			summary.HeapGrowth += series.HeapInUse[last] - series.HeapInUse[first]
+			summary.HeapInUse += series.HeapInUse[last]
+		}
+		if measured > 0 {
+			summary.GCPauseFraction /= float64(measured)
+			result.Phases = append(result.Phases, summary)
+		}
+	}
+	return artifacts.Write(dataDir, goRuntimeFile, result)
+}
+
+type gcPauses struct {
+	count, sum float64
+}
+
+// gcSummary reads the summary of the pauses of the collector, which counts every collection.
+func gcSummary(snapshot metricsSnapshot) gcPauses {
+	family, exists := snapshot.families["go_gc_duration_seconds"]
+	if !exists {
+		return gcPauses{}
+	}
+	var pauses gcPauses
+	for _, sample := range family.Metric {
+		if sample.Summary != nil {
+			pauses.count += float64(sample.Summary.GetSampleCount())
+			pauses.sum += sample.Summary.GetSampleSum()
+		}
+	}
+	return pauses
+}
+
+func loadGoRuntime(dataDir string) (*goRuntime, error) {
+	var result goRuntime
+	if err := artifacts.Load(dataDir, goRuntimeFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
+}
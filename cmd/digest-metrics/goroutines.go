@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+type goroutinesPerWatch struct {
+	// PerWatch is the slope of the goroutines all replicas ran against the watches open, over the whole run.
+	PerWatch float64 `json:"perWatch"`
+	// Phases holds the mean goroutines all replicas ran in every phase, keyed by phase.
+	Phases map[string]float64 `json:"phases,omitempty"`
+}
+
+// goroutinesPerWatchOf determines how many goroutines the API servers run for every watch held open.
+func goroutinesPerWatchOf(dataDir string) (*goroutinesPerWatch, error) {
+	var goroutines artifacts.Goroutines
+	if err := artifacts.Load(dataDir, artifacts.GoroutinesFile, &goroutines); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	open := make([]float64, len(goroutines.Open))
+	for i, value := range goroutines.Open {
+		open[i] = float64(value)
+	}
+	result := goroutinesPerWatch{PerWatch: slope(open, goroutines.Total), Phases: map[string]float64{}}
+	for _, phase := range phases {
+		var inPhase []float64
+		for i, offset := range goroutines.Offsets {
+			if phase.Contains(goroutines.Start.Add(time.Duration(offset * float64(time.Second)))) {
+				inPhase = append(inPhase, goroutines.Total[i])
+			}
+		}
+		if len(inPhase) > 0 {
+			result.Phases[phase.Name] = meanOf(inPhase)
+		}
+	}
+	return &result, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The raw timeseries are written in the InfluxDB line protocol as a measurement per metric, tagged with the run and
+// where they were sampled, with the sample in the value field and its time in nanoseconds, so that they can be
+// written to InfluxDB or read by Telegraf as they are. Like tidy data, the protocol has no use for breaks in series,
+// and it cannot represent values which are not finite, so both are left out.
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+type influxTag struct {
+	key, value string
+}
+
+func writeRawInflux(dataDir, path string, series rawSeriesSource) error {
+	labels, err := runLabels(dataDir)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	writer := bufio.NewWriter(file)
+	if err := series(func(s rawSeries) error {
+		name, label, value := splitSeriesName(s.metric)
+		var tags []influxTag
+		for key, value := range labels {
+			tags = append(tags, influxTag{key: key, value: value})
+		}
+		// tags without a value are left out, as the protocol does not allow them
+		for _, tag := range []influxTag{{key: "identifier", value: s.identifier}, {key: "pod", value: s.pod}, {key: "container", value: s.container}, {key: label, value: value}} {
+			if tag.key != "" && tag.value != "" {
+				tags = append(tags, tag)
+			}
+		}
+		// InfluxDB sorts tags by key, which is fastest when they are sorted already
+		sort.Slice(tags, func(i, j int) bool {
+			return tags[i].key < tags[j].key
+		})
+		var key strings.Builder
+		key.WriteString(influxMeasurementEscaper.Replace(name))
+		for _, tag := range tags {
+			key.WriteString("," + influxTagEscaper.Replace(tag.key) + "=" + influxTagEscaper.Replace(tag.value))
+		}
+		key.WriteString(" value=")
+		for _, p := range s.points {
+			if p.value == nil || math.IsNaN(*p.value) || math.IsInf(*p.value, 0) {
+				continue
+			}
+			if _, err := writer.WriteString(key.String() + strconv.FormatFloat(*p.value, 'f', -1, 64) + " " + strconv.FormatInt(p.time.UnixNano(), 10) + "\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
@@ -1,38 +1,136 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
 )
 
 type options struct {
-	dataDir string
+	dataDir            string
+	auditPair          string
+	baseline           string
+	thresholds         thresholds
+	steadyPhase        string
+	format             string
+	sqlite             string
+	resample           time.Duration
+	aggregation        string
+	trimStart          time.Duration
+	trimEnd            time.Duration
+	workers            int
+	memory             memoryStatistics
+	prometheusSeries   string
+	rollups            string
+	remoteWrite        string
+	remoteWriteLabels  keyValues
+	remoteWriteHeaders keyValues
 }
 
 func defaultOptions() *options {
-	return &options{}
+	return &options{
+		steadyPhase:      steadyStatePhase,
+		format:           jsonFormat,
+		aggregation:      "mean",
+		workers:          runtime.NumCPU(),
+		memory:           memoryStatistics{"working-set"},
+		prometheusSeries: defaultPrometheusSeries,
+		rollups:          defaultRollups,
+	}
 }
 
 func bindOptions(fs *flag.FlagSet, defaults *options) *options {
 	fs.StringVar(&defaults.dataDir, "data", defaults.dataDir, "Path to data directory.")
+	fs.StringVar(&defaults.auditPair, "audit-pair", defaults.auditPair, "Path to the data directory of the paired audit-impact run, to compute resource usage attributable to audit logging.")
+	fs.StringVar(&defaults.baseline, "baseline", defaults.baseline, "Path to the data directory of a baseline run of the same experiment, to compare this run to phase by phase.")
+	fs.Var(&defaults.thresholds, "threshold", fmt.Sprintf("Largest increase of a measure over the baseline run which passes, like api@steady:p99CpuCores=5%%, where the scope is an identifier or %q with a kind of latency for the measure, and the phase is optional. May be given more than once; the digest exits with %d when any threshold is crossed.", latencyScope, exitCodeRegressed))
+	fs.StringVar(&defaults.format, "format", defaults.format, fmt.Sprintf("Format to write the raw timeseries in, one of %v.", rawFormats))
+	fs.StringVar(&defaults.sqlite, "sqlite", defaults.sqlite, "Path to the SQLite database to add the run to with --format=sqlite, in place of one in the data directory, so that several runs can be queried together. Digesting a run again replaces its rows.")
+	fs.DurationVar(&defaults.resample, "resample", defaults.resample, "Interval to resample the raw timeseries onto, on a grid aligned to the epoch so that series of different pods and runs share timestamps. Zero leaves them as sampled.")
+	fs.StringVar(&defaults.aggregation, "resample-aggregation", defaults.aggregation, fmt.Sprintf("Aggregation of the samples in every resampled interval, one of %v. Cumulative counters always take the last sample. The last sample is stamped at the end of its interval, others at its start.", aggregationNames))
+	fs.DurationVar(&defaults.trimStart, "trim-start", defaults.trimStart, "Time to leave out of the start of every phase, and of the run when it has no steady phase, in the usage statistics and comparisons, so that the ramp-up of watches does not distort them.")
+	fs.DurationVar(&defaults.trimEnd, "trim-end", defaults.trimEnd, "Time to leave out of the end of every phase, and of the run when it has no steady phase, in the usage statistics and comparisons, so that the teardown of watches does not distort them.")
+	fs.StringVar(&defaults.steadyPhase, "steady-phase", defaults.steadyPhase, "Name of the phases in steady state, to summarize usage over; phases named with it and a dash-delimited suffix are included. Usage is summarized over the whole run when there are none.")
+	fs.Var(&defaults.memory, "memory", fmt.Sprintf("Comma-separated statistics on memory to digest, of %v. Memory usage is summarized by the first, which must be in bytes; the rest are recorded as metrics of their own.", memoryStatisticNames))
+	fs.StringVar(&defaults.prometheusSeries, "prometheus-series", defaults.prometheusSeries, "Comma-separated families of the API server and etcd metrics to record alongside the usage in the raw timeseries, each as family[:label] to break it down by the label. Counters are recorded as rates, histograms as percentiles and gauges as they are. Empty records none.")
+	fs.StringVar(&defaults.rollups, "rollup", defaults.rollups, fmt.Sprintf("Comma-separated aggregations of %v to roll up the raw timeseries of the pods sharing an identifier with, recorded for the identifier as a whole alongside those of every pod. Empty rolls up none.", rollupNames))
+	fs.StringVar(&defaults.remoteWrite, "remote-write", defaults.remoteWrite, "URL of a Prometheus remote-write endpoint to push the raw timeseries to, labelled with the experiment and the run. The endpoint must accept samples as old as the run.")
+	fs.Var(&defaults.remoteWriteLabels, "remote-write-label", "Label to add to every series pushed with --remote-write, as name=value, overriding the experiment and run labels when named after them. May be given more than once.")
+	fs.Var(&defaults.remoteWriteHeaders, "remote-write-header", "Header to send with every request to --remote-write, as name=value, like a tenant or authorization header. May be given more than once.")
+	fs.IntVar(&defaults.workers, "workers", defaults.workers, "Number of node directories of metrics to parse at once.")
 	return defaults
 }
 
+func (o *options) trimmed() trim {
+	return trim{start: o.trimStart, end: o.trimEnd}
+}
+
+// selectedRollups parses the rollups selected, which validate made sure it can.
+func (o *options) selectedRollups() []string {
+	rollups, _ := parseRollups(o.rollups)
+	return rollups
+}
+
+// prometheusSelections parses the families selected, which validate made sure it can.
+func (o *options) prometheusSelections() []prometheusSelection {
+	selections, _ := parsePrometheusSeries(o.prometheusSeries)
+	return selections
+}
+
 func (o *options) validate() error {
 	if o.dataDir == "" {
 		return errors.New("--data is required")
 	}
+	if len(o.thresholds) > 0 && o.baseline == "" {
+		return errors.New("--threshold requires --baseline")
+	}
+	if _, known := rawDataFiles[o.format]; !known {
+		return fmt.Errorf("--format must be one of %v", rawFormats)
+	}
+	if o.sqlite != "" && o.format != sqliteFormat {
+		return fmt.Errorf("--sqlite requires --format=%s", sqliteFormat)
+	}
+	if o.trimStart < 0 || o.trimEnd < 0 {
+		return errors.New("--trim-start and --trim-end must not be negative")
+	}
+	if o.resample < 0 {
+		return errors.New("--resample must not be negative")
+	}
+	if _, known := aggregations[o.aggregation]; !known {
+		return fmt.Errorf("--resample-aggregation must be one of %v", aggregationNames)
+	}
+	if _, err := parsePrometheusSeries(o.prometheusSeries); err != nil {
+		return fmt.Errorf("--prometheus-series is invalid: %w", err)
+	}
+	if _, err := parseRollups(o.rollups); err != nil {
+		return fmt.Errorf("--rollup is invalid: %w", err)
+	}
+	if o.remoteWrite != "" {
+		if err := validateRemoteWrite(o.remoteWrite, o.remoteWriteLabels); err != nil {
+			return fmt.Errorf("--remote-write is invalid: %w", err)
+		}
+	} else if len(o.remoteWriteLabels) > 0 || len(o.remoteWriteHeaders) > 0 {
+		return errors.New("--remote-write-label and --remote-write-header require --remote-write")
+	}
+	if o.workers < 1 {
+		return errors.New("--workers must be positive")
+	}
 	return nil
 }
 
@@ -46,15 +144,22 @@ func main() {
 	if err := opts.validate(); err != nil {
 		logrus.WithError(err).Fatal("invalid options")
 	}
+	parseWorkers = opts.workers
 
-	raw, err := os.ReadFile(filepath.Join(opts.dataDir, "podInfo.json"))
+	comparison, err := isComparison(opts.dataDir)
 	if err != nil {
-		logrus.WithError(err).Fatal("failed to read pod info")
+		logrus.WithError(err).Fatal("failed to determine what the data directory holds")
+	}
+	if comparison {
+		if err := digestComparison(opts.dataDir, opts.trimmed(), opts.memory); err != nil {
+			logrus.WithError(err).Fatal("failed to digest comparison")
+		}
+		return
 	}
 
-	var podsByIdentifier map[string][]types.NamespacedName
-	if err := json.Unmarshal(raw, &podsByIdentifier); err != nil {
-		logrus.WithError(err).Fatal("failed to unmarshal pod info")
+	podsByIdentifier, err := loadPodInfo(opts.dataDir)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to load pod info")
 	}
 
 	fields := logrus.Fields{}
@@ -63,6 +168,206 @@ func main() {
 	}
 	logrus.WithFields(fields).Info("found control plane pods")
 
+	metrics, err := loadMetrics(opts.dataDir, podsByIdentifier, opts.memory)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to read metrics")
+	}
+	defer func() {
+		_ = metrics.close()
+	}()
+
+	if err := derivePhases(opts.dataDir, metrics); err != nil {
+		logrus.WithError(err).Fatal("failed to derive phases")
+	}
+
+	stretches, err := loadCollectionErrors(opts.dataDir)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to load collection errors")
+	}
+
+	scraped, err := prometheusSeriesOf(opts.dataDir, opts.prometheusSelections())
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to read metrics scrapes")
+	}
+	defer func() {
+		_ = scraped.close()
+	}()
+	series := rawSeriesFrom(metrics, scraped, stretches, opts.resample, opts.aggregation, opts.selectedRollups())
+	if err := writeRawData(opts.dataDir, opts.format, opts.sqlite, series); err != nil {
+		logrus.WithError(err).Fatal("failed to write raw data")
+	}
+	if opts.remoteWrite != "" {
+		if err := pushRemoteWrite(opts.dataDir, opts.remoteWrite, opts.remoteWriteLabels, opts.remoteWriteHeaders, series); err != nil {
+			logrus.WithError(err).Fatal("failed to push raw data")
+		}
+	}
+
+	if err := digestRestarts(opts.dataDir, metrics); err != nil {
+		logrus.WithError(err).Fatal("failed to digest restarts")
+	}
+
+	if err := digestSampling(opts.dataDir, metrics); err != nil {
+		logrus.WithError(err).Fatal("failed to digest sampling calibration")
+	}
+
+	if err := digestPhaseUsage(opts.dataDir, opts.trimmed(), metrics); err != nil {
+		logrus.WithError(err).Fatal("failed to digest phase usage")
+	}
+
+	if err := digestUsageSummary(opts.dataDir, opts.steadyPhase, opts.trimmed(), metrics); err != nil {
+		logrus.WithError(err).Fatal("failed to digest usage summary")
+	}
+
+	if err := digestWatchCost(opts.dataDir, opts.trimmed(), metrics); err != nil {
+		logrus.WithError(err).Fatal("failed to digest watch cost")
+	}
+
+	if err := digestClientUsage(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest benchmark resource usage")
+	}
+
+	if err := digestPSI(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest pressure stall information")
+	}
+
+	if err := digestCgroupUsage(opts.dataDir, podsByIdentifier); err != nil {
+		logrus.WithError(err).Fatal("failed to digest cgroup usage")
+	}
+
+	if err := digestAuditLog(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest audit log")
+	}
+
+	if err := digestCAdvisor(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest cAdvisor metrics")
+	}
+
+	if err := digestCohorts(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest cohorts")
+	}
+
+	if err := digestAmplification(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest amplification")
+	}
+
+	if err := digestFlowControl(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest flow control")
+	}
+
+	if err := digestServerWatches(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest server-side watches")
+	}
+
+	if err := digestConnections(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest connections")
+	}
+
+	if err := digestConntrack(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest conntrack")
+	}
+
+	if err := digestWatchCache(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest watch cache")
+	}
+
+	if err := digestStorageObjects(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest stored objects")
+	}
+
+	if err := digestGoRuntime(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest Go runtime")
+	}
+
+	if err := digestCPUProfiles(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest CPU profiles")
+	}
+
+	if err := digestRequestLatency(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest request latency")
+	}
+
+	if err := digestRequestRates(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest request rates")
+	}
+
+	if err := digestEtcdDatabase(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest etcd database size")
+	}
+
+	if err := digestEtcdDisk(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest etcd disk latency")
+	}
+
+	if err := digestEtcdKeyspace(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest etcd keyspace")
+	}
+
+	if err := digestTimeline(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest timeline")
+	}
+
+	if err := digestBacklog(opts.dataDir); err != nil {
+		logrus.WithError(err).Fatal("failed to digest watch backlog")
+	}
+
+	if err := digestReport(opts.dataDir, opts.trimmed(), metrics); err != nil {
+		logrus.WithError(err).Fatal("failed to digest report")
+	}
+
+	if opts.auditPair != "" {
+		if err := digestAuditImpact(opts.dataDir, opts.auditPair, opts.memory); err != nil {
+			logrus.WithError(err).Fatal("failed to digest audit impact")
+		}
+	}
+
+	if opts.baseline != "" {
+		if err := digestBaselineComparison(opts.dataDir, opts.baseline, opts.trimmed(), opts.memory); err != nil {
+			logrus.WithError(err).Fatal("failed to compare to baseline")
+		}
+	}
+
+	if len(opts.thresholds) > 0 {
+		result, err := evaluateThresholds(opts.dataDir, opts.thresholds)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to evaluate thresholds")
+		}
+		if !result.Passed {
+			for _, failed := range result.Checks {
+				if !failed.Passed {
+					logrus.WithFields(logrus.Fields{"phase": failed.Phase, "baseline": failed.Baseline, "candidate": failed.Candidate, "reason": failed.Reason}).Errorf("threshold %s crossed", failed.Threshold)
+				}
+			}
+			os.Exit(exitCodeRegressed)
+		}
+	}
+}
+
+const (
+	cpuMetric             = "cpu"
+	cpuCoresMetric        = "cpu-cores"
+	memoryMetric          = "memory"
+	networkReceiveMetric  = "network-rx"
+	networkTransmitMetric = "network-tx"
+)
+
+// nodeIdentifier is the identifier under which the usage of the nodes running the monitored pods is recorded, and
+// the prefix of those for the system containers on them, like the kubelet.
+const nodeIdentifier = "node"
+
+// podMetrics holds the samples for each metric of each pod of an identifier, sorted by time.
+type podMetrics map[statsv1alpha1.PodReference]map[string][]metric
+
+func loadPodInfo(dataDir string) (map[string][]types.NamespacedName, error) {
+	var podsByIdentifier map[string][]types.NamespacedName
+	if err := artifacts.Load(dataDir, artifacts.PodInfoFile, &podsByIdentifier); err != nil {
+		return nil, err
+	}
+	return podsByIdentifier, nil
+}
+
+// loadMetrics reads the samples of every metric of every pod into a spill file, from which the samples of one
+// identifier at a time are loaded. The caller closes it.
+func loadMetrics(dataDir string, podsByIdentifier map[string][]types.NamespacedName, memory memoryStatistics) (*metricSamples, error) {
 	identifierForPod := map[statsv1alpha1.PodReference]string{}
 	for identifier, pods := range podsByIdentifier {
 		for _, pod := range pods {
@@ -70,92 +375,227 @@ func main() {
 		}
 	}
 
-	metrics := map[string]map[statsv1alpha1.PodReference]map[string][]metric{}
+	metrics, err := newMetricSamples()
+	if err != nil {
+		return nil, err
+	}
 	for identifier, pods := range podsByIdentifier {
-		metrics[identifier] = map[statsv1alpha1.PodReference]map[string][]metric{}
+		// components which were not found, like those a managed control plane hides, have no pods to report usage of
 		for _, pod := range pods {
-			metrics[identifier][referenceFor(pod)] = map[string][]metric{
-				"cpu":    {},
-				"memory": {},
-			}
+			metrics.add(identifier, referenceFor(pod), cpuMetric, memoryMetric, networkReceiveMetric, networkTransmitMetric)
+		}
+	}
+	// a pod replaced by another of the same name, as static pods are, is told apart by its UID
+	instances := map[statsv1alpha1.PodReference]map[string]uint32{}
+	instanceOf := func(ref statsv1alpha1.PodReference, uid string) uint32 {
+		if instances[ref] == nil {
+			instances[ref] = map[string]uint32{}
 		}
+		if _, seen := instances[ref][uid]; !seen {
+			instances[ref][uid] = uint32(len(instances[ref]))
+		}
+		return instances[ref][uid]
 	}
-	if err := filepath.WalkDir(filepath.Join(opts.dataDir, "metrics"), func(path string, info os.DirEntry, err error) error {
-		if err != nil || info == nil {
-			return err
+	if err := walkSummaries(dataDir, func(summary statsv1alpha1.Summary) {
+		for _, pod := range summary.Pods {
+			uid := pod.PodRef.UID
+			pod.PodRef.UID = ""
+			if label, exists := identifierForPod[pod.PodRef]; exists {
+				instance := instanceOf(pod.PodRef, uid)
+				// pods on the host network report the interfaces of the node, which they share with everything else
+				// on it
+				recordUsage(metrics, label, pod.PodRef, instance, memory, pod.CPU, pod.Memory, pod.Network)
+				// containers of pods with sidecars are recorded under identifiers of their own, nested under that of
+				// their pod, so that the sidecars can be told apart from the component they run next to
+				for _, container := range pod.Containers {
+					if len(pod.Containers) > 1 {
+						recordUsage(metrics, label+"/"+container.Name, pod.PodRef, instance, memory, container.CPU, container.Memory, nil)
+					}
+				}
+			}
 		}
 
-		if filepath.Ext(path) != ".json" {
+		// the node and the system containers on it are recorded under identifiers of their own, with the node in
+		// place of a pod, so that a saturated node shows up even when the monitored pods do not account for it
+		if summary.Node.NodeName != "" {
+			node := statsv1alpha1.PodReference{Name: summary.Node.NodeName}
+			recordUsage(metrics, nodeIdentifier, node, 0, memory, summary.Node.CPU, summary.Node.Memory, summary.Node.Network)
+			for _, container := range summary.Node.SystemContainers {
+				if container.Name == statsv1alpha1.SystemContainerKubelet || container.Name == statsv1alpha1.SystemContainerRuntime {
+					recordUsage(metrics, nodeIdentifier+"/"+container.Name, node, 0, memory, container.CPU, container.Memory, nil)
+				}
+			}
+		}
+	}); err != nil {
+		_ = metrics.close()
+		return nil, err
+	}
+	if metrics.spill.err != nil {
+		_ = metrics.close()
+		return nil, metrics.spill.err
+	}
+	return metrics, nil
+}
+
+// walkSummaries reads every kubelet stats summary recorded, whether in files of newline-delimited summaries or, as
+// older runs did, in a file per summary, along with the summaries equivalent to the resource metrics recorded
+// instead. The directories of the nodes are read in parallel, but the visitor is only ever called for one summary at
+// a time, and for those of a node in the order they were recorded.
+func walkSummaries(dataDir string, visit func(summary statsv1alpha1.Summary)) error {
+	if err := walkResourceMetrics(dataDir, visit); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(dataDir, artifacts.SummariesDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
 			return nil
 		}
+		return fmt.Errorf("failed to read %s: %w", artifacts.SummariesDir, err)
+	}
+	var lock sync.Mutex
+	serialized := func(summary statsv1alpha1.Summary) {
+		lock.Lock()
+		defer lock.Unlock()
+		visit(summary)
+	}
+	var tasks []func() error
+	for _, entry := range entries {
+		path := filepath.Join(dataDir, artifacts.SummariesDir, entry.Name())
+		tasks = append(tasks, func() error {
+			return filepath.WalkDir(path, func(path string, info os.DirEntry, err error) error {
+				if err != nil || info == nil {
+					return err
+				}
+				return readSummaries(path, serialized)
+			})
+		})
+	}
+	return inParallel(tasks)
+}
 
-		raw, err := os.ReadFile(path)
+// readSummaries reads the summaries in the file, by its extension; files of other kinds hold none.
+func readSummaries(path string, visit func(summary statsv1alpha1.Summary)) error {
+	switch filepath.Ext(path) {
+	case ".json":
+		file, err := os.Open(path)
 		if err != nil {
 			return fmt.Errorf("failed to read %s: %w", path, err)
 		}
-
 		var summary statsv1alpha1.Summary
-		if err := json.Unmarshal(raw, &summary); err != nil {
+		err = json.NewDecoder(file).Decode(&summary)
+		_ = file.Close()
+		if err != nil {
 			return fmt.Errorf("failed to unmarshal %s: %w", path, err)
 		}
-
-		for _, pod := range summary.Pods {
-			pod.PodRef.UID = ""
-			if label, exists := identifierForPod[pod.PodRef]; exists {
-				metrics[label][pod.PodRef]["cpu"] = append(metrics[label][pod.PodRef]["cpu"], metric{
-					timestamp: pod.CPU.Time,
-					value:     pod.CPU.UsageCoreNanoSeconds,
-				})
-				metrics[label][pod.PodRef]["memory"] = append(metrics[label][pod.PodRef]["memory"], metric{
-					timestamp: pod.Memory.Time,
-					value:     pod.Memory.WorkingSetBytes,
-				})
-			}
-		}
-
-		return nil
-	}); err != nil {
-		logrus.WithError(err).Fatal("failed to read metrics")
+		visit(summary)
+	case artifacts.SummaryLogExtension:
+		return readSummaryLog(path, visit)
 	}
+	return nil
+}
 
-	data := map[string]map[string][]timeseries{}
-	for podLabel, pods := range metrics {
-		for _, items := range pods {
-			for metricLabel, values := range items {
-				series := timeseries{}
-				sort.Slice(values, func(i, j int) bool {
-					return values[i].timestamp.Time.Before(values[j].timestamp.Time)
-				})
-				for _, value := range values {
-					series.Times = append(series.Times, value.timestamp.Time.Format(time.RFC3339Nano))
-					series.Values = append(series.Values, value.value)
-				}
-				if _, exists := data[metricLabel]; !exists {
-					data[metricLabel] = map[string][]timeseries{}
+// readSummaryLog reads a file of newline-delimited summaries. A summary cut short at the end of the file is where
+// the benchmark was stopped while writing it, and is ignored.
+func readSummaryLog(path string, visit func(summary statsv1alpha1.Summary)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		raw, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("failed to read %s: %w", path, readErr)
+		}
+		if len(bytes.TrimSpace(raw)) > 0 {
+			var summary statsv1alpha1.Summary
+			if err := json.Unmarshal(raw, &summary); err != nil {
+				if readErr != nil {
+					logrus.WithError(err).Warnf("ignoring truncated summary at the end of %s", path)
+					return nil
 				}
-				data[metricLabel][podLabel] = append(data[metricLabel][podLabel], series)
+				return fmt.Errorf("failed to unmarshal line %d of %s: %w", line, path, err)
 			}
+			visit(summary)
+		}
+		if readErr != nil {
+			return nil
 		}
 	}
+}
 
-	rawData, err := json.Marshal(data)
-	if err != nil {
-		logrus.WithError(err).Fatal("failed to marshal raw data")
+// recordUsage records the samples in the stats under the metrics they belong to, as taken of the instance of the
+// pod, with the statistics on memory selected.
+func recordUsage(metrics *metricSamples, identifier string, ref statsv1alpha1.PodReference, instance uint32, statistics memoryStatistics, cpu *statsv1alpha1.CPUStats, memory *statsv1alpha1.MemoryStats, network *statsv1alpha1.NetworkStats) {
+	metrics.add(identifier, ref)
+	if cpu != nil {
+		metrics.record(identifier, ref, cpuMetric, metric{timestamp: cpu.Time, value: cpu.UsageCoreNanoSeconds, instance: instance})
 	}
-
-	if err := os.WriteFile(filepath.Join(opts.dataDir, "data.json"), rawData, 0666); err != nil {
-		logrus.WithError(err).Fatal("failed to write raw data")
+	if memory != nil {
+		statistics.record(metrics, identifier, ref, instance, memory)
+	}
+	if network != nil {
+		metrics.record(identifier, ref, networkReceiveMetric, metric{timestamp: network.Time, value: network.RxBytes, instance: instance})
+		metrics.record(identifier, ref, networkTransmitMetric, metric{timestamp: network.Time, value: network.TxBytes, instance: instance})
 	}
 }
 
 type metric struct {
 	timestamp metav1.Time
 	value     *uint64
+	// instance tells apart the pods of the same name the samples were taken of, numbered as they were first seen.
+	instance uint32
+}
+
+// point is one value of a timeseries; a missing value breaks the series.
+type point struct {
+	time  time.Time
+	value *float64
 }
 
-type timeseries struct {
-	Times  []string  `json:"times"`
-	Values []*uint64 `json:"values"`
+func pointsOf(values []metric) []point {
+	points := make([]point, 0, len(values))
+	for _, value := range values {
+		var converted *float64
+		if value.value != nil {
+			v := float64(*value.value)
+			converted = &v
+		}
+		points = append(points, point{time: value.timestamp.Time, value: converted})
+	}
+	return points
+}
+
+// counterRatesOf derives the rate of a cumulative counter per nanosecond between consecutive distinct samples, at the
+// time of the later one; for CPU usage that is the cores used. The counter starting over, as it does when a
+// container restarts or the pod is replaced, breaks the series, since what was counted before the restart is not
+// known.
+func counterRatesOf(values []metric) []point {
+	var points []point
+	var previous *metric
+	for _, value := range dedupe(values) {
+		value := value
+		if value.value == nil {
+			continue
+		}
+		if previous != nil {
+			elapsed := value.timestamp.Time.Sub(previous.timestamp.Time)
+			switch {
+			case elapsed <= 0:
+				continue
+			case restartedAt(*previous, value, true):
+				points = append(points, point{time: value.timestamp.Time})
+			default:
+				cores := float64(*value.value-*previous.value) / float64(elapsed.Nanoseconds())
+				points = append(points, point{time: value.timestamp.Time, value: &cores})
+			}
+		}
+		previous = &value
+	}
+	return points
 }
 
 func referenceFor(namespacedName types.NamespacedName) statsv1alpha1.PodReference {
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// perWatch is the cost of holding one more watch open.
+type perWatch struct {
+	MemoryBytes float64 `json:"memoryBytes"`
+	CPUCores    float64 `json:"cpuCores"`
+}
+
+type stepCost struct {
+	Phase string `json:"phase"`
+	// Watches is the mean number of watches open over the second half of the step, when the run recorded them,
+	// or else the number open when the step started.
+	Watches float64 `json:"watches"`
+	// Usage is measured over the second half of the step, once memory has stabilized, keyed by identifier.
+	Usage map[string]usage `json:"usage"`
+	// Marginal is the cost per watch added since the previous step, keyed by identifier.
+	Marginal map[string]perWatch `json:"marginal,omitempty"`
+}
+
+type marginalCost struct {
+	Steps []stepCost `json:"steps"`
+	// Fit is the slope of a least-squares fit over all steps, keyed by identifier.
+	Fit map[string]perWatch `json:"fit"`
+}
+
+// marginalCostOf determines the cost per watch from the deltas between steps, when the experiment recorded steps.
+func marginalCostOf(dataDir string, gauge *artifacts.Gauge, metrics *metricSamples) (*marginalCost, error) {
+	var steps []artifacts.Step
+	if err := artifacts.Load(dataDir, artifacts.StepsFile, &steps); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil {
+		return nil, err
+	}
+	settled := map[string]artifacts.Phase{}
+	for _, phase := range phases {
+		phase.Start = phase.Start.Add(phase.End.Sub(phase.Start) / 2)
+		settled[phase.Name] = phase
+	}
+
+	result := marginalCost{Fit: map[string]perWatch{}}
+	for _, step := range steps {
+		phase, recorded := settled[step.Phase]
+		if !recorded {
+			continue
+		}
+		usages, err := usageByPhase(metrics, []artifacts.Phase{phase})
+		if err != nil {
+			return nil, err
+		}
+		cost := stepCost{
+			Phase:   step.Phase,
+			Watches: float64(step.Watches),
+			Usage:   usages[phase.Name],
+		}
+		if open, recorded := meanOpenWatches(gauge, phase); recorded {
+			cost.Watches = open
+		}
+		if len(result.Steps) > 0 {
+			previous := result.Steps[len(result.Steps)-1]
+			if added := cost.Watches - previous.Watches; added > 0 {
+				cost.Marginal = map[string]perWatch{}
+				for identifier, current := range cost.Usage {
+					cost.Marginal[identifier] = perWatch{
+						MemoryBytes: (current.MemoryBytes - previous.Usage[identifier].MemoryBytes) / added,
+						CPUCores:    (current.CPUCores - previous.Usage[identifier].CPUCores) / added,
+					}
+				}
+			}
+		}
+		result.Steps = append(result.Steps, cost)
+	}
+
+	for _, identifier := range metrics.identifiers() {
+		var watches, memory, cpu []float64
+		for _, step := range result.Steps {
+			watches = append(watches, step.Watches)
+			memory = append(memory, step.Usage[identifier].MemoryBytes)
+			cpu = append(cpu, step.Usage[identifier].CPUCores)
+		}
+		result.Fit[identifier] = perWatch{
+			MemoryBytes: slope(watches, memory),
+			CPUCores:    slope(watches, cpu),
+		}
+	}
+	return &result, nil
+}
+
+// slope determines the slope of the least-squares line through the points.
+func slope(x, y []float64) float64 {
+	if len(x) < 2 {
+		return 0
+	}
+	meanX, meanY := meanOf(x), meanOf(y)
+	var covariance, variance float64
+	for i := range x {
+		covariance += (x[i] - meanX) * (y[i] - meanY)
+		variance += (x[i] - meanX) * (x[i] - meanX)
+	}
+	if variance == 0 {
+		return 0
+	}
+	return covariance / variance
+}
+
+func meanOf(values []float64) float64 {
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
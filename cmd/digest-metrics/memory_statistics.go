@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+)
+
+const (
+	workingSetMetric      = "memory-working-set"
+	rssMetric             = "memory-rss"
+	memoryUsageMetric     = "memory-usage"
+	pageFaultsMetric      = "page-faults"
+	majorPageFaultsMetric = "major-page-faults"
+	// pageFaultRateMetric and majorPageFaultRateMetric are the faults per second, in the usage summary.
+	pageFaultRateMetric      = "page-fault-rate"
+	majorPageFaultRateMetric = "major-page-fault-rate"
+)
+
+// memoryStatistic is one of the statistics the kubelet reports on memory, recorded as the metric when it is not
+// the one memory usage is summarized by. Only statistics in bytes can be that one; page faults are counted.
+type memoryStatistic struct {
+	metric string
+	value  func(stats *statsv1alpha1.MemoryStats) *uint64
+	bytes  bool
+}
+
+var memoryStatisticsByName = map[string]memoryStatistic{
+	"working-set": {metric: workingSetMetric, bytes: true, value: func(stats *statsv1alpha1.MemoryStats) *uint64 {
+		return stats.WorkingSetBytes
+	}},
+	"rss": {metric: rssMetric, bytes: true, value: func(stats *statsv1alpha1.MemoryStats) *uint64 {
+		return stats.RSSBytes
+	}},
+	"usage": {metric: memoryUsageMetric, bytes: true, value: func(stats *statsv1alpha1.MemoryStats) *uint64 {
+		return stats.UsageBytes
+	}},
+	"page-faults": {metric: pageFaultsMetric, value: func(stats *statsv1alpha1.MemoryStats) *uint64 {
+		return stats.PageFaults
+	}},
+	"major-page-faults": {metric: majorPageFaultsMetric, value: func(stats *statsv1alpha1.MemoryStats) *uint64 {
+		return stats.MajorPageFaults
+	}},
+}
+
+var memoryStatisticNames = []string{"working-set", "rss", "usage", "page-faults", "major-page-faults"}
+
+// memoryStatistics select the statistics on memory to digest. Memory usage is summarized by the first throughout,
+// as memoryMetric; the rest are recorded alongside it, as metrics of their own. The working set is what the kubelet
+// evicts by and what the OOM killer sees, but the RSS leaves out the page cache the API server barely uses, and
+// page faults show pressure before the working set does.
+type memoryStatistics []string
+
+func (m *memoryStatistics) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *memoryStatistics) Set(value string) error {
+	var selected memoryStatistics
+	seen := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		statistic, known := memoryStatisticsByName[name]
+		if !known {
+			return fmt.Errorf("memory statistic %q is none of %v", name, memoryStatisticNames)
+		}
+		if len(selected) == 0 && !statistic.bytes {
+			return fmt.Errorf("memory statistic %q is not in bytes, so memory usage cannot be summarized by it", name)
+		}
+		if !seen[name] {
+			selected = append(selected, name)
+			seen[name] = true
+		}
+	}
+	*m = selected
+	return nil
+}
+
+// record records the selected statistics in the stats under the metrics they belong to. Other than the first, a
+// statistic the kubelet did not report is left out rather than recorded as missing, as the resource metrics only
+// ever hold the working set.
+func (m memoryStatistics) record(metrics *metricSamples, identifier string, ref statsv1alpha1.PodReference, instance uint32, memory *statsv1alpha1.MemoryStats) {
+	for i, name := range m {
+		statistic := memoryStatisticsByName[name]
+		value := statistic.value(memory)
+		if i == 0 {
+			metrics.record(identifier, ref, memoryMetric, metric{timestamp: memory.Time, value: value, instance: instance})
+			continue
+		}
+		if value != nil {
+			metrics.record(identifier, ref, statistic.metric, metric{timestamp: memory.Time, value: value, instance: instance})
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+)
+
+// metricRecordBytes is the size of a sample in the spill file: the time in nanoseconds, flags, the value and the
+// instance.
+const metricRecordBytes = 8 + 1 + 8 + 4
+
+const (
+	recordHasValue = 1 << iota
+	// recordZeroTime marks a sample without a time, which has no representation in nanoseconds since the epoch.
+	recordZeroTime
+)
+
+// metricSamples holds the samples of every metric of every pod read, keyed by identifier, pod and then metric, in a
+// spill file rather than in memory. The digest loads the samples of one identifier at a time, so that digesting a long
+// run takes no more memory than its largest identifier does.
+type metricSamples struct {
+	spill  *spillFile
+	series map[string]map[statsv1alpha1.PodReference]map[string]*metricSeries
+	// start and end are the first and last times any metric was sampled at.
+	start, end time.Time
+}
+
+type metricSeries struct {
+	spilled spilledSeries
+	// last is the time of the sample appended last, if any, which a sample the kubelet served from its cache repeats.
+	last     metav1.Time
+	appended bool
+}
+
+func newMetricSamples() (*metricSamples, error) {
+	spill, err := newSpillFile()
+	if err != nil {
+		return nil, err
+	}
+	return &metricSamples{spill: spill, series: map[string]map[statsv1alpha1.PodReference]map[string]*metricSeries{}}, nil
+}
+
+// add makes sure the identifier has the pod, with a series for every metric, even if it is never sampled.
+func (m *metricSamples) add(identifier string, ref statsv1alpha1.PodReference, names ...string) {
+	if m.series[identifier] == nil {
+		m.series[identifier] = map[statsv1alpha1.PodReference]map[string]*metricSeries{}
+	}
+	if m.series[identifier][ref] == nil {
+		m.series[identifier][ref] = map[string]*metricSeries{}
+	}
+	for _, name := range names {
+		m.seriesFor(identifier, ref, name)
+	}
+}
+
+func (m *metricSamples) seriesFor(identifier string, ref statsv1alpha1.PodReference, name string) *metricSeries {
+	m.add(identifier, ref)
+	if m.series[identifier][ref][name] == nil {
+		m.series[identifier][ref][name] = &metricSeries{}
+	}
+	return m.series[identifier][ref][name]
+}
+
+// record appends the sample to the series of the metric of the pod unless the kubelet served it from its cache since
+// the last one, which dedupe would drop anyway; polling far faster than the kubelet refreshes its stats over a long
+// run otherwise holds many copies of every sample.
+func (m *metricSamples) record(identifier string, ref statsv1alpha1.PodReference, name string, sample metric) {
+	series := m.seriesFor(identifier, ref, name)
+	if series.appended && series.last.Time.Equal(sample.timestamp.Time) {
+		return
+	}
+	series.last, series.appended = sample.timestamp, true
+	if m.start.IsZero() || sample.timestamp.Time.Before(m.start) {
+		m.start = sample.timestamp.Time
+	}
+	if sample.timestamp.Time.After(m.end) {
+		m.end = sample.timestamp.Time
+	}
+
+	var record [metricRecordBytes]byte
+	if sample.timestamp.IsZero() {
+		record[8] |= recordZeroTime
+	} else {
+		binary.LittleEndian.PutUint64(record[0:8], uint64(sample.timestamp.UnixNano()))
+	}
+	if sample.value != nil {
+		record[8] |= recordHasValue
+		binary.LittleEndian.PutUint64(record[9:17], *sample.value)
+	}
+	binary.LittleEndian.PutUint32(record[17:21], sample.instance)
+	m.spill.append(&series.spilled, record[:])
+}
+
+// identifiers lists every identifier with samples, sorted.
+func (m *metricSamples) identifiers() []string {
+	var identifiers []string
+	for identifier := range m.series {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	return identifiers
+}
+
+// span determines the first and last times any metric was sampled at.
+func (m *metricSamples) span() (time.Time, time.Time) {
+	return m.start, m.end
+}
+
+// load reads back the samples of every metric of every pod of the identifier, sorted by time. Samples taken at the
+// same time stay in the order they were polled, so that deduplication keeps the first.
+func (m *metricSamples) load(identifier string) (podMetrics, error) {
+	pods := podMetrics{}
+	for ref, items := range m.series[identifier] {
+		pods[ref] = map[string][]metric{}
+		for name, series := range items {
+			records, err := m.spill.read(&series.spilled)
+			if err != nil {
+				return nil, err
+			}
+			values := make([]metric, 0, len(records)/metricRecordBytes)
+			for offset := 0; offset+metricRecordBytes <= len(records); offset += metricRecordBytes {
+				record := records[offset : offset+metricRecordBytes]
+				var value metric
+				if record[8]&recordZeroTime == 0 {
+					value.timestamp = metav1.NewTime(time.Unix(0, int64(binary.LittleEndian.Uint64(record[0:8]))))
+				}
+				if record[8]&recordHasValue != 0 {
+					v := binary.LittleEndian.Uint64(record[9:17])
+					value.value = &v
+				}
+				value.instance = binary.LittleEndian.Uint32(record[17:21])
+				values = append(values, value)
+			}
+			sort.SliceStable(values, func(i, j int) bool {
+				return values[i].timestamp.Time.Before(values[j].timestamp.Time)
+			})
+			pods[ref][name] = values
+		}
+	}
+	return pods, nil
+}
+
+func (m *metricSamples) close() error {
+	return m.spill.close()
+}
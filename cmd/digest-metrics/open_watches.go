@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// loadOpenWatches loads the gauge of open watches, returning nil for runs which did not record one.
+func loadOpenWatches(dataDir string) (*artifacts.Gauge, error) {
+	var gauge artifacts.Gauge
+	if err := artifacts.Load(dataDir, artifacts.OpenWatchesFile, &gauge); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &gauge, nil
+}
+
+// meanOpenWatches determines the mean number of watches open during the phase. Per-watch metrics must be divided
+// by this, not by the number of watches issued, which overstates the load when watches fail.
+func meanOpenWatches(gauge *artifacts.Gauge, phase artifacts.Phase) (float64, bool) {
+	if gauge == nil {
+		return 0, false
+	}
+	var sum float64
+	var count int
+	for i, offset := range gauge.Offsets {
+		if phase.Contains(gauge.Start.Add(time.Duration(offset * float64(time.Second)))) {
+			sum += float64(gauge.Values[i])
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / float64(count), true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// The raw timeseries are written to Parquet with the same tidy schema as to CSV: every column is required, strings
+// are dictionary-encoded, and the file is split into row groups so that no page grows past what readers accept.
+
+// parquetRowGroupRows bounds the rows in every row group.
+const parquetRowGroupRows = 1 << 20
+
+// parquetRow is one sample, with the time in microseconds.
+type parquetRow struct {
+	Timestamp  int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MICROS, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS"`
+	Identifier string  `parquet:"name=identifier, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Pod        string  `parquet:"name=pod, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Container  string  `parquet:"name=container, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Metric     string  `parquet:"name=metric, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value      float64 `parquet:"name=value, type=DOUBLE"`
+}
+
+// writeRawParquet writes one row for every sample, like writeRawCSV.
+func writeRawParquet(path string, series rawSeriesSource) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if err := writeParquetRows(file, series); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+func writeParquetRows(file *os.File, series rawSeriesSource) error {
+	rows, err := writer.NewParquetWriterFromWriter(file, new(parquetRow), 1)
+	if err != nil {
+		return err
+	}
+	rows.CompressionType = parquet.CompressionCodec_SNAPPY
+	written := 0
+	if err := series(func(s rawSeries) error {
+		for _, p := range s.points {
+			if p.value == nil {
+				continue
+			}
+			if err := rows.Write(parquetRow{
+				Timestamp:  p.time.UnixMicro(),
+				Identifier: s.identifier,
+				Pod:        s.pod,
+				Container:  s.container,
+				Metric:     s.metric,
+				Value:      *p.value,
+			}); err != nil {
+				return err
+			}
+			// row groups are otherwise only bounded by their size in memory, which says little about how many
+			// values their pages hold
+			if written++; written%parquetRowGroupRows == 0 {
+				if err := rows.Flush(true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return rows.WriteStop()
+}
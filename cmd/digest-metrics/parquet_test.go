@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestWriteRawParquetReadsBack(t *testing.T) {
+	value := func(v float64) *float64 {
+		return &v
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	series := []rawSeries{
+		{identifier: "api", pod: "kube-apiserver-a", container: "kube-apiserver", metric: cpuMetric, points: []point{
+			{time: start, value: value(1.5)},
+			{time: start.Add(time.Second)},
+			{time: start.Add(2 * time.Second), value: value(2.25)},
+		}},
+		{identifier: "etcd", pod: "etcd-a", metric: "memory", points: []point{
+			{time: start, value: value(1 << 30)},
+		}},
+	}
+	path := filepath.Join(t.TempDir(), "data.parquet")
+	if err := writeRawParquet(path, rawSeriesIn(series)); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	read, err := reader.NewParquetReader(file, new(parquetRow), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer read.ReadStop()
+	rows := make([]parquetRow, read.GetNumRows())
+	if err := read.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+
+	// breaks are left out, and times are truncated to microseconds
+	micros := start.UnixMicro()
+	expected := []parquetRow{
+		{Timestamp: micros, Identifier: "api", Pod: "kube-apiserver-a", Container: "kube-apiserver", Metric: cpuMetric, Value: 1.5},
+		{Timestamp: micros + 2e6, Identifier: "api", Pod: "kube-apiserver-a", Container: "kube-apiserver", Metric: cpuMetric, Value: 2.25},
+		{Timestamp: micros, Identifier: "etcd", Pod: "etcd-a", Metric: "memory", Value: 1 << 30},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %+v, read %+v", expected, rows)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+type phasePerWatch struct {
+	Phase   string  `json:"phase"`
+	Watches float64 `json:"watches"`
+	// PerWatch is the usage above the baseline divided by the watches open, keyed by identifier.
+	PerWatch map[string]perWatch `json:"perWatch"`
+}
+
+// perWatchUsageOf determines the cost of every watch held open in each phase, relative to a baseline phase in which
+// none were, so that phases holding watches on different resources can be compared directly.
+func perWatchUsageOf(dataDir string, gauge *artifacts.Gauge, metrics *metricSamples) ([]phasePerWatch, error) {
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if gauge == nil {
+		return nil, nil
+	}
+	usages, err := usageByPhase(metrics, phases)
+	if err != nil {
+		return nil, err
+	}
+	baseline, recorded := usages[artifacts.BaselinePhase]
+	if !recorded {
+		return nil, nil
+	}
+
+	var result []phasePerWatch
+	for _, phase := range phases {
+		if phase.Name == artifacts.BaselinePhase {
+			continue
+		}
+		open, recorded := meanOpenWatches(gauge, phase)
+		if !recorded || open <= 0 {
+			continue
+		}
+		cost := phasePerWatch{Phase: phase.Name, Watches: open, PerWatch: map[string]perWatch{}}
+		for identifier, current := range usages[phase.Name] {
+			cost.PerWatch[identifier] = perWatch{
+				MemoryBytes: (current.MemoryBytes - baseline[identifier].MemoryBytes) / open,
+				CPUCores:    (current.CPUCores - baseline[identifier].CPUCores) / open,
+			}
+		}
+		result = append(result, cost)
+	}
+	return result, nil
+}
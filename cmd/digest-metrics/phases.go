@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const phaseUsageFile = "phase-usage.json"
+
+// digestPhaseUsage records the resource usage in each phase of the experiment, when it recorded phases.
+func digestPhaseUsage(dataDir string, trimmed trim, metrics *metricSamples) error {
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	usages, err := usageByPhase(metrics, trimmed.apply(phases))
+	if err != nil {
+		return err
+	}
+	return artifacts.Write(dataDir, phaseUsageFile, usages)
+}
+
+// trim is how much of the start and of the end of every window to leave out of the statistics taken over it, as
+// watches are still being established at the start of a phase and torn down at the end of the run, which distorts
+// means and percentiles of what is meant to be a steady state.
+type trim struct {
+	start, end time.Duration
+}
+
+// apply trims the phases, leaving out those which are shorter than what is trimmed.
+func (t trim) apply(phases []artifacts.Phase) []artifacts.Phase {
+	if t.start == 0 && t.end == 0 {
+		return phases
+	}
+	var trimmed []artifacts.Phase
+	for _, phase := range phases {
+		phase.Start, phase.End = phase.Start.Add(t.start), phase.End.Add(-t.end)
+		if !phase.End.After(phase.Start) {
+			logrus.Warnf("leaving out phase %s, which is too short to trim", phase.Name)
+			continue
+		}
+		trimmed = append(trimmed, phase)
+	}
+	return trimmed
+}
+
+// usage summarizes the resources consumed by all pods for an identifier over some window.
+type usage struct {
+	CPUCores       float64 `json:"cpuCores"`
+	PeakCPUCores   float64 `json:"peakCpuCores"`
+	P99CPUCores    float64 `json:"p99CpuCores"`
+	MemoryBytes    float64 `json:"memoryBytes"`
+	P99MemoryBytes float64 `json:"p99MemoryBytes"`
+	// NetworkReceiveBytes and NetworkTransmitBytes are the mean rates of traffic over the default interface, per
+	// second.
+	NetworkReceiveBytes  float64 `json:"networkReceiveBytes"`
+	NetworkTransmitBytes float64 `json:"networkTransmitBytes"`
+}
+
+// usageByPhase determines the resource usage for every identifier in every phase, keyed by phase and then
+// identifier. CPU usage and network traffic are average rates over the phase, while memory usage is the mean working
+// set; both are summed over the pods for an identifier. The peak CPU usage is the highest rate between two samples
+// of any one pod. The 99th percentiles are taken over the distinct samples of every pod and summed, so they bound
+// the usage of the identifier from above.
+func usageByPhase(metrics *metricSamples, phases []artifacts.Phase) (map[string]map[string]usage, error) {
+	usages := map[string]map[string]usage{}
+	for _, phase := range phases {
+		usages[phase.Name] = map[string]usage{}
+	}
+	for _, identifier := range metrics.identifiers() {
+		pods, err := metrics.load(identifier)
+		if err != nil {
+			return nil, err
+		}
+		for _, phase := range phases {
+			var total usage
+			for _, items := range pods {
+				cpu := inPhase(items[cpuMetric], phase)
+				total.CPUCores += cpuRate(cpu)
+				if peak := peakCPURate(cpu); peak > total.PeakCPUCores {
+					total.PeakCPUCores = peak
+				}
+				total.P99CPUCores += p99CPURate(cpu)
+				memory := inPhase(items[memoryMetric], phase)
+				total.MemoryBytes += mean(memory)
+				total.P99MemoryBytes += p99(memory)
+				total.NetworkReceiveBytes += bytesPerSecond(inPhase(items[networkReceiveMetric], phase))
+				total.NetworkTransmitBytes += bytesPerSecond(inPhase(items[networkTransmitMetric], phase))
+			}
+			usages[phase.Name][identifier] = total
+		}
+	}
+	return usages, nil
+}
+
+// inPhase selects the distinct samples taken in the phase.
+func inPhase(values []metric, phase artifacts.Phase) []metric {
+	var filtered []metric
+	for _, value := range values {
+		if value.value != nil && phase.Contains(value.timestamp.Time) {
+			filtered = append(filtered, value)
+		}
+	}
+	return dedupe(filtered)
+}
+
+// cpuRate determines the average rate of CPU usage in cores from cumulative usage samples, over the stretches
+// between restarts, as what was used between the last sample before a restart and the first after it is not known.
+func cpuRate(values []metric) float64 {
+	var increase uint64
+	var elapsed time.Duration
+	for _, segment := range segments(values, true) {
+		first, last := segment[0], segment[len(segment)-1]
+		increase += *last.value - *first.value
+		elapsed += last.timestamp.Time.Sub(first.timestamp.Time)
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(increase) / float64(elapsed.Nanoseconds())
+}
+
+// bytesPerSecond determines the average rate of a cumulative byte counter; cpuRate is the increase per nanosecond of
+// any cumulative counter.
+func bytesPerSecond(values []metric) float64 {
+	return cpuRate(values) * float64(time.Second)
+}
+
+func peakCPURate(values []metric) float64 {
+	var peak float64
+	for _, rate := range cpuRates(values) {
+		if rate > peak {
+			peak = rate
+		}
+	}
+	return peak
+}
+
+// p99CPURate determines the 99th percentile of the rates between distinct samples.
+func p99CPURate(values []metric) float64 {
+	return percentile(cpuRates(values), 0.99)
+}
+
+// cpuRates determines the rates between consecutive distinct samples, other than across a restart.
+func cpuRates(values []metric) []float64 {
+	var rates []float64
+	for _, segment := range segments(values, true) {
+		for i := 1; i < len(segment); i++ {
+			rates = append(rates, cpuRate(segment[i-1:i+1]))
+		}
+	}
+	return rates
+}
+
+func p99(values []metric) float64 {
+	var samples []float64
+	for _, value := range values {
+		samples = append(samples, float64(*value.value))
+	}
+	return percentile(samples, 0.99)
+}
+
+// percentile determines the nearest-rank percentile of the values.
+func percentile(values []float64, quantile float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(quantile*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func mean(values []metric) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, value := range values {
+		sum += float64(*value.value)
+	}
+	return sum / float64(len(values))
+}
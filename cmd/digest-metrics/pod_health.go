@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+func loadPodHealth(dataDir string) ([]artifacts.PodHealthEvent, error) {
+	var events []artifacts.PodHealthEvent
+	if err := artifacts.Load(dataDir, artifacts.PodHealthFile, &events); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return events, nil
+}
+
+// healthAnnotation marks the event on the timeline, against the pod it happened to or else the node.
+func healthAnnotation(event artifacts.PodHealthEvent) artifacts.Annotation {
+	target := event.Node
+	if event.Pod != "" {
+		target = event.Pod
+		if event.Container != "" {
+			target += "/" + event.Container
+		}
+	}
+	description := fmt.Sprintf("%s of %s", event.Kind, target)
+	if event.Induced {
+		description = "induced " + description
+	}
+	if event.Reason != "" {
+		description += ": " + event.Reason
+	}
+	annotation := artifacts.Annotation{Time: event.Time, Kind: artifacts.AnnotationHealth, Description: description}
+	if event.Started != nil && event.Started.After(event.Time) {
+		// a restarted container was down until it ran again
+		annotation.End = event.Started
+	}
+	return annotation
+}
+
+// podHealthAlarm warns when the control plane was OOM killed, evicted or restarted during the run, or the nodes
+// running it came under memory pressure, as what the run measured after is the recovery and not the load. What the
+// experiment induced is what it set out to measure.
+func podHealthAlarm(dataDir string) (string, error) {
+	recorded, err := loadPodHealth(dataDir)
+	if err != nil {
+		return "", err
+	}
+	var events []artifacts.PodHealthEvent
+	for _, event := range recorded {
+		if !event.Induced {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return "", nil
+	}
+	counts := map[string]int{}
+	targets := map[string]bool{}
+	for _, event := range events {
+		counts[event.Kind]++
+		if event.Pod != "" {
+			targets[event.Pod] = true
+		} else {
+			targets[event.Node] = true
+		}
+	}
+	var kinds []string
+	for kind, count := range counts {
+		kinds = append(kinds, fmt.Sprintf("%d %s", count, kind))
+	}
+	sort.Strings(kinds)
+	var names []string
+	for target := range targets {
+		names = append(names, target)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("The control plane fell over during the run, with %s events on %s, first at %s. Figures after that measure its recovery, not the load.", strings.Join(kinds, ", "), strings.Join(names, ", "), events[0].Time.Format("15:04:05")), nil
+}
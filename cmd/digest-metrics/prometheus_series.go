@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// defaultPrometheusSeries are the families of the API server and etcd metrics recorded as raw timeseries by default.
+const defaultPrometheusSeries = "apiserver_request_total:verb,apiserver_request_duration_seconds:verb,apiserver_registered_watchers,apiserver_longrunning_requests,apiserver_current_inflight_requests:request_kind,go_goroutines,process_cpu_seconds_total,process_resident_memory_bytes,etcd_disk_wal_fsync_duration_seconds,etcd_mvcc_db_total_size_in_bytes"
+
+// prometheusQuantiles are the quantiles of histograms recorded as timeseries.
+var prometheusQuantiles = []struct {
+	name     string
+	quantile float64
+}{{name: "p50", quantile: 0.5}, {name: "p99", quantile: 0.99}}
+
+// prometheusSources are the directories of scrapes, by the identifier their series are recorded under.
+var prometheusSources = map[string]string{
+	"apiserver": artifacts.APIServerMetricsDir,
+	"etcd":      artifacts.EtcdMetricsDir,
+}
+
+// prometheusSelection is a family of metrics to record as timeseries, added up over every label but the one it is
+// broken down by, if any.
+type prometheusSelection struct {
+	family, label string
+}
+
+// parsePrometheusSeries parses selections like apiserver_request_total:verb, which records the rate of requests
+// of every verb.
+func parsePrometheusSeries(value string) ([]prometheusSelection, error) {
+	var selections []prometheusSelection
+	for _, raw := range strings.Split(value, ",") {
+		if raw == "" {
+			continue
+		}
+		family, label, _ := strings.Cut(raw, ":")
+		if family == "" || strings.Contains(label, ":") {
+			return nil, fmt.Errorf("series %q is not of the form family[:label]", raw)
+		}
+		selections = append(selections, prometheusSelection{family: family, label: label})
+	}
+	return selections, nil
+}
+
+// scrapedSeries holds the points of the series recorded from scrapes in a spill file, keyed by identifier, replica and
+// then name, so that only those of one identifier are ever loaded at once.
+type scrapedSeries struct {
+	spill  *spillFile
+	series map[string]map[string]map[string]*spilledSeries
+}
+
+// scrapedRecordBytes is the size of a point in the spill file: the time in nanoseconds and the value.
+const scrapedRecordBytes = 8 + 8
+
+// record appends the value to the series.
+func (s *scrapedSeries) record(identifier, pod, name string, at time.Time, value float64) {
+	if s.series[identifier] == nil {
+		s.series[identifier] = map[string]map[string]*spilledSeries{}
+	}
+	if s.series[identifier][pod] == nil {
+		s.series[identifier][pod] = map[string]*spilledSeries{}
+	}
+	if s.series[identifier][pod][name] == nil {
+		s.series[identifier][pod][name] = &spilledSeries{}
+	}
+	var record [scrapedRecordBytes]byte
+	binary.LittleEndian.PutUint64(record[0:8], uint64(at.UnixNano()))
+	binary.LittleEndian.PutUint64(record[8:16], math.Float64bits(value))
+	s.spill.append(s.series[identifier][pod][name], record[:])
+}
+
+// identifiers lists every identifier with series, sorted.
+func (s *scrapedSeries) identifiers() []string {
+	var identifiers []string
+	for identifier := range s.series {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	return identifiers
+}
+
+// load reads back the series of the identifier, sorted by replica and name, broken where scrapes could not be taken.
+func (s *scrapedSeries) load(identifier string, stretches []artifacts.CollectionError) ([]rawSeries, error) {
+	var series []rawSeries
+	for pod, names := range s.series[identifier] {
+		for name, spilled := range names {
+			records, err := s.spill.read(spilled)
+			if err != nil {
+				return nil, err
+			}
+			points := make([]point, 0, len(records)/scrapedRecordBytes)
+			for offset := 0; offset+scrapedRecordBytes <= len(records); offset += scrapedRecordBytes {
+				value := math.Float64frombits(binary.LittleEndian.Uint64(records[offset+8 : offset+16]))
+				points = append(points, point{time: time.Unix(0, int64(binary.LittleEndian.Uint64(records[offset:offset+8]))), value: &value})
+			}
+			series = append(series, rawSeries{identifier: identifier, pod: pod, metric: name, points: withGaps(points, stretches)})
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].pod != series[j].pod {
+			return series[i].pod < series[j].pod
+		}
+		return series[i].metric < series[j].metric
+	})
+	return series, nil
+}
+
+func (s *scrapedSeries) close() error {
+	return s.spill.close()
+}
+
+// prometheusSeriesOf records the timeseries of the selected families from every scrape of the API servers and etcd
+// members, a series per replica, named like the rules which would record them in Prometheus: counters as their rate
+// per second between consecutive scrapes, histograms as quantiles of what was observed between them, and gauges as
+// they are. The caller closes the series.
+func prometheusSeriesOf(dataDir string, selections []prometheusSelection) (*scrapedSeries, error) {
+	spill, err := newSpillFile()
+	if err != nil {
+		return nil, err
+	}
+	series := &scrapedSeries{spill: spill, series: map[string]map[string]map[string]*spilledSeries{}}
+	if len(selections) == 0 {
+		return series, nil
+	}
+	var families []string
+	for _, selection := range selections {
+		families = append(families, selection.family)
+	}
+	for identifier, dir := range prometheusSources {
+		previous := map[string]metricsSnapshot{}
+		if err := walkMetricsSnapshots(dataDir, dir, families, func(snapshot metricsSnapshot) error {
+			before, scraped := previous[snapshot.node]
+			previous[snapshot.node] = snapshot
+			for _, selection := range selections {
+				for name, value := range selection.valuesOf(snapshot, before, scraped) {
+					series.record(identifier, snapshot.node, name, snapshot.time, value)
+				}
+			}
+			return spill.err
+		}); err != nil {
+			_ = series.close()
+			return nil, err
+		}
+	}
+	return series, nil
+}
+
+// valuesOf derives the values of the selection at the time of the scrape, keyed by the name of their series.
+// Counters and histograms need the scrape before it, and have no values at the first.
+func (s prometheusSelection) valuesOf(snapshot, before metricsSnapshot, scraped bool) map[string]float64 {
+	values := map[string]float64{}
+	family, exists := snapshot.families[s.family]
+	if !exists {
+		return values
+	}
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		if !scraped {
+			return values
+		}
+		elapsed := snapshot.time.Sub(before.time).Seconds()
+		earlier := before.sumBy(s.family, s.label)
+		for value, count := range snapshot.sumBy(s.family, s.label) {
+			if previous, counted := earlier[value]; counted && elapsed > 0 {
+				values[s.name("rate", value)] = increase(previous, count) / elapsed
+			}
+		}
+	case dto.MetricType_HISTOGRAM:
+		if !scraped {
+			return values
+		}
+		earlier, later := s.bucketsBy(before), s.bucketsBy(snapshot)
+		for value, buckets := range later {
+			previous, counted := earlier[value]
+			if !counted {
+				continue
+			}
+			observed := buckets.since(previous)
+			if observed.count <= 0 {
+				continue
+			}
+			for _, q := range prometheusQuantiles {
+				values[s.name(q.name, value)] = observed.quantile(q.quantile)
+			}
+		}
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		for value, sum := range snapshot.sumBy(s.family, s.label) {
+			values[s.name("", value)] = sum
+		}
+	}
+	return values
+}
+
+// bucketsBy adds up the histograms in the family, keyed by the value of the label.
+func (s prometheusSelection) bucketsBy(snapshot metricsSnapshot) map[string]bucketCounts {
+	buckets := map[string]bucketCounts{}
+	family, exists := snapshot.families[s.family]
+	if !exists {
+		return buckets
+	}
+	for _, sample := range family.Metric {
+		value := labelValue(sample, s.label)
+		if _, seen := buckets[value]; !seen {
+			buckets[value] = bucketsOf(sample.Histogram)
+			continue
+		}
+		buckets[value] = buckets[value].add(bucketsOf(sample.Histogram))
+	}
+	return buckets
+}
+
+// name names a series like a recording rule, with the operation applied to the family and the value of the label
+// it is broken down by, like apiserver_request_total:rate{verb=LIST}. The value is not quoted as it would be in
+// Prometheus, which only gets in the way of the formats series are written in.
+func (s prometheusSelection) name(operation, value string) string {
+	name := s.family
+	if operation != "" {
+		name += ":" + operation
+	}
+	if s.label != "" {
+		name += "{" + s.label + "=" + value + "}"
+	}
+	return name
+}
+
+// splitSeriesName splits the name of a series named by name into the family and operation and the label it is broken
+// down by, for formats which record labels apart from names. Other names are returned as they are.
+func splitSeriesName(metric string) (name, label, value string) {
+	i := strings.Index(metric, "{")
+	if i < 0 || !strings.HasSuffix(metric, "}") {
+		return metric, "", ""
+	}
+	label, value, found := strings.Cut(metric[i+1:len(metric)-1], "=")
+	if !found {
+		return metric, "", ""
+	}
+	return metric[:i], label, value
+}
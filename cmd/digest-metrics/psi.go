@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const psiFile = "psi.json"
+
+// runWindow is the name under which figures for the whole run are recorded, next to those for every phase.
+const runWindow = "run"
+
+// stall is the percentage of time in which some or all runnable tasks were stalled on a resource.
+type stall struct {
+	Some float64 `json:"some"`
+	Full float64 `json:"full"`
+}
+
+type psiSample struct {
+	time time.Time
+	// some and full are the cumulative stall times, in microseconds.
+	some, full float64
+}
+
+// digestPSI determines the stall percentages on every node, for every resource, over the run and in every phase,
+// keyed by window, node and resource, when the run recorded pressure stall information.
+func digestPSI(dataDir string) error {
+	files, err := filepath.Glob(filepath.Join(dataDir, artifacts.NodeCollectorDir, "*", artifacts.PSIFile))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	stalls := map[string]map[string]map[string]stall{runWindow: {}}
+	for _, phase := range phases {
+		stalls[phase.Name] = map[string]map[string]stall{}
+	}
+	for _, file := range files {
+		node := filepath.Base(filepath.Dir(file))
+		samples, err := loadPSI(file)
+		if err != nil {
+			return err
+		}
+		for resource, series := range samples {
+			if len(series) == 0 {
+				continue
+			}
+			windows := append([]artifacts.Phase{{
+				Name:  runWindow,
+				Start: series[0].time,
+				End:   series[len(series)-1].time.Add(time.Nanosecond),
+			}}, phases...)
+			for _, window := range windows {
+				var inWindow []psiSample
+				for _, sample := range series {
+					if window.Contains(sample.time) {
+						inWindow = append(inWindow, sample)
+					}
+				}
+				if len(inWindow) < 2 {
+					continue
+				}
+				first, last := inWindow[0], inWindow[len(inWindow)-1]
+				elapsed := float64(last.time.Sub(first.time).Microseconds())
+				if elapsed <= 0 {
+					continue
+				}
+				if stalls[window.Name][node] == nil {
+					stalls[window.Name][node] = map[string]stall{}
+				}
+				stalls[window.Name][node][resource] = stall{
+					Some: 100 * (last.some - first.some) / elapsed,
+					Full: 100 * (last.full - first.full) / elapsed,
+				}
+			}
+		}
+	}
+	return artifacts.Write(dataDir, psiFile, stalls)
+}
+
+// loadPSI parses the samples for every resource, from lines like:
+//
+//	2006-01-02T15:04:05.999999999Z cpu some avg10=0.00 avg60=0.00 avg300=0.00 total=1234 full avg10=0.00 ... total=0
+func loadPSI(path string) (map[string][]psiSample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	samples := map[string][]psiSample{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp in %s: %w", path, err)
+		}
+		sample := psiSample{time: timestamp}
+		var kind string
+		for _, field := range fields[2:] {
+			switch {
+			case field == "some" || field == "full":
+				kind = field
+			case strings.HasPrefix(field, "total="):
+				total, err := strconv.ParseFloat(strings.TrimPrefix(field, "total="), 64)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse total in %s: %w", path, err)
+				}
+				if kind == "some" {
+					sample.some = total
+				} else {
+					sample.full = total
+				}
+			}
+		}
+		samples[fields[1]] = append(samples[fields[1]], sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return samples, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const (
+	jsonFormat    = "json"
+	csvFormat     = "csv"
+	parquetFormat = "parquet"
+	sqliteFormat  = "sqlite"
+	influxFormat  = "influx"
+)
+
+// rawDataFiles name the file the raw timeseries are written to in every format.
+var rawDataFiles = map[string]string{
+	jsonFormat:    "data.json",
+	csvFormat:     "data.csv",
+	parquetFormat: "data.parquet",
+	sqliteFormat:  "data.sqlite",
+	influxFormat:  "data.lp",
+}
+
+var rawFormats = []string{jsonFormat, csvFormat, parquetFormat, sqliteFormat, influxFormat}
+
+// rawSeries is the timeseries of one metric of one pod, or of one container in it. Identifiers of containers nest
+// under that of their pod, as api/kube-apiserver does under api.
+type rawSeries struct {
+	identifier, pod, container, metric string
+	points                             []point
+}
+
+// label is the identifier the series is recorded under in the JSON output, with the container in it.
+func (s rawSeries) label() string {
+	if s.container == "" {
+		return s.identifier
+	}
+	return s.identifier + "/" + s.container
+}
+
+// rawSeriesSource visits every raw timeseries in turn, stopping at the first error the visitor returns, so that the
+// series need not all be held in memory at once.
+type rawSeriesSource func(visit func(s rawSeries) error) error
+
+// rawSeriesIn visits the series in the slice.
+func rawSeriesIn(series []rawSeries) rawSeriesSource {
+	return func(visit func(s rawSeries) error) error {
+		for _, s := range series {
+			if err := visit(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rawSeriesFrom assembles the raw timeseries an identifier at a time, in order of identifier: those of the usage of
+// its pods, then those recorded from its scrapes, resampled onto the interval unless it is zero, then their rollups.
+// Only the series of one identifier are ever held in memory, and they are assembled afresh every time they are
+// visited.
+func rawSeriesFrom(metrics *metricSamples, scraped *scrapedSeries, stretches []artifacts.CollectionError, interval time.Duration, aggregation string, rollups []string) rawSeriesSource {
+	return func(visit func(s rawSeries) error) error {
+		identifiers := sets.NewString(metrics.identifiers()...).Insert(scraped.identifiers()...)
+		for _, identifier := range identifiers.List() {
+			pods, err := metrics.load(identifier)
+			if err != nil {
+				return err
+			}
+			series := rawSeriesOf(identifier, pods, stretches)
+			recorded, err := scraped.load(identifier, stretches)
+			if err != nil {
+				return err
+			}
+			series = append(series, recorded...)
+			if interval > 0 {
+				series = resample(series, interval, aggregation)
+			}
+			series = append(series, rollupsOf(series, rollups)...)
+			if err := rawSeriesIn(series)(visit); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rawSeriesOf assembles the timeseries of every metric of the pods of an identifier, and those derived from them,
+// sorted by pod and metric, from the distinct samples. Series are broken with a null value where samples could not
+// be collected, rather than drawn across the gap.
+func rawSeriesOf(label string, pods podMetrics, stretches []artifacts.CollectionError) []rawSeries {
+	identifier, container := label, ""
+	if i := strings.Index(label, "/"); i >= 0 {
+		identifier, container = label[:i], label[i+1:]
+	}
+	var series []rawSeries
+	for ref, items := range pods {
+		pod := ref.Name
+		if ref.Namespace != "" {
+			pod = ref.Namespace + "/" + ref.Name
+		}
+		for name, values := range items {
+			series = append(series, rawSeries{identifier: identifier, pod: pod, container: container, metric: name, points: withGaps(pointsBetweenRestarts(dedupe(values), cumulativeMetrics[name]), stretches)})
+			if name == cpuMetric {
+				series = append(series, rawSeries{identifier: identifier, pod: pod, container: container, metric: cpuCoresMetric, points: withGaps(counterRatesOf(values), stretches)})
+			}
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].pod != series[j].pod {
+			return series[i].pod < series[j].pod
+		}
+		return series[i].metric < series[j].metric
+	})
+	return series
+}
+
+func withGaps(points []point, stretches []artifacts.CollectionError) []point {
+	var broken []point
+	for i, p := range points {
+		if i > 0 {
+			if start, gap := gapBetween(points[i-1].time, p.time, stretches); gap {
+				broken = append(broken, point{time: start})
+			}
+		}
+		broken = append(broken, p)
+	}
+	return broken
+}
+
+// runLabels identify the run the raw timeseries were taken in, for formats which keep those of several runs together:
+// the experiment, and the run by when it started.
+func runLabels(dataDir string) (map[string]string, error) {
+	var manifest artifacts.Manifest
+	if err := artifacts.Load(dataDir, artifacts.ManifestFile, &manifest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	labels := map[string]string{}
+	if manifest.Experiment != "" {
+		labels["experiment"] = manifest.Experiment
+	}
+	if !manifest.Start.IsZero() {
+		labels["run"] = manifest.Start.UTC().Format(time.RFC3339)
+	}
+	return labels, nil
+}
+
+type timeseries struct {
+	Times  []string   `json:"times"`
+	Values []*float64 `json:"values"`
+}
+
+// writeRawData writes the raw timeseries in the format, adding them to the database at sqlitePath instead of the
+// one in the data directory when it is set.
+func writeRawData(dataDir, format, sqlitePath string, series rawSeriesSource) error {
+	path := filepath.Join(dataDir, rawDataFiles[format])
+	if format == sqliteFormat && sqlitePath != "" {
+		path = sqlitePath
+	}
+	switch format {
+	case csvFormat:
+		return writeRawCSV(path, series)
+	case parquetFormat:
+		return writeRawParquet(path, series)
+	case sqliteFormat:
+		return writeRawSQLite(dataDir, path, series)
+	case influxFormat:
+		return writeRawInflux(dataDir, path, series)
+	default:
+		return writeRawJSON(path, series)
+	}
+}
+
+// writeRawJSON writes the series keyed by metric and then identifier, with the series of every pod in a list. The
+// series are visited by identifier, so every one is encoded into a spill file as it is visited, and the document is
+// assembled from the spill file once they all have been.
+func writeRawJSON(path string, series rawSeriesSource) error {
+	spill, err := newSpillFile()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = spill.close()
+	}()
+	encoded := map[string]map[string]*spilledSeries{}
+	if err := series(func(s rawSeries) error {
+		formatted := timeseries{}
+		for _, p := range s.points {
+			formatted.Times = append(formatted.Times, p.time.Format(time.RFC3339Nano))
+			formatted.Values = append(formatted.Values, p.value)
+		}
+		raw, err := json.Marshal(formatted)
+		if err != nil {
+			return fmt.Errorf("failed to marshal raw data: %w", err)
+		}
+		if _, exists := encoded[s.metric]; !exists {
+			encoded[s.metric] = map[string]*spilledSeries{}
+		}
+		list, exists := encoded[s.metric][s.label()]
+		if !exists {
+			list = &spilledSeries{}
+			encoded[s.metric][s.label()] = list
+		} else {
+			spill.append(list, []byte(","))
+		}
+		spill.append(list, raw)
+		return spill.err
+	}); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if err := writeJSONDocument(bufio.NewWriter(file), spill, encoded); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// writeJSONDocument writes the lists of encoded series as an object keyed by metric and then identifier, with the
+// keys sorted as encoding/json sorts those of maps.
+func writeJSONDocument(writer *bufio.Writer, spill *spillFile, encoded map[string]map[string]*spilledSeries) error {
+	// errors writing stick to the writer, so only that of the flush at the end is checked
+	key := func(name string) []byte {
+		raw, _ := json.Marshal(name)
+		return raw
+	}
+	var metrics []string
+	for metric := range encoded {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	_ = writer.WriteByte('{')
+	for i, metric := range metrics {
+		if i > 0 {
+			_ = writer.WriteByte(',')
+		}
+		_, _ = writer.Write(key(metric))
+		_, _ = writer.WriteString(":{")
+		var labels []string
+		for label := range encoded[metric] {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for j, label := range labels {
+			if j > 0 {
+				_ = writer.WriteByte(',')
+			}
+			list, err := spill.read(encoded[metric][label])
+			if err != nil {
+				return err
+			}
+			_, _ = writer.Write(key(label))
+			_, _ = writer.WriteString(":[")
+			_, _ = writer.Write(list)
+			_ = writer.WriteByte(']')
+		}
+		_ = writer.WriteByte('}')
+	}
+	_ = writer.WriteByte('}')
+	return writer.Flush()
+}
+
+// writeRawCSV writes one row for every sample, leaving out the breaks in the series, which tidy data has no use for.
+func writeRawCSV(path string, series rawSeriesSource) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	writer := csv.NewWriter(file)
+	if err := writer.Write([]string{"timestamp", "identifier", "pod", "container", "metric", "value"}); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := series(func(s rawSeries) error {
+		for _, p := range s.points {
+			if p.value == nil {
+				continue
+			}
+			if err := writer.Write([]string{p.time.Format(time.RFC3339Nano), s.identifier, s.pod, s.container, s.metric, strconv.FormatFloat(*p.value, 'f', -1, 64)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
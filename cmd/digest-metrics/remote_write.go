@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// remoteWriteNamespace prefixes the name of every series pushed, so that they cannot be mistaken for what the
+	// endpoint scrapes from production clusters.
+	remoteWriteNamespace = "watch_benchmark"
+	// remoteWriteBatchSamples is how many samples are sent in one request, as Prometheus does by default.
+	remoteWriteBatchSamples = 2000
+	remoteWriteAttempts     = 5
+	remoteWriteTimeout      = 30 * time.Second
+)
+
+// staleNaN is the value Prometheus marks a series stale with, which ends it as a break in the raw timeseries does.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// keyValues are given as repeated name=value flags, like the labels and headers of remote-write requests.
+type keyValues map[string]string
+
+func (k *keyValues) String() string {
+	var pairs []string
+	for key, value := range *k {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (k *keyValues) Set(value string) error {
+	key, val, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("%q is not of the form name=value", value)
+	}
+	if *k == nil {
+		*k = keyValues{}
+	}
+	(*k)[key] = val
+	return nil
+}
+
+type remoteWriteLabel struct {
+	name, value string
+}
+
+// remoteWriteSeries is a raw timeseries as it is pushed, with its labels sorted by name as remote-write requires.
+type remoteWriteSeries struct {
+	labels  []remoteWriteLabel
+	samples []point
+}
+
+// pushRemoteWrite pushes the raw timeseries to a Prometheus remote-write endpoint, labelled with the experiment and
+// the run, so that they can be queried next to what production clusters report. The endpoint has to accept samples as
+// old as the run, which most only do when out-of-order ingestion is enabled.
+func pushRemoteWrite(dataDir, endpoint string, labels, headers keyValues, series rawSeriesSource) error {
+	common, err := runLabels(dataDir)
+	if err != nil {
+		return err
+	}
+	for name, value := range labels {
+		common[name] = value
+	}
+
+	client := &http.Client{Timeout: remoteWriteTimeout}
+	requests := remoteWriteRequests{send: func(request []byte) error {
+		return sendRemoteWrite(client, endpoint, headers, request)
+	}}
+	var pushed int
+	if err := series(func(s rawSeries) error {
+		pushed++
+		return requests.add(remoteWriteSeriesOf(s, common))
+	}); err != nil {
+		return fmt.Errorf("failed to push to %s: %w", endpoint, err)
+	}
+	if err := requests.flush(); err != nil {
+		return fmt.Errorf("failed to push to %s: %w", endpoint, err)
+	}
+	logrus.Infof("pushed %d series in %d requests to %s", pushed, requests.sent, endpoint)
+	return nil
+}
+
+// remoteWriteSeriesOf names and labels the raw timeseries. Series recorded from the API server and etcd metrics carry
+// the label they are broken down by in their name, like apiserver_request_total:rate{verb=LIST}, which becomes a label
+// of its own again.
+func remoteWriteSeriesOf(s rawSeries, common map[string]string) remoteWriteSeries {
+	labels := map[string]string{}
+	for name, value := range common {
+		labels[name] = value
+	}
+	name, label, value := splitSeriesName(s.metric)
+	if label != "" {
+		labels[label] = value
+	}
+	labels["__name__"] = remoteWriteNamespace + "_" + strings.Map(func(r rune) rune {
+		if r == ':' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+	labels["component"] = s.identifier
+	// rollups of every pod of a component have none
+	if s.pod != "" {
+		labels["pod"] = s.pod
+	}
+	if s.container != "" {
+		labels["container"] = s.container
+	}
+
+	var pushed remoteWriteSeries
+	for name, value := range labels {
+		pushed.labels = append(pushed.labels, remoteWriteLabel{name: name, value: value})
+	}
+	sort.Slice(pushed.labels, func(i, j int) bool {
+		return pushed.labels[i].name < pushed.labels[j].name
+	})
+	for i, p := range s.points {
+		if p.value == nil && (i == 0 || s.points[i-1].value == nil) {
+			continue
+		}
+		pushed.samples = append(pushed.samples, p)
+	}
+	return pushed
+}
+
+// remoteWriteRequests encodes series into WriteRequest messages of about remoteWriteBatchSamples samples each,
+// splitting the samples of long series across requests in order, and sends every request as soon as it is full.
+type remoteWriteRequests struct {
+	send    func(request []byte) error
+	request []byte
+	batched int
+	sent    int
+}
+
+func (r *remoteWriteRequests) add(s remoteWriteSeries) error {
+	for start := 0; start < len(s.samples); {
+		end := start + remoteWriteBatchSamples - r.batched
+		if end > len(s.samples) {
+			end = len(s.samples)
+		}
+		r.request = protowire.AppendTag(r.request, 1, protowire.BytesType)
+		r.request = protowire.AppendBytes(r.request, encodeRemoteWriteSeries(s.labels, s.samples[start:end]))
+		r.batched += end - start
+		start = end
+		if r.batched >= remoteWriteBatchSamples {
+			if err := r.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush sends the request being encoded, if it holds any samples.
+func (r *remoteWriteRequests) flush() error {
+	if r.batched == 0 {
+		return nil
+	}
+	r.sent++
+	if err := r.send(r.request); err != nil {
+		return fmt.Errorf("failed to push request %d: %w", r.sent, err)
+	}
+	r.request, r.batched = nil, 0
+	return nil
+}
+
+// encodeRemoteWriteSeries encodes a TimeSeries message, with a stale marker for every break in the series.
+func encodeRemoteWriteSeries(labels []remoteWriteLabel, samples []point) []byte {
+	var message []byte
+	for _, label := range labels {
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, label.name)
+		encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, label.value)
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendBytes(message, encoded)
+	}
+	for _, sample := range samples {
+		value := staleNaN
+		if sample.value != nil {
+			value = *sample.value
+		}
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, 1, protowire.Fixed64Type)
+		encoded = protowire.AppendFixed64(encoded, math.Float64bits(value))
+		encoded = protowire.AppendTag(encoded, 2, protowire.VarintType)
+		encoded = protowire.AppendVarint(encoded, uint64(sample.time.UnixMilli()))
+		message = protowire.AppendTag(message, 2, protowire.BytesType)
+		message = protowire.AppendBytes(message, encoded)
+	}
+	return message
+}
+
+// sendRemoteWrite sends one request, retrying while the endpoint is unavailable or rate-limits it. Other errors are
+// the request's fault and would fail again.
+func sendRemoteWrite(client *http.Client, endpoint string, headers keyValues, request []byte) error {
+	body := snappy.Encode(nil, request)
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= remoteWriteAttempts; attempt++ {
+		var retry bool
+		if retry, err = postRemoteWrite(client, endpoint, headers, body); err == nil || !retry {
+			return err
+		}
+		if attempt < remoteWriteAttempts {
+			logrus.WithError(err).Warnf("remote-write request failed, retrying in %s", delay)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+func postRemoteWrite(client *http.Client, endpoint string, headers keyValues, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("User-Agent", "apiserver-watch-benchmarking")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	response, err := client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode/100 == 2 {
+		return false, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	err = fmt.Errorf("endpoint responded %s: %s", response.Status, strings.TrimSpace(string(message)))
+	return response.StatusCode/100 == 5 || response.StatusCode == http.StatusTooManyRequests, err
+}
+
+// validateRemoteWrite checks the endpoint is an HTTP URL and the labels can be sent, without overriding those every
+// series is named and told apart by.
+func validateRemoteWrite(endpoint string, labels keyValues) error {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("%q is not an HTTP URL", endpoint)
+	}
+	for name := range labels {
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("%q is not a valid label name", name)
+		}
+		switch name {
+		case "component", "pod", "container":
+			return fmt.Errorf("label %q is set on every series", name)
+		}
+	}
+	return nil
+}
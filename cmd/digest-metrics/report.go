@@ -0,0 +1,879 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const (
+	reportHTMLFile     = "report.html"
+	reportMarkdownFile = "report.md"
+)
+
+type report struct {
+	Experiment string
+	// Alarms are warnings about the run which must be read before any of its figures.
+	Alarms []string
+	// Notes are what people recorded about the run, which the benchmark could not observe.
+	Notes        []string
+	WatchCost    []watchCostRow
+	Phases       []phaseRow
+	Requests     []requestRow
+	GoRuntime    []goRuntimeRow
+	CPUProfiles  []profileRow
+	EtcdDatabase []etcdDatabaseRow
+	EtcdKeyspace []etcdKeyspacePrefix
+	Heatmaps     []heatmap
+	Charts       []lineChart
+	Timeline     []timelineRow
+}
+
+// requestRow is one line of the server-side request latency table, formatted for display.
+type requestRow struct {
+	Phase, Verb             string
+	Rate, P50, P99, P99Size string
+}
+
+// goRuntimeRow is one line of the API server Go runtime table, formatted for display.
+type goRuntimeRow struct {
+	Phase                           string
+	AllocationRate, GCRate, GCPause string
+	HeapGrowth, HeapInUse           string
+}
+
+// profileRow is one of the functions most CPU time was spent in on a replica, formatted for display.
+type profileRow struct {
+	Window, Node, Function string
+	Flat, Cumulative       string
+}
+
+// etcdDatabaseRow is one line of the etcd database size table, formatted for display.
+type etcdDatabaseRow struct {
+	Phase                             string
+	Growth, InUseGrowth, Total, InUse string
+}
+
+// timelineRow is one entry of the timeline, with its time formatted as an offset into the run.
+type timelineRow struct {
+	Offset, Duration  string
+	Kind, Description string
+}
+
+// watchCostRow is one line of the table of the cost of watches, formatted for display.
+type watchCostRow struct {
+	Identifier  string
+	CPU, Memory string
+	Samples     int
+}
+
+// phaseRow is one line of the resource usage table, formatted for display.
+type phaseRow struct {
+	Phase, Identifier     string
+	CPUCores, P99CPUCores string
+	Memory, P99Memory     string
+	NetworkIn, NetworkOut string
+}
+
+// digestReport renders the human-readable reports for the run.
+func digestReport(dataDir string, trimmed trim, metrics *metricSamples) error {
+	var manifest artifacts.Manifest
+	if err := artifacts.Load(dataDir, artifacts.ManifestFile, &manifest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var latencies artifacts.Latencies
+	if err := artifacts.Load(dataDir, artifacts.LatenciesFile, &latencies); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	annotations, err := loadTimeline(dataDir)
+	if err != nil {
+		return err
+	}
+
+	content := report{Experiment: manifest.Experiment, Notes: manifest.Notes}
+	for _, annotation := range annotations {
+		row := timelineRow{
+			Offset:      fmt.Sprintf("%.0fs", annotation.Time.Sub(manifest.Start).Seconds()),
+			Kind:        annotation.Kind,
+			Description: annotation.Description,
+		}
+		if annotation.End != nil {
+			row.Duration = fmt.Sprintf("%.0fs", annotation.End.Sub(annotation.Time).Seconds())
+		}
+		content.Timeline = append(content.Timeline, row)
+	}
+	requests, err := loadRequestLatency(dataDir)
+	if err != nil {
+		return err
+	}
+	if requests != nil {
+		for _, verb := range requests.Verbs {
+			content.Requests = append(content.Requests, requestRow{
+				Phase:   verb.Phase,
+				Verb:    verb.Verb,
+				Rate:    fmt.Sprintf("%.1f/s", verb.Rate),
+				P50:     formatSeconds(verb.Latency.P50),
+				P99:     formatSeconds(verb.Latency.P99),
+				P99Size: formatSize(verb.Size.P99),
+			})
+		}
+	}
+	runtime, err := loadGoRuntime(dataDir)
+	if err != nil {
+		return err
+	}
+	if runtime != nil {
+		for _, phase := range runtime.Phases {
+			content.GoRuntime = append(content.GoRuntime, goRuntimeRow{
+				Phase:          phase.Phase,
+				AllocationRate: formatByteRate(phase.AllocationRate),
+				GCRate:         fmt.Sprintf("%.2f/s", phase.GCRate),
+				GCPause:        fmt.Sprintf("%.2f%%", phase.GCPauseFraction*100),
+				HeapGrowth:     formatSignedBytes(phase.HeapGrowth),
+				HeapInUse:      formatBytes(phase.HeapInUse),
+			})
+		}
+	}
+	if content.CPUProfiles, err = loadCPUProfiles(dataDir, phases); err != nil {
+		return err
+	}
+	database, err := loadEtcdDatabase(dataDir)
+	if err != nil {
+		return err
+	}
+	if database != nil {
+		for _, phase := range database.Phases {
+			content.EtcdDatabase = append(content.EtcdDatabase, etcdDatabaseRow{
+				Phase:       phase.Phase,
+				Growth:      formatSignedBytes(phase.Growth),
+				InUseGrowth: formatSignedBytes(phase.InUseGrowth),
+				Total:       formatBytes(phase.Total),
+				InUse:       formatBytes(phase.InUse),
+			})
+		}
+	}
+	if content.EtcdKeyspace, err = loadEtcdKeyspaceGrowth(dataDir); err != nil {
+		return err
+	}
+	for _, alarmFor := range []func(string) (string, error){backlogAlarm, flowControlAlarm, serverWatchesAlarm, clientUsageAlarm, podHealthAlarm, offeredLoadAlarm, conntrackAlarm} {
+		alarm, err := alarmFor(dataDir)
+		if err != nil {
+			return err
+		}
+		if alarm != "" {
+			content.Alarms = append(content.Alarms, alarm)
+		}
+	}
+	if content.WatchCost, err = loadWatchCost(dataDir); err != nil {
+		return err
+	}
+	steady := trimmed.apply(phases)
+	usages, err := usageByPhase(metrics, steady)
+	if err != nil {
+		return err
+	}
+	for _, phase := range steady {
+		for _, identifier := range metrics.identifiers() {
+			used := usages[phase.Name][identifier]
+			content.Phases = append(content.Phases, phaseRow{
+				Phase:       phase.Name,
+				Identifier:  identifier,
+				CPUCores:    fmt.Sprintf("%.2f", used.CPUCores),
+				P99CPUCores: fmt.Sprintf("%.2f", used.P99CPUCores),
+				Memory:      formatBytes(used.MemoryBytes),
+				P99Memory:   formatBytes(used.P99MemoryBytes),
+				NetworkIn:   formatByteRate(used.NetworkReceiveBytes),
+				NetworkOut:  formatByteRate(used.NetworkTransmitBytes),
+			})
+		}
+	}
+
+	var kinds []string
+	for kind := range latencies {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		if len(latencies[kind].Seconds) == 0 {
+			continue
+		}
+		content.Heatmaps = append(content.Heatmaps, heatmapFor(kind, latencies[kind], annotations))
+	}
+
+	charts, err := usageCharts(dataDir, metrics)
+	if err != nil {
+		return err
+	}
+	for _, chartFor := range []func(string) (*lineChart, error){watchCountChart, storageObjectsChart} {
+		chart, err := chartFor(dataDir)
+		if err != nil {
+			return err
+		}
+		if chart != nil {
+			charts = append(charts, chart)
+		}
+	}
+	for _, chart := range charts {
+		chart.mark(annotations)
+		content.Charts = append(content.Charts, *chart)
+	}
+
+	if err := render(filepath.Join(dataDir, reportHTMLFile), reportTemplate, content); err != nil {
+		return err
+	}
+	return render(filepath.Join(dataDir, reportMarkdownFile), markdownReportTemplate, content)
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+func render(path string, template executor, content report) error {
+	output, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", filepath.Base(path), err)
+	}
+	defer func() {
+		_ = output.Close()
+	}()
+	if err := template.Execute(output, content); err != nil {
+		return fmt.Errorf("could not render %s: %w", filepath.Base(path), err)
+	}
+	return output.Close()
+}
+
+const (
+	heatmapColumns  = 60
+	heatmapRows     = 30
+	heatmapCellSize = 12
+)
+
+// heatmap bins latency observations by the time they were made and by the logarithm of the latency, so that
+// multimodal distributions and periodic spikes stand out where a percentile line would average them away.
+type heatmap struct {
+	Title  string
+	Width  int
+	Height int
+	Cell   int
+	Cells  []heatmapCell
+	XTicks []heatmapTick
+	YTicks []heatmapTick
+	// Markers overlay the timeline of the run, so that changes in latency can be attributed to what caused them.
+	Markers []heatmapMarker
+}
+
+type heatmapCell struct {
+	X, Y    int
+	Opacity float64
+	Count   int
+}
+
+type heatmapTick struct {
+	Position int
+	Label    string
+}
+
+type heatmapMarker struct {
+	X           int
+	Color       string
+	Description string
+}
+
+// markerColors distinguishes the kinds of annotation; phases, which partition the whole run, are drawn faintest.
+var markerColors = map[string]string{
+	artifacts.AnnotationPhase:   "#969696",
+	artifacts.AnnotationRestart: "#6a51a3",
+	artifacts.AnnotationChaos:   "#d94801",
+	artifacts.AnnotationErrors:  "#cb181d",
+	artifacts.AnnotationRate:    "#238b45",
+	artifacts.AnnotationLeader:  "#2171b5",
+	artifacts.AnnotationGap:     "#525252",
+	artifacts.AnnotationBudget:  "#8c6d31",
+	artifacts.AnnotationHealth:  "#a50f15",
+}
+
+// markersFor places the annotations which fall within the span of seconds from the start across the width.
+func markersFor(annotations []artifacts.Annotation, start time.Time, span float64, width int) []heatmapMarker {
+	var markers []heatmapMarker
+	for _, annotation := range annotations {
+		offset := annotation.Time.Sub(start).Seconds()
+		if offset < 0 || offset > span {
+			continue
+		}
+		color, known := markerColors[annotation.Kind]
+		if !known {
+			color = "#000000"
+		}
+		markers = append(markers, heatmapMarker{
+			X:           int(offset / span * float64(width)),
+			Color:       color,
+			Description: annotation.Kind + ": " + annotation.Description,
+		})
+	}
+	return markers
+}
+
+func heatmapFor(kind string, series artifacts.LatencySeries, annotations []artifacts.Annotation) heatmap {
+	maxOffset := 0.0
+	minLatency, maxLatency := math.Inf(1), math.Inf(-1)
+	for i, offset := range series.Offsets {
+		maxOffset = math.Max(maxOffset, offset)
+		if latency := series.Seconds[i]; latency > 0 {
+			minLatency = math.Min(minLatency, latency)
+			maxLatency = math.Max(maxLatency, latency)
+		}
+	}
+	if math.IsInf(minLatency, 1) {
+		minLatency, maxLatency = 1e-3, 1
+	}
+	// round the range out to quarter decades, so that a constant latency still spans a visible band
+	low, high := math.Floor(math.Log10(minLatency)*4)/4, math.Ceil(math.Log10(maxLatency)*4)/4
+	if high <= low {
+		high = low + 0.25
+	}
+	if maxOffset == 0 {
+		maxOffset = 1
+	}
+
+	counts := make([][]int, heatmapColumns)
+	for i := range counts {
+		counts[i] = make([]int, heatmapRows)
+	}
+	peak := 0
+	for i, offset := range series.Offsets {
+		latency := series.Seconds[i]
+		if latency <= 0 {
+			latency = minLatency
+		}
+		column := clampBin(int(offset/maxOffset*heatmapColumns), heatmapColumns)
+		row := clampBin(int((math.Log10(latency)-low)/(high-low)*heatmapRows), heatmapRows)
+		counts[column][row]++
+		if counts[column][row] > peak {
+			peak = counts[column][row]
+		}
+	}
+
+	result := heatmap{
+		Title:  fmt.Sprintf("Watch %s latency, %d observations", kind, len(series.Seconds)),
+		Width:  heatmapColumns * heatmapCellSize,
+		Height: heatmapRows * heatmapCellSize,
+		Cell:   heatmapCellSize,
+	}
+	for column := range counts {
+		for row, count := range counts[column] {
+			if count == 0 {
+				continue
+			}
+			result.Cells = append(result.Cells, heatmapCell{
+				X: column * heatmapCellSize,
+				// latency increases upwards
+				Y:       (heatmapRows - 1 - row) * heatmapCellSize,
+				Opacity: 0.1 + 0.9*math.Log1p(float64(count))/math.Log1p(float64(peak)),
+				Count:   count,
+			})
+		}
+	}
+	result.Markers = markersFor(annotations, series.Start, maxOffset, result.Width)
+	for i := 0; i <= 4; i++ {
+		result.XTicks = append(result.XTicks, heatmapTick{
+			Position: i * result.Width / 4,
+			Label:    fmt.Sprintf("%.0fs", maxOffset*float64(i)/4),
+		})
+		result.YTicks = append(result.YTicks, heatmapTick{
+			Position: result.Height - i*result.Height/4,
+			Label:    formatSeconds(math.Pow(10, low+(high-low)*float64(i)/4)),
+		})
+	}
+	return result
+}
+
+const (
+	lineChartWidth  = heatmapColumns * heatmapCellSize
+	lineChartHeight = heatmapRows * heatmapCellSize / 2
+)
+
+// chartPalette colors series which have no color of their own.
+var chartPalette = []string{"#08519c", "#d94801", "#238b45", "#6a51a3", "#cb181d"}
+
+// lineChart plots series sampled at the same offsets into the run, in seconds, on a shared linear scale. Missing
+// values, which are NaN, break the series.
+type lineChart struct {
+	Title  string
+	Width  int
+	Height int
+	Series []lineSeries
+	XTicks []heatmapTick
+	YTicks []heatmapTick
+	// Overlay is drawn on a scale of its own, with ticks on the right, to show what the series responded to.
+	Overlay      *lineSeries
+	OverlayTicks []heatmapTick
+	Markers      []heatmapMarker
+
+	// Span is the seconds into the run the chart spans.
+	Span float64
+
+	start time.Time
+}
+
+type lineSeries struct {
+	Name, Color string
+	// Path draws the series, as SVG expects it.
+	Path string
+	// Offsets and Values list the samples of the series, the values formatted, for the readout under the cursor.
+	Offsets, Values string
+}
+
+func newLineChart(title string, start time.Time, offsets []float64, series map[string][]float64, colors map[string]string, format func(float64) string) *lineChart {
+	maxValue := maxOf(series)
+	chart := &lineChart{Title: title, Width: lineChartWidth, Height: lineChartHeight, start: start, Span: offsets[len(offsets)-1]}
+	if chart.Span <= 0 {
+		chart.Span = 1
+	}
+	var names []string
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		chart.Series = append(chart.Series, chart.lineSeries(name, colors[name], offsets, series[name], maxValue, format))
+	}
+	for i := 0; i <= 4; i++ {
+		chart.XTicks = append(chart.XTicks, heatmapTick{
+			Position: i * chart.Width / 4,
+			Label:    fmt.Sprintf("%.0fs", chart.Span*float64(i)/4),
+		})
+		chart.YTicks = append(chart.YTicks, heatmapTick{
+			Position: chart.Height - i*chart.Height/4,
+			Label:    format(maxValue * float64(i) / 4),
+		})
+	}
+	return chart
+}
+
+// maxOf determines the largest of the values, or one when there is none, so that the scale is never empty.
+func maxOf(series map[string][]float64) float64 {
+	maxValue := 0.0
+	for _, values := range series {
+		for _, value := range values {
+			if !math.IsNaN(value) {
+				maxValue = math.Max(maxValue, value)
+			}
+		}
+	}
+	if maxValue <= 0 {
+		maxValue = 1
+	}
+	return maxValue
+}
+
+func (c *lineChart) lineSeries(name, color string, offsets, values []float64, maxValue float64, format func(float64) string) lineSeries {
+	var path, at, formatted []string
+	drawing := false
+	for i, value := range values {
+		if offsets[i] < 0 || offsets[i] > c.Span {
+			continue
+		}
+		at = append(at, fmt.Sprintf("%.1f", offsets[i]))
+		if math.IsNaN(value) {
+			formatted = append(formatted, "-")
+			drawing = false
+			continue
+		}
+		formatted = append(formatted, format(value))
+		command := "L"
+		if !drawing {
+			command = "M"
+		}
+		drawing = true
+		x := offsets[i] / c.Span * float64(c.Width)
+		y := float64(c.Height) - value/maxValue*float64(c.Height)
+		path = append(path, fmt.Sprintf("%s%.1f,%.1f", command, x, y))
+	}
+	return lineSeries{Name: name, Color: color, Path: strings.Join(path, " "), Offsets: strings.Join(at, ","), Values: strings.Join(formatted, "|")}
+}
+
+// overlay draws the series sampled at the times over the chart, on its own scale.
+func (c *lineChart) overlay(name, color string, times []time.Time, values []float64, format func(float64) string) {
+	offsets := make([]float64, len(times))
+	for i, at := range times {
+		offsets[i] = at.Sub(c.start).Seconds()
+	}
+	maxValue := maxOf(map[string][]float64{name: values})
+	series := c.lineSeries(name, color, offsets, values, maxValue, format)
+	c.Overlay = &series
+	c.OverlayTicks = nil
+	for i := 0; i <= 4; i++ {
+		c.OverlayTicks = append(c.OverlayTicks, heatmapTick{
+			Position: c.Height - i*c.Height/4,
+			Label:    format(maxValue * float64(i) / 4),
+		})
+	}
+}
+
+// mark overlays the timeline of the run on the chart.
+func (c *lineChart) mark(annotations []artifacts.Annotation) {
+	c.Markers = markersFor(annotations, c.start, c.Span, c.Width)
+}
+
+func clampBin(bin, bins int) int {
+	if bin < 0 {
+		return 0
+	}
+	if bin >= bins {
+		return bins - 1
+	}
+	return bin
+}
+
+func formatSeconds(seconds float64) string {
+	switch {
+	case seconds >= 1:
+		return fmt.Sprintf("%.1fs", seconds)
+	case seconds >= 1e-3:
+		return fmt.Sprintf("%.1fms", seconds*1e3)
+	default:
+		return fmt.Sprintf("%.0fµs", seconds*1e6)
+	}
+}
+
+func formatCount(count float64) string {
+	return fmt.Sprintf("%.0f", count)
+}
+
+func formatBytes(bytes float64) string {
+	const mebibyte = 1024 * 1024
+	if bytes >= 1024*mebibyte {
+		return fmt.Sprintf("%.2fGiB", bytes/(1024*mebibyte))
+	}
+	return fmt.Sprintf("%.0fMiB", bytes/mebibyte)
+}
+
+// formatByteRate formats a rate of bytes per second, in finer units than formatBytes as traffic is often small.
+func formatByteRate(bytes float64) string {
+	if bytes >= 1024*1024 {
+		return fmt.Sprintf("%.1fMiB/s", bytes/(1024*1024))
+	}
+	return fmt.Sprintf("%.1fKiB/s", bytes/1024)
+}
+
+// formatSize formats the size of a single response, in finer units than formatBytes as most responses are small.
+func formatSize(bytes float64) string {
+	switch {
+	case bytes >= 1024*1024:
+		return fmt.Sprintf("%.1fMiB", bytes/(1024*1024))
+	case bytes >= 1024:
+		return fmt.Sprintf("%.1fKiB", bytes/1024)
+	default:
+		return fmt.Sprintf("%.0fB", bytes)
+	}
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ if .Experiment }}{{ .Experiment }} {{ end }}benchmark report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+svg text { font-size: 11px; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; }
+td.number { text-align: right; font-variant-numeric: tabular-nums; }
+.alarm { padding: 0.5em 1em; border-left: 4px solid #cb181d; background: #fee0d2; }
+figure.chart { margin: 0; }
+.readout { margin-left: 4em; font-size: 0.9em; min-height: 1.2em; }
+.legend { list-style: none; padding-left: 4em; }
+.legend li { cursor: pointer; }
+.legend li.hidden { opacity: 0.4; }
+</style>
+</head>
+<body>
+<h1>{{ if .Experiment }}{{ .Experiment }} {{ end }}benchmark report</h1>
+{{- range .Alarms }}
+<p class="alarm">{{ . }}</p>
+{{- end }}
+{{- if .Notes }}
+<h2>Notes</h2>
+<ul>
+{{- range .Notes }}
+<li>{{ . }}</li>
+{{- end }}
+</ul>
+{{- end }}
+{{- if .WatchCost }}
+<h2>Cost per 1000 watches</h2>
+<table>
+<tr><th>Component</th><th>CPU (cores)</th><th>Memory</th><th>Samples</th></tr>
+{{- range .WatchCost }}
+<tr><td>{{ .Identifier }}</td><td class="number">{{ .CPU }}</td><td class="number">{{ .Memory }}</td><td class="number">{{ .Samples }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .Phases }}
+<h2>Resource usage by phase</h2>
+<table>
+<tr><th>Phase</th><th>Component</th><th>Mean CPU (cores)</th><th>P99 CPU (cores)</th><th>Mean memory</th><th>P99 memory</th><th>Network in</th><th>Network out</th></tr>
+{{- range .Phases }}
+<tr><td>{{ .Phase }}</td><td>{{ .Identifier }}</td><td class="number">{{ .CPUCores }}</td><td class="number">{{ .P99CPUCores }}</td><td class="number">{{ .Memory }}</td><td class="number">{{ .P99Memory }}</td><td class="number">{{ .NetworkIn }}</td><td class="number">{{ .NetworkOut }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .Requests }}
+<h2>Server-side request latency</h2>
+<table>
+<tr><th>Phase</th><th>Verb</th><th>Rate</th><th>P50 latency</th><th>P99 latency</th><th>P99 response size</th></tr>
+{{- range .Requests }}
+<tr><td>{{ .Phase }}</td><td>{{ .Verb }}</td><td class="number">{{ .Rate }}</td><td class="number">{{ .P50 }}</td><td class="number">{{ .P99 }}</td><td class="number">{{ .P99Size }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .GoRuntime }}
+<h2>API server Go runtime</h2>
+<table>
+<tr><th>Phase</th><th>Allocation rate</th><th>Collections</th><th>Time paused</th><th>Heap growth</th><th>Heap at end</th></tr>
+{{- range .GoRuntime }}
+<tr><td>{{ .Phase }}</td><td class="number">{{ .AllocationRate }}</td><td class="number">{{ .GCRate }}</td><td class="number">{{ .GCPause }}</td><td class="number">{{ .HeapGrowth }}</td><td class="number">{{ .HeapInUse }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .CPUProfiles }}
+<h2>API server CPU profiles</h2>
+<table>
+<tr><th>Window</th><th>Node</th><th>Function</th><th>Flat</th><th>Cumulative</th></tr>
+{{- range .CPUProfiles }}
+<tr><td>{{ .Window }}</td><td>{{ .Node }}</td><td>{{ .Function }}</td><td class="number">{{ .Flat }}</td><td class="number">{{ .Cumulative }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .EtcdDatabase }}
+<h2>etcd database size</h2>
+<table>
+<tr><th>Phase</th><th>Growth</th><th>Growth in use</th><th>Size at end</th><th>In use at end</th></tr>
+{{- range .EtcdDatabase }}
+<tr><td>{{ .Phase }}</td><td class="number">{{ .Growth }}</td><td class="number">{{ .InUseGrowth }}</td><td class="number">{{ .Total }}</td><td class="number">{{ .InUse }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{- if .EtcdKeyspace }}
+<h2>etcd keys</h2>
+<table>
+<tr><th>Prefix</th><th>Before</th><th>After</th><th>Growth</th></tr>
+{{- range .EtcdKeyspace }}
+<tr><td>{{ .Prefix }}</td><td class="number">{{ .Before }}</td><td class="number">{{ .After }}</td><td class="number">{{ printf "%+d" .Growth }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+{{ range .Heatmaps }}
+<h2>{{ .Title }}</h2>
+<svg width="{{ .Width }}" height="{{ .Height }}" style="overflow: visible; margin: 0 0 2em 4em">
+<rect x="0" y="0" width="{{ .Width }}" height="{{ .Height }}" fill="#f7f7f7"/>
+{{- $cell := .Cell }}
+{{- range .Cells }}
+<rect x="{{ .X }}" y="{{ .Y }}" width="{{ $cell }}" height="{{ $cell }}" fill="#08519c" fill-opacity="{{ printf "%.2f" .Opacity }}"><title>{{ .Count }}</title></rect>
+{{- end }}
+{{- $height := .Height }}
+{{- range .Markers }}
+<line x1="{{ .X }}" y1="0" x2="{{ .X }}" y2="{{ $height }}" stroke="{{ .Color }}" stroke-width="2"><title>{{ .Description }}</title></line>
+{{- end }}
+{{- range .XTicks }}
+<text x="{{ .Position }}" y="{{ $height }}" dy="16" text-anchor="middle">{{ .Label }}</text>
+{{- end }}
+{{- range .YTicks }}
+<text x="-6" y="{{ .Position }}" dy="4" text-anchor="end">{{ .Label }}</text>
+{{- end }}
+</svg>
+{{ end }}
+{{- range .Charts }}
+<h2>{{ .Title }}</h2>
+<figure class="chart">
+<svg width="{{ .Width }}" height="{{ .Height }}" style="overflow: visible; margin: 0 4em 2em 4em">
+<rect x="0" y="0" width="{{ .Width }}" height="{{ .Height }}" fill="#f7f7f7"/>
+{{- $height := .Height }}
+{{- $width := .Width }}
+{{- range .Markers }}
+<line x1="{{ .X }}" y1="0" x2="{{ .X }}" y2="{{ $height }}" stroke="{{ .Color }}" stroke-width="1"><title>{{ .Description }}</title></line>
+{{- end }}
+{{- with .Overlay }}
+<path class="series" d="{{ .Path }}" fill="none" stroke="{{ .Color }}" stroke-width="2" stroke-dasharray="4 3" data-name="{{ .Name }}" data-offsets="{{ .Offsets }}" data-values="{{ .Values }}"><title>{{ .Name }}</title></path>
+{{- end }}
+{{- range .Series }}
+<path class="series" d="{{ .Path }}" fill="none" stroke="{{ .Color }}" stroke-width="2" data-name="{{ .Name }}" data-offsets="{{ .Offsets }}" data-values="{{ .Values }}"><title>{{ .Name }}</title></path>
+{{- end }}
+{{- range .XTicks }}
+<text x="{{ .Position }}" y="{{ $height }}" dy="16" text-anchor="middle">{{ .Label }}</text>
+{{- end }}
+{{- range .YTicks }}
+<text x="-6" y="{{ .Position }}" dy="4" text-anchor="end">{{ .Label }}</text>
+{{- end }}
+{{- range .OverlayTicks }}
+<text x="{{ $width }}" y="{{ .Position }}" dx="6" dy="4" fill="#969696">{{ .Label }}</text>
+{{- end }}
+<line class="cursor" x1="0" y1="0" x2="0" y2="{{ $height }}" stroke="#000000" stroke-width="1" visibility="hidden"/>
+<rect class="hover" x="0" y="0" width="{{ .Width }}" height="{{ .Height }}" fill="transparent" data-span="{{ printf "%.1f" .Span }}"/>
+</svg>
+<figcaption class="readout">&nbsp;</figcaption>
+<ul class="legend">
+{{- range .Series }}
+<li data-name="{{ .Name }}"><svg width="12" height="12"><rect width="12" height="12" fill="{{ .Color }}"/></svg> {{ .Name }}</li>
+{{- end }}
+{{- with .Overlay }}
+<li data-name="{{ .Name }}"><svg width="12" height="12"><rect width="12" height="12" fill="{{ .Color }}"/></svg> {{ .Name }}, on the right</li>
+{{- end }}
+</ul>
+</figure>
+{{- end }}
+{{- if .Timeline }}
+<h2>Timeline</h2>
+<table>
+<tr><th>Offset</th><th>Duration</th><th>Kind</th><th>Description</th></tr>
+{{- range .Timeline }}
+<tr><td class="number">{{ .Offset }}</td><td class="number">{{ .Duration }}</td><td>{{ .Kind }}</td><td>{{ .Description }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+<script>
+// the charts read out every series under the cursor, and hide a series when its legend entry is clicked
+document.querySelectorAll("figure.chart").forEach(function (figure) {
+  var hover = figure.querySelector("rect.hover"), cursor = figure.querySelector("line.cursor");
+  var readout = figure.querySelector(".readout"), span = parseFloat(hover.dataset.span);
+  var series = Array.prototype.slice.call(figure.querySelectorAll("path.series"));
+  hover.addEventListener("mousemove", function (event) {
+    var box = hover.getBoundingClientRect(), x = event.clientX - box.left;
+    var offset = x / box.width * span, parts = [offset.toFixed(0) + "s"];
+    series.forEach(function (path) {
+      if (path.style.display === "none" || !path.dataset.offsets) {
+        return;
+      }
+      var offsets = path.dataset.offsets.split(",").map(parseFloat), values = path.dataset.values.split("|");
+      var nearest = 0;
+      offsets.forEach(function (at, i) {
+        if (Math.abs(at - offset) < Math.abs(offsets[nearest] - offset)) {
+          nearest = i;
+        }
+      });
+      parts.push(path.dataset.name + ": " + values[nearest]);
+    });
+    cursor.setAttribute("x1", x);
+    cursor.setAttribute("x2", x);
+    cursor.setAttribute("visibility", "visible");
+    readout.textContent = parts.join(", ");
+  });
+  hover.addEventListener("mouseleave", function () {
+    cursor.setAttribute("visibility", "hidden");
+  });
+  figure.querySelectorAll(".legend li").forEach(function (entry) {
+    entry.addEventListener("click", function () {
+      var hidden = entry.classList.toggle("hidden");
+      series.forEach(function (path) {
+        if (path.dataset.name === entry.dataset.name) {
+          path.style.display = hidden ? "none" : "";
+        }
+      });
+    });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+var markdownReportTemplate = texttemplate.Must(texttemplate.New("report").Parse(`# {{ if .Experiment }}{{ .Experiment }} {{ end }}benchmark report
+{{ range .Alarms }}
+> **Alarm:** {{ . }}
+{{ end }}
+{{- if .Notes }}
+## Notes
+{{ range .Notes }}
+- {{ . }}
+{{- end }}
+{{ end }}
+{{- if .WatchCost }}
+## Cost per 1000 watches
+
+With 95% confidence intervals, allowing for the correlation between consecutive samples.
+
+| Component | CPU (cores) | Memory | Samples |
+|-----------|------------:|-------:|--------:|
+{{- range .WatchCost }}
+| {{ .Identifier }} | {{ .CPU }} | {{ .Memory }} | {{ .Samples }} |
+{{- end }}
+{{ end }}
+{{- if .Phases }}
+## Resource usage by phase
+
+| Phase | Component | Mean CPU (cores) | P99 CPU (cores) | Mean memory | P99 memory | Network in | Network out |
+|-------|-----------|-----------------:|----------------:|------------:|-----------:|-----------:|------------:|
+{{- range .Phases }}
+| {{ .Phase }} | {{ .Identifier }} | {{ .CPUCores }} | {{ .P99CPUCores }} | {{ .Memory }} | {{ .P99Memory }} | {{ .NetworkIn }} | {{ .NetworkOut }} |
+{{- end }}
+{{ end }}
+{{- if .Requests }}
+## Server-side request latency
+
+| Phase | Verb | Rate | P50 latency | P99 latency | P99 response size |
+|-------|------|-----:|------------:|------------:|------------------:|
+{{- range .Requests }}
+| {{ .Phase }} | {{ .Verb }} | {{ .Rate }} | {{ .P50 }} | {{ .P99 }} | {{ .P99Size }} |
+{{- end }}
+{{ end }}
+{{- if .GoRuntime }}
+## API server Go runtime
+
+| Phase | Allocation rate | Collections | Time paused | Heap growth | Heap at end |
+|-------|----------------:|------------:|------------:|------------:|------------:|
+{{- range .GoRuntime }}
+| {{ .Phase }} | {{ .AllocationRate }} | {{ .GCRate }} | {{ .GCPause }} | {{ .HeapGrowth }} | {{ .HeapInUse }} |
+{{- end }}
+{{ end }}
+{{- if .CPUProfiles }}
+## API server CPU profiles
+
+The functions most CPU time was spent in, from the merged profiles in merged-profiles.
+
+| Window | Node | Function | Flat | Cumulative |
+|--------|------|----------|-----:|-----------:|
+{{- range .CPUProfiles }}
+| {{ .Window }} | {{ .Node }} | {{ .Function }} | {{ .Flat }} | {{ .Cumulative }} |
+{{- end }}
+{{ end }}
+{{- if .EtcdDatabase }}
+## etcd database size
+
+| Phase | Growth | Growth in use | Size at end | In use at end |
+|-------|-------:|--------------:|------------:|--------------:|
+{{- range .EtcdDatabase }}
+| {{ .Phase }} | {{ .Growth }} | {{ .InUseGrowth }} | {{ .Total }} | {{ .InUse }} |
+{{- end }}
+{{ end }}
+{{- if .EtcdKeyspace }}
+## etcd keys
+
+| Prefix | Before | After | Growth |
+|--------|-------:|------:|-------:|
+{{- range .EtcdKeyspace }}
+| {{ .Prefix }} | {{ .Before }} | {{ .After }} | {{ printf "%+d" .Growth }} |
+{{- end }}
+{{ end }}
+{{- if .Timeline }}
+## Timeline
+
+| Offset | Duration | Kind | Description |
+|-------:|---------:|------|-------------|
+{{- range .Timeline }}
+| {{ .Offset }} | {{ .Duration }} | {{ .Kind }} | {{ .Description }} |
+{{- end }}
+{{ end }}`))
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const requestLatencyFile = "request-latency.json"
+
+// longRunningVerbs are observed for as long as they are served, which says nothing about how fast the servers are,
+// so they are left out of the latencies.
+var longRunningVerbs = map[string]bool{"WATCH": true, "WATCHLIST": true, "CONNECT": true}
+
+// requestQuantiles summarize a histogram of observations, estimated from its buckets.
+type requestQuantiles struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+}
+
+func quantilesOf(buckets bucketCounts) requestQuantiles {
+	if buckets.count == 0 {
+		return requestQuantiles{}
+	}
+	return requestQuantiles{
+		Mean: buckets.sum / buckets.count,
+		P50:  buckets.quantile(0.5),
+		P90:  buckets.quantile(0.9),
+		P99:  buckets.quantile(0.99),
+	}
+}
+
+// requestLatencyPhase summarizes the requests the API servers served over a phase, across replicas, as the servers
+// measured them. Latencies are in seconds and sizes in bytes; summaries of a verb across resources leave Resource
+// empty.
+type requestLatencyPhase struct {
+	Phase    string  `json:"phase"`
+	Verb     string  `json:"verb"`
+	Resource string  `json:"resource,omitempty"`
+	Count    float64 `json:"count"`
+	// Rate is in requests per second.
+	Rate    float64          `json:"rate"`
+	Latency requestQuantiles `json:"latency"`
+	Size    requestQuantiles `json:"size"`
+}
+
+// requestLatencySeries holds the latency of the requests for a verb one replica served between consecutive
+// snapshots, with the time of the later one.
+type requestLatencySeries struct {
+	Node  string      `json:"node"`
+	Verb  string      `json:"verb"`
+	Times []time.Time `json:"times"`
+	Rates []float64   `json:"rates"`
+	P50   []float64   `json:"p50"`
+	P99   []float64   `json:"p99"`
+}
+
+type requestLatency struct {
+	Series []requestLatencySeries `json:"series"`
+	Verbs  []requestLatencyPhase  `json:"verbs,omitempty"`
+	Phases []requestLatencyPhase  `json:"phases,omitempty"`
+}
+
+// requestKey identifies the requests histograms are added up for.
+type requestKey struct {
+	verb, resource string
+}
+
+// requestHistograms adds up the histograms in the family by verb and resource, leaving out long-running requests.
+func requestHistograms(snapshot metricsSnapshot, name string) map[requestKey]bucketCounts {
+	sums := map[requestKey]bucketCounts{}
+	family, exists := snapshot.families[name]
+	if !exists {
+		return sums
+	}
+	for _, sample := range family.Metric {
+		key := requestKey{verb: labelValue(sample, "verb"), resource: labelValue(sample, "resource")}
+		if sample.Histogram == nil || longRunningVerbs[key.verb] {
+			continue
+		}
+		sums[key] = bucketsOf(sample.Histogram).add(sums[key])
+	}
+	return sums
+}
+
+// digestRequestLatency derives the latency and response sizes of the requests the API servers served from the
+// histograms in their metrics snapshots, windowed between snapshots and over every phase, so that server-side
+// latency is known for every experiment without inferring it from what the clients saw.
+func digestRequestLatency(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.APIServerMetricsDir, "apiserver_request_duration_seconds", "apiserver_response_sizes")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var nodes []string
+	for node := range snapshots {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var result requestLatency
+	for _, node := range nodes {
+		byVerb := map[string]*requestLatencySeries{}
+		var previous map[requestKey]bucketCounts
+		for i, snapshot := range snapshots[node] {
+			current := requestHistograms(snapshot, "apiserver_request_duration_seconds")
+			if previous != nil {
+				elapsed := snapshot.time.Sub(snapshots[node][i-1].time).Seconds()
+				for verb, delta := range byVerbSince(previous, current) {
+					series, exists := byVerb[verb]
+					if !exists {
+						series = &requestLatencySeries{Node: node, Verb: verb}
+						byVerb[verb] = series
+					}
+					series.Times = append(series.Times, snapshot.time)
+					series.Rates = append(series.Rates, delta.count/elapsed)
+					series.P50 = append(series.P50, delta.quantile(0.5))
+					series.P99 = append(series.P99, delta.quantile(0.99))
+				}
+			}
+			previous = current
+		}
+		var verbs []string
+		for verb := range byVerb {
+			verbs = append(verbs, verb)
+		}
+		sort.Strings(verbs)
+		for _, verb := range verbs {
+			result.Series = append(result.Series, *byVerb[verb])
+		}
+	}
+
+	for _, phase := range phases {
+		latencies, sizes := map[requestKey]bucketCounts{}, map[requestKey]bucketCounts{}
+		var elapsed float64
+		for _, node := range nodes {
+			// histograms are measured from the last snapshot before the phase, when there is one
+			first, last := -1, -1
+			for i, snapshot := range snapshots[node] {
+				if snapshot.time.Before(phase.Start) {
+					first = i
+				}
+				if phase.Contains(snapshot.time) {
+					if first < 0 {
+						first = i
+					}
+					last = i
+				}
+			}
+			if last <= first || first < 0 {
+				continue
+			}
+			before, after := snapshots[node][first], snapshots[node][last]
+			// replicas are scraped at the same interval, so the longest window stands in for all of them
+			if span := after.time.Sub(before.time).Seconds(); span > elapsed {
+				elapsed = span
+			}
+			for name, sums := range map[string]map[requestKey]bucketCounts{"apiserver_request_duration_seconds": latencies, "apiserver_response_sizes": sizes} {
+				earlier := requestHistograms(before, name)
+				for key, later := range requestHistograms(after, name) {
+					sums[key] = later.since(earlier[key]).add(sums[key])
+				}
+			}
+		}
+		if elapsed == 0 {
+			continue
+		}
+		var keys []requestKey
+		for key, latency := range latencies {
+			if latency.count > 0 {
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].verb != keys[j].verb {
+				return keys[i].verb < keys[j].verb
+			}
+			return keys[i].resource < keys[j].resource
+		})
+		verbLatencies, verbSizes := map[string]bucketCounts{}, map[string]bucketCounts{}
+		var verbs []string
+		for _, key := range keys {
+			if _, seen := verbLatencies[key.verb]; !seen {
+				verbs = append(verbs, key.verb)
+			}
+			verbLatencies[key.verb] = latencies[key].add(verbLatencies[key.verb])
+			verbSizes[key.verb] = sizes[key].add(verbSizes[key.verb])
+			result.Phases = append(result.Phases, requestLatencyPhaseOf(phase.Name, key.verb, key.resource, latencies[key], sizes[key], elapsed))
+		}
+		for _, verb := range verbs {
+			result.Verbs = append(result.Verbs, requestLatencyPhaseOf(phase.Name, verb, "", verbLatencies[verb], verbSizes[verb], elapsed))
+		}
+	}
+	return artifacts.Write(dataDir, requestLatencyFile, result)
+}
+
+// byVerbSince adds up the observations made between two snapshots of a replica by verb.
+func byVerbSince(before, after map[requestKey]bucketCounts) map[string]bucketCounts {
+	deltas := map[string]bucketCounts{}
+	for key, later := range after {
+		deltas[key.verb] = later.since(before[key]).add(deltas[key.verb])
+	}
+	return deltas
+}
+
+func requestLatencyPhaseOf(phase, verb, resource string, latency, size bucketCounts, elapsed float64) requestLatencyPhase {
+	return requestLatencyPhase{
+		Phase:    phase,
+		Verb:     verb,
+		Resource: resource,
+		Count:    latency.count,
+		Rate:     latency.count / elapsed,
+		Latency:  quantilesOf(latency),
+		Size:     quantilesOf(size),
+	}
+}
+
+func loadRequestLatency(dataDir string) (*requestLatency, error) {
+	var result requestLatency
+	if err := artifacts.Load(dataDir, requestLatencyFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const requestRatesFile = "request-rates.json"
+
+// offeredLoadShortfall is the fraction of the intended rate of requests below which the API servers are taken not
+// to have been offered the load the experiment meant to offer.
+const offeredLoadShortfall = 0.9
+
+// requestRateSeries holds the rate at which one API server replica served requests for a verb and resource between
+// consecutive snapshots, in requests per second, with the time of the later one.
+type requestRateSeries struct {
+	Node     string      `json:"node"`
+	Verb     string      `json:"verb"`
+	Resource string      `json:"resource"`
+	Times    []time.Time `json:"times"`
+	Rates    []float64   `json:"rates"`
+}
+
+// requestRatePhase is the rate at which the API servers served requests for a verb and resource over a phase,
+// added up across replicas.
+type requestRatePhase struct {
+	Phase    string  `json:"phase"`
+	Verb     string  `json:"verb"`
+	Resource string  `json:"resource"`
+	Rate     float64 `json:"rate"`
+}
+
+// offeredLoad compares the rate at which the experiment meant to issue requests to the rate the API servers served
+// them at, over the time the experiment issued them.
+type offeredLoad struct {
+	Description string    `json:"description"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Intended    float64   `json:"intended"`
+	Served      float64   `json:"served"`
+}
+
+type requestRates struct {
+	Series  []requestRateSeries `json:"series"`
+	Phases  []requestRatePhase  `json:"phases,omitempty"`
+	Offered []offeredLoad       `json:"offered,omitempty"`
+}
+
+// requestCounts adds up the requests in the counter by verb and resource.
+func requestCounts(snapshot metricsSnapshot) map[requestKey]float64 {
+	counts := map[requestKey]float64{}
+	family, exists := snapshot.families["apiserver_request_total"]
+	if !exists {
+		return counts
+	}
+	for _, sample := range family.Metric {
+		counts[requestKey{verb: labelValue(sample, "verb"), resource: labelValue(sample, "resource")}] += sampleValue(sample)
+	}
+	return counts
+}
+
+// servedBetween determines the rate at which every replica served requests for every verb and resource between the
+// last snapshots at or before the times, added up across replicas.
+func servedBetween(snapshots map[string][]metricsSnapshot, start, end time.Time) map[requestKey]float64 {
+	rates := map[requestKey]float64{}
+	for _, series := range snapshots {
+		first, last := -1, -1
+		for i, snapshot := range series {
+			if !snapshot.time.After(start) {
+				first = i
+			}
+			if !snapshot.time.After(end) {
+				last = i
+			}
+		}
+		if first < 0 || last <= first {
+			continue
+		}
+		elapsed := series[last].time.Sub(series[first].time).Seconds()
+		before := requestCounts(series[first])
+		for key, count := range requestCounts(series[last]) {
+			rates[key] += increase(before[key], count) / elapsed
+		}
+	}
+	return rates
+}
+
+// digestRequestRates derives the rate at which the API servers served requests, by verb and resource, from the
+// counters in their metrics snapshots, and compares it to the load the experiment meant to offer, so that a run
+// which did not load the servers as intended is not mistaken for one which did.
+func digestRequestRates(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.APIServerMetricsDir, "apiserver_request_total")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var nodes []string
+	for node := range snapshots {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var result requestRates
+	for _, node := range nodes {
+		byKey := map[requestKey]*requestRateSeries{}
+		var previous map[requestKey]float64
+		for i, snapshot := range snapshots[node] {
+			current := requestCounts(snapshot)
+			if previous != nil {
+				elapsed := snapshot.time.Sub(snapshots[node][i-1].time).Seconds()
+				for key, count := range current {
+					series, exists := byKey[key]
+					if !exists {
+						series = &requestRateSeries{Node: node, Verb: key.verb, Resource: key.resource}
+						byKey[key] = series
+					}
+					series.Times = append(series.Times, snapshot.time)
+					series.Rates = append(series.Rates, increase(previous[key], count)/elapsed)
+				}
+			}
+			previous = current
+		}
+		var keys []requestKey
+		for key := range byKey {
+			keys = append(keys, key)
+		}
+		sortRequestKeys(keys)
+		for _, key := range keys {
+			result.Series = append(result.Series, *byKey[key])
+		}
+	}
+
+	for _, phase := range phases {
+		rates := servedBetween(snapshots, phase.Start, phase.End)
+		var keys []requestKey
+		for key, rate := range rates {
+			if rate > 0 {
+				keys = append(keys, key)
+			}
+		}
+		sortRequestKeys(keys)
+		for _, key := range keys {
+			result.Phases = append(result.Phases, requestRatePhase{Phase: phase.Name, Verb: key.verb, Resource: key.resource, Rate: rates[key]})
+		}
+	}
+
+	noise, err := offeredNoise(dataDir, snapshots)
+	if err != nil {
+		return err
+	}
+	if noise != nil {
+		result.Offered = append(result.Offered, *noise)
+	}
+	return artifacts.Write(dataDir, requestRatesFile, result)
+}
+
+func sortRequestKeys(keys []requestKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].verb != keys[j].verb {
+			return keys[i].verb < keys[j].verb
+		}
+		return keys[i].resource < keys[j].resource
+	})
+}
+
+// noiseVerbs map the verbs background requests are configured with to those the API servers count them under.
+var noiseVerbs = map[string]string{"get": "GET", "list": "LIST", "create": "POST", "update": "PUT", "delete": "DELETE"}
+
+// offeredNoise compares the rate of background requests the run was configured with to the rate at which the API
+// servers served requests of the verbs and resources they were issued for, while they were issued. Other clients
+// issue such requests too, so only a shortfall is telling.
+func offeredNoise(dataDir string, snapshots map[string][]metricsSnapshot) (*offeredLoad, error) {
+	var manifest artifacts.Manifest
+	if err := artifacts.Load(dataDir, artifacts.ManifestFile, &manifest); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rate, err := strconv.Atoi(manifest.Configuration["noise.rate"])
+	if err != nil || rate == 0 {
+		return nil, nil
+	}
+	var annotations []artifacts.Annotation
+	if err := artifacts.Load(dataDir, artifacts.TimelineFile, &annotations); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var start, end time.Time
+	for _, annotation := range annotations {
+		switch {
+		case annotation.Kind != artifacts.AnnotationRate:
+		case strings.HasPrefix(annotation.Description, "started background requests"):
+			start = annotation.Time
+		case strings.HasPrefix(annotation.Description, "stopped background requests"):
+			end = annotation.Time
+		}
+	}
+	if start.IsZero() || !end.After(start) {
+		return nil, nil
+	}
+
+	verbs := map[string]bool{}
+	for _, part := range strings.Split(manifest.Configuration["noise.verbs"], ",") {
+		if verb, known := noiseVerbs[strings.Split(part, "=")[0]]; known {
+			verbs[verb] = true
+		}
+	}
+	resources := map[string]bool{}
+	for _, resource := range strings.Split(manifest.Configuration["noise.resources"], ",") {
+		resources[resource] = true
+	}
+	noise := &offeredLoad{Description: "background requests", Start: start, End: end, Intended: float64(rate)}
+	for key, served := range servedBetween(snapshots, start, end) {
+		if verbs[key.verb] && resources[key.resource] {
+			noise.Served += served
+		}
+	}
+	return noise, nil
+}
+
+// offeredLoadAlarm warns when the API servers served markedly fewer requests than the experiment meant to offer.
+func offeredLoadAlarm(dataDir string) (string, error) {
+	var result requestRates
+	if err := artifacts.Load(dataDir, requestRatesFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	var short []string
+	for _, offered := range result.Offered {
+		if offered.Served < offered.Intended*offeredLoadShortfall {
+			short = append(short, fmt.Sprintf("%s were meant to be issued at %.1f/s but were served at %.1f/s", offered.Description, offered.Intended, offered.Served))
+		}
+	}
+	if len(short) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("The API servers were not offered the intended load: %s. The benchmark could not keep up, or requests were lost on the way.", strings.Join(short, "; ")), nil
+}
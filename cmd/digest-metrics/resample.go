@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// aggregations reduce the values of a series which fall in one interval of the grid to one.
+var aggregations = map[string]func([]float64) float64{
+	"mean": meanOf,
+	"min": func(values []float64) float64 {
+		lowest := math.Inf(1)
+		for _, value := range values {
+			lowest = math.Min(lowest, value)
+		}
+		return lowest
+	},
+	"max": func(values []float64) float64 {
+		highest := math.Inf(-1)
+		for _, value := range values {
+			highest = math.Max(highest, value)
+		}
+		return highest
+	},
+	"last": func(values []float64) float64 {
+		return values[len(values)-1]
+	},
+}
+
+var aggregationNames = []string{"mean", "min", "max", "last"}
+
+// cumulativeMetrics count up over the run; their value in an interval is always the last one, as any other
+// aggregation of a counter is meaningless.
+var cumulativeMetrics = map[string]bool{
+	cpuMetric:             true,
+	networkReceiveMetric:  true,
+	networkTransmitMetric: true,
+	pageFaultsMetric:      true,
+	majorPageFaultsMetric: true,
+}
+
+// resample moves every series onto a grid of the interval, aligned to the epoch rather than to the start of the
+// series, so that series from different pods and runs, sampled at jittered times, share their timestamps. Every
+// interval holds the aggregate of the values in it, at its start, except for the last value, which is the value at
+// its end and so is stamped there, or counters would be shifted back by up to an interval; an interval without
+// values where the series was broken is a break, and one without either is left out.
+func resample(series []rawSeries, interval time.Duration, aggregation string) []rawSeries {
+	resampled := make([]rawSeries, 0, len(series))
+	for _, s := range series {
+		aggregate, stamp := aggregations[aggregation], time.Duration(0)
+		if cumulativeMetrics[s.metric] || aggregation == "last" {
+			aggregate, stamp = aggregations["last"], interval
+		}
+		moved := s
+		moved.points = nil
+		var bucket time.Time
+		var values []float64
+		broken := false
+		flush := func() {
+			switch {
+			case len(values) > 0:
+				value := aggregate(values)
+				moved.points = append(moved.points, point{time: bucket.Add(stamp), value: &value})
+			case broken:
+				moved.points = append(moved.points, point{time: bucket.Add(stamp)})
+			}
+			values, broken = nil, false
+		}
+		for i, p := range s.points {
+			if start := p.time.Truncate(interval); i == 0 || !start.Equal(bucket) {
+				if i > 0 {
+					flush()
+				}
+				bucket = start
+			}
+			if p.value == nil {
+				broken = true
+				continue
+			}
+			values = append(values, *p.value)
+		}
+		if len(s.points) > 0 {
+			flush()
+		}
+		resampled = append(resampled, moved)
+	}
+	return resampled
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// walkResourceMetrics reads every scrape of the resource metrics of the kubelet as the summary holding the same
+// usage, for the node and every pod on it. Every sample carries the time the kubelet took it at, which the summary
+// records in the stats instead.
+func walkResourceMetrics(dataDir string, visit func(summary statsv1alpha1.Summary)) error {
+	return walkMetricsSnapshots(dataDir, artifacts.ResourceMetricsDir, []string{"node_", "pod_", "container_"}, func(scrape metricsSnapshot) error {
+		summary := statsv1alpha1.Summary{Node: statsv1alpha1.NodeStats{NodeName: scrape.node}}
+		if family, exists := scrape.families["node_cpu_usage_seconds_total"]; exists && len(family.Metric) > 0 {
+			summary.Node.CPU = cpuStatsOf(family.Metric[0], scrape.time)
+		}
+		if family, exists := scrape.families["node_memory_working_set_bytes"]; exists && len(family.Metric) > 0 {
+			summary.Node.Memory = memoryStatsOf(family.Metric[0], scrape.time)
+		}
+		pods := map[statsv1alpha1.PodReference]*statsv1alpha1.PodStats{}
+		podFor := func(sample *dto.Metric) *statsv1alpha1.PodStats {
+			ref := statsv1alpha1.PodReference{Name: labelValue(sample, "pod"), Namespace: labelValue(sample, "namespace")}
+			if _, exists := pods[ref]; !exists {
+				pods[ref] = &statsv1alpha1.PodStats{PodRef: ref}
+			}
+			return pods[ref]
+		}
+		if family, exists := scrape.families["pod_cpu_usage_seconds_total"]; exists {
+			for _, sample := range family.Metric {
+				podFor(sample).CPU = cpuStatsOf(sample, scrape.time)
+			}
+		}
+		if family, exists := scrape.families["pod_memory_working_set_bytes"]; exists {
+			for _, sample := range family.Metric {
+				podFor(sample).Memory = memoryStatsOf(sample, scrape.time)
+			}
+		}
+		containers := map[statsv1alpha1.PodReference]map[string]*statsv1alpha1.ContainerStats{}
+		containerFor := func(sample *dto.Metric) *statsv1alpha1.ContainerStats {
+			ref, name := podFor(sample).PodRef, labelValue(sample, "container")
+			if containers[ref] == nil {
+				containers[ref] = map[string]*statsv1alpha1.ContainerStats{}
+			}
+			if _, exists := containers[ref][name]; !exists {
+				containers[ref][name] = &statsv1alpha1.ContainerStats{Name: name}
+			}
+			return containers[ref][name]
+		}
+		if family, exists := scrape.families["container_cpu_usage_seconds_total"]; exists {
+			for _, sample := range family.Metric {
+				containerFor(sample).CPU = cpuStatsOf(sample, scrape.time)
+			}
+		}
+		if family, exists := scrape.families["container_memory_working_set_bytes"]; exists {
+			for _, sample := range family.Metric {
+				containerFor(sample).Memory = memoryStatsOf(sample, scrape.time)
+			}
+		}
+		for ref, pod := range pods {
+			for _, container := range containers[ref] {
+				pod.Containers = append(pod.Containers, *container)
+			}
+			summary.Pods = append(summary.Pods, *pod)
+		}
+		visit(summary)
+		return nil
+	})
+}
+
+// sampleTime determines when the kubelet took the sample, falling back to when it was scraped.
+func sampleTime(sample *dto.Metric, scraped time.Time) metav1.Time {
+	if sample.TimestampMs != nil {
+		return metav1.NewTime(time.UnixMilli(sample.GetTimestampMs()))
+	}
+	return metav1.NewTime(scraped)
+}
+
+func cpuStatsOf(sample *dto.Metric, scraped time.Time) *statsv1alpha1.CPUStats {
+	usage := uint64(sampleValue(sample) * 1e9)
+	return &statsv1alpha1.CPUStats{Time: sampleTime(sample, scraped), UsageCoreNanoSeconds: &usage}
+}
+
+func memoryStatsOf(sample *dto.Metric, scraped time.Time) *statsv1alpha1.MemoryStats {
+	workingSet := uint64(sampleValue(sample))
+	return &statsv1alpha1.MemoryStats{Time: sampleTime(sample, scraped), WorkingSetBytes: &workingSet}
+}
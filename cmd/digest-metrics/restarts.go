@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const restartsFile = "restarts.json"
+
+// restart is where the samples of a monitored pod, or of a container in it, started over during the run.
+type restart struct {
+	Identifier string    `json:"identifier"`
+	Pod        string    `json:"pod"`
+	Time       time.Time `json:"time"`
+	// Replaced is set when another pod by the same name took the place of the one sampled before, rather than a
+	// container in the same pod restarting.
+	Replaced bool `json:"replaced,omitempty"`
+}
+
+// restartedAt determines whether the pod or container started over between the samples: another pod by the same
+// name was sampled, or, for a cumulative counter, the count went backwards.
+func restartedAt(previous, value metric, cumulative bool) bool {
+	if value.instance != previous.instance {
+		return true
+	}
+	return cumulative && previous.value != nil && value.value != nil && *value.value < *previous.value
+}
+
+// segments splits the distinct samples where the pod or container started over, so that nothing is derived across a
+// restart, where counters start from zero again. Samples without a value are kept with those before them.
+func segments(values []metric, cumulative bool) [][]metric {
+	var split [][]metric
+	start, last := 0, -1
+	for i, value := range values {
+		if last >= 0 && value.value != nil && restartedAt(values[last], value, cumulative) {
+			split = append(split, values[start:i])
+			start = i
+		}
+		if value.value != nil {
+			last = i
+		}
+	}
+	if start < len(values) {
+		split = append(split, values[start:])
+	}
+	return split
+}
+
+// pointsBetweenRestarts converts the distinct samples to points, breaking the series between the last sample before
+// every restart and the first after it.
+func pointsBetweenRestarts(values []metric, cumulative bool) []point {
+	var points []point
+	for i, segment := range segments(values, cumulative) {
+		if i > 0 {
+			before := points[len(points)-1].time
+			points = append(points, point{time: before.Add(segment[0].timestamp.Time.Sub(before) / 2)})
+		}
+		points = append(points, pointsOf(segment)...)
+	}
+	return points
+}
+
+// digestRestarts records where the samples of every monitored pod started over, from its CPU usage, which every
+// restart resets. Statistics are derived within the stretches between restarts, never across them.
+func digestRestarts(dataDir string, metrics *metricSamples) error {
+	var restarts []restart
+	for _, identifier := range metrics.identifiers() {
+		pods, err := metrics.load(identifier)
+		if err != nil {
+			return err
+		}
+		for ref, items := range pods {
+			pod := ref.Name
+			if ref.Namespace != "" {
+				pod = ref.Namespace + "/" + ref.Name
+			}
+			var sampled []metric
+			for _, value := range dedupe(items[cpuMetric]) {
+				if value.value != nil {
+					sampled = append(sampled, value)
+				}
+			}
+			split := segments(sampled, true)
+			for i := 1; i < len(split); i++ {
+				before, after := split[i-1][len(split[i-1])-1], split[i][0]
+				restarts = append(restarts, restart{Identifier: identifier, Pod: pod, Time: after.timestamp.Time, Replaced: after.instance != before.instance})
+			}
+		}
+	}
+	if len(restarts) == 0 {
+		// restarts found by an earlier digest are not left behind for the timeline to pick up
+		if err := os.Remove(filepath.Join(dataDir, restartsFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	sort.Slice(restarts, func(i, j int) bool {
+		if !restarts[i].Time.Equal(restarts[j].Time) {
+			return restarts[i].Time.Before(restarts[j].Time)
+		}
+		return restarts[i].Identifier < restarts[j].Identifier
+	})
+	logrus.Warnf("monitored pods started over %d times during the run; usage is derived between restarts", len(restarts))
+	return artifacts.Write(dataDir, restartsFile, restarts)
+}
+
+// restartAnnotations marks the restarts found in the metrics on the timeline.
+func restartAnnotations(dataDir string) ([]artifacts.Annotation, error) {
+	var restarts []restart
+	if err := artifacts.Load(dataDir, restartsFile, &restarts); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var annotations []artifacts.Annotation
+	for _, restarted := range restarts {
+		description := fmt.Sprintf("%s of %s restarted", restarted.Pod, restarted.Identifier)
+		if restarted.Replaced {
+			description = fmt.Sprintf("%s of %s replaced", restarted.Pod, restarted.Identifier)
+		}
+		annotations = append(annotations, artifacts.Annotation{Time: restarted.Time, Kind: artifacts.AnnotationRestart, Description: description})
+	}
+	return annotations, nil
+}
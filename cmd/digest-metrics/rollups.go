@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultRollups roll up the series of pods sharing an identifier into both their sum and their mean, as the
+// replicas of a highly-available control plane share its load.
+const defaultRollups = "sum,mean"
+
+// rollupAggregations combine the values of the pods present at a time into the value of the rollup.
+var rollupAggregations = map[string]func([]float64) float64{
+	"sum": func(values []float64) float64 {
+		var sum float64
+		for _, value := range values {
+			sum += value
+		}
+		return sum
+	},
+	"mean": meanOf,
+	"max":  aggregations["max"],
+	"min":  aggregations["min"],
+}
+
+var rollupNames = []string{"sum", "mean", "max", "min"}
+
+func parseRollups(value string) ([]string, error) {
+	var rollups []string
+	for _, name := range strings.Split(value, ",") {
+		if name == "" {
+			continue
+		}
+		if _, known := rollupAggregations[name]; !known {
+			return nil, fmt.Errorf("rollup %q is none of %v", name, rollupNames)
+		}
+		rollups = append(rollups, name)
+	}
+	return rollups, nil
+}
+
+// rollupsOf rolls up the series of every metric of the pods sharing an identifier, when there is more than one, into
+// a series for the identifier as a whole, without a pod, named like a recording rule with the aggregation appended,
+// like cpu-cores:sum. Cumulative counters are left out, as they start over when any one pod restarts; their rates are
+// rolled up instead.
+//
+// Pods are sampled at different times, so a rollup has a value whenever any pod was sampled, from the latest value
+// of every pod present at the time. A pod is present from its first sample until a break in its series, or until it
+// would have been sampled again after its last.
+func rollupsOf(series []rawSeries, rollups []string) []rawSeries {
+	type group struct {
+		identifier, container, metric string
+	}
+	members := map[group][]rawSeries{}
+	for _, s := range series {
+		if cumulativeMetrics[s.metric] || s.pod == "" {
+			continue
+		}
+		key := group{identifier: s.identifier, container: s.container, metric: s.metric}
+		members[key] = append(members[key], s)
+	}
+	var rolled []rawSeries
+	for key, pods := range members {
+		if len(pods) < 2 {
+			continue
+		}
+		times, values := presentValues(pods)
+		for _, rollup := range rollups {
+			aggregate := rollupAggregations[rollup]
+			combined := rawSeries{identifier: key.identifier, container: key.container, metric: rollupName(key.metric, rollup)}
+			for i, at := range times {
+				if len(values[i]) == 0 {
+					if n := len(combined.points); n > 0 && combined.points[n-1].value != nil {
+						combined.points = append(combined.points, point{time: at})
+					}
+					continue
+				}
+				value := aggregate(values[i])
+				combined.points = append(combined.points, point{time: at, value: &value})
+			}
+			rolled = append(rolled, combined)
+		}
+	}
+	sort.Slice(rolled, func(i, j int) bool {
+		if rolled[i].label() != rolled[j].label() {
+			return rolled[i].label() < rolled[j].label()
+		}
+		return rolled[i].metric < rolled[j].metric
+	})
+	return rolled
+}
+
+// presentValues lists every time any of the series has a point at, with the values of the series present then.
+func presentValues(series []rawSeries) ([]time.Time, [][]float64) {
+	var times []time.Time
+	seen := map[time.Time]bool{}
+	for _, s := range series {
+		for _, p := range s.points {
+			if !seen[p.time] {
+				seen[p.time] = true
+				times = append(times, p.time)
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+	values := make([][]float64, len(times))
+	for _, s := range series {
+		// the points of every series are walked along with the times, as both are in order
+		next := 0
+		for i, at := range times {
+			for next < len(s.points) && !s.points[next].time.After(at) {
+				next++
+			}
+			if next == 0 {
+				continue
+			}
+			latest := s.points[next-1]
+			if latest.value == nil {
+				continue
+			}
+			if next == len(s.points) {
+				// the last point holds for as long as the pod took to be sampled before it
+				var interval time.Duration
+				if next > 1 {
+					interval = latest.time.Sub(s.points[next-2].time)
+				}
+				if at.Sub(latest.time) > interval {
+					continue
+				}
+			}
+			values[i] = append(values[i], *latest.value)
+		}
+	}
+	return times, values
+}
+
+// rollupName appends the aggregation to the name of the metric, ahead of the label it is broken down by, if any.
+func rollupName(metric, rollup string) string {
+	name, label, value := splitSeriesName(metric)
+	if label == "" {
+		return metric + ":" + rollup
+	}
+	return name + ":" + rollup + "{" + label + "=" + value + "}"
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const (
+	samplingFile = "sampling.json"
+	// unchangedSamplesFile lists the times at which a node was polled but none of its stats had changed.
+	unchangedSamplesFile = "unchanged.txt"
+)
+
+// samplingCalibration compares the rate at which we polled the kubelet with the rate at which it actually
+// refreshed its stats. The kubelet serves cached stats between housekeeping intervals, so most polls return a
+// sample identical to the last, and any feature shorter than the effective resolution is an artifact.
+type samplingCalibration struct {
+	Samples         int `json:"samples"`
+	DistinctSamples int `json:"distinctSamples"`
+	// PollInterval is the mean time between our polls, while EffectiveResolution is the median time between the
+	// kubelet's distinct samples, both in seconds.
+	PollInterval        float64 `json:"pollInterval"`
+	EffectiveResolution float64 `json:"effectiveResolution"`
+	// Oversampling is the number of polls made for every distinct sample.
+	Oversampling float64 `json:"oversampling"`
+}
+
+// digestSampling records the sampling calibration for every metric of every pod, keyed by identifier, pod and
+// then metric.
+func digestSampling(dataDir string, metrics *metricSamples) error {
+	// the run duration is a better measure of our polling than the span of the samples, which the kubelet's cache
+	// truncates at both ends; older runs do not record it, however
+	var duration time.Duration
+	var manifest artifacts.Manifest
+	if err := artifacts.Load(dataDir, artifacts.ManifestFile, &manifest); err == nil && manifest.End != nil {
+		duration = manifest.End.Sub(manifest.Start)
+	}
+
+	polls, err := countPolls(dataDir)
+	if err != nil {
+		return err
+	}
+
+	calibrations := map[string]map[string]map[string]samplingCalibration{}
+	var coarsest float64
+	var finest float64
+	for _, identifier := range metrics.identifiers() {
+		pods, err := metrics.load(identifier)
+		if err != nil {
+			return err
+		}
+		calibrations[identifier] = map[string]map[string]samplingCalibration{}
+		for pod, items := range pods {
+			name := pod.Namespace + "/" + pod.Name
+			calibrations[identifier][name] = map[string]samplingCalibration{}
+			for metricLabel, values := range items {
+				calibration := calibrate(values, polls, duration)
+				calibrations[identifier][name][metricLabel] = calibration
+				if calibration.EffectiveResolution > coarsest {
+					coarsest = calibration.EffectiveResolution
+				}
+				if calibration.PollInterval > 0 && (finest == 0 || calibration.PollInterval < finest) {
+					finest = calibration.PollInterval
+				}
+			}
+		}
+	}
+	if coarsest > finest && finest > 0 {
+		logrus.Warnf("metrics were polled every %.1fs but refreshed at best every %.1fs; features shorter than that are sampling artifacts", finest, coarsest)
+	}
+	return artifacts.Write(dataDir, samplingFile, calibrations)
+}
+
+// calibrate determines the sampling calibration for a series. When unchanged samples were dropped at collection
+// time, or cached ones as they were read, the number of polls made of the node is needed to know how many samples
+// we really took.
+func calibrate(values []metric, polls int, duration time.Duration) samplingCalibration {
+	distinct := dedupe(values)
+	calibration := samplingCalibration{
+		Samples:         len(values),
+		DistinctSamples: len(distinct),
+	}
+	if polls > calibration.Samples {
+		calibration.Samples = polls
+	}
+	switch {
+	case duration > 0 && calibration.Samples > 0:
+		calibration.PollInterval = duration.Seconds() / float64(calibration.Samples)
+	case len(values) > 1:
+		span := values[len(values)-1].timestamp.Time.Sub(values[0].timestamp.Time)
+		calibration.PollInterval = span.Seconds() / float64(calibration.Samples-1)
+	}
+	if len(distinct) > 1 {
+		var intervals []time.Duration
+		for i := 1; i < len(distinct); i++ {
+			intervals = append(intervals, distinct[i].timestamp.Time.Sub(distinct[i-1].timestamp.Time))
+		}
+		sort.Slice(intervals, func(i, j int) bool {
+			return intervals[i] < intervals[j]
+		})
+		calibration.EffectiveResolution = intervals[len(intervals)/2].Seconds()
+	}
+	if len(distinct) > 0 {
+		calibration.Oversampling = float64(calibration.Samples) / float64(len(distinct))
+	}
+	return calibration
+}
+
+// countPolls determines how many times the most-polled node was polled, including the polls that were not
+// persisted as nothing had changed.
+func countPolls(dataDir string) (int, error) {
+	var most int
+	for _, dir := range []string{artifacts.SummariesDir, artifacts.ResourceMetricsDir} {
+		nodes, err := os.ReadDir(filepath.Join(dataDir, dir))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return 0, fmt.Errorf("failed to read %s: %w", dir, err)
+		}
+		for _, node := range nodes {
+			if !node.IsDir() {
+				continue
+			}
+			nodeDir := filepath.Join(dataDir, dir, node.Name())
+			files, err := os.ReadDir(nodeDir)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read %s for %s: %w", dir, node.Name(), err)
+			}
+			var polls int
+			for _, file := range files {
+				switch {
+				case file.Name() == unchangedSamplesFile:
+					unchanged, err := countLines(filepath.Join(nodeDir, file.Name()))
+					if err != nil {
+						return 0, fmt.Errorf("failed to read unchanged samples for %s: %w", node.Name(), err)
+					}
+					polls += unchanged
+				case dir == artifacts.ResourceMetricsDir && filepath.Ext(file.Name()) == artifacts.MetricsSnapshotExtension:
+					polls++
+				case filepath.Ext(file.Name()) == ".json":
+					polls++
+				case filepath.Ext(file.Name()) == artifacts.SummaryLogExtension:
+					summaries, err := countLines(filepath.Join(nodeDir, file.Name()))
+					if err != nil {
+						return 0, fmt.Errorf("failed to read %s for %s: %w", dir, node.Name(), err)
+					}
+					polls += summaries
+				}
+			}
+			if polls > most {
+				most = polls
+			}
+		}
+	}
+	return most, nil
+}
+
+// countLines counts the lines in the file without holding it in memory, as logs of summaries grow large.
+func countLines(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var lines int
+	buffer := make([]byte, 64*1024)
+	for {
+		read, err := file.Read(buffer)
+		lines += bytes.Count(buffer[:read], []byte("\n"))
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// dedupe drops samples which the kubelet served from its cache between refreshes of its stats, by the time it took
+// them at rather than the time we polled: every sample not taken after the last one kept was seen before. Polling
+// faster than the kubelet refreshes otherwise weighs every sample by how long it stayed cached.
+func dedupe(values []metric) []metric {
+	var distinct []metric
+	for _, value := range values {
+		if len(distinct) > 0 && !value.timestamp.Time.After(distinct[len(distinct)-1].timestamp.Time) {
+			continue
+		}
+		distinct = append(distinct, value)
+	}
+	return distinct
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const serverWatchesFile = "server-watches.json"
+
+// serverWatches compares the watches the API servers were serving with those the benchmark believed it held open,
+// at the time of every snapshot of the metrics of any replica.
+type serverWatches struct {
+	Times []time.Time `json:"times"`
+	// Server is the number of watches all replicas were serving, by apiserver_longrunning_requests, and Inflight
+	// the requests they were executing, by apiserver_current_inflight_requests, keyed by kind of request.
+	Server   []float64            `json:"server"`
+	Inflight map[string][]float64 `json:"inflight"`
+	// Registered is the number of watchers all replicas had registered with their watch caches, by
+	// apiserver_registered_watchers, keyed by kind.
+	Registered map[string][]float64 `json:"registered,omitempty"`
+	// Open and Issued are the watches the benchmark held open and had issued at the time.
+	Open   []int64 `json:"open,omitempty"`
+	Issued []int64 `json:"issued,omitempty"`
+	// Missing is the number of watches the benchmark held open which the servers were not serving, counting the
+	// watches served at the first snapshot as belonging to other clients.
+	Missing []float64 `json:"missing,omitempty"`
+}
+
+// missingWatchTolerance is the fraction of open watches which may be missing on the servers before it is alarming;
+// the client and servers are sampled at different times, so a fast-changing fleet never matches exactly.
+const missingWatchTolerance = 0.01
+
+// digestServerWatches lines up the watches the API servers report serving with those the benchmark opened, so that
+// watches dropped without the client noticing show up.
+func digestServerWatches(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.APIServerMetricsDir, "apiserver_")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	type sample struct {
+		time       time.Time
+		node       string
+		watches    float64
+		inflight   map[string]float64
+		registered map[string]float64
+	}
+	var samples []sample
+	for node, series := range snapshots {
+		for _, snapshot := range series {
+			samples = append(samples, sample{
+				time:       snapshot.time,
+				node:       node,
+				watches:    snapshot.sumBy("apiserver_longrunning_requests", "verb")["WATCH"],
+				inflight:   snapshot.sumBy("apiserver_current_inflight_requests", "request_kind"),
+				registered: registeredWatchers(snapshot),
+			})
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].time.Before(samples[j].time)
+	})
+
+	open, err := loadOpenWatches(dataDir)
+	if err != nil {
+		return err
+	}
+	var issued *artifacts.Gauge
+	var issuedGauge artifacts.Gauge
+	if err := artifacts.Load(dataDir, artifacts.IssuedWatchesFile, &issuedGauge); err == nil {
+		issued = &issuedGauge
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// every replica is represented by its latest snapshot at the time of any other
+	result := serverWatches{Inflight: map[string][]float64{}, Registered: map[string][]float64{}}
+	latest := map[string]sample{}
+	var baseline float64
+	for i, current := range samples {
+		latest[current.node] = current
+		var watches float64
+		inflight, registered := map[string]float64{}, map[string]float64{}
+		for _, replica := range latest {
+			watches += replica.watches
+			for kind, value := range replica.inflight {
+				inflight[kind] += value
+			}
+			for kind, value := range replica.registered {
+				registered[kind] += value
+			}
+		}
+		if i == 0 {
+			baseline = watches
+		}
+		result.Times = append(result.Times, current.time)
+		result.Server = append(result.Server, watches)
+		for kind := range inflight {
+			if _, exists := result.Inflight[kind]; !exists {
+				result.Inflight[kind] = make([]float64, i)
+			}
+		}
+		for kind := range result.Inflight {
+			result.Inflight[kind] = append(result.Inflight[kind], inflight[kind])
+		}
+		for kind := range registered {
+			if _, exists := result.Registered[kind]; !exists {
+				result.Registered[kind] = make([]float64, i)
+			}
+		}
+		for kind := range result.Registered {
+			result.Registered[kind] = append(result.Registered[kind], registered[kind])
+		}
+		if open != nil {
+			value := gaugeAt(open, current.time)
+			result.Open = append(result.Open, value)
+			result.Missing = append(result.Missing, math.Max(0, float64(value)-(watches-baseline)))
+		}
+		if issued != nil {
+			result.Issued = append(result.Issued, gaugeAt(issued, current.time))
+		}
+	}
+	return artifacts.Write(dataDir, serverWatchesFile, result)
+}
+
+// registeredWatchers sums the watchers registered with the watch caches of the replica by kind, qualified by group
+// for kinds outside of the core group.
+func registeredWatchers(snapshot metricsSnapshot) map[string]float64 {
+	registered := map[string]float64{}
+	family, exists := snapshot.families["apiserver_registered_watchers"]
+	if !exists {
+		return registered
+	}
+	for _, sample := range family.Metric {
+		kind := labelValue(sample, "kind")
+		if group := labelValue(sample, "group"); group != "" {
+			kind += "." + group
+		}
+		registered[kind] += sampleValue(sample)
+	}
+	return registered
+}
+
+// watchCountColors are the colors the watch counts are charted in.
+var watchCountColors = map[string]string{
+	"issued by the benchmark":    "#969696",
+	"open in the benchmark":      "#08519c",
+	"served by the API servers":  "#d94801",
+	"registered with the caches": "#238b45",
+}
+
+// watchCountChart charts the watches the benchmark issued and held open against those the API servers served and
+// registered with their watch caches, so that it can be seen whether the servers held the watches the benchmark
+// believes it created. Runs which did not record the metrics of the API servers have no chart.
+func watchCountChart(dataDir string) (*lineChart, error) {
+	var result serverWatches
+	if err := artifacts.Load(dataDir, serverWatchesFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(result.Times) < 2 {
+		return nil, nil
+	}
+	offsets := make([]float64, len(result.Times))
+	for i, at := range result.Times {
+		offsets[i] = at.Sub(result.Times[0]).Seconds()
+	}
+	registered := make([]float64, len(result.Times))
+	for _, values := range result.Registered {
+		for i, value := range values {
+			registered[i] += value
+		}
+	}
+	series := map[string][]float64{
+		"served by the API servers": result.Server,
+	}
+	if len(result.Registered) > 0 {
+		series["registered with the caches"] = registered
+	}
+	for name, values := range map[string][]int64{"issued by the benchmark": result.Issued, "open in the benchmark": result.Open} {
+		if len(values) == 0 {
+			continue
+		}
+		converted := make([]float64, len(values))
+		for i, value := range values {
+			converted[i] = float64(value)
+		}
+		series[name] = converted
+	}
+	return newLineChart("Watches held over the run", result.Times[0], offsets, series, watchCountColors, formatCount), nil
+}
+
+// gaugeAt determines the value of the gauge at the time, which is its latest sample before then.
+func gaugeAt(gauge *artifacts.Gauge, at time.Time) int64 {
+	var value int64
+	for i, offset := range gauge.Offsets {
+		if gauge.Start.Add(time.Duration(offset * float64(time.Second))).After(at) {
+			break
+		}
+		value = gauge.Values[i]
+	}
+	return value
+}
+
+// serverWatchesAlarm warns when watches the benchmark held open were missing on the servers in consecutive
+// snapshots, which is what silently dropped watches look like.
+func serverWatchesAlarm(dataDir string) (string, error) {
+	var result serverWatches
+	if err := artifacts.Load(dataDir, serverWatchesFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	var worst float64
+	for i := 1; i < len(result.Missing); i++ {
+		tolerated := missingWatchTolerance * float64(result.Open[i])
+		if result.Missing[i-1] > missingWatchTolerance*float64(result.Open[i-1]) && result.Missing[i] > tolerated {
+			worst = math.Max(worst, math.Min(result.Missing[i-1], result.Missing[i]))
+		}
+	}
+	if worst == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("Up to %.0f watches the benchmark held open were not being served by the API servers. Watches may have been dropped without the client noticing.", worst), nil
+}
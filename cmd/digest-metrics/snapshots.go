@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// metricsSnapshot is one scrape of the metrics endpoint of a replica, holding only the families asked for.
+type metricsSnapshot struct {
+	node     string
+	time     time.Time
+	families map[string]*dto.MetricFamily
+}
+
+// loadMetricsSnapshots parses the snapshots in the directory, like artifacts.APIServerMetricsDir, keeping the
+// families with any of the prefixes. Snapshots are grouped by node and sorted by time.
+func loadMetricsSnapshots(dataDir, dir string, prefixes ...string) (map[string][]metricsSnapshot, error) {
+	snapshots := map[string][]metricsSnapshot{}
+	if err := walkMetricsSnapshots(dataDir, dir, prefixes, func(snapshot metricsSnapshot) error {
+		snapshots[snapshot.node] = append(snapshots[snapshot.node], snapshot)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// walkMetricsSnapshots parses the snapshots in the directory one at a time for every node and in order of time,
+// keeping the families with any of the prefixes, so that only what the visitor keeps of them stays in memory. Nodes
+// are parsed in parallel, but the visitor is only ever called for one snapshot at a time.
+func walkMetricsSnapshots(dataDir, dir string, prefixes []string, visit func(snapshot metricsSnapshot) error) error {
+	nodes, err := os.ReadDir(filepath.Join(dataDir, dir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var lock sync.Mutex
+	var tasks []func() error
+	for _, node := range nodes {
+		if !node.IsDir() {
+			continue
+		}
+		node := node.Name()
+		tasks = append(tasks, func() error {
+			return walkNodeSnapshots(filepath.Join(dataDir, dir, node), node, prefixes, func(snapshot metricsSnapshot) error {
+				lock.Lock()
+				defer lock.Unlock()
+				return visit(snapshot)
+			})
+		})
+	}
+	return inParallel(tasks)
+}
+
+func walkNodeSnapshots(nodeDir, node string, prefixes []string, visit func(snapshot metricsSnapshot) error) error {
+	files, err := os.ReadDir(nodeDir)
+	if err != nil {
+		return err
+	}
+	type scrape struct {
+		name string
+		time time.Time
+	}
+	var scrapes []scrape
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != artifacts.MetricsSnapshotExtension {
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), artifacts.MetricsSnapshotExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		scrapes = append(scrapes, scrape{name: file.Name(), time: time.Unix(0, nanos)})
+	}
+	sort.Slice(scrapes, func(i, j int) bool {
+		return scrapes[i].time.Before(scrapes[j].time)
+	})
+	for _, scraped := range scrapes {
+		path := filepath.Join(nodeDir, scraped.name)
+		raw, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(raw)
+		_ = raw.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		for name := range families {
+			if !hasAnyPrefix(name, prefixes) {
+				delete(families, name)
+			}
+		}
+		if err := visit(metricsSnapshot{node: node, time: scraped.time, families: families}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sumBy adds up the values of all samples in the family, keyed by the value of one label. Histograms contribute
+// the number of observations they hold.
+func (s metricsSnapshot) sumBy(name, label string) map[string]float64 {
+	sums := map[string]float64{}
+	family, exists := s.families[name]
+	if !exists {
+		return sums
+	}
+	for _, sample := range family.Metric {
+		sums[labelValue(sample, label)] += sampleValue(sample)
+	}
+	return sums
+}
+
+// histogramSumBy adds up the sums of the observations in every histogram in the family, keyed by one label.
+func (s metricsSnapshot) histogramSumBy(name, label string) map[string]float64 {
+	sums := map[string]float64{}
+	family, exists := s.families[name]
+	if !exists {
+		return sums
+	}
+	for _, sample := range family.Metric {
+		if sample.Histogram != nil {
+			sums[labelValue(sample, label)] += sample.Histogram.GetSampleSum()
+		}
+	}
+	return sums
+}
+
+// bucketCounts holds the observations of a histogram, or of several added up, with the cumulative count of every
+// bucket keyed by its upper bound. Buckets of histograms which are added up must have the same bounds.
+type bucketCounts struct {
+	count, sum float64
+	cumulative map[float64]float64
+}
+
+func bucketsOf(histogram *dto.Histogram) bucketCounts {
+	buckets := bucketCounts{cumulative: map[float64]float64{}}
+	if histogram == nil {
+		return buckets
+	}
+	buckets.count, buckets.sum = float64(histogram.GetSampleCount()), histogram.GetSampleSum()
+	for _, bucket := range histogram.Bucket {
+		buckets.cumulative[bucket.GetUpperBound()] = float64(bucket.GetCumulativeCount())
+	}
+	return buckets
+}
+
+func (b bucketCounts) add(other bucketCounts) bucketCounts {
+	sum := bucketCounts{count: b.count + other.count, sum: b.sum + other.sum, cumulative: map[float64]float64{}}
+	for _, buckets := range []bucketCounts{b, other} {
+		for bound, count := range buckets.cumulative {
+			sum.cumulative[bound] += count
+		}
+	}
+	return sum
+}
+
+// since determines the observations made after the earlier scrape. When the histogram was reset in between, every
+// observation in the later scrape is counted.
+func (b bucketCounts) since(before bucketCounts) bucketCounts {
+	if b.count < before.count {
+		return b
+	}
+	delta := bucketCounts{count: b.count - before.count, sum: b.sum - before.sum, cumulative: map[float64]float64{}}
+	for bound, count := range b.cumulative {
+		delta.cumulative[bound] = count - before.cumulative[bound]
+	}
+	return delta
+}
+
+// quantile estimates the quantile of the observations from the buckets, so it is only as precise as they are fine.
+func (b bucketCounts) quantile(q float64) float64 {
+	var bounds []float64
+	for bound := range b.cumulative {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	rank := q * b.count
+	lower, below := 0.0, 0.0
+	for _, bound := range bounds {
+		if b.cumulative[bound] >= rank {
+			if math.IsInf(bound, 1) {
+				return lower
+			}
+			// interpolate linearly within the bucket, as Prometheus does
+			inBucket := b.cumulative[bound] - below
+			if inBucket == 0 {
+				return bound
+			}
+			return lower + (bound-lower)*(rank-below)/inBucket
+		}
+		lower, below = bound, b.cumulative[bound]
+	}
+	return lower
+}
+
+func labelValue(sample *dto.Metric, name string) string {
+	for _, pair := range sample.Label {
+		if pair.GetName() == name {
+			return pair.GetValue()
+		}
+	}
+	return ""
+}
+
+func sampleValue(sample *dto.Metric) float64 {
+	switch {
+	case sample.Counter != nil:
+		return sample.Counter.GetValue()
+	case sample.Gauge != nil:
+		return sample.Gauge.GetValue()
+	case sample.Untyped != nil:
+		return sample.Untyped.GetValue()
+	case sample.Histogram != nil:
+		return float64(sample.Histogram.GetSampleCount())
+	}
+	return 0
+}
+
+// increase determines how much a counter grew between two samples, taking the whole latest value when the counter
+// was reset by a restart in between.
+func increase(before, after float64) float64 {
+	if after < before {
+		return after
+	}
+	return after - before
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// spillBufferBytes bounds what is held in memory of every series being read before it is written out to the spill
+// file.
+const spillBufferBytes = 8 << 10
+
+// spillFile holds series on disk while they are read, in chunks of the records of every series, so that reading a run
+// takes memory in proportion to the number of series rather than to how long it ran. Only the series being digested
+// are read back. Like a bufio.Writer, the first error writing the file sticks, and is returned by everything after.
+type spillFile struct {
+	file *os.File
+	size int64
+	err  error
+	// removed is set once the file is unlinked, which is done right away where open files can be, so that it goes
+	// away however the digest exits.
+	removed bool
+}
+
+// spilledSeries is a series in the spill file: the chunks already written out, and the records not yet.
+type spilledSeries struct {
+	chunks   []spilledChunk
+	buffered []byte
+}
+
+type spilledChunk struct {
+	offset int64
+	length int
+}
+
+func newSpillFile() (*spillFile, error) {
+	file, err := os.CreateTemp("", "digest-metrics-*.spill")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill file: %w", err)
+	}
+	return &spillFile{file: file, removed: os.Remove(file.Name()) == nil}, nil
+}
+
+// append adds the record to the series, writing out its buffered records once they fill a chunk.
+func (f *spillFile) append(s *spilledSeries, record []byte) {
+	if f.err != nil {
+		return
+	}
+	s.buffered = append(s.buffered, record...)
+	if len(s.buffered) < spillBufferBytes {
+		return
+	}
+	if _, err := f.file.WriteAt(s.buffered, f.size); err != nil {
+		f.err = fmt.Errorf("failed to write spill file: %w", err)
+		return
+	}
+	s.chunks = append(s.chunks, spilledChunk{offset: f.size, length: len(s.buffered)})
+	f.size += int64(len(s.buffered))
+	s.buffered = s.buffered[:0]
+}
+
+// read reads back every record of the series, in the order they were appended.
+func (f *spillFile) read(s *spilledSeries) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	length := len(s.buffered)
+	for _, chunk := range s.chunks {
+		length += chunk.length
+	}
+	records := make([]byte, 0, length)
+	for _, chunk := range s.chunks {
+		start := len(records)
+		records = records[:start+chunk.length]
+		if _, err := f.file.ReadAt(records[start:], chunk.offset); err != nil {
+			return nil, fmt.Errorf("failed to read spill file: %w", err)
+		}
+	}
+	return append(records, s.buffered...), nil
+}
+
+func (f *spillFile) close() error {
+	err := f.file.Close()
+	if !f.removed {
+		if removeErr := os.Remove(f.file.Name()); removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
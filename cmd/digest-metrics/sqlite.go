@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	// registers the pure Go SQLite driver, so that the tool needs no C toolchain to build
+	_ "modernc.org/sqlite"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// The raw timeseries are written to SQLite together with the run and its timeline, so that runs can be queried with
+// SQL. Every run is added to the database with an identifier of its own, so that the runs of a sweep can be digested
+// into one database and compared; a run digested again replaces its own rows. Times are in nanoseconds since the
+// epoch.
+
+var sqliteSchema = []string{
+	"CREATE TABLE IF NOT EXISTS runs (id INTEGER PRIMARY KEY, experiment TEXT, started INTEGER, ended INTEGER, invalid TEXT, configuration TEXT)",
+	"CREATE TABLE IF NOT EXISTS series (id INTEGER PRIMARY KEY, run INTEGER REFERENCES runs (id), identifier TEXT, pod TEXT, container TEXT, metric TEXT)",
+	"CREATE TABLE IF NOT EXISTS samples (series INTEGER REFERENCES series (id), time INTEGER, value REAL)",
+	"CREATE TABLE IF NOT EXISTS events (run INTEGER REFERENCES runs (id), time INTEGER, ended INTEGER, kind TEXT, description TEXT)",
+	"CREATE INDEX IF NOT EXISTS samples_series ON samples (series)",
+}
+
+// writeRawSQLite adds the run, its timeseries and its timeline to a database, leaving out the breaks in the series
+// as writeRawCSV does.
+func writeRawSQLite(dataDir, path string, series rawSeriesSource) error {
+	var manifest artifacts.Manifest
+	if err := artifacts.Load(dataDir, artifacts.ManifestFile, &manifest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var annotations []artifacts.Annotation
+	if err := artifacts.Load(dataDir, artifacts.TimelineFile, &annotations); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if err := writeSQLiteTables(db, manifest, series, annotations); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return db.Close()
+}
+
+func writeSQLiteTables(db *sql.DB, manifest artifacts.Manifest, series rawSeriesSource, annotations []artifacts.Annotation) error {
+	// the run is added in one transaction, so that a failed digest leaves the runs already in the database intact
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	for _, statement := range sqliteSchema {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+
+	var started, ended, invalid, configuration interface{}
+	if !manifest.Start.IsZero() {
+		started = manifest.Start.UnixNano()
+	}
+	if manifest.End != nil {
+		ended = manifest.End.UnixNano()
+	}
+	if manifest.Invalid != nil {
+		invalid = manifest.Invalid.Reason
+	}
+	if len(manifest.Configuration) > 0 {
+		raw, err := json.Marshal(manifest.Configuration)
+		if err != nil {
+			return fmt.Errorf("failed to marshal configuration: %w", err)
+		}
+		configuration = string(raw)
+	}
+	// a run is known by its experiment and when it started, and keeps its identifier when digested again
+	var run interface{}
+	var previous int64
+	switch err := tx.QueryRow("SELECT id FROM runs WHERE experiment IS ? AND started IS ?", manifest.Experiment, started).Scan(&previous); {
+	case err == nil:
+		run = previous
+		for _, statement := range []string{
+			"DELETE FROM samples WHERE series IN (SELECT id FROM series WHERE run = ?)",
+			"DELETE FROM series WHERE run = ?",
+			"DELETE FROM events WHERE run = ?",
+			"DELETE FROM runs WHERE id = ?",
+		} {
+			if _, err := tx.Exec(statement, previous); err != nil {
+				return fmt.Errorf("failed to replace run %d: %w", previous, err)
+			}
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("failed to look up run: %w", err)
+	}
+	inserted, err := tx.Exec("INSERT INTO runs VALUES (?, ?, ?, ?, ?, ?)", run, manifest.Experiment, started, ended, invalid, configuration)
+	if err != nil {
+		return fmt.Errorf("failed to insert run: %w", err)
+	}
+	runID, err := inserted.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	insertSeries, err := tx.Prepare("INSERT INTO series VALUES (NULL, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	insertSample, err := tx.Prepare("INSERT INTO samples VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	if err := series(func(s rawSeries) error {
+		var container interface{}
+		if s.container != "" {
+			container = s.container
+		}
+		inserted, err := insertSeries.Exec(runID, s.identifier, s.pod, container, s.metric)
+		if err != nil {
+			return fmt.Errorf("failed to insert series: %w", err)
+		}
+		id, err := inserted.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, p := range s.points {
+			if p.value == nil {
+				continue
+			}
+			if _, err := insertSample.Exec(id, p.time.UnixNano(), *p.value); err != nil {
+				return fmt.Errorf("failed to insert sample: %w", err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	insertEvent, err := tx.Prepare("INSERT INTO events VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	for _, annotation := range annotations {
+		var ended interface{}
+		if annotation.End != nil {
+			ended = annotation.End.UnixNano()
+		}
+		if _, err := insertEvent.Exec(runID, annotation.Time.UnixNano(), ended, annotation.Kind, annotation.Description); err != nil {
+			return fmt.Errorf("failed to insert event: %w", err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const storageObjectsFile = "storage-objects.json"
+
+// storageObjectsCharted is the number of resources whose population is charted in the report, those which changed
+// the most over the run.
+const storageObjectsCharted = 5
+
+// storageObjects holds the number of objects of every resource in etcd, as the API servers counted them, at the
+// time of every snapshot of the metrics of any replica.
+type storageObjects struct {
+	Times     []time.Time          `json:"times"`
+	Resources map[string][]float64 `json:"resources"`
+	Phases    []storageObjectPhase `json:"phases,omitempty"`
+}
+
+// storageObjectPhase summarizes the population of one resource over a phase.
+type storageObjectPhase struct {
+	Phase    string  `json:"phase"`
+	Resource string  `json:"resource"`
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Peak     float64 `json:"peak"`
+}
+
+// digestStorageObjects tracks how many objects of every resource were stored over the run, so that write-heavy
+// experiments show the population their latencies were measured against.
+func digestStorageObjects(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.APIServerMetricsDir, "apiserver_storage_objects", "apiserver_resource_objects")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var all []metricsSnapshot
+	for _, series := range snapshots {
+		all = append(all, series...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].time.Before(all[j].time)
+	})
+
+	// every replica counts the same objects, but refreshes its count on its own, so the latest count of any
+	// replica is the most accurate at any time; replicas which have not counted a resource yet report none
+	result := storageObjects{Resources: map[string][]float64{}}
+	latest := map[string]map[string]float64{}
+	for i, snapshot := range all {
+		counts := snapshot.sumBy("apiserver_storage_objects", "resource")
+		// newer API servers report the count under another name, qualified by group
+		for resource, count := range snapshot.sumBy("apiserver_resource_objects", "resource") {
+			counts[resource] = math.Max(counts[resource], count)
+		}
+		latest[snapshot.node] = counts
+		merged := map[string]float64{}
+		for _, replica := range latest {
+			for resource, count := range replica {
+				merged[resource] = math.Max(merged[resource], count)
+			}
+		}
+		result.Times = append(result.Times, snapshot.time)
+		for resource := range merged {
+			if _, exists := result.Resources[resource]; !exists {
+				result.Resources[resource] = make([]float64, i)
+			}
+		}
+		for resource := range result.Resources {
+			result.Resources[resource] = append(result.Resources[resource], merged[resource])
+		}
+	}
+
+	var resources []string
+	for resource := range result.Resources {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	for _, phase := range phases {
+		first, last := -1, -1
+		for i, at := range result.Times {
+			if phase.Contains(at) {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+		if first < 0 {
+			continue
+		}
+		for _, resource := range resources {
+			counts := result.Resources[resource][first : last+1]
+			summary := storageObjectPhase{Phase: phase.Name, Resource: resource, Start: counts[0], End: counts[len(counts)-1]}
+			for _, count := range counts {
+				summary.Peak = math.Max(summary.Peak, count)
+			}
+			if summary.Peak > 0 {
+				result.Phases = append(result.Phases, summary)
+			}
+		}
+	}
+	return artifacts.Write(dataDir, storageObjectsFile, result)
+}
+
+// storageObjectsChart charts the population of the resources which changed the most over the run.
+func storageObjectsChart(dataDir string) (*lineChart, error) {
+	var result storageObjects
+	if err := artifacts.Load(dataDir, storageObjectsFile, &result); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(result.Times) < 2 {
+		return nil, nil
+	}
+	type change struct {
+		resource string
+		span     float64
+	}
+	var changes []change
+	for resource, counts := range result.Resources {
+		low, high := math.Inf(1), math.Inf(-1)
+		for _, count := range counts {
+			low, high = math.Min(low, count), math.Max(high, count)
+		}
+		if high > low {
+			changes = append(changes, change{resource: resource, span: high - low})
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].span != changes[j].span {
+			return changes[i].span > changes[j].span
+		}
+		return changes[i].resource < changes[j].resource
+	})
+	if len(changes) > storageObjectsCharted {
+		changes = changes[:storageObjectsCharted]
+	}
+	offsets := make([]float64, len(result.Times))
+	for i, at := range result.Times {
+		offsets[i] = at.Sub(result.Times[0]).Seconds()
+	}
+	series, colors := map[string][]float64{}, map[string]string{}
+	for i, changed := range changes {
+		series[changed.resource] = result.Resources[changed.resource]
+		colors[changed.resource] = chartPalette[i%len(chartPalette)]
+	}
+	return newLineChart("Objects stored over the run", result.Times[0], offsets, series, colors, formatCount), nil
+}
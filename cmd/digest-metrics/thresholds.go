@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const verdictFile = "verdict.json"
+
+// exitCodeRegressed is used when the run regressed past a threshold against its baseline, so that automation can
+// tell a regression from a failure to digest, and from the flag package's usage errors.
+const exitCodeRegressed = 3
+
+// latencyScope is the scope of thresholds on the latencies the experiment recorded, rather than on the usage of a
+// component.
+const latencyScope = "latency"
+
+// usageMeasures name the measures of usage thresholds may be set on, as they are named in the comparison.
+var usageMeasures = map[string]func(usage) float64{
+	"cpuCores":             func(u usage) float64 { return u.CPUCores },
+	"peakCpuCores":         func(u usage) float64 { return u.PeakCPUCores },
+	"p99CpuCores":          func(u usage) float64 { return u.P99CPUCores },
+	"memoryBytes":          func(u usage) float64 { return u.MemoryBytes },
+	"p99MemoryBytes":       func(u usage) float64 { return u.P99MemoryBytes },
+	"networkReceiveBytes":  func(u usage) float64 { return u.NetworkReceiveBytes },
+	"networkTransmitBytes": func(u usage) float64 { return u.NetworkTransmitBytes },
+}
+
+// threshold bounds how much a measure may grow over its baseline, like:
+//
+//	api@steady:p99CpuCores=5%
+//
+// which fails the run when the 99th percentile of the CPU the API servers used in the steady phase grew by more
+// than five percent. The scope is an identifier, or latencyScope with a kind of latency for the measure; without a
+// phase, the threshold holds in every phase both runs have.
+type threshold struct {
+	raw                    string
+	scope, phase, measure  string
+	allowedIncreasePercent float64
+}
+
+// thresholds collect every value of a flag which may be given more than once.
+type thresholds []threshold
+
+func (t *thresholds) String() string {
+	var raw []string
+	for _, limit := range *t {
+		raw = append(raw, limit.raw)
+	}
+	return strings.Join(raw, ", ")
+}
+
+func (t *thresholds) Set(value string) error {
+	limit := threshold{raw: value}
+	target, percent, found := strings.Cut(value, "=")
+	if !found || !strings.HasSuffix(percent, "%") {
+		return fmt.Errorf("threshold %q is not of the form scope[@phase]:measure=percent%%", value)
+	}
+	allowed, err := strconv.ParseFloat(strings.TrimSuffix(percent, "%"), 64)
+	if err != nil || allowed < 0 {
+		return fmt.Errorf("threshold %q does not allow a non-negative percentage", value)
+	}
+	limit.allowedIncreasePercent = allowed
+	scope, measure, found := strings.Cut(target, ":")
+	if !found || scope == "" || measure == "" {
+		return fmt.Errorf("threshold %q is not of the form scope[@phase]:measure=percent%%", value)
+	}
+	limit.scope, limit.phase, _ = strings.Cut(scope, "@")
+	limit.measure = measure
+	if _, known := usageMeasures[measure]; limit.scope != latencyScope && !known {
+		var names []string
+		for name := range usageMeasures {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("threshold %q measures %s, which is none of %v", value, measure, names)
+	}
+	*t = append(*t, limit)
+	return nil
+}
+
+// check is the evaluation of a threshold against one measurement in both runs.
+type check struct {
+	Threshold string  `json:"threshold"`
+	Phase     string  `json:"phase,omitempty"`
+	Baseline  float64 `json:"baseline"`
+	Candidate float64 `json:"candidate"`
+	// IncreasePercent is how much the measure grew over the baseline, unset when the baseline was zero.
+	IncreasePercent float64 `json:"increasePercent"`
+	Passed          bool    `json:"passed"`
+	// Reason explains a failure which is not a regression, like a measure neither run recorded.
+	Reason string `json:"reason,omitempty"`
+}
+
+type verdict struct {
+	Passed bool    `json:"passed"`
+	Checks []check `json:"checks"`
+}
+
+// evaluateThresholds checks the comparison of the run to its baseline against every threshold and records the
+// verdict. A threshold which matches nothing fails, so that a misspelt one cannot pass a regression.
+func evaluateThresholds(dataDir string, limits thresholds) (verdict, error) {
+	var paired pairedComparison
+	if err := artifacts.Load(dataDir, baselineComparisonFile, &paired); err != nil {
+		return verdict{}, err
+	}
+	result := verdict{Passed: true}
+	for _, limit := range limits {
+		var checks []check
+		if limit.scope == latencyScope {
+			if latency, exists := paired.Latencies[limit.measure]; exists {
+				checks = append(checks, limit.check("", latency.A, latency.B))
+			}
+		} else {
+			var phases []string
+			for phase := range paired.Phases {
+				if limit.phase == "" || limit.phase == phase {
+					phases = append(phases, phase)
+				}
+			}
+			sort.Strings(phases)
+			for _, phase := range phases {
+				if used, exists := paired.Phases[phase][limit.scope]; exists {
+					measure := usageMeasures[limit.measure]
+					checks = append(checks, limit.check(phase, measure(used.A), measure(used.B)))
+				}
+			}
+		}
+		if len(checks) == 0 {
+			checks = append(checks, check{Threshold: limit.raw, Phase: limit.phase, Reason: "no measurement in both runs matches the threshold"})
+		}
+		for _, evaluated := range checks {
+			result.Passed = result.Passed && evaluated.Passed
+		}
+		result.Checks = append(result.Checks, checks...)
+	}
+	return result, artifacts.Write(dataDir, verdictFile, result)
+}
+
+func (t threshold) check(phase string, baseline, candidate float64) check {
+	evaluated := check{Threshold: t.raw, Phase: phase, Baseline: baseline, Candidate: candidate}
+	if baseline == 0 {
+		evaluated.Passed = candidate <= 0
+		if !evaluated.Passed {
+			evaluated.Reason = "the baseline measured none"
+		}
+		return evaluated
+	}
+	evaluated.IncreasePercent = (candidate - baseline) / baseline * 100
+	evaluated.Passed = evaluated.IncreasePercent <= t.allowedIncreasePercent
+	return evaluated
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const annotatedTimelineFile = "annotated-timeline.json"
+
+// digestTimeline consolidates everything the run recorded about what happened when, the phases of the experiment,
+// the annotations of the benchmark, the gaps in what it collected and the restarts in what it sampled, onto one
+// timeline.
+func digestTimeline(dataDir string) error {
+	annotations, err := loadTimeline(dataDir)
+	if err != nil {
+		return err
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	return artifacts.Write(dataDir, annotatedTimelineFile, annotations)
+}
+
+// loadTimeline loads the phases and annotations of the run, ordered by the time they started.
+func loadTimeline(dataDir string) ([]artifacts.Annotation, error) {
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var annotations []artifacts.Annotation
+	if err := artifacts.Load(dataDir, artifacts.TimelineFile, &annotations); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	stretches, err := loadCollectionErrors(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, stretch := range stretches {
+		annotations = append(annotations, gapAnnotation(stretch))
+	}
+	health, err := loadPodHealth(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range health {
+		annotations = append(annotations, healthAnnotation(event))
+	}
+	restarts, err := restartAnnotations(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	annotations = append(annotations, restarts...)
+	for _, phase := range phases {
+		end := phase.End
+		annotations = append(annotations, artifacts.Annotation{Time: phase.Start, End: &end, Kind: artifacts.AnnotationPhase, Description: phase.Name})
+	}
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].Time.Before(annotations[j].Time)
+	})
+	return annotations, nil
+}
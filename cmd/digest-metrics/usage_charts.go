@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// usageChartPoints is how many times the usage charts sample the run at.
+const usageChartPoints = 4 * heatmapColumns
+
+// usageCharts plot the CPU and memory every component used over the run, added up across its replicas, with the
+// watches the benchmark had issued overlaid, so that the cost of the watches can be read off the report.
+func usageCharts(dataDir string, metrics *metricSamples) ([]*lineChart, error) {
+	start, end := metrics.span()
+	if !end.After(start) {
+		return nil, nil
+	}
+	step := end.Sub(start) / usageChartPoints
+	grid := make([]time.Time, usageChartPoints+1)
+	offsets := make([]float64, len(grid))
+	for i := range grid {
+		grid[i] = start.Add(time.Duration(i) * step)
+		offsets[i] = grid[i].Sub(start).Seconds()
+	}
+
+	var issued *artifacts.Gauge
+	var gauge artifacts.Gauge
+	if err := artifacts.Load(dataDir, artifacts.IssuedWatchesFile, &gauge); err == nil {
+		issued = &gauge
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var charts []*lineChart
+	for _, chart := range []struct {
+		title  string
+		points func([]metric) []point
+		source string
+		format func(float64) string
+	}{
+		{title: "CPU used over the run", points: counterRatesOf, source: cpuMetric, format: func(cores float64) string { return fmt.Sprintf("%.2f", cores) }},
+		{title: "Memory used over the run", points: pointsOf, source: memoryMetric, format: formatBytes},
+	} {
+		series, colors := map[string][]float64{}, map[string]string{}
+		for _, identifier := range metrics.identifiers() {
+			// containers of pods with sidecars are already counted in their pod
+			if strings.Contains(identifier, "/") {
+				continue
+			}
+			pods, err := metrics.load(identifier)
+			if err != nil {
+				return nil, err
+			}
+			// the total is over the replicas which have a value, as replicas come and go during a run
+			total := make([]float64, len(grid))
+			reported := make([]bool, len(grid))
+			for _, items := range pods {
+				for i, value := range heldAt(chart.points(items[chart.source]), grid) {
+					if !math.IsNaN(value) {
+						total[i] += value
+						reported[i] = true
+					}
+				}
+			}
+			seen := false
+			for i := range total {
+				if !reported[i] {
+					total[i] = math.NaN()
+				}
+				seen = seen || reported[i]
+			}
+			if seen {
+				series[identifier] = total
+			}
+		}
+		if len(series) == 0 {
+			continue
+		}
+		var identifiers []string
+		for identifier := range series {
+			identifiers = append(identifiers, identifier)
+		}
+		sort.Strings(identifiers)
+		for i, identifier := range identifiers {
+			colors[identifier] = chartPalette[i%len(chartPalette)]
+		}
+		line := newLineChart(chart.title, start, offsets, series, colors, chart.format)
+		if issued != nil && len(issued.Offsets) > 0 {
+			times := make([]time.Time, len(issued.Offsets))
+			values := make([]float64, len(issued.Values))
+			for j, offset := range issued.Offsets {
+				times[j] = issued.Start.Add(time.Duration(offset * float64(time.Second)))
+				values[j] = float64(issued.Values[j])
+			}
+			line.overlay("watches issued by the benchmark", "#969696", times, values, formatCount)
+		}
+		charts = append(charts, line)
+	}
+	return charts, nil
+}
+
+// heldAt determines the value of the series at every time on the grid, which is its latest point at or before then;
+// there is none before the series starts or where it is broken, which leaves NaN.
+func heldAt(points []point, grid []time.Time) []float64 {
+	values := make([]float64, len(grid))
+	next := 0
+	for i, at := range grid {
+		for next < len(points) && !points[next].time.After(at) {
+			next++
+		}
+		values[i] = math.NaN()
+		if next > 0 && points[next-1].value != nil {
+			values[i] = *points[next-1].value
+		}
+	}
+	return values
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const usageSummaryFile = "usage-summary.json"
+
+// distribution summarizes the samples of a metric. Rates are summarized by the rate between consecutive samples.
+type distribution struct {
+	Samples int     `json:"samples"`
+	Mean    float64 `json:"mean"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Max     float64 `json:"max"`
+}
+
+func distributionOf(values []float64) distribution {
+	if len(values) == 0 {
+		return distribution{}
+	}
+	summary := distribution{
+		Samples: len(values),
+		P50:     percentile(values, 0.5),
+		P90:     percentile(values, 0.9),
+		P99:     percentile(values, 0.99),
+		Max:     math.Inf(-1),
+	}
+	for _, value := range values {
+		summary.Mean += value / float64(len(values))
+		summary.Max = math.Max(summary.Max, value)
+	}
+	return summary
+}
+
+type usageSummary struct {
+	// Window names the phases the samples were taken from, or runWindow when the run had none in steady state.
+	Window string `json:"window"`
+	// Identifiers hold the distribution of every metric, keyed by identifier and then metric. The samples of all
+	// pods for an identifier are pooled, so the distribution is that of one replica.
+	Identifiers map[string]map[string]distribution `json:"identifiers"`
+}
+
+// summaryMetrics are the metrics summarized, with how to derive the values from the samples of one pod.
+var summaryMetrics = map[string]struct {
+	source string
+	values func([]metric) []float64
+}{
+	cpuCoresMetric:           {source: cpuMetric, values: ratesOf(1)},
+	memoryMetric:             {source: memoryMetric, values: valuesOf},
+	networkReceiveMetric:     {source: networkReceiveMetric, values: ratesOf(float64(time.Second))},
+	networkTransmitMetric:    {source: networkTransmitMetric, values: ratesOf(float64(time.Second))},
+	workingSetMetric:         {source: workingSetMetric, values: valuesOf},
+	rssMetric:                {source: rssMetric, values: valuesOf},
+	memoryUsageMetric:        {source: memoryUsageMetric, values: valuesOf},
+	pageFaultRateMetric:      {source: pageFaultsMetric, values: ratesOf(float64(time.Second))},
+	majorPageFaultRateMetric: {source: majorPageFaultsMetric, values: ratesOf(float64(time.Second))},
+}
+
+func valuesOf(values []metric) []float64 {
+	var samples []float64
+	for _, value := range dedupe(values) {
+		if value.value != nil {
+			samples = append(samples, float64(*value.value))
+		}
+	}
+	return samples
+}
+
+// ratesOf derives the rates of a cumulative counter between samples, per nanosecond times the scale.
+func ratesOf(scale float64) func([]metric) []float64 {
+	return func(values []metric) []float64 {
+		var rates []float64
+		for _, p := range counterRatesOf(values) {
+			if p.value != nil {
+				rates = append(rates, *p.value*scale)
+			}
+		}
+		return rates
+	}
+}
+
+// digestUsageSummary summarizes every metric of every identifier over the steady state of the run, so that runs
+// can be compared by a handful of numbers rather than by their series. The steady state is every phase named for
+// it, or the whole run when none is, trimmed.
+func digestUsageSummary(dataDir, steadyPhase string, trimmed trim, metrics *metricSamples) error {
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var steady []artifacts.Phase
+	var names []string
+	for _, phase := range phases {
+		if phase.Name == steadyPhase || strings.HasPrefix(phase.Name, steadyPhase+"-") {
+			steady = append(steady, phase)
+			names = append(names, phase.Name)
+		}
+	}
+	result := usageSummary{Window: runWindow, Identifiers: map[string]map[string]distribution{}}
+	if len(steady) > 0 {
+		result.Window = strings.Join(names, ",")
+	} else {
+		start, end := metrics.span()
+		steady = []artifacts.Phase{{Name: runWindow, Start: start, End: end.Add(time.Nanosecond)}}
+	}
+	steady = trimmed.apply(steady)
+
+	for _, identifier := range metrics.identifiers() {
+		pods, err := metrics.load(identifier)
+		if err != nil {
+			return err
+		}
+		summaries := map[string]distribution{}
+		for name, derivation := range summaryMetrics {
+			var pooled []float64
+			for _, items := range pods {
+				// rates are derived within every phase, never across the gap between two of them
+				var windows [][]metric
+				for _, phase := range steady {
+					windows = append(windows, inPhase(items[derivation.source], phase))
+				}
+				for _, window := range windows {
+					pooled = append(pooled, derivation.values(window)...)
+				}
+			}
+			if len(pooled) > 0 {
+				summaries[name] = distributionOf(pooled)
+			}
+		}
+		if len(summaries) > 0 {
+			result.Identifiers[identifier] = summaries
+		}
+	}
+	return artifacts.Write(dataDir, usageSummaryFile, result)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+const watchCacheFile = "watch-cache.json"
+
+// watchCacheSeries holds what the watch cache of one resource did on one API server replica, sample by sample. The
+// counters count what happened since the first sample.
+type watchCacheSeries struct {
+	Node            string      `json:"node"`
+	Resource        string      `json:"resource"`
+	Times           []time.Time `json:"times"`
+	Capacity        []float64   `json:"capacity"`
+	Received        []float64   `json:"received"`
+	Dispatched      []float64   `json:"dispatched"`
+	Initializations []float64   `json:"initializations"`
+	Resizes         []float64   `json:"resizes"`
+}
+
+// watchCachePhase summarizes the watch cache of one resource across replicas over a phase. Rates are per second.
+type watchCachePhase struct {
+	Phase           string  `json:"phase"`
+	Resource        string  `json:"resource"`
+	ReceivedRate    float64 `json:"receivedRate"`
+	DispatchedRate  float64 `json:"dispatchedRate"`
+	Initializations float64 `json:"initializations"`
+	Resizes         float64 `json:"resizes"`
+	// Capacity is the largest capacity of any replica at the end of the phase.
+	Capacity float64 `json:"capacity"`
+}
+
+type watchCache struct {
+	Series []watchCacheSeries `json:"series"`
+	Phases []watchCachePhase  `json:"phases,omitempty"`
+}
+
+// digestWatchCache extracts how the watch caches of the API servers behaved from their metrics snapshots, so that
+// resizes, event rates and re-initializations caused by the experiment are visible.
+func digestWatchCache(dataDir string) error {
+	snapshots, err := loadMetricsSnapshots(dataDir, artifacts.APIServerMetricsDir, "apiserver_watch_cache_", "watch_cache_")
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	var phases []artifacts.Phase
+	if err := loadPhases(dataDir, &phases); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var result watchCache
+	var nodes []string
+	for node := range snapshots {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		byResource := map[string]*watchCacheSeries{}
+		var previous map[string]map[string]float64
+		for _, snapshot := range snapshots[node] {
+			current := map[string]map[string]float64{
+				"capacity":        watchCacheSumBy(snapshot, "watch_cache_capacity"),
+				"received":        watchCacheSumBy(snapshot, "apiserver_watch_cache_events_received_total"),
+				"dispatched":      watchCacheSumBy(snapshot, "apiserver_watch_cache_events_dispatched_total"),
+				"initializations": watchCacheSumBy(snapshot, "apiserver_watch_cache_initializations_total"),
+				"increases":       watchCacheSumBy(snapshot, "watch_cache_capacity_increase_total"),
+				"decreases":       watchCacheSumBy(snapshot, "watch_cache_capacity_decrease_total"),
+			}
+			resources := map[string]struct{}{}
+			for _, values := range current {
+				for resource := range values {
+					resources[resource] = struct{}{}
+				}
+			}
+			for resource := range resources {
+				series, exists := byResource[resource]
+				if !exists {
+					series = &watchCacheSeries{Node: node, Resource: resource}
+					byResource[resource] = series
+				}
+				since := func(counters []float64, names ...string) float64 {
+					// the first sample is the reference that later increases are measured from
+					if previous == nil || len(counters) == 0 {
+						return 0
+					}
+					total := counters[len(counters)-1]
+					for _, name := range names {
+						total += increase(previous[name][resource], current[name][resource])
+					}
+					return total
+				}
+				series.Received = append(series.Received, since(series.Received, "received"))
+				series.Dispatched = append(series.Dispatched, since(series.Dispatched, "dispatched"))
+				series.Initializations = append(series.Initializations, since(series.Initializations, "initializations"))
+				series.Resizes = append(series.Resizes, since(series.Resizes, "increases", "decreases"))
+				series.Times = append(series.Times, snapshot.time)
+				series.Capacity = append(series.Capacity, current["capacity"][resource])
+			}
+			previous = current
+		}
+		var resources []string
+		for resource := range byResource {
+			resources = append(resources, resource)
+		}
+		sort.Strings(resources)
+		for _, resource := range resources {
+			result.Series = append(result.Series, *byResource[resource])
+		}
+	}
+
+	for _, phase := range phases {
+		byResource := map[string]*watchCachePhase{}
+		var resources []string
+		for _, series := range result.Series {
+			// counters are measured from the last sample before the phase, when there is one
+			first, last := -1, -1
+			for i, at := range series.Times {
+				if at.Before(phase.Start) {
+					first = i
+				}
+				if phase.Contains(at) {
+					if first < 0 {
+						first = i
+					}
+					last = i
+				}
+			}
+			if last <= first || first < 0 {
+				continue
+			}
+			summary, exists := byResource[series.Resource]
+			if !exists {
+				summary = &watchCachePhase{Phase: phase.Name, Resource: series.Resource}
+				byResource[series.Resource] = summary
+				resources = append(resources, series.Resource)
+			}
+			elapsed := series.Times[last].Sub(series.Times[first]).Seconds()
+			summary.ReceivedRate += (series.Received[last] - series.Received[first]) / elapsed
+			summary.DispatchedRate += (series.Dispatched[last] - series.Dispatched[first]) / elapsed
+			summary.Initializations += series.Initializations[last] - series.Initializations[first]
+			summary.Resizes += series.Resizes[last] - series.Resizes[first]
+			if series.Capacity[last] > summary.Capacity {
+				summary.Capacity = series.Capacity[last]
+			}
+		}
+		sort.Strings(resources)
+		for _, resource := range resources {
+			result.Phases = append(result.Phases, *byResource[resource])
+		}
+	}
+	return artifacts.Write(dataDir, watchCacheFile, result)
+}
+
+// watchCacheSumBy sums a watch cache family by resource. Older API servers report some families without the
+// apiserver_ prefix and newer ones with it, so both names are read.
+func watchCacheSumBy(snapshot metricsSnapshot, name string) map[string]float64 {
+	sums := snapshot.sumBy(name, "resource")
+	other := "apiserver_" + name
+	if strings.HasPrefix(name, "apiserver_") {
+		other = strings.TrimPrefix(name, "apiserver_")
+	}
+	for resource, value := range snapshot.sumBy(other, "resource") {
+		sums[resource] += value
+	}
+	return sums
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"apiserver-watch-benchmarking/pkg/artifacts"
+)
+
+// watchCostFile holds every estimate of what watches cost the components: from the deltas between steps, from the
+// usage of each phase above the baseline, from a regression over the whole run, and in API server goroutines.
+const watchCostFile = "watch-cost.json"
+
+// watchCostUnit is the number of watches the cost is reported for, as the cost of one is too small to read.
+const watchCostUnit = 1000
+
+// confidenceZ is the quantile of the normal distribution bounding a 95% confidence interval. Runs take hundreds of
+// samples, far more than needed for the normal approximation to the distribution of the slope to hold.
+const confidenceZ = 1.959964
+
+// estimate is a cost with its 95% confidence interval.
+type estimate struct {
+	Value float64 `json:"value"`
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+type componentWatchCost struct {
+	Samples int `json:"samples"`
+	// CPUCores and MemoryBytes are the cost of every watchCostUnit watches open, summed over the replicas.
+	CPUCores    estimate `json:"cpuCores"`
+	MemoryBytes estimate `json:"memoryBytes"`
+}
+
+type watchCostRegression struct {
+	// Watches is the most watches open at once.
+	Watches int64 `json:"watches"`
+	// Components are keyed by identifier.
+	Components map[string]componentWatchCost `json:"components"`
+}
+
+type watchCost struct {
+	// Steps is the cost from the deltas between steps, for experiments which add watches in steps.
+	Steps *marginalCost `json:"steps,omitempty"`
+	// Phases is the cost in every phase over the baseline phase.
+	Phases []phasePerWatch `json:"phases,omitempty"`
+	// Regression is the cost from every sample of the run, with its confidence interval.
+	Regression *watchCostRegression `json:"regression,omitempty"`
+	// Goroutines is how many goroutines the API servers run for every watch.
+	Goroutines *goroutinesPerWatch `json:"goroutines,omitempty"`
+}
+
+// digestWatchCost estimates the cost of watches in every way the run allows, all against the watches open at the
+// time rather than those issued, which overstates the load when watches fail.
+func digestWatchCost(dataDir string, trimmed trim, metrics *metricSamples) error {
+	gauge, err := loadOpenWatches(dataDir)
+	if err != nil {
+		return err
+	}
+	var result watchCost
+	if result.Steps, err = marginalCostOf(dataDir, gauge, metrics); err != nil {
+		return err
+	}
+	if result.Phases, err = perWatchUsageOf(dataDir, gauge, metrics); err != nil {
+		return err
+	}
+	if result.Regression, err = watchCostRegressionOf(gauge, trimmed, metrics); err != nil {
+		return err
+	}
+	if result.Goroutines, err = goroutinesPerWatchOf(dataDir); err != nil {
+		return err
+	}
+	if result.Steps == nil && result.Phases == nil && result.Regression == nil && result.Goroutines == nil {
+		return nil
+	}
+	return artifacts.Write(dataDir, watchCostFile, result)
+}
+
+// watchCostRegressionOf regresses the usage of every component against the number of watches open when it was
+// sampled, over the whole run. Unlike the marginal cost between steps, this needs no steps and uses every sample, so
+// it comes with a confidence interval.
+func watchCostRegressionOf(gauge *artifacts.Gauge, trimmed trim, metrics *metricSamples) (*watchCostRegression, error) {
+	if gauge == nil || len(gauge.Offsets) == 0 {
+		return nil, nil
+	}
+	start, end := metrics.span()
+	run := trimmed.apply([]artifacts.Phase{{Name: runWindow, Start: start, End: end.Add(time.Nanosecond)}})
+	if len(run) == 0 {
+		return nil, nil
+	}
+
+	result := watchCostRegression{Components: map[string]componentWatchCost{}}
+	for _, open := range gauge.Values {
+		if open > result.Watches {
+			result.Watches = open
+		}
+	}
+	watchesAt := openWatchesAt(gauge)
+	for _, identifier := range metrics.identifiers() {
+		pods, err := metrics.load(identifier)
+		if err != nil {
+			return nil, err
+		}
+		var cpu, memory fit
+		// the watches open are the same at any time for every replica, so the slope of the total is the sum of the
+		// slopes of the replicas
+		for _, items := range pods {
+			replicaCPU := fitOf(counterRatesOf(inPhase(items[cpuMetric], run[0])), watchesAt)
+			replicaMemory := fitOf(pointsOf(inPhase(items[memoryMetric], run[0])), watchesAt)
+			cpu.add(replicaCPU)
+			memory.add(replicaMemory)
+		}
+		if cpu.samples == 0 && memory.samples == 0 {
+			continue
+		}
+		result.Components[identifier] = componentWatchCost{
+			Samples:     cpu.samples,
+			CPUCores:    cpu.estimate(),
+			MemoryBytes: memory.estimate(),
+		}
+	}
+	if len(result.Components) == 0 {
+		return nil, nil
+	}
+	return &result, nil
+}
+
+// openWatchesAt determines the watches open at any time from the latest sample of the gauge before it. Times before
+// the first sample have none.
+func openWatchesAt(gauge *artifacts.Gauge) func(time.Time) (float64, bool) {
+	return func(at time.Time) (float64, bool) {
+		offset := at.Sub(gauge.Start).Seconds()
+		i := sort.Search(len(gauge.Offsets), func(i int) bool {
+			return gauge.Offsets[i] > offset
+		})
+		if i == 0 {
+			return 0, false
+		}
+		return float64(gauge.Values[i-1]), true
+	}
+}
+
+// fit is the slope of a least-squares line and the variance of that slope.
+type fit struct {
+	samples         int
+	slope, variance float64
+}
+
+func (f *fit) add(other fit) {
+	f.samples += other.samples
+	f.slope += other.slope
+	f.variance += other.variance
+}
+
+func (f fit) estimate() estimate {
+	margin := confidenceZ * math.Sqrt(f.variance)
+	return estimate{
+		Value: f.slope * watchCostUnit,
+		Lower: (f.slope - margin) * watchCostUnit,
+		Upper: (f.slope + margin) * watchCostUnit,
+	}
+}
+
+// fitOf fits a line through the values of the series against the watches open when they were sampled. A series with
+// too few points, or sampled while the watches did not change, has no slope to fit.
+//
+// Consecutive samples are not independent, as usage lags behind the watches and is smoothed over the interval rates
+// are taken over, so the variance of the slope is estimated as Newey and West do, from the products of residuals up to
+// a few samples apart, which the ordinary estimate would take to be zero.
+func fitOf(points []point, watchesAt func(time.Time) (float64, bool)) fit {
+	var x, y []float64
+	for _, p := range points {
+		if p.value == nil {
+			continue
+		}
+		if watches, known := watchesAt(p.time); known {
+			x = append(x, watches)
+			y = append(y, *p.value)
+		}
+	}
+	n := len(x)
+	if n < 3 {
+		return fit{}
+	}
+	meanX, meanY := meanOf(x), meanOf(y)
+	var sxx, sxy float64
+	for i := range x {
+		sxx += (x[i] - meanX) * (x[i] - meanX)
+		sxy += (x[i] - meanX) * (y[i] - meanY)
+	}
+	if sxx == 0 {
+		return fit{}
+	}
+	slope := sxy / sxx
+	scores := make([]float64, n)
+	for i := range x {
+		scores[i] = (x[i] - meanX) * (y[i] - meanY - slope*(x[i]-meanX))
+	}
+	var long float64
+	for _, score := range scores {
+		long += score * score
+	}
+	// the lags follow the usual rule of thumb, weighted down linearly so that the estimate cannot be negative
+	lags := int(math.Floor(4 * math.Pow(float64(n)/100, 2.0/9)))
+	for lag := 1; lag <= lags && lag < n; lag++ {
+		weight := 1 - float64(lag)/float64(lags+1)
+		for i := lag; i < n; i++ {
+			long += 2 * weight * scores[i] * scores[i-lag]
+		}
+	}
+	return fit{samples: n, slope: slope, variance: long * float64(n) / float64(n-2) / (sxx * sxx)}
+}
+
+// loadWatchCost loads the cost of watches for the report, returning none for runs without it.
+func loadWatchCost(dataDir string) ([]watchCostRow, error) {
+	var cost watchCost
+	if err := artifacts.Load(dataDir, watchCostFile, &cost); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if cost.Regression == nil {
+		return nil, nil
+	}
+	var identifiers []string
+	for identifier := range cost.Regression.Components {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	signedSize := func(bytes float64) string {
+		if bytes < 0 {
+			return "-" + formatSize(-bytes)
+		}
+		return formatSize(bytes)
+	}
+	var rows []watchCostRow
+	for _, identifier := range identifiers {
+		component := cost.Regression.Components[identifier]
+		rows = append(rows, watchCostRow{
+			Identifier: identifier,
+			CPU:        formatEstimate(component.CPUCores, func(cores float64) string { return fmt.Sprintf("%.3f", cores) }),
+			Memory:     formatEstimate(component.MemoryBytes, signedSize),
+			Samples:    component.Samples,
+		})
+	}
+	return rows, nil
+}
+
+func formatEstimate(e estimate, format func(float64) string) string {
+	return fmt.Sprintf("%s (%s to %s)", format(e.Value), format(e.Lower), format(e.Upper))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"sync"
+)
+
+// parseWorkers is how many directories of metrics, one per node, are parsed at once.
+var parseWorkers = 1
+
+// inParallel runs the tasks, up to parseWorkers at a time, returning the first error of any of them in order.
+func inParallel(tasks []func() error) error {
+	slots := make(chan struct{}, parseWorkers)
+	errs := make([]error, len(tasks))
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, task func() error) {
+			defer wg.Done()
+			defer func() {
+				<-slots
+			}()
+			errs[i] = task()
+		}(i, task)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
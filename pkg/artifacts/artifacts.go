@@ -0,0 +1,338 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	PodInfoFile          = "podInfo.json"
+	ManifestFile         = "manifest.json"
+	PhasesFile           = "phases.json"
+	RequestsFile         = "requests.json"
+	StepsFile            = "steps.json"
+	LatenciesFile        = "latencies.json"
+	OpenWatchesFile      = "open-watches.json"
+	IssuedWatchesFile    = "issued-watches.json"
+	CohortsFile          = "cohorts.json"
+	BacklogFile          = "backlog.json"
+	TimelineFile         = "timeline.json"
+	GoroutinesFile       = "goroutines.json"
+	ClientUsageFile      = "client-usage.json"
+	CollectionErrorsFile = "collection-errors.json"
+	PodHealthFile        = "pod-health.json"
+	EtcdKeyspaceFile     = "etcd-keyspace.json"
+)
+
+// LatentWatchFile lists the times at which the latent watch experiment established its watches, in order of
+// establishment.
+const LatentWatchFile = "latent-watch.json"
+
+// SummariesDir holds the kubelet stats summaries of every node running a monitored pod, in a directory per node and
+// a series of files of newline-delimited summaries, named after the Unix time in nanoseconds they were started.
+// Older runs recorded a file per summary, named after its index and with the plain JSON extension.
+const (
+	SummariesDir        = "metrics"
+	SummaryLogExtension = ".jsonl"
+)
+
+// ResourceMetricsDir holds what the kubelet of every node running a monitored pod reported on its resource metrics
+// endpoint, when read instead of the stats summary, in a directory per node and a file per scrape in the Prometheus
+// text format, named after the Unix time in nanoseconds it was taken. Scrapes identical to the last one are only
+// listed in the unchanged samples of the node.
+const ResourceMetricsDir = "resource-metrics"
+
+// NodeCollectorDir holds what the collector deployed onto control-plane nodes recorded, in a directory per node
+// and a file per collector, with a line per sample prefixed by its RFC 3339 timestamp.
+const (
+	NodeCollectorDir = "node-collector"
+	PSIFile          = "psi.txt"
+	CgroupsFile      = "cgroups.txt"
+	AuditLogFile     = "audit.txt"
+	SocketsFile      = "sockets.txt"
+	ConntrackFile    = "conntrack.txt"
+)
+
+// APIServerMetricsDir and EtcdMetricsDir hold what every API server replica and etcd member reported on its metrics
+// endpoint, and CAdvisorDir what the kubelet of every node reported for the monitored pods on its cAdvisor endpoint,
+// in a directory per node and a file per scrape in the Prometheus text format, named after the Unix time in
+// nanoseconds it was taken.
+const (
+	CAdvisorDir              = "cadvisor"
+	APIServerMetricsDir      = "apiserver-metrics"
+	EtcdMetricsDir           = "etcd-metrics"
+	MetricsSnapshotExtension = ".txt"
+)
+
+// ProfilesDir holds the profiles taken of every API server replica, in a directory per node and a gzipped pprof
+// file per profile, named after the kind of profile and the Unix time in nanoseconds it was requested.
+const (
+	ProfilesDir      = "profiles"
+	ProfileExtension = ".pb.gz"
+	CPUProfile       = "profile"
+	HeapProfile      = "heap"
+)
+
+// PodLogsDir holds the logs of the monitored pods, in a directory per namespace and pod and a file per container,
+// with every line prefixed by its RFC 3339 timestamp.
+const (
+	PodLogsDir      = "pod-logs"
+	PodLogExtension = ".log"
+)
+
+// APFDumpsDir holds the state API Priority and Fairness dumped on every API server replica, in a directory per node
+// and a table per dump, named after what was dumped and the Unix time in nanoseconds it was requested.
+const (
+	APFDumpsDir           = "apf-dumps"
+	APFDumpExtension      = ".txt"
+	APFPriorityLevelsDump = "priority-levels"
+	APFRequestsDump       = "requests"
+)
+
+// HeapSnapshotsFile, in the ProfilesDir, lists when heap profiles were taken, which share their time in the names
+// of their files across nodes.
+const HeapSnapshotsFile = "heap-snapshots.json"
+
+// HeapSnapshot records the milestone of the experiment a heap profile was taken at, like the start of a phase, and
+// how many watches the benchmark held open at the time.
+type HeapSnapshot struct {
+	Milestone   string    `json:"milestone"`
+	Time        time.Time `json:"time"`
+	OpenWatches int64     `json:"openWatches"`
+}
+
+// Manifest records what was run, when, and under which conditions that the benchmark cannot
+// observe on its own, so that digested results can be interpreted later.
+type Manifest struct {
+	Experiment string            `json:"experiment"`
+	Start      time.Time         `json:"start"`
+	End        *time.Time        `json:"end,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	// Notes hold free-form context people attached to the run, like how the cluster under test was built.
+	Notes []string `json:"notes,omitempty"`
+	// Configuration holds the effective value of every flag, defaulted or not, and Reproduce is a command line
+	// which runs the benchmark with exactly that configuration again.
+	Configuration map[string]string `json:"configuration,omitempty"`
+	Reproduce     string            `json:"reproduce,omitempty"`
+	// Invalid is set when the run was aborted and its results must not be used.
+	Invalid *Invalidation `json:"invalid,omitempty"`
+}
+
+type Invalidation struct {
+	Reason   string   `json:"reason"`
+	Evidence []string `json:"evidence,omitempty"`
+}
+
+// ComparisonFile records how the runs against two clusters were paired, in the directory which holds the output of
+// every run in a subdirectory named after its side.
+const ComparisonFile = "comparison.json"
+
+var ComparisonSides = []string{"a", "b"}
+
+// Comparison records the context every side ran against, keyed by side, and the seed both ran with.
+type Comparison struct {
+	Seed     int64             `json:"seed"`
+	Start    *time.Time        `json:"start,omitempty"`
+	Contexts map[string]string `json:"contexts"`
+}
+
+// BaselinePhase is the name of a phase in which the experiment holds no load, against which the others are compared.
+const BaselinePhase = "baseline"
+
+// Phase is a named window of an experiment, used to segment metrics during digestion.
+type Phase struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Contains determines if the instant falls within the phase.
+func (p Phase) Contains(t time.Time) bool {
+	return !t.Before(p.Start) && t.Before(p.End)
+}
+
+// Annotation marks something which happened during a run, lasting until End when that is set, so that it can be
+// lined up with the metrics recorded at the time.
+type Annotation struct {
+	Time        time.Time  `json:"time"`
+	End         *time.Time `json:"end,omitempty"`
+	Kind        string     `json:"kind"`
+	Description string     `json:"description"`
+}
+
+const (
+	AnnotationPhase   = "phase"
+	AnnotationRestart = "restart"
+	AnnotationChaos   = "chaos"
+	AnnotationErrors  = "errors"
+	AnnotationRate    = "rate"
+	AnnotationLeader  = "leader"
+	AnnotationGap     = "gap"
+	AnnotationBudget  = "budget"
+	AnnotationHealth  = "health"
+)
+
+// Step records the number of watches held open through a phase of a stepped experiment.
+type Step struct {
+	Phase   string `json:"phase"`
+	Watches int    `json:"watches"`
+}
+
+// Latencies holds individual latency observations, keyed by what was measured.
+type Latencies map[string]LatencySeries
+
+// LatencySeries holds observations column-wise to keep long series compact: the observation at every index was
+// made Offsets seconds after Start and took Seconds.
+type LatencySeries struct {
+	Start   time.Time `json:"start"`
+	Offsets []float64 `json:"offsets"`
+	Seconds []float64 `json:"seconds"`
+}
+
+// Gauge holds samples of a value column-wise: the sample at every index was taken Offsets seconds after Start. The
+// watches open at the time are recorded in OpenWatchesFile, and the watch requests sent since the start of the run,
+// reconnections included, in IssuedWatchesFile.
+type Gauge struct {
+	Start   time.Time `json:"start"`
+	Offsets []float64 `json:"offsets"`
+	Values  []int64   `json:"values"`
+}
+
+// Backlog holds samples, column-wise like a Gauge, of the watch events the API servers sent and the events the
+// benchmark received, both counted since Start, and the number of watches open at the time.
+type Backlog struct {
+	Start    time.Time `json:"start"`
+	Offsets  []float64 `json:"offsets"`
+	Sent     []float64 `json:"sent"`
+	Received []int64   `json:"received"`
+	Open     []int64   `json:"open"`
+}
+
+// Goroutines holds samples, column-wise like a Gauge, of the goroutines every API server replica ran, keyed by pod,
+// and in total, along with the number of watches open at the time. Replicas which were not scraped for a sample,
+// like those which were not running yet, report zero goroutines.
+type Goroutines struct {
+	Start    time.Time            `json:"start"`
+	Offsets  []float64            `json:"offsets"`
+	Total    []float64            `json:"total"`
+	Replicas map[string][]float64 `json:"replicas"`
+	Open     []int64              `json:"open"`
+}
+
+// ClientUsage holds samples, column-wise like a Gauge, of the resources the benchmark itself used, so that a load
+// generator which could not keep up can be told apart from an API server which could not. CPU is the mean number of
+// cores used since the previous sample, out of the CPUs the Go runtime could use.
+type ClientUsage struct {
+	Start      time.Time `json:"start"`
+	CPUs       int       `json:"cpus"`
+	Offsets    []float64 `json:"offsets"`
+	CPU        []float64 `json:"cpu"`
+	RSS        []float64 `json:"rss"`
+	Goroutines []int     `json:"goroutines"`
+	FDs        []int     `json:"fds"`
+	Sockets    []int     `json:"sockets"`
+}
+
+// CollectionError records a stretch of consecutive failures of one monitor to collect from one target, like a node
+// or a replica, from the first failure until the monitor collected from the target again. End is unset when it
+// never did. Reasons counts the failures by their error. CollectionErrorsFile lists those of every monitor.
+type CollectionError struct {
+	Monitor  string         `json:"monitor"`
+	Target   string         `json:"target"`
+	Start    time.Time      `json:"start"`
+	End      *time.Time     `json:"end,omitempty"`
+	Failures int            `json:"failures"`
+	Reasons  map[string]int `json:"reasons"`
+}
+
+// The monitors which record their CollectionErrors.
+const (
+	SummaryMonitor          = "summary"
+	ResourceMetricsMonitor  = "resource-metrics"
+	CAdvisorMonitor         = "cadvisor"
+	APIServerMetricsMonitor = "apiserver-metrics"
+	EtcdMetricsMonitor      = "etcd-metrics"
+	APFDumpsMonitor         = "apf-dumps"
+)
+
+// PodHealthEvent records a monitored pod being OOM killed, evicted or restarted, or the node running one coming
+// under memory pressure. Events for a node leave the Pod unset. Restarts record when the container was terminated,
+// with the reason and exit code of its last termination, and Started when it ran again. Induced events happened on
+// a node while the experiment was restarting something on it. PodHealthFile lists those of a run.
+type PodHealthEvent struct {
+	Time      time.Time  `json:"time"`
+	Kind      string     `json:"kind"`
+	Node      string     `json:"node,omitempty"`
+	Pod       string     `json:"pod,omitempty"`
+	Container string     `json:"container,omitempty"`
+	Restarts  int        `json:"restarts,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Induced   bool       `json:"induced,omitempty"`
+}
+
+const (
+	PodHealthOOMKill        = "oom-kill"
+	PodHealthEviction       = "eviction"
+	PodHealthRestart        = "restart"
+	PodHealthMemoryPressure = "memory-pressure"
+)
+
+// EtcdKeyspaceSnapshot counts the keys in etcd under every prefix at a milestone of the experiment, named like
+// those of a HeapSnapshot. EtcdKeyspaceFile lists those of a run.
+type EtcdKeyspaceSnapshot struct {
+	Milestone string         `json:"milestone"`
+	Time      time.Time      `json:"time"`
+	Keys      map[string]int `json:"keys"`
+}
+
+// Cohorts describe how populations of watches configured differently within one run recovered from a disruption,
+// keyed by population, so that they can be compared directly.
+type Cohorts map[string]Cohort
+
+type Cohort struct {
+	Watches       int   `json:"watches"`
+	Disconnected  int   `json:"disconnected"`
+	Reestablished int   `json:"reestablished"`
+	Relists       int64 `json:"relists"`
+	// Reestablishment holds the time, in seconds, every re-established watch took to reconnect.
+	Reestablishment []float64 `json:"reestablishment"`
+}
+
+// Requests counts the requests made over the course of an experiment, both those the benchmark issued to the API
+// servers, keyed by verb, and those the API servers issued to etcd, keyed by operation.
+type Requests struct {
+	Client map[string]int64   `json:"client"`
+	Etcd   map[string]float64 `json:"etcd,omitempty"`
+	// Seconds is how long the requests to etcd were counted for, and EtcdIdleRate the requests to etcd per second,
+	// by operation, counted while the experiment had yet to start, which is the background traffic of the cluster
+	// and of the benchmark's own monitoring.
+	Seconds      float64            `json:"seconds,omitempty"`
+	EtcdIdleRate map[string]float64 `json:"etcdIdleRate,omitempty"`
+}
+
+func Write(dir, name string, from interface{}) error {
+	raw, err := json.Marshal(from)
+	if err != nil {
+		return fmt.Errorf("could not marshal %s: %w", name, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), raw, 0666); err != nil {
+		return fmt.Errorf("could not write %s: %w", name, err)
+	}
+	return nil
+}
+
+func Load(dir, name string, into interface{}) error {
+	raw, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", name, err)
+	}
+	if err := json.Unmarshal(raw, into); err != nil {
+		return fmt.Errorf("could not unmarshal %s: %w", name, err)
+	}
+	return nil
+}